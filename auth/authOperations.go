@@ -6,6 +6,7 @@ import (
 	"crypto/rsa"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/lestrrat-go/jwx/jwk"
@@ -45,21 +46,21 @@ func Login(ctx context.Context, domain string, headers map[string]string, body s
 }
 
 func signNewToken(username string) (string, error) {
-	mySigningKey := []byte("AllYourBase")
+	now := time.Now()
 
 	// Create the Claims
 	claims := &jwt.StandardClaims{
-		ExpiresAt: 15000,
+		Subject:   username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(tokenLifetime).Unix(),
 		Issuer:    "test",
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	ss, err := token.SignedString(mySigningKey)
+	ss, err := token.SignedString(signingKey)
 	if err != nil {
 		return "", err
 	}
-	fmt.Printf("%v", ss)
-
 	return ss, nil
 }
 
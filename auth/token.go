@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// tokenLifetime is how long a login lasts
+const tokenLifetime = 12 * time.Hour
+
+// signingKey signs and verifies the tokens, the default is only good for running locally
+var signingKey = []byte("AllYourBase")
+
+// ErrInvalidToken is returned for tokens that are malformed, expired or not signed by us
+var ErrInvalidToken = errors.New("invalid token")
+
+// SetSigningKey replaces the key tokens are signed with
+func SetSigningKey(key string) {
+	signingKey = []byte(key)
+}
+
+// VerifyToken checks the signature and expiry of the token and returns the user it was issued to
+func VerifyToken(token string) (string, error) {
+	claims := &jwt.StandardClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return signingKey, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+
+	return claims.Subject, nil
+}
+
+// TokenFromRequest finds the token in the Authorization header, or the auth cookie for
+// requests the browser makes on its own such as images
+func TokenFromRequest(headers map[string]string, cookies []string) string {
+	for name, value := range headers {
+		if strings.EqualFold(name, "authorization") && strings.HasPrefix(strings.ToLower(value), "bearer ") {
+			return strings.TrimSpace(value[len("bearer "):])
+		}
+	}
+
+	for _, cookie := range cookies {
+		for _, part := range strings.Split(cookie, ";") {
+			pair := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(pair) == 2 && pair[0] == authCookie {
+				return pair[1]
+			}
+		}
+	}
+
+	return ""
+}
+
+// TokenCookie sets the token as a cookie only the api can read
+func TokenCookie(token string) string {
+	return fmt.Sprintf("%s=%s; Path=/api; Max-Age=%d; Secure; HttpOnly; SameSite=Strict", authCookie, token, int(tokenLifetime.Seconds()))
+}
@@ -4,17 +4,22 @@ echo "[INFO] Building postmaster..."
 
 cd ./handler/postmaster
 rm ../../bin/postmaster 2> /dev/null
-env GOOS=linux GOARCH=amd64 go build -o ../../bin/postmaster main.go
+env GOOS=linux GOARCH=amd64 go build -o ../../bin/postmaster .
 
 echo "[INFO] Building mailman..."
 cd ../../handler/mailman
 rm ../../bin/mailman 2> /dev/null
-env GOOS=linux GOARCH=amd64 go build -o ../../bin/mailman main.go
+env GOOS=linux GOARCH=amd64 go build -o ../../bin/mailman .
 
 echo "[INFO] Building mailtruck..."
 cd ../../handler/mailtruck
 rm ../../bin/mailtruck 2> /dev/null
-env GOOS=linux GOARCH=amd64 go build -o ../../bin/mailtruck main.go
+env GOOS=linux GOARCH=amd64 go build -o ../../bin/mailtruck .
+
+echo "[INFO] Building shredder..."
+cd ../../handler/shredder
+rm ../../bin/shredder 2> /dev/null
+env GOOS=linux GOARCH=amd64 go build -o ../../bin/shredder .
 cd ../../
 
 CMD=zip
@@ -40,4 +45,9 @@ echo "[INFO] Archiving mailtruck..."
 rm mailtruck.zip
 chmod +x mailtruck 2> /dev/null
 $CMD mailtruck.zip mailtruck 
+
+echo "[INFO] Archiving shredder..."
+rm shredder.zip 2> /dev/null
+chmod +x shredder
+$CMD shredder.zip shredder
 cd ../
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+// exportCommand writes a user's mailbox to a file, or stdout
+func exportCommand(ctx context.Context, store email.MailStore, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	userID := flags.String("user", "", "mailbox to export")
+	format := flags.String("format", email.ExportMbox, "mboxrd or maildir")
+	folder := flags.String("folder", "", "only export this folder and its sub-folders")
+	after := flags.String("after", "", "only export mail dated on or after YYYY-MM-DD")
+	before := flags.String("before", "", "only export mail dated before YYYY-MM-DD")
+	output := flags.String("o", "-", "file to write, - is stdout")
+	flags.Parse(args)
+
+	if *userID == "" {
+		return errors.New("export: -user is required")
+	}
+
+	opts, err := email.ParseExportOptions(map[string]string{
+		"format": *format,
+		"folder": *folder,
+		"after":  *after,
+		"before": *before,
+	})
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	writer := bufio.NewWriter(w)
+	err = email.ExportMailbox(ctx, store, mailboxPrefix, *userID, writer, opts)
+	if err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
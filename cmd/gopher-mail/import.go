@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+// importCommand reads mbox files, Maildirs and .eml files into a user's mailbox
+func importCommand(ctx context.Context, store email.MailStore, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	userID := flags.String("user", "", "mailbox to import into")
+	folder := flags.String("folder", email.FolderInbox, "folder for messages the archive doesn't file in one")
+	flags.Parse(args)
+
+	if *userID == "" || flags.NArg() == 0 {
+		return errors.New("import: -user and at least one mbox, Maildir, Maildir .tar or .eml are required")
+	}
+
+	for _, name := range flags.Args() {
+		// the absolute path names the import so running it again resumes it
+		name, err := filepath.Abs(name)
+		if err != nil {
+			return err
+		}
+
+		source, closer, err := openSource(name)
+		if err != nil {
+			return err
+		}
+
+		report, err := email.ImportMessages(ctx, store, mailboxPrefix, *userID, name, source, *folder)
+		if closer != nil {
+			closer.Close()
+		}
+		fmt.Printf("%s: %d imported, %d duplicates, %d already imported, %d failed\n", name, report.Imported, report.Duplicates, report.Resumed, report.Failed)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// openSource picks the reader by what the file looks like: a directory is a Maildir, a .tar
+// a Maildir tarball, a .eml a single message, and anything else an mbox
+func openSource(name string) (email.MessageSource, *os.File, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		source, err := email.NewMaildirSource(name)
+		return source, nil, err
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".tar":
+		return email.NewMaildirTarSource(file), file, nil
+	case ".eml":
+		return email.NewEmlSource(file), file, nil
+	}
+
+	return email.NewMboxSource(file), file, nil
+}
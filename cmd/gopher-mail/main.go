@@ -0,0 +1,61 @@
+// Command gopher-mail works on the mailboxes directly, for jobs too big for a lambda.
+// It reads the same environment as the handlers to find the mailboxes.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+var mailboxBucket string
+var mailboxPrefix string
+
+// commands by name, each parses its own flags
+var commands = map[string]func(ctx context.Context, store email.MailStore, args []string) error{
+	"export":  exportCommand,
+	"import":  importCommand,
+	"reindex": reindexCommand,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gopher-mail <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  export   write a mailbox as mboxrd or a Maildir tarball")
+	fmt.Fprintln(os.Stderr, "  import   read mbox files, Maildirs and .eml files into a mailbox")
+	fmt.Fprintln(os.Stderr, "  reindex  regenerate email metadata and the indexes from the original messages")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Mailboxes are read from MAILBOX_DIR, or MAILBOX_BUCKET, under MAILBOX_PREFIX.")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+
+	mailboxBucket = os.Getenv("MAILBOX_BUCKET")
+	mailboxPrefix = os.Getenv("MAILBOX_PREFIX")
+	if mailboxPrefix == "" {
+		mailboxPrefix = "mailbox"
+	}
+
+	store, err := email.NewStoreFromEnv(mailboxBucket, mailboxPrefix, email.StoreOptions{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	err = command(context.Background(), store, os.Args[2:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
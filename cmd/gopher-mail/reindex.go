@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+// reindexCommand regenerates the metadata of mailboxes from the original messages
+func reindexCommand(ctx context.Context, store email.MailStore, args []string) error {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	userID := flags.String("user", "", "mailbox to reindex, every mailbox when empty")
+	all := flags.Bool("all", false, "rewrite metadata that already has the current version, to pick up parser changes")
+	flags.Parse(args)
+
+	userIDs := []string{*userID}
+	if *userID == "" {
+		var err error
+		userIDs, err = email.ListMailboxes(ctx, store, mailboxPrefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, user := range userIDs {
+		report, err := email.ReindexMailbox(ctx, store, mailboxPrefix, user, *all)
+		fmt.Printf("%s: %d reindexed, %d current, %d failed\n", user, report.Reindexed, report.Current, report.Failed)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
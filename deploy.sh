@@ -19,4 +19,7 @@ echo "[INFO] Uploading mailman to $LAMBDA_ARCHIVE_BUCKET/mailman/"
 aws s3 cp ./bin/mailman.zip s3://$LAMBDA_ARCHIVE_BUCKET/mailman/mailman.zip
 
 echo "[INFO] Uploading mailtruck to $LAMBDA_ARCHIVE_BUCKET/mailtruck/"
-aws s3 cp ./bin/mailtruck.zip s3://$LAMBDA_ARCHIVE_BUCKET/mailtruck/mailtruck.zip
\ No newline at end of file
+aws s3 cp ./bin/mailtruck.zip s3://$LAMBDA_ARCHIVE_BUCKET/mailtruck/mailtruck.zip
+
+echo "[INFO] Uploading shredder to $LAMBDA_ARCHIVE_BUCKET/shredder/"
+aws s3 cp ./bin/shredder.zip s3://$LAMBDA_ARCHIVE_BUCKET/shredder/shredder.zip
\ No newline at end of file
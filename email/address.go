@@ -0,0 +1,324 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// addressLock serializes changes to the address map within this process
+var addressLock sync.Mutex
+
+var (
+	// ErrInvalidAddress is returned for user, alias and group names that can't be used as an address
+	ErrInvalidAddress = errors.New("invalid address")
+	// ErrAddressExists is returned when a name is already taken by a user, alias or group
+	ErrAddressExists = errors.New("address already exists")
+	// ErrAddressInUse is returned when removing a user that aliases, groups or the catch-all deliver to
+	ErrAddressInUse = errors.New("address in use")
+	// ErrUnknownUser is returned when an alias, group or the catch-all points at a user that doesn't exist
+	ErrUnknownUser = errors.New("unknown user")
+)
+
+// addressNameRegex matches the local parts that can be a user, alias or group
+var addressNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9\-_.]*$`)
+
+// reservedAddresses can't be used as a name because they collide with mailman routes
+var reservedAddresses = []string{"admin", "auth"}
+
+// AddressMap decides which users the mail for an address of a domain is delivered to. Every
+// domain has its own, the users, aliases and groups in it are local parts of that domain.
+type AddressMap struct {
+	// Users have a mailbox and receive the mail for their own name
+	Users []string
+	// Aliases deliver to one user
+	Aliases map[string]string
+	// Groups deliver to every user in them
+	Groups map[string][]string
+	// CatchAll is the user mail for any other address goes to, the mail is rejected when it is empty
+	CatchAll string
+}
+
+// addressesKey is the key of the address map of the domain namespace, the primary domain's
+// namespace is empty and it keeps the key from before there was more than one domain
+func addressesKey(mailboxPrefix, namespace string) string {
+	if namespace == "" {
+		return mailboxPrefix + "/_addresses.json"
+	}
+
+	return mailboxPrefix + "/_addresses/" + namespace + ".json"
+}
+
+// LoadAddressMap of the domain namespace, see DomainRegistry.Namespace. Returns ErrNotFound
+// when no address map has been set up, postmaster then delivers mail for every address of the
+// domain to the mailbox of the same name.
+func LoadAddressMap(ctx context.Context, store MailStore, mailboxPrefix, namespace string) (AddressMap, error) {
+	addresses := AddressMap{
+		Users:   []string{},
+		Aliases: make(map[string]string),
+		Groups:  make(map[string][]string),
+	}
+
+	buf, err := store.Get(ctx, addressesKey(mailboxPrefix, namespace))
+	if err != nil {
+		return addresses, err
+	}
+
+	err = json.Unmarshal(buf, &addresses)
+	if err != nil {
+		return addresses, err
+	}
+	if addresses.Users == nil {
+		addresses.Users = []string{}
+	}
+	if addresses.Aliases == nil {
+		addresses.Aliases = make(map[string]string)
+	}
+	if addresses.Groups == nil {
+		addresses.Groups = make(map[string][]string)
+	}
+
+	return addresses, nil
+}
+
+// updateAddressMap loads the address map, or starts an empty one, applies fn to it and writes it back
+func updateAddressMap(ctx context.Context, store MailStore, mailboxPrefix, namespace string, fn func(*AddressMap) error) (AddressMap, error) {
+	addressLock.Lock()
+	defer addressLock.Unlock()
+
+	addresses, err := LoadAddressMap(ctx, store, mailboxPrefix, namespace)
+	if err != nil && err != ErrNotFound {
+		return addresses, err
+	}
+
+	err = fn(&addresses)
+	if err != nil {
+		return addresses, err
+	}
+
+	buf, err := json.Marshal(addresses)
+	if err != nil {
+		return addresses, err
+	}
+
+	return addresses, store.Put(ctx, addressesKey(mailboxPrefix, namespace), buf, "application/json")
+}
+
+// canonicalAddress lower cases the local part and checks it can be used as a name
+func canonicalAddress(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !addressNameRegex.MatchString(name) || containsString(reservedAddresses, name) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidAddress, name)
+	}
+
+	return name, nil
+}
+
+// localPart of the address, lower cased
+func localPart(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		address = address[:i]
+	}
+
+	return strings.ToLower(address)
+}
+
+// Resolve the recipient addresses to the users the mail is delivered to, each user once, and
+// every subaddress tag each user was sent the mail with, empty for the plain address. Returns
+// the addresses that are rejected because nothing matched them and there is no catch-all.
+func (a AddressMap) Resolve(recipients []string) ([]string, map[string][]string, []string) {
+	users := []string{}
+	tags := make(map[string][]string)
+	rejected := []string{}
+
+	for _, recipient := range recipients {
+		// user+tag is delivered like user
+		name, tag := splitSubaddress(localPart(recipient))
+		add := func(userID string) {
+			if !containsString(users, userID) {
+				users = append(users, userID)
+			}
+			if !containsString(tags[userID], tag) {
+				tags[userID] = append(tags[userID], tag)
+			}
+		}
+
+		switch {
+		case containsString(a.Users, name):
+			add(name)
+		case a.Aliases[name] != "":
+			add(a.Aliases[name])
+		case len(a.Groups[name]) > 0:
+			for _, userID := range a.Groups[name] {
+				add(userID)
+			}
+		case a.CatchAll != "":
+			add(a.CatchAll)
+		default:
+			rejected = append(rejected, recipient)
+		}
+	}
+
+	return users, tags, rejected
+}
+
+// taken reports if the name is already a user, alias or group
+func (a AddressMap) taken(name string) bool {
+	_, alias := a.Aliases[name]
+	_, group := a.Groups[name]
+
+	return alias || group || containsString(a.Users, name)
+}
+
+// AddUser gives the user a mailbox that receives the mail for their name
+func AddUser(ctx context.Context, store MailStore, mailboxPrefix, namespace, userID string) (AddressMap, error) {
+	userID, err := canonicalAddress(userID)
+	if err != nil {
+		return AddressMap{}, err
+	}
+
+	return updateAddressMap(ctx, store, mailboxPrefix, namespace, func(addresses *AddressMap) error {
+		if addresses.taken(userID) {
+			return fmt.Errorf("%w: %q", ErrAddressExists, userID)
+		}
+		addresses.Users = append(addresses.Users, userID)
+		sort.Strings(addresses.Users)
+
+		return nil
+	})
+}
+
+// RemoveUser stops delivering mail to the user, the mailbox itself is kept. Returns
+// ErrAddressInUse while an alias, a group or the catch-all still delivers to the user.
+func RemoveUser(ctx context.Context, store MailStore, mailboxPrefix, namespace, userID string) (AddressMap, error) {
+	userID = strings.ToLower(userID)
+
+	return updateAddressMap(ctx, store, mailboxPrefix, namespace, func(addresses *AddressMap) error {
+		if !containsString(addresses.Users, userID) {
+			return ErrNotFound
+		}
+
+		for alias, target := range addresses.Aliases {
+			if target == userID {
+				return fmt.Errorf("%w: alias %q delivers to %q", ErrAddressInUse, alias, userID)
+			}
+		}
+		for group, members := range addresses.Groups {
+			if containsString(members, userID) {
+				return fmt.Errorf("%w: group %q delivers to %q", ErrAddressInUse, group, userID)
+			}
+		}
+		if addresses.CatchAll == userID {
+			return fmt.Errorf("%w: the catch-all delivers to %q", ErrAddressInUse, userID)
+		}
+
+		users := []string{}
+		for _, user := range addresses.Users {
+			if user != userID {
+				users = append(users, user)
+			}
+		}
+		addresses.Users = users
+
+		return nil
+	})
+}
+
+// SetAlias delivers the mail for alias to the user, replacing what the alias delivered to before
+func SetAlias(ctx context.Context, store MailStore, mailboxPrefix, namespace, alias, userID string) (AddressMap, error) {
+	alias, err := canonicalAddress(alias)
+	if err != nil {
+		return AddressMap{}, err
+	}
+	userID = strings.ToLower(userID)
+
+	return updateAddressMap(ctx, store, mailboxPrefix, namespace, func(addresses *AddressMap) error {
+		if _, ok := addresses.Aliases[alias]; !ok && addresses.taken(alias) {
+			return fmt.Errorf("%w: %q", ErrAddressExists, alias)
+		}
+		if !containsString(addresses.Users, userID) {
+			return fmt.Errorf("%w: %q", ErrUnknownUser, userID)
+		}
+		addresses.Aliases[alias] = userID
+
+		return nil
+	})
+}
+
+// RemoveAlias stops delivering the mail for alias, returns ErrNotFound if it isn't an alias
+func RemoveAlias(ctx context.Context, store MailStore, mailboxPrefix, namespace, alias string) (AddressMap, error) {
+	alias = strings.ToLower(alias)
+
+	return updateAddressMap(ctx, store, mailboxPrefix, namespace, func(addresses *AddressMap) error {
+		if _, ok := addresses.Aliases[alias]; !ok {
+			return ErrNotFound
+		}
+		delete(addresses.Aliases, alias)
+
+		return nil
+	})
+}
+
+// SetGroup delivers the mail for group to every one of the users, replacing the members it had before
+func SetGroup(ctx context.Context, store MailStore, mailboxPrefix, namespace, group string, userIDs []string) (AddressMap, error) {
+	group, err := canonicalAddress(group)
+	if err != nil {
+		return AddressMap{}, err
+	}
+	if len(userIDs) == 0 {
+		return AddressMap{}, fmt.Errorf("%w: group %q has no users", ErrInvalidAddress, group)
+	}
+
+	return updateAddressMap(ctx, store, mailboxPrefix, namespace, func(addresses *AddressMap) error {
+		if _, ok := addresses.Groups[group]; !ok && addresses.taken(group) {
+			return fmt.Errorf("%w: %q", ErrAddressExists, group)
+		}
+
+		members := []string{}
+		for _, userID := range userIDs {
+			userID = strings.ToLower(userID)
+			if !containsString(addresses.Users, userID) {
+				return fmt.Errorf("%w: %q", ErrUnknownUser, userID)
+			}
+			if !containsString(members, userID) {
+				members = append(members, userID)
+			}
+		}
+		addresses.Groups[group] = members
+
+		return nil
+	})
+}
+
+// RemoveGroup stops delivering the mail for group, returns ErrNotFound if it isn't a group
+func RemoveGroup(ctx context.Context, store MailStore, mailboxPrefix, namespace, group string) (AddressMap, error) {
+	group = strings.ToLower(group)
+
+	return updateAddressMap(ctx, store, mailboxPrefix, namespace, func(addresses *AddressMap) error {
+		if _, ok := addresses.Groups[group]; !ok {
+			return ErrNotFound
+		}
+		delete(addresses.Groups, group)
+
+		return nil
+	})
+}
+
+// SetCatchAll delivers the mail for every other address to the user, an empty user rejects it instead
+func SetCatchAll(ctx context.Context, store MailStore, mailboxPrefix, namespace, userID string) (AddressMap, error) {
+	userID = strings.ToLower(strings.TrimSpace(userID))
+
+	return updateAddressMap(ctx, store, mailboxPrefix, namespace, func(addresses *AddressMap) error {
+		if userID != "" && !containsString(addresses.Users, userID) {
+			return fmt.Errorf("%w: %q", ErrUnknownUser, userID)
+		}
+		addresses.CatchAll = userID
+
+		return nil
+	})
+}
@@ -0,0 +1,119 @@
+package email
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddressMapResolve(t *testing.T) {
+	addresses := AddressMap{
+		Users:   []string{"alice", "bob", "carol"},
+		Aliases: map[string]string{"ali": "alice", "postmaster": "bob"},
+		Groups:  map[string][]string{"team": {"alice", "bob"}, "empty": {}},
+	}
+	catchAll := addresses
+	catchAll.CatchAll = "carol"
+
+	for _, tc := range []struct {
+		name         string
+		addresses    AddressMap
+		recipients   []string
+		wantUsers    []string
+		wantTags     map[string][]string
+		wantRejected []string
+	}{
+		{
+			name:         "user",
+			addresses:    addresses,
+			recipients:   []string{"alice@example.com"},
+			wantUsers:    []string{"alice"},
+			wantTags:     map[string][]string{"alice": {""}},
+			wantRejected: []string{},
+		},
+		{
+			name:         "upper case",
+			addresses:    addresses,
+			recipients:   []string{"Alice@Example.com"},
+			wantUsers:    []string{"alice"},
+			wantTags:     map[string][]string{"alice": {""}},
+			wantRejected: []string{},
+		},
+		{
+			name:         "alias",
+			addresses:    addresses,
+			recipients:   []string{"postmaster@example.com"},
+			wantUsers:    []string{"bob"},
+			wantTags:     map[string][]string{"bob": {""}},
+			wantRejected: []string{},
+		},
+		{
+			name:         "group",
+			addresses:    addresses,
+			recipients:   []string{"team@example.com"},
+			wantUsers:    []string{"alice", "bob"},
+			wantTags:     map[string][]string{"alice": {""}, "bob": {""}},
+			wantRejected: []string{},
+		},
+		{
+			name:         "group and a member",
+			addresses:    addresses,
+			recipients:   []string{"team@example.com", "ali@example.com"},
+			wantUsers:    []string{"alice", "bob"},
+			wantTags:     map[string][]string{"alice": {""}, "bob": {""}},
+			wantRejected: []string{},
+		},
+		{
+			name:         "tag",
+			addresses:    addresses,
+			recipients:   []string{"alice+github@example.com"},
+			wantUsers:    []string{"alice"},
+			wantTags:     map[string][]string{"alice": {"github"}},
+			wantRejected: []string{},
+		},
+		{
+			name:         "tag of an alias and a group",
+			addresses:    addresses,
+			recipients:   []string{"ali+shop@example.com", "team+news@example.com"},
+			wantUsers:    []string{"alice", "bob"},
+			wantTags:     map[string][]string{"alice": {"shop", "news"}, "bob": {"news"}},
+			wantRejected: []string{},
+		},
+		{
+			name:         "unknown address",
+			addresses:    addresses,
+			recipients:   []string{"dave@example.com", "dave+news@example.com", "alice@example.com"},
+			wantUsers:    []string{"alice"},
+			wantTags:     map[string][]string{"alice": {""}},
+			wantRejected: []string{"dave@example.com", "dave+news@example.com"},
+		},
+		{
+			name:         "empty group",
+			addresses:    addresses,
+			recipients:   []string{"empty@example.com"},
+			wantUsers:    []string{},
+			wantTags:     map[string][]string{},
+			wantRejected: []string{"empty@example.com"},
+		},
+		{
+			name:         "catch-all",
+			addresses:    catchAll,
+			recipients:   []string{"dave+news@example.com", "alice@example.com"},
+			wantUsers:    []string{"carol", "alice"},
+			wantTags:     map[string][]string{"carol": {"news"}, "alice": {""}},
+			wantRejected: []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			users, tags, rejected := tc.addresses.Resolve(tc.recipients)
+			if !reflect.DeepEqual(users, tc.wantUsers) {
+				t.Errorf("users = %v, want %v", users, tc.wantUsers)
+			}
+			if !reflect.DeepEqual(tags, tc.wantTags) {
+				t.Errorf("tags = %v, want %v", tags, tc.wantTags)
+			}
+			if !reflect.DeepEqual(rejected, tc.wantRejected) {
+				t.Errorf("rejected = %v, want %v", rejected, tc.wantRejected)
+			}
+		})
+	}
+}
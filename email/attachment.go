@@ -0,0 +1,124 @@
+package email
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/DusanKasan/parsemail"
+)
+
+// Attachment of an email, the content is stored as its own object next to the email
+type Attachment struct {
+	ID          string
+	Filename    string
+	ContentType string
+	// ContentID is set on embedded files, the html body refers to them as cid:<ContentID>
+	ContentID string
+	Embedded  bool
+	Size      int
+	SHA256    string
+}
+
+// attachmentKey is the key of the attachment content
+func attachmentKey(mailboxPrefix, userID, messageID, attachmentID string) string {
+	return rawKey(mailboxPrefix, userID, messageID) + ".attachments/" + attachmentID
+}
+
+// extractAttachments reads the attachments and embedded files out of the parsed email.
+// The readers on the email are drained and removed so the email can be marshaled.
+func extractAttachments(email *parsemail.Email) ([]Attachment, [][]byte, error) {
+	attachments := []Attachment{}
+	contents := [][]byte{}
+
+	add := func(attachment Attachment, data []byte) {
+		sum := sha256.Sum256(data)
+		attachment.ID = strconv.Itoa(len(attachments) + 1)
+		attachment.Size = len(data)
+		attachment.SHA256 = hex.EncodeToString(sum[:])
+		if attachment.ContentType == "" {
+			attachment.ContentType = "application/octet-stream"
+		}
+
+		attachments = append(attachments, attachment)
+		contents = append(contents, data)
+	}
+
+	for _, a := range email.Attachments {
+		data, err := ioutil.ReadAll(a.Data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading attachment %q: %w", a.Filename, err)
+		}
+		add(Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+		}, data)
+	}
+	for _, e := range email.EmbeddedFiles {
+		data, err := ioutil.ReadAll(e.Data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading embedded file %q: %w", e.CID, err)
+		}
+		add(Attachment{
+			ContentType: e.ContentType,
+			ContentID:   strings.Trim(e.CID, "<>"),
+			Embedded:    true,
+		}, data)
+	}
+
+	email.Attachments = nil
+	email.EmbeddedFiles = nil
+	email.Content = nil
+
+	return attachments, contents, nil
+}
+
+// hasAttachments reports if any of the attachments are files rather than embedded in the html body
+func hasAttachments(attachments []Attachment) bool {
+	for i := range attachments {
+		if !attachments[i].Embedded {
+			return true
+		}
+	}
+
+	return false
+}
+
+// putAttachments writes the content of each attachment
+func putAttachments(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string, attachments []Attachment, contents [][]byte) error {
+	for i := range attachments {
+		err := store.Put(ctx, attachmentKey(mailboxPrefix, userID, messageID, attachments[i].ID), contents[i], attachments[i].ContentType)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAttachment returns the attachment record and its content
+func GetAttachment(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID, attachmentID string) (Attachment, []byte, error) {
+	email, err := loadMetadata(ctx, store, mailboxPrefix, userID, messageID)
+	if err != nil {
+		return Attachment{}, nil, err
+	}
+
+	for _, attachment := range email.Attachments {
+		if attachment.ID != attachmentID {
+			continue
+		}
+
+		data, err := store.Get(ctx, attachmentKey(mailboxPrefix, userID, messageID, attachmentID))
+		if err != nil {
+			return attachment, nil, err
+		}
+
+		return attachment, data, nil
+	}
+
+	return Attachment{}, nil, ErrNotFound
+}
@@ -0,0 +1,170 @@
+package email
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// blobLock serializes changes to blob references within this process
+var blobLock sync.Mutex
+
+// blobRef is what a mailbox holds in place of the original message
+type blobRef struct {
+	Blob string
+}
+
+// blobRefs lists the emails, as "<userID>/<messageID>", that point at a blob
+type blobRefs struct {
+	Refs []string
+}
+
+// blobKey is where the original message with this content hash is stored once for every mailbox
+func blobKey(mailboxPrefix, hash string) string {
+	return mailboxPrefix + "/_blobs/" + hash
+}
+
+// blobRefsKey is the key of the list of emails that point at the blob
+func blobRefsKey(mailboxPrefix, hash string) string {
+	return blobKey(mailboxPrefix, hash) + ".refs"
+}
+
+// refKey is the key of the reference a mailbox holds to the original message
+func refKey(mailboxPrefix, userID, messageID string) string {
+	return rawKey(mailboxPrefix, userID, messageID) + ".ref"
+}
+
+func contentHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// decodeBlobRefs, no references when buf is nil
+func decodeBlobRefs(buf []byte) (blobRefs, error) {
+	refs := blobRefs{
+		Refs: []string{},
+	}
+	if buf == nil {
+		return refs, nil
+	}
+
+	return refs, json.Unmarshal(buf, &refs)
+}
+
+// updateBlobRefs loads the references to the blob, applies fn to them and writes them back.
+// fn is run again when another writer changed the references in the meantime.
+func updateBlobRefs(ctx context.Context, store MailStore, mailboxPrefix, hash string, fn func(*blobRefs) error) error {
+	return updateObject(ctx, store, blobRefsKey(mailboxPrefix, hash), "application/json", func(buf []byte) ([]byte, error) {
+		refs, err := decodeBlobRefs(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		err = fn(&refs)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(refs)
+	})
+}
+
+// putBlob stores the original message under its content hash and records a reference for
+// each of the mailboxes it is delivered to. Returns the hash.
+func putBlob(ctx context.Context, store MailStore, mailboxPrefix string, body []byte, refs []string) (string, error) {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	hash := contentHash(body)
+
+	// the blob is written before its references, so a release that raced with this one and
+	// deleted it has it put back when the references are written again
+	return hash, updateBlobRefs(ctx, store, mailboxPrefix, hash, func(current *blobRefs) error {
+		for _, ref := range refs {
+			if !containsString(current.Refs, ref) {
+				current.Refs = append(current.Refs, ref)
+			}
+		}
+
+		// the blob is readable by every user that has a reference to it
+		users := []string{}
+		for _, ref := range current.Refs {
+			userID := strings.SplitN(ref, "/", 2)[0]
+			if !containsString(users, userID) {
+				users = append(users, userID)
+			}
+		}
+
+		return store.Put(withRecipients(ctx, users), blobKey(mailboxPrefix, hash), body, "message/rfc822")
+	})
+}
+
+// putRef points the email at the blob
+func putRef(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID, hash string) error {
+	buf, err := json.Marshal(blobRef{Blob: hash})
+	if err != nil {
+		return err
+	}
+
+	return store.Put(ctx, refKey(mailboxPrefix, userID, messageID), buf, "application/json")
+}
+
+// loadRef returns the hash of the blob the email points at
+func loadRef(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string) (string, error) {
+	buf, err := store.Get(ctx, refKey(mailboxPrefix, userID, messageID))
+	if err != nil {
+		return "", err
+	}
+
+	var ref blobRef
+	err = json.Unmarshal(buf, &ref)
+	if err != nil {
+		return "", err
+	}
+
+	return ref.Blob, nil
+}
+
+// loadRaw reads the original message through the mailbox's reference to it, mail delivered
+// before messages were shared between mailboxes holds its own copy
+func loadRaw(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string) ([]byte, error) {
+	hash, err := loadRef(ctx, store, mailboxPrefix, userID, messageID)
+	if err == ErrNotFound {
+		return store.Get(ctx, rawKey(mailboxPrefix, userID, messageID))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return store.Get(ctx, blobKey(mailboxPrefix, hash))
+}
+
+// releaseBlob drops the email's reference to the blob, the blob is deleted along with its last
+// reference. The empty list of references is kept, deleting it can't be made conditional and
+// would drop a reference another delivery added in the meantime.
+func releaseBlob(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID, hash string) error {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	unused := false
+	err := updateBlobRefs(ctx, store, mailboxPrefix, hash, func(refs *blobRefs) error {
+		kept := []string{}
+		for _, ref := range refs.Refs {
+			if ref != userID+"/"+messageID {
+				kept = append(kept, ref)
+			}
+		}
+		refs.Refs = kept
+		unused = len(kept) == 0
+
+		return nil
+	})
+	if err != nil || !unused {
+		return err
+	}
+
+	return store.Delete(ctx, blobKey(mailboxPrefix, hash))
+}
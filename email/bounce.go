@@ -0,0 +1,67 @@
+package email
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+)
+
+// Bouncer returns a received message to its sender
+type Bouncer interface {
+	// Bounce the message with the SES message ID for the users it couldn't be delivered to
+	Bounce(ctx context.Context, messageID string, userIDs []string) error
+	// Reject the message with the SES message ID for the user, with the reason the user gave
+	Reject(ctx context.Context, messageID, userID, reason string) error
+}
+
+// SESBouncer sends bounces for mail SES received
+type SESBouncer struct {
+	client *ses.Client
+	domain string
+}
+
+// NewSESBouncer bounces mail received for users of the domain, the bounce is sent from MAILER-DAEMON of the domain
+func NewSESBouncer(client *ses.Client, domain string) *SESBouncer {
+	return &SESBouncer{
+		client: client,
+		domain: domain,
+	}
+}
+
+// Bounce the message because the users' mailboxes are full
+func (b *SESBouncer) Bounce(ctx context.Context, messageID string, userIDs []string) error {
+	recipients := []ses.BouncedRecipientInfo{}
+	for _, userID := range userIDs {
+		recipients = append(recipients, ses.BouncedRecipientInfo{
+			Recipient:  aws.String(MailboxAddress(userID, b.domain)),
+			BounceType: ses.BounceTypeExceededQuota,
+		})
+	}
+
+	_, err := b.client.SendBounceRequest(&ses.SendBounceInput{
+		OriginalMessageId:        aws.String(messageID),
+		BounceSender:             aws.String("MAILER-DAEMON@" + b.domain),
+		Explanation:              aws.String("The mailbox is full."),
+		BouncedRecipientInfoList: recipients,
+	}).Send(ctx)
+
+	return err
+}
+
+// Reject the message because the user's Sieve script refused it
+func (b *SESBouncer) Reject(ctx context.Context, messageID, userID, reason string) error {
+	_, err := b.client.SendBounceRequest(&ses.SendBounceInput{
+		OriginalMessageId: aws.String(messageID),
+		BounceSender:      aws.String("MAILER-DAEMON@" + b.domain),
+		Explanation:       aws.String(reason),
+		BouncedRecipientInfoList: []ses.BouncedRecipientInfo{
+			{
+				Recipient:  aws.String(MailboxAddress(userID, b.domain)),
+				BounceType: ses.BounceTypeContentRejected,
+			},
+		},
+	}).Send(ctx)
+
+	return err
+}
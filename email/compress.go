@@ -0,0 +1,164 @@
+package email
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encodings objects can be compressed with
+const (
+	EncodingGzip     = "gzip"
+	EncodingZstd     = "zstd"
+	EncodingIdentity = "identity"
+)
+
+// compressedMagic starts every object written by a CompressedStore, it is followed by the
+// encoding and a newline. Objects without it were written uncompressed, before compression
+// was turned on or by SES, and are returned as they are.
+var compressedMagic = []byte("\x89GMZ\r\n\x1a\n")
+
+// minCompressedSize is the smallest object worth compressing
+const minCompressedSize = 512
+
+// ErrUnknownEncoding is returned for an encoding the store can't read or write
+var ErrUnknownEncoding = errors.New("unknown encoding")
+
+// zstd encoders and decoders are safe for concurrent use with EncodeAll and DecodeAll
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// CompressedStore compresses objects on their way into the MailStore it wraps, and
+// decompresses them on the way out
+type CompressedStore struct {
+	MailStore
+	encoding string
+}
+
+// NewCompressedStore wraps store so objects are written with the encoding, which defaults to zstd
+func NewCompressedStore(store MailStore, encoding string) (*CompressedStore, error) {
+	if encoding == "" {
+		encoding = EncodingZstd
+	}
+	if encoding != EncodingGzip && encoding != EncodingZstd && encoding != EncodingIdentity {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownEncoding, encoding)
+	}
+
+	return &CompressedStore{
+		MailStore: store,
+		encoding:  encoding,
+	}, nil
+}
+
+// Get the object at key, decompressed
+func (c *CompressedStore) Get(ctx context.Context, key string) ([]byte, error) {
+	body, err := c.MailStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return decompress(body)
+}
+
+// Put the body at key, compressed unless it is too small to be worth it
+func (c *CompressedStore) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	encoded, err := compress(body, c.encoding)
+	if err != nil {
+		return err
+	}
+
+	return c.MailStore.Put(ctx, key, encoded, contentType)
+}
+
+// GetVersion of the object at key, decompressed
+func (c *CompressedStore) GetVersion(ctx context.Context, key string) ([]byte, string, error) {
+	body, version, err := getVersion(ctx, c.MailStore, key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	body, err = decompress(body)
+
+	return body, version, err
+}
+
+// PutIfVersion puts the body at key compressed, if the object is still at version
+func (c *CompressedStore) PutIfVersion(ctx context.Context, key string, body []byte, contentType, version string) error {
+	encoded, err := compress(body, c.encoding)
+	if err != nil {
+		return err
+	}
+
+	return putIfVersion(ctx, c.MailStore, key, encoded, contentType, version)
+}
+
+// compress the body and frame it with the encoding
+func compress(body []byte, encoding string) ([]byte, error) {
+	if len(body) < minCompressedSize || encoding == EncodingIdentity {
+		if !bytes.HasPrefix(body, compressedMagic) {
+			return body, nil
+		}
+		// an uncompressed body that happens to start with the magic has to be framed to be read back
+		encoding = EncodingIdentity
+	}
+
+	var buf bytes.Buffer
+	buf.Write(compressedMagic)
+	buf.WriteString(encoding + "\n")
+
+	switch encoding {
+	case EncodingGzip:
+		writer := gzip.NewWriter(&buf)
+		_, err := writer.Write(body)
+		if err != nil {
+			return nil, err
+		}
+		err = writer.Close()
+		if err != nil {
+			return nil, err
+		}
+	case EncodingZstd:
+		return zstdEncoder.EncodeAll(body, buf.Bytes()), nil
+	case EncodingIdentity:
+		buf.Write(body)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownEncoding, encoding)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompress a framed body, anything else is returned as it is
+func decompress(body []byte) ([]byte, error) {
+	if !bytes.HasPrefix(body, compressedMagic) {
+		return body, nil
+	}
+
+	rest := body[len(compressedMagic):]
+	end := bytes.IndexByte(rest, '\n')
+	if end < 0 {
+		return nil, fmt.Errorf("%w: missing encoding", ErrUnknownEncoding)
+	}
+	encoding, data := string(rest[:end]), rest[end+1:]
+
+	switch encoding {
+	case EncodingGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	case EncodingZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	case EncodingIdentity:
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrUnknownEncoding, encoding)
+}
@@ -0,0 +1,100 @@
+package email
+
+import (
+	"context"
+	"log"
+)
+
+// DeleteEmail from the user's mailbox for good, along with its attachments. The original
+// message is deleted once no other mailbox refers to it.
+func DeleteEmail(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string) error {
+	_, err := store.Get(ctx, metaKey(mailboxPrefix, userID, messageID))
+	if err != nil {
+		return err
+	}
+
+	// usage that was never recorded is counted from the index, so it has to be recorded while
+	// the email is still in there for the deletion to be taken off a count that includes it
+	_, err = updateUsage(ctx, store, mailboxPrefix, userID, func(u *usage) {})
+	if err != nil {
+		return err
+	}
+
+	// take it out of the indexes first so it is never listed half deleted
+	size := -1
+	err = updateIndex(ctx, store, mailboxPrefix, userID, func(index *Index) error {
+		size = -1
+		kept := []Meta{}
+		for i := range index.Emails {
+			if index.Emails[i].MessageID != messageID {
+				kept = append(kept, index.Emails[i])
+			} else {
+				size = index.Emails[i].Size
+			}
+		}
+		index.Emails = kept
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = updateSearchIndex(ctx, store, mailboxPrefix, userID, func(index *searchIndex) {
+		index.remove(messageID)
+	})
+	if err != nil {
+		return err
+	}
+
+	attachments, err := store.List(ctx, attachmentKey(mailboxPrefix, userID, messageID, ""))
+	if err != nil {
+		return err
+	}
+	for _, key := range attachments {
+		err = store.Delete(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range []string{metaKey(mailboxPrefix, userID, messageID), stateKey(mailboxPrefix, userID, messageID)} {
+		err = store.Delete(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = deleteRaw(ctx, store, mailboxPrefix, userID, messageID)
+	if err != nil {
+		return err
+	}
+
+	// the quota is adjusted last, a failure before this leaves the usage over rather than under
+	// what is stored
+	if size < 0 {
+		return nil
+	}
+
+	return recordDeletion(ctx, store, mailboxPrefix, userID, size)
+}
+
+// deleteRaw drops the email's reference to the original message, or its own copy of it
+func deleteRaw(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string) error {
+	hash, err := loadRef(ctx, store, mailboxPrefix, userID, messageID)
+	if err == ErrNotFound {
+		// delivered before messages were shared, the mailbox has its own copy
+		return store.Delete(ctx, rawKey(mailboxPrefix, userID, messageID))
+	}
+	if err != nil {
+		return err
+	}
+
+	err = store.Delete(ctx, refKey(mailboxPrefix, userID, messageID))
+	if err != nil {
+		return err
+	}
+	log.Printf("Releasing blob \"%s\" of \"%s\"\n", hash, rawKey(mailboxPrefix, userID, messageID))
+
+	return releaseBlob(ctx, store, mailboxPrefix, userID, messageID, hash)
+}
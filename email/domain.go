@@ -0,0 +1,268 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// domainLock serializes changes to the domain registry within this process
+var domainLock sync.Mutex
+
+var (
+	// ErrInvalidDomain is returned for names that aren't a domain, and when removing the primary domain
+	ErrInvalidDomain = errors.New("invalid domain")
+	// ErrDomainExists is returned when adding a domain that is already hosted
+	ErrDomainExists = errors.New("domain already exists")
+	// ErrDomainNotFound is returned for domains the deployment doesn't host
+	ErrDomainNotFound = errors.New("domain not found")
+)
+
+// domainRegex matches a domain name with at least two labels
+var domainRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9\-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9\-]*[a-z0-9])?)+$`)
+
+// DomainRegistry is every domain the deployment receives mail for. Each domain has its own
+// users, aliases and catch-all, and its own mailboxes so bob@a.com and bob@b.com don't collide.
+type DomainRegistry struct {
+	// Primary is the domain the deployment was set up with, its mailboxes are named after the user alone
+	Primary string
+	// Hosted are the other domains, their mailboxes are named user@domain
+	Hosted []string
+}
+
+// domainsKey is the key of the hosted domains, the primary domain comes from the environment
+func domainsKey(mailboxPrefix string) string {
+	return mailboxPrefix + "/_domains.json"
+}
+
+// canonicalDomain lower cases the domain and checks it is a domain name
+func canonicalDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if len(domain) > 253 || !domainRegex.MatchString(domain) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidDomain, domain)
+	}
+
+	return domain, nil
+}
+
+// LoadDomainRegistry of the deployment, with only the primary domain until other domains are added
+func LoadDomainRegistry(ctx context.Context, store MailStore, mailboxPrefix, primary string) (DomainRegistry, error) {
+	registry := DomainRegistry{
+		Primary: strings.ToLower(primary),
+		Hosted:  []string{},
+	}
+
+	buf, err := store.Get(ctx, domainsKey(mailboxPrefix))
+	if err == ErrNotFound {
+		return registry, nil
+	}
+	if err != nil {
+		return registry, err
+	}
+
+	var stored struct {
+		Hosted []string
+	}
+	err = json.Unmarshal(buf, &stored)
+	if stored.Hosted != nil {
+		registry.Hosted = stored.Hosted
+	}
+
+	return registry, err
+}
+
+// updateDomainRegistry loads the registry, applies fn to it and writes the hosted domains back
+func updateDomainRegistry(ctx context.Context, store MailStore, mailboxPrefix, primary string, fn func(*DomainRegistry) error) (DomainRegistry, error) {
+	domainLock.Lock()
+	defer domainLock.Unlock()
+
+	registry, err := LoadDomainRegistry(ctx, store, mailboxPrefix, primary)
+	if err != nil {
+		return registry, err
+	}
+
+	err = fn(&registry)
+	if err != nil {
+		return registry, err
+	}
+
+	buf, err := json.Marshal(struct {
+		Hosted []string
+	}{registry.Hosted})
+	if err != nil {
+		return registry, err
+	}
+
+	return registry, store.Put(ctx, domainsKey(mailboxPrefix), buf, "application/json")
+}
+
+// AddDomain to the registry, postmaster delivers its mail from then on. SES has to receive
+// mail for the domain as well.
+func AddDomain(ctx context.Context, store MailStore, mailboxPrefix, primary, domain string) (DomainRegistry, error) {
+	domain, err := canonicalDomain(domain)
+	if err != nil {
+		return DomainRegistry{}, err
+	}
+
+	return updateDomainRegistry(ctx, store, mailboxPrefix, primary, func(registry *DomainRegistry) error {
+		if registry.Hosts(domain) {
+			return fmt.Errorf("%w: %q", ErrDomainExists, domain)
+		}
+		registry.Hosted = append(registry.Hosted, domain)
+		sort.Strings(registry.Hosted)
+
+		return nil
+	})
+}
+
+// RemoveDomain stops delivering the mail for the domain, its mailboxes and address map are kept
+func RemoveDomain(ctx context.Context, store MailStore, mailboxPrefix, primary, domain string) (DomainRegistry, error) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+
+	return updateDomainRegistry(ctx, store, mailboxPrefix, primary, func(registry *DomainRegistry) error {
+		if domain == registry.Primary {
+			return fmt.Errorf("%w: the primary domain %q can't be removed", ErrInvalidDomain, domain)
+		}
+
+		hosted := []string{}
+		for _, d := range registry.Hosted {
+			if d != domain {
+				hosted = append(hosted, d)
+			}
+		}
+		if len(hosted) == len(registry.Hosted) {
+			return fmt.Errorf("%w: %q", ErrDomainNotFound, domain)
+		}
+		registry.Hosted = hosted
+
+		return nil
+	})
+}
+
+// Hosts reports if the deployment receives mail for the domain
+func (r DomainRegistry) Hosts(domain string) bool {
+	domain = strings.ToLower(domain)
+
+	return domain == r.Primary || containsString(r.Hosted, domain)
+}
+
+// Namespace of the domain for its address map, empty for the primary domain. An empty domain
+// is the primary one, returns ErrDomainNotFound for domains that aren't hosted.
+func (r DomainRegistry) Namespace(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if domain == "" || domain == r.Primary {
+		return "", nil
+	}
+	if !r.Hosts(domain) {
+		return "", fmt.Errorf("%w: %q", ErrDomainNotFound, domain)
+	}
+
+	return domain, nil
+}
+
+// MailboxID is the name of the mailbox of the user of the domain. The primary domain's mailboxes
+// are named after the user alone, as they were before there was more than one domain.
+func (r DomainRegistry) MailboxID(domain, user string) string {
+	domain = strings.ToLower(domain)
+	if domain == r.Primary || domain == "" {
+		return user
+	}
+
+	return user + "@" + domain
+}
+
+// MailboxAddress is the address of the mailbox, mailboxes of the primary domain are named
+// after the user alone so primary is added to them
+func MailboxAddress(mailboxID, primary string) string {
+	if strings.Contains(mailboxID, "@") {
+		return mailboxID
+	}
+
+	return mailboxID + "@" + primary
+}
+
+// splitAddress into the local part and the domain, the domain is lower cased
+func splitAddress(address string) (string, string) {
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return address, ""
+	}
+
+	return address[:i], strings.ToLower(address[i+1:])
+}
+
+// ResolveRecipients replaces the mailboxes of the email with the ones its recipients are
+// delivered to through the address map of their domain, along with their subaddress tags.
+// Domains without an address map deliver every address that can be a user name to the mailbox of
+// the same name, addresses like _errored that name a system area are rejected.
+// Rejected recipients are dropped, they aren't bounced so spam sent to made up addresses
+// doesn't send bounces to the forged senders.
+func ResolveRecipients(ctx context.Context, store MailStore, mailboxPrefix string, registry DomainRegistry, email MoveOperation) (MoveOperation, error) {
+	byDomain := make(map[string][]string)
+	domains := []string{}
+	for _, recipient := range email.Recipients {
+		_, domain := splitAddress(recipient)
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], recipient)
+	}
+
+	destPrefixes := []string{}
+	tags := make(map[string][]string)
+	deliver := func(mailboxID string, userTags ...string) {
+		if !containsString(destPrefixes, mailboxID) {
+			destPrefixes = append(destPrefixes, mailboxID)
+		}
+		for _, tag := range userTags {
+			if !containsString(tags[mailboxID], tag) {
+				tags[mailboxID] = append(tags[mailboxID], tag)
+			}
+		}
+	}
+
+	for _, domain := range domains {
+		namespace, err := registry.Namespace(domain)
+		if err != nil {
+			return email, err
+		}
+
+		addresses, err := LoadAddressMap(ctx, store, mailboxPrefix, namespace)
+		if err == ErrNotFound {
+			for _, recipient := range byDomain[domain] {
+				local, _ := splitAddress(recipient)
+				user, tag := splitSubaddress(local)
+				// names like _errored or .. would write into the system areas next to the mailboxes
+				user, err := canonicalAddress(addressRegex.ReplaceAllString(user, "-"))
+				if err != nil {
+					log.Printf("Rejecting \"%s\" for \"%s\", %s\n", email.MessageID, recipient, err)
+					continue
+				}
+				deliver(registry.MailboxID(domain, user), strings.ToLower(tag))
+			}
+			continue
+		}
+		if err != nil {
+			return email, err
+		}
+
+		users, userTags, rejected := addresses.Resolve(byDomain[domain])
+		for _, recipient := range rejected {
+			log.Printf("Rejecting \"%s\" for \"%s\", no user, alias or group has the address\n", email.MessageID, recipient)
+		}
+		for _, user := range users {
+			deliver(registry.MailboxID(domain, user), userTags[user]...)
+		}
+	}
+
+	email.DestPrefixes = destPrefixes
+	email.Tags = tags
+
+	return email, nil
+}
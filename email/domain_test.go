@@ -0,0 +1,111 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestResolveRecipients(t *testing.T) {
+	registry := DomainRegistry{Primary: "example.com", Hosted: []string{"example.net", "example.org"}}
+	addresses := AddressMap{
+		Users:   []string{"alice", "bob"},
+		Aliases: map[string]string{"ali": "alice"},
+		Groups:  map[string][]string{"team": {"alice", "bob"}},
+	}
+
+	for _, tc := range []struct {
+		name       string
+		maps       map[string]AddressMap
+		recipients []string
+		wantDest   []string
+		wantTags   map[string][]string
+	}{
+		{
+			name:       "primary without an address map",
+			recipients: []string{"alice@example.com", "Bob+News@Example.com"},
+			wantDest:   []string{"alice", "bob"},
+			wantTags:   map[string][]string{"alice": {""}, "bob": {"news"}},
+		},
+		{
+			name:       "primary without an address map drops system areas",
+			recipients: []string{"_errored@example.com", "_held@example.com", "_blobs@example.com", "_quarantine@example.com", ".hidden@example.com", "admin@example.com", "alice@example.com"},
+			wantDest:   []string{"alice"},
+			wantTags:   map[string][]string{"alice": {""}},
+		},
+		{
+			name:       "primary with an address map",
+			maps:       map[string]AddressMap{"": addresses},
+			recipients: []string{"ali+shop@example.com", "team@example.com", "carol@example.com"},
+			wantDest:   []string{"alice", "bob"},
+			wantTags:   map[string][]string{"alice": {"shop", ""}, "bob": {""}},
+		},
+		{
+			name:       "hosted without an address map",
+			recipients: []string{"alice@example.net", "carol+news@example.org"},
+			wantDest:   []string{"alice@example.net", "carol@example.org"},
+			wantTags:   map[string][]string{"alice@example.net": {""}, "carol@example.org": {"news"}},
+		},
+		{
+			name:       "hosted without an address map drops system areas",
+			recipients: []string{"_errored@example.net"},
+			wantDest:   []string{},
+			wantTags:   map[string][]string{},
+		},
+		{
+			name:       "hosted with an address map",
+			maps:       map[string]AddressMap{"example.net": addresses},
+			recipients: []string{"ali@example.net", "team+news@example.net", "carol@example.net"},
+			wantDest:   []string{"alice@example.net", "bob@example.net"},
+			wantTags:   map[string][]string{"alice@example.net": {"", "news"}, "bob@example.net": {"news"}},
+		},
+		{
+			name:       "the same user on the primary and a hosted domain",
+			maps:       map[string]AddressMap{"example.net": addresses},
+			recipients: []string{"alice@example.com", "alice@example.net"},
+			wantDest:   []string{"alice", "alice@example.net"},
+			wantTags:   map[string][]string{"alice": {""}, "alice@example.net": {""}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemoryStore()
+			for namespace, addresses := range tc.maps {
+				_, err := updateAddressMap(ctx, store, "mailbox", namespace, func(a *AddressMap) error {
+					*a = addresses
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			email, err := ResolveRecipients(ctx, store, "mailbox", registry, MoveOperation{
+				MessageID:  "message",
+				Recipients: tc.recipients,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(email.DestPrefixes, tc.wantDest) {
+				t.Errorf("DestPrefixes = %v, want %v", email.DestPrefixes, tc.wantDest)
+			}
+			if !reflect.DeepEqual(email.Tags, tc.wantTags) {
+				t.Errorf("Tags = %v, want %v", email.Tags, tc.wantTags)
+			}
+		})
+	}
+}
+
+func TestResolveRecipientsUnhostedDomain(t *testing.T) {
+	registry := DomainRegistry{Primary: "example.com", Hosted: []string{}}
+
+	_, err := ResolveRecipients(context.Background(), NewMemoryStore(), "mailbox", registry, MoveOperation{
+		MessageID:  "message",
+		Recipients: []string{"alice@example.net"},
+	})
+	if !errors.Is(err, ErrDomainNotFound) {
+		t.Errorf("ResolveRecipients returned %v, want ErrDomainNotFound", err)
+	}
+}
@@ -3,17 +3,14 @@ package email
 import (
 	"bytes"
 	"context"
-	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"log"
-	"net/url"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/DusanKasan/parsemail"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/aws/awserr"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 var addressRegex = regexp.MustCompile(`[^a-zA-Z0-9\-_()*'.].*`)
@@ -25,29 +22,57 @@ type MoveOperation struct {
 	SourceBucket    string
 	SourceObjectKey string
 
+	// Sender is the envelope sender of the email, empty for bounces
+	Sender string
+	// Recipients are the addresses of the domains we host the email was sent to
+	Recipients    []string
 	DestPrefixes  []string
 	DestObjectKey string
+	// Tags are the subaddress tags the email was sent to each of the DestPrefixes with, e.g. github
+	// for alice+github, and an empty tag for the plain address. Once the tags are filtered only the
+	// tag the email is delivered with is left.
+	Tags map[string][]string
+	// Verdicts are the checks SES ran on the email, nil when they aren't known
+	Verdicts *Verdicts
 
 	Errored bool
 }
 
 // SortEmailIntoMailbox for the given users in the To list
-func SortEmailIntoMailbox(ctx context.Context, s3Client *s3.Client, mailboxBucket, mailboxPrefix string, email MoveOperation) error {
+func SortEmailIntoMailbox(ctx context.Context, store MailStore, mailboxPrefix string, email MoveOperation) error {
 	var errList []error
 
-	for _, prefix := range email.DestPrefixes {
-		destObjectKey := mailboxPrefix + "/" + prefix + "/" + email.DestObjectKey
-		err := processEmail(ctx, s3Client, mailboxBucket, email.MessageID, email.SourceBucket, email.SourceObjectKey, destObjectKey)
-		if err != nil {
-			// Log the error and mark the email as errored
-			log.Println(err)
-			email.Errored = true
+	email, err := filterSubaddresses(ctx, store, mailboxPrefix, email)
+	if err != nil {
+		return err
+	}
+
+	// the message is downloaded, stored and parsed once no matter how many users it is for
+	destPrefixes, deliveries, keep, parsed, err := readEmail(ctx, store, mailboxPrefix, email)
+	if err != nil {
+		// Log the error and mark the email as errored
+		log.Println(err)
+		email.Errored = true
+		destPrefixes = nil
+	}
+
+	for _, prefix := range destPrefixes {
+		parsed.Tag = email.tag(prefix)
+		for i, delivery := range deliveries[prefix] {
+			parsed.Folder = delivery.Folder
+			parsed.Flags = delivery.Flags
+			err := processEmail(ctx, store, mailboxPrefix, prefix, copyKey(email.MessageID, i), copyKey(email.DestObjectKey, i), parsed)
+			if err != nil {
+				// Log the error and mark the email as errored
+				log.Println(err)
+				email.Errored = true
+			}
 		}
 	}
 
 	// Attempt to copy errored emails to _errored bucket.
 	if email.Errored {
-		err := copyErroredEmail(ctx, s3Client, mailboxBucket, mailboxPrefix, email.SourceBucket, email.SourceObjectKey, email.DestObjectKey)
+		err := copyErroredEmail(ctx, store, mailboxPrefix, email.SourceObjectKey, email.DestObjectKey)
 		if err != nil {
 			log.Println("Failed to copy errored email to the '_errored' mailbox, skipping delete")
 			log.Println(email)
@@ -57,18 +82,24 @@ func SortEmailIntoMailbox(ctx context.Context, s3Client *s3.Client, mailboxBucke
 		}
 	}
 
-	// if we don't have an error copying the object we can delete the old one
-	delInput := &s3.DeleteObjectInput{
-		Bucket: aws.String(email.SourceBucket),
-		Key:    aws.String(email.SourceObjectKey),
+	// held mail that still doesn't fit stays where it is
+	if keep {
+		return nil
 	}
+
+	// if we don't have an error copying the object we can delete the old one
 	log.Printf("Deleting object \"%s\"\n", email.SourceBucket+"/"+email.SourceObjectKey)
 
-	delResp, err := s3Client.DeleteObjectRequest(delInput).Send(ctx)
+	err = store.Delete(ctx, email.SourceObjectKey)
 	if err != nil {
-		log.Println(delResp)
 		return err
 	}
+	if strings.HasPrefix(email.SourceObjectKey, heldPrefix(mailboxPrefix)) {
+		err = store.Delete(ctx, heldVerdictsKey(email.SourceObjectKey))
+		if err != nil {
+			return err
+		}
+	}
 
 	if len(errList) != 0 {
 		return errList[0]
@@ -79,99 +110,197 @@ func SortEmailIntoMailbox(ctx context.Context, s3Client *s3.Client, mailboxBucke
 	return nil
 }
 
-func processEmail(ctx context.Context, s3Client *s3.Client, mailboxBucket, messageID, srcBucket, srcObjectKey, destObjectKey string) error {
-	getInput := &s3.GetObjectInput{
-		Bucket: aws.String(srcBucket),
-		Key:    aws.String(srcObjectKey),
-	}
-	log.Printf("Getting raw email from \"%s\"\n", srcBucket+"/"+srcObjectKey)
+// parsedEmail is a message read and parsed once, and shared by every mailbox it is sorted into
+type parsedEmail struct {
+	Email          Message
+	Attachments    []Attachment
+	contents       [][]byte
+	TrackingPixels int
+	Size           int
+	// Blob is the content hash the original message is stored under
+	Blob string
+	// Tag is the subaddress tag the email was sent to the mailbox it is being processed for with
+	Tag string
+	// Folder and Flags are where the user's Sieve script files the copy being processed, an
+	// empty Folder is the Inbox or the folder of the Tag
+	Folder string
+	Flags  []string
+	// Verdicts are the checks SES ran on the message, if they are known
+	Verdicts *Verdicts
+}
 
-	result, err := s3Client.GetObjectRequest(getInput).Send(ctx)
-	if checkAwsErr(err) != nil {
-		return err
+// copyKey is the name of each copy of a message a Sieve script files into more than one folder
+func copyKey(destObjectKey string, i int) string {
+	if i == 0 {
+		return destObjectKey
 	}
-	bodyBuf, err := ioutil.ReadAll(result.Body)
+
+	return fmt.Sprintf("%s-%d", destObjectKey, i)
+}
+
+// readEmail downloads the message, triages it by its SES verdicts, applies the quota of each
+// recipient, runs their Sieve scripts, stores the original once for the recipients it is still
+// delivered to and parses it. Returns those recipients, the copies each of them gets, and keep
+// if the message has to stay where it is.
+func readEmail(ctx context.Context, store MailStore, mailboxPrefix string, email MoveOperation) ([]string, map[string][]SieveDelivery, bool, parsedEmail, error) {
+	log.Printf("Getting raw email from \"%s\"\n", email.SourceObjectKey)
+
+	bodyBuf, err := store.Get(ctx, email.SourceObjectKey)
 	if err != nil {
 		log.Println("Failed to read the contents of the raw email")
-		return err
+		return nil, nil, false, parsedEmail{}, err
 	}
 
-	putInput := &s3.PutObjectInput{
-		Bucket: aws.String(mailboxBucket),
-		Key:    aws.String(destObjectKey),
+	// mail that is dropped or quarantined doesn't count against the quota or run any scripts
+	email, spam, err := triageEmail(ctx, store, mailboxPrefix, email, bodyBuf)
+	if err != nil || len(email.DestPrefixes) == 0 {
+		return nil, nil, false, parsedEmail{}, err
+	}
 
-		Body:        bytes.NewReader(bodyBuf),
-		ContentType: aws.String("application/octet-stream"),
+	destPrefixes, keep, err := checkQuotas(ctx, store, mailboxPrefix, email, bodyBuf)
+	if err != nil || len(destPrefixes) == 0 {
+		return nil, nil, keep, parsedEmail{}, err
 	}
-	log.Printf("Writing raw email to \"%s\"\n", mailboxBucket+"/"+destObjectKey)
 
-	putResp, err := s3Client.PutObjectRequest(putInput).Send(ctx)
-	if checkAwsErr(err) != nil {
-		log.Println(putResp)
-		return err
+	destPrefixes, deliveries, err := runFilters(ctx, store, mailboxPrefix, email, destPrefixes, spam, bodyBuf)
+	if err != nil || len(destPrefixes) == 0 {
+		return nil, nil, keep, parsedEmail{}, err
+	}
+
+	// parsed before the blob is referenced, mail that can't be parsed goes to the errored
+	// mailbox and mustn't leave references to copies that were never written
+	parsed, err := parseEmail(bodyBuf, contentHash(bodyBuf))
+	if err != nil {
+		return nil, nil, keep, parsedEmail{}, err
+	}
+	parsed.Verdicts = email.Verdicts
+
+	refs := []string{}
+	for _, prefix := range destPrefixes {
+		for i := range deliveries[prefix] {
+			refs = append(refs, prefix+"/"+copyKey(email.DestObjectKey, i))
+		}
+	}
+	_, err = putBlob(ctx, store, mailboxPrefix, bodyBuf, refs)
+	if err != nil {
+		return nil, nil, keep, parsedEmail{}, err
+	}
+
+	return destPrefixes, deliveries, keep, parsed, nil
+}
+
+// parseEmail and pull out the parts that are stored on their own
+func parseEmail(bodyBuf []byte, hash string) (parsedEmail, error) {
+	parsed := parsedEmail{
+		Size: len(bodyBuf),
+		Blob: hash,
 	}
 
-	// Create a payload with the messageID and a nested object for the email
 	email, err := parsemail.Parse(bytes.NewReader(bodyBuf))
 	if err != nil {
-		log.Println(err)
+		return parsed, err
+	}
+
+	// attachments are stored as their own objects so the metadata stays small and can be read back
+	parsed.Attachments, parsed.contents, err = extractAttachments(&email)
+	if err != nil {
+		return parsed, err
+	}
+
+	// tracking pixels are removed before anything reads the html body
+	email.HTMLBody, parsed.TrackingPixels = stripTrackingPixels(email.HTMLBody)
+	parsed.Email = newMessage(email)
+
+	return parsed, nil
+}
+
+func processEmail(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID, destObjectKey string, parsed parsedEmail) error {
+	err := putRef(ctx, store, mailboxPrefix, userID, destObjectKey, parsed.Blob)
+	if err != nil {
 		return err
 	}
 
-	//nest the email struct onto the json object
-	emailMeta := make(map[string]interface{})
-	emailMeta["MessageID"] = messageID
-	emailMeta["Email"] = email
+	err = putMetadata(ctx, store, mailboxPrefix, userID, messageID, destObjectKey, parsed)
+	if err != nil {
+		return err
+	}
 
-	buf, err := json.Marshal(emailMeta)
+	threadID, err := assignThread(ctx, store, mailboxPrefix, userID, destObjectKey, parsed.Email)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
-	bodyReader := strings.NewReader(string(buf))
 
-	putInput = &s3.PutObjectInput{
-		Bucket: aws.String(mailboxBucket),
-		Key:    aws.String(destObjectKey + ".json"),
+	// new mail is delivered into the Inbox, or the folder of its tag, unless a Sieve script filed it
+	folder := parsed.Folder
+	if folder == "" {
+		folder, err = tagFolder(ctx, store, mailboxPrefix, userID, parsed.Tag)
+	} else {
+		_, err = CreateFolder(ctx, store, mailboxPrefix, userID, folder)
+		if errors.Is(err, ErrFolderExists) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	flags := parsed.Flags
+	if flags == nil {
+		flags = []string{}
+	}
+	state := messageState{
+		Folder:   folder,
+		Flags:    flags,
+		ThreadID: threadID,
+		Filed:    time.Now().UTC(),
+	}
+	err = saveState(ctx, store, mailboxPrefix, userID, destObjectKey, state)
+	if err != nil {
+		return err
+	}
 
-		Body:        bodyReader,
-		ContentType: aws.String("application/json"),
+	err = addToSearchIndex(ctx, store, mailboxPrefix, userID, destObjectKey, parsed.Email)
+	if err != nil {
+		return err
 	}
-	log.Printf("Writing json email to \"%s\"\n", mailboxBucket+"/"+destObjectKey+".json")
 
-	putResp, err = s3Client.PutObjectRequest(putInput).Send(ctx)
-	if checkAwsErr(err) != nil {
-		log.Println(putResp)
+	meta := newMeta(messageID, parsed.Email, parsed.Attachments, parsed.Size)
+	meta.Tag = parsed.Tag
+	meta.applyState(state)
+
+	// counted before it is indexed, usage that was never recorded is counted from the index.
+	// An email that is processed again is already counted.
+	indexed, err := isIndexed(ctx, store, mailboxPrefix, userID, messageID)
+	if err != nil {
 		return err
 	}
+	if !indexed {
+		err = recordDelivery(ctx, store, mailboxPrefix, userID, parsed.Size)
+		if err != nil {
+			return err
+		}
+	}
 
-	return nil
+	return addToIndex(ctx, store, mailboxPrefix, userID, meta)
 }
 
 // LoadErroredEmails from the _errored mailbox
-func LoadErroredEmails(ctx context.Context, s3Client *s3.Client, mailboxBucket, mailboxPrefix string) ([]MoveOperation, error) {
+func LoadErroredEmails(ctx context.Context, store MailStore, mailboxPrefix string) ([]MoveOperation, error) {
 	ret := []MoveOperation{}
 
-	listInput := &s3.ListObjectsV2Input{
-		Bucket: aws.String(mailboxBucket),
-		Prefix: aws.String(mailboxPrefix + "/_errored/"),
-	}
-	log.Printf("Loading '_errored' emails from \"%s/%s/_errored/\"\n", mailboxBucket, mailboxPrefix)
+	log.Printf("Loading '_errored' emails from \"%s/_errored/\"\n", mailboxPrefix)
 
-	result, err := s3Client.ListObjectsV2Request(listInput).Send(ctx)
-	if checkAwsErr(err) != nil {
-		log.Println(result)
+	keys, err := store.List(ctx, erroredKey(mailboxPrefix, ""))
+	if err != nil {
 		return ret, err
 	}
 
-	for i := range result.Contents {
+	for i := range keys {
 		// TODO: Load errored email, parse it for the To addresses, and then set the Dest fields on MoveOperation
 
 		ret = append(ret, MoveOperation{
-			MessageID: *result.Contents[i].Key,
+			MessageID: keys[i],
 
-			SourceBucket:    mailboxBucket,
-			SourceObjectKey: *result.Contents[i].Key,
+			SourceObjectKey: keys[i],
 		})
 	}
 
@@ -179,46 +308,6 @@ func LoadErroredEmails(ctx context.Context, s3Client *s3.Client, mailboxBucket,
 }
 
 // copyErroredEmail is called when an email has failed and we want to copy it into the `_errored` mailbox
-func copyErroredEmail(ctx context.Context, s3Client *s3.Client, mailboxBucket, mailboxPrefix, srcBucket, srcObjectKey, destKey string) error {
-	sourcePath := srcBucket + "/" + srcObjectKey
-	destBucketPath := mailboxPrefix + "/_errored/" + destKey
-
-	copyInput := &s3.CopyObjectInput{
-		CopySource: aws.String(url.PathEscape(sourcePath)),
-
-		Bucket: aws.String(mailboxBucket),
-		Key:    aws.String(destBucketPath),
-
-		ContentType: aws.String("application/octet-stream"),
-	}
-	log.Printf("Copying from \"%s\" to \"%s\"\n", sourcePath, mailboxBucket+"/"+destBucketPath)
-
-	copyResp, err := s3Client.CopyObjectRequest(copyInput).Send(ctx)
-	if checkAwsErr(err) != nil {
-		log.Println(copyResp)
-		return err
-	}
-
-	return nil
-}
-
-func checkAwsErr(err error) error {
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case s3.ErrCodeNoSuchBucket:
-				log.Println(s3.ErrCodeNoSuchBucket, aerr.Error())
-			default:
-				log.Println(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Println(err.Error())
-		}
-
-		return err
-	}
-
-	return nil
+func copyErroredEmail(ctx context.Context, store MailStore, mailboxPrefix, srcObjectKey, destKey string) error {
+	return store.Copy(ctx, srcObjectKey, erroredKey(mailboxPrefix, destKey))
 }
@@ -0,0 +1,106 @@
+package email
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const testMessage = "From: Carol <carol@example.com>\r\n" +
+	"To: alice@example.com\r\n" +
+	"Subject: Lunch\r\n" +
+	"Message-ID: <lunch@example.com>\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Noon on Friday?\r\n"
+
+// deliver the raw message to the users the way postmaster does
+func deliver(t *testing.T, store MailStore, messageID, raw string, users ...string) {
+	t.Helper()
+	ctx := context.Background()
+
+	err := store.Put(ctx, "incoming/"+messageID, []byte(raw), "message/rfc822")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SortEmailIntoMailbox(ctx, store, "mailbox", MoveOperation{
+		MessageID:       messageID,
+		SourceObjectKey: "incoming/" + messageID,
+		DestObjectKey:   messageID,
+		DestPrefixes:    users,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnparsableEmailLeavesNoBlobRefs(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	deliver(t, store, "broken", "Content-Type: multipart/mixed\r\n\r\nno boundary", "alice")
+
+	errored, _ := store.List(ctx, erroredKey("mailbox", ""))
+	if len(errored) != 1 {
+		t.Errorf("errored mailbox has %v, want the message", errored)
+	}
+	refs, _ := store.List(ctx, "mailbox/_blobs/")
+	if len(refs) != 0 {
+		t.Errorf("blobs %v were referenced for a message that wasn't delivered", refs)
+	}
+}
+
+func TestDeleteEmailAdjustsQuota(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	deliver(t, store, "lunch", testMessage, "alice", "bob")
+
+	quota, err := GetQuota(ctx, store, "mailbox", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.Used != int64(len(testMessage)) || quota.Messages != 1 {
+		t.Fatalf("quota after delivery is %d bytes in %d messages", quota.Used, quota.Messages)
+	}
+
+	err = DeleteEmail(ctx, store, "mailbox", "alice", "lunch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	quota, _ = GetQuota(ctx, store, "mailbox", "alice")
+	if quota.Used != 0 || quota.Messages != 0 {
+		t.Errorf("quota after delete is %d bytes in %d messages", quota.Used, quota.Messages)
+	}
+
+	// bob still holds a reference, the original stays until he deletes it too
+	raw, err := loadRaw(ctx, store, "mailbox", "bob", "lunch")
+	if err != nil || !strings.Contains(string(raw), "Noon on Friday?") {
+		t.Fatalf("bob's copy is gone: %v", err)
+	}
+	err = DeleteEmail(ctx, store, "mailbox", "bob", "lunch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Get(ctx, blobKey("mailbox", contentHash([]byte(testMessage))))
+	if err != ErrNotFound {
+		t.Errorf("blob left behind after the last reference was deleted: %v", err)
+	}
+}
+
+func TestProcessEmailAgainCountsOnce(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	// a delivery that is retried, e.g. after its lambda timed out, processes the email again
+	deliver(t, store, "lunch", testMessage, "alice")
+	deliver(t, store, "lunch", testMessage, "alice")
+
+	quota, err := GetQuota(ctx, store, "mailbox", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.Used != int64(len(testMessage)) || quota.Messages != 1 {
+		t.Errorf("quota after processing twice is %d bytes in %d messages", quota.Used, quota.Messages)
+	}
+}
@@ -0,0 +1,367 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// encryptedMagic starts every object written by an EncryptedStore. It is followed by the
+// length of the envelope, the envelope and the ciphertext. Objects without it were written
+// before encryption was turned on and are returned as they are.
+var encryptedMagic = []byte("\x89GME\r\n\x1a\n")
+
+// maxCachedKeys bounds the unwrapped data keys kept in memory
+const maxCachedKeys = 1024
+
+// ErrForbidden is returned when reading or writing mail that belongs to another user
+var ErrForbidden = errors.New("mail belongs to another user")
+
+type ownerKey struct{}
+type recipientsKey struct{}
+
+// WithOwner marks the context as acting for the authenticated user, an EncryptedStore that
+// requires an owner only decrypts that user's mail
+func WithOwner(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, ownerKey{}, userID)
+}
+
+func ownerFromContext(ctx context.Context) (string, bool) {
+	userID, ok := ctx.Value(ownerKey{}).(string)
+	return userID, ok && userID != ""
+}
+
+// withRecipients sets the users an object outside of any mailbox, such as a shared blob, is encrypted for
+func withRecipients(ctx context.Context, userIDs []string) context.Context {
+	return context.WithValue(ctx, recipientsKey{}, userIDs)
+}
+
+// envelope holds the data key of an object wrapped for every user that can read it
+type envelope struct {
+	Keys  map[string][]byte
+	Nonce []byte
+}
+
+// EncryptedStore encrypts every object in a user's mailbox with its own data key, wrapped by
+// the user's key from the KeyProvider. Objects shared between mailboxes are wrapped for each
+// of the recipients. Objects that belong to no one, like the errored mailbox, are not encrypted.
+type EncryptedStore struct {
+	MailStore
+	mailboxPrefix string
+	keys          KeyProvider
+
+	// RequireOwner only allows the user set with WithOwner to read and write, otherwise the
+	// store acts for the system and can read any mailbox
+	RequireOwner bool
+
+	cacheLock sync.Mutex
+	cache     map[string][]byte
+}
+
+// NewEncryptedStore wraps store so the mailboxes under mailboxPrefix are encrypted with keys from the provider
+func NewEncryptedStore(store MailStore, mailboxPrefix string, keys KeyProvider) *EncryptedStore {
+	return &EncryptedStore{
+		MailStore:     store,
+		mailboxPrefix: mailboxPrefix,
+		keys:          keys,
+		cache:         make(map[string][]byte),
+	}
+}
+
+// keyOwner is the user whose mailbox the key is in, system objects have no owner
+func (e *EncryptedStore) keyOwner(key string) string {
+	rest := strings.TrimPrefix(key, e.mailboxPrefix+"/")
+	if rest == key {
+		return ""
+	}
+
+	userID := strings.SplitN(rest, "/", 2)[0]
+	if userID == "" || strings.HasPrefix(userID, "_") || !strings.Contains(rest, "/") {
+		return ""
+	}
+
+	return userID
+}
+
+// Get the object at key, decrypted with the owner's key
+func (e *EncryptedStore) Get(ctx context.Context, key string) ([]byte, error) {
+	err := e.checkOwner(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := e.MailStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.decrypt(ctx, key, body)
+}
+
+// GetVersion of the object at key, decrypted with the owner's key
+func (e *EncryptedStore) GetVersion(ctx context.Context, key string) ([]byte, string, error) {
+	err := e.checkOwner(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	body, version, err := getVersion(ctx, e.MailStore, key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	body, err = e.decrypt(ctx, key, body)
+
+	return body, version, err
+}
+
+// Copy the object at srcKey to destKey, both have to be in the owner's mailbox when the store requires an owner
+func (e *EncryptedStore) Copy(ctx context.Context, srcKey, destKey string) error {
+	err := e.checkOwner(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	err = e.checkOwner(ctx, destKey)
+	if err != nil {
+		return err
+	}
+
+	return e.MailStore.Copy(ctx, srcKey, destKey)
+}
+
+// List the keys under prefix, when the store requires an owner the keys in other users'
+// mailboxes are left out
+func (e *EncryptedStore) List(ctx context.Context, prefix string) ([]string, error) {
+	err := e.checkOwner(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := e.MailStore.List(ctx, prefix)
+	if err != nil || !e.RequireOwner {
+		return keys, err
+	}
+
+	// a prefix such as "mailbox/" spans every mailbox
+	owned := []string{}
+	for _, key := range keys {
+		if e.checkOwner(ctx, key) == nil {
+			owned = append(owned, key)
+		}
+	}
+
+	return owned, nil
+}
+
+// Delete the object at key, only from the owner's mailbox when the store requires an owner
+func (e *EncryptedStore) Delete(ctx context.Context, key string) error {
+	err := e.checkOwner(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return e.MailStore.Delete(ctx, key)
+}
+
+// checkOwner refuses keys in another user's mailbox when the store requires an owner
+func (e *EncryptedStore) checkOwner(ctx context.Context, key string) error {
+	owner, _ := ownerFromContext(ctx)
+	if keyOwner := e.keyOwner(key); e.RequireOwner && keyOwner != "" && keyOwner != owner {
+		return fmt.Errorf("%w: %s", ErrForbidden, key)
+	}
+
+	return nil
+}
+
+// decrypt an object read from the wrapped store, objects that aren't encrypted are returned as they are
+func (e *EncryptedStore) decrypt(ctx context.Context, key string, body []byte) ([]byte, error) {
+	owner, authenticated := ownerFromContext(ctx)
+	keyOwner := e.keyOwner(key)
+	if !bytes.HasPrefix(body, encryptedMagic) {
+		return body, nil
+	}
+
+	header, ciphertext, env, err := readEnvelope(body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+
+	// the system reads as whoever the object belongs to
+	userID := owner
+	if !authenticated && !e.RequireOwner {
+		userID = keyOwner
+		if _, ok := env.Keys[userID]; !ok {
+			userID = firstKey(env.Keys)
+		}
+	}
+	wrapped, ok := env.Keys[userID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrForbidden, key)
+	}
+
+	dataKey, err := e.unwrap(ctx, userID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, env.Nonce, ciphertext, header)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", key, ErrInvalidKey, err)
+	}
+
+	return plaintext, nil
+}
+
+// Put the body at key encrypted with a new data key, wrapped for the owner of the key or
+// the recipients of a shared object
+func (e *EncryptedStore) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	encrypted, err := e.encrypt(ctx, key, body)
+	if err != nil {
+		return err
+	}
+
+	return e.MailStore.Put(ctx, key, encrypted, contentType)
+}
+
+// PutIfVersion puts the body at key encrypted, if the object is still at version
+func (e *EncryptedStore) PutIfVersion(ctx context.Context, key string, body []byte, contentType, version string) error {
+	encrypted, err := e.encrypt(ctx, key, body)
+	if err != nil {
+		return err
+	}
+
+	return putIfVersion(ctx, e.MailStore, key, encrypted, contentType, version)
+}
+
+// encrypt the body for the owner of the key or the recipients of a shared object, objects that
+// belong to no one are returned as they are
+func (e *EncryptedStore) encrypt(ctx context.Context, key string, body []byte) ([]byte, error) {
+	err := e.checkOwner(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	recipients := []string{}
+	if keyOwner := e.keyOwner(key); keyOwner != "" {
+		recipients = append(recipients, keyOwner)
+	} else if userIDs, ok := ctx.Value(recipientsKey{}).([]string); ok {
+		recipients = append(recipients, userIDs...)
+	}
+
+	if len(recipients) == 0 {
+		return body, nil
+	}
+
+	dataKey := make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	env := envelope{
+		Keys:  make(map[string][]byte),
+		Nonce: make([]byte, 12),
+	}
+	_, err = io.ReadFull(rand.Reader, env.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	for _, userID := range recipients {
+		env.Keys[userID], err = e.keys.WrapKey(ctx, userID, dataKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	header, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(encryptedMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(len(header)))
+	buf.Write(header)
+	// the envelope is authenticated along with the body so the recipients can't be swapped
+	buf.Write(aead.Seal(nil, env.Nonce, body, header))
+
+	return buf.Bytes(), nil
+}
+
+// unwrap the data key, keys are cached so reading the same object again doesn't go back to the provider
+func (e *EncryptedStore) unwrap(ctx context.Context, userID string, wrapped []byte) ([]byte, error) {
+	cacheKey := userID + "\x00" + string(wrapped)
+
+	e.cacheLock.Lock()
+	dataKey, ok := e.cache[cacheKey]
+	e.cacheLock.Unlock()
+	if ok {
+		return dataKey, nil
+	}
+
+	dataKey, err := e.keys.UnwrapKey(ctx, userID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	e.cacheLock.Lock()
+	if len(e.cache) >= maxCachedKeys {
+		e.cache = make(map[string][]byte)
+	}
+	e.cache[cacheKey] = dataKey
+	e.cacheLock.Unlock()
+
+	return dataKey, nil
+}
+
+// readEnvelope splits an encrypted object into the raw envelope, the ciphertext and the parsed envelope
+func readEnvelope(body []byte) ([]byte, []byte, envelope, error) {
+	var env envelope
+
+	rest := body[len(encryptedMagic):]
+	if len(rest) < 4 {
+		return nil, nil, env, fmt.Errorf("%w: truncated envelope", ErrInvalidKey)
+	}
+	size := binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+	if uint64(size) > uint64(len(rest)) {
+		return nil, nil, env, fmt.Errorf("%w: truncated envelope", ErrInvalidKey)
+	}
+
+	header := rest[:size]
+	err := json.Unmarshal(header, &env)
+	if err != nil {
+		return nil, nil, env, fmt.Errorf("%w: %s", ErrInvalidKey, err)
+	}
+
+	return header, rest[size:], env, nil
+}
+
+func firstKey(keys map[string][]byte) string {
+	userIDs := []string{}
+	for userID := range keys {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	if len(userIDs) == 0 {
+		return ""
+	}
+
+	return userIDs[0]
+}
@@ -0,0 +1,83 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestEncryptedStoreRequiresOwner(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemoryStore()
+	keys := NewFileKeyProvider(tempDir(t))
+
+	// the system writes mail for both users
+	system := NewEncryptedStore(base, "mailbox", keys)
+	for _, key := range []string{"mailbox/alice/a", "mailbox/bob/b"} {
+		err := system.Put(ctx, key, []byte("mail"), "text/plain")
+		if err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	store := NewEncryptedStore(base, "mailbox", keys)
+	store.RequireOwner = true
+	alice := WithOwner(ctx, "alice")
+
+	_, err := store.Get(alice, "mailbox/alice/a")
+	if err != nil {
+		t.Errorf("Get of the owner's mail: %v", err)
+	}
+	err = store.Copy(alice, "mailbox/alice/a", "mailbox/alice/c")
+	if err != nil {
+		t.Errorf("Copy within the owner's mailbox: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		run  func(ctx context.Context) error
+	}{
+		{"Get", func(ctx context.Context) error {
+			_, err := store.Get(ctx, "mailbox/bob/b")
+			return err
+		}},
+		{"Put", func(ctx context.Context) error {
+			return store.Put(ctx, "mailbox/bob/b", []byte("x"), "text/plain")
+		}},
+		{"Delete", func(ctx context.Context) error {
+			return store.Delete(ctx, "mailbox/bob/b")
+		}},
+		{"Copy from", func(ctx context.Context) error {
+			return store.Copy(ctx, "mailbox/bob/b", "mailbox/alice/b")
+		}},
+		{"Copy to", func(ctx context.Context) error {
+			return store.Copy(ctx, "mailbox/alice/a", "mailbox/bob/a")
+		}},
+		{"List", func(ctx context.Context) error {
+			_, err := store.List(ctx, "mailbox/bob/")
+			return err
+		}},
+	} {
+		if err := tc.run(alice); !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s of another user's mail returned %v, want ErrForbidden", tc.name, err)
+		}
+		if err := tc.run(ctx); !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s without an owner returned %v, want ErrForbidden", tc.name, err)
+		}
+	}
+
+	// a prefix spanning every mailbox only lists the owner's
+	listed, err := store.List(alice, "mailbox/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if want := []string{"mailbox/alice/a", "mailbox/alice/c"}; !reflect.DeepEqual(listed, want) {
+		t.Errorf("List = %v, want %v", listed, want)
+	}
+
+	buf, err := system.Get(ctx, "mailbox/bob/b")
+	if err != nil || string(buf) != "mail" {
+		t.Errorf("another user's mail was changed, got %q, %v", buf, err)
+	}
+}
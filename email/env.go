@@ -0,0 +1,58 @@
+package email
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// StoreOptions are the parts of the mailbox storage that differ between the handlers
+type StoreOptions struct {
+	// RequireOwner only decrypts mail for the user set with WithOwner, for handlers that act for a signed in user
+	RequireOwner bool
+}
+
+// NewStoreFromEnv opens the mailbox storage the handlers and the command share. Mail is kept
+// in MAILBOX_DIR on a laptop and in the mailbox bucket otherwise, encrypted when a key provider
+// is configured with KMS_KEY_ID or KEY_DIR, and compressed with MAILBOX_COMPRESSION. The
+// stores are always stacked as Compressed(Encrypted(base)) so every handler reads what the
+// others wrote.
+func NewStoreFromEnv(mailboxBucket, mailboxPrefix string, opts StoreOptions) (MailStore, error) {
+	var base MailStore
+	var keys KeyProvider
+
+	// Use a local directory instead of S3 when running on a laptop
+	if dir := os.Getenv("MAILBOX_DIR"); dir != "" {
+		base = NewFileStore(dir)
+	} else {
+		cfg, err := external.LoadDefaultAWSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("unable to load SDK config, %w", err)
+		}
+
+		base = NewS3Store(s3.New(cfg), mailboxBucket)
+		if keyID := os.Getenv("KMS_KEY_ID"); keyID != "" {
+			keys = NewKMSKeyProvider(kms.New(cfg), keyID)
+		}
+	}
+
+	// Use a directory of keys instead of KMS when running on a laptop
+	if dir := os.Getenv("KEY_DIR"); dir != "" {
+		keys = NewFileKeyProvider(dir)
+	}
+	if keys != nil {
+		encrypted := NewEncryptedStore(base, mailboxPrefix, keys)
+		encrypted.RequireOwner = opts.RequireOwner
+		base = encrypted
+	}
+
+	compressed, err := NewCompressedStore(base, os.Getenv("MAILBOX_COMPRESSION"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure compression, %w", err)
+	}
+
+	return compressed, nil
+}
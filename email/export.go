@@ -0,0 +1,274 @@
+package email
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Formats a mailbox can be exported as
+const (
+	// ExportMbox is a single mboxrd file
+	ExportMbox = "mboxrd"
+	// ExportMaildir is a tarball of a Maildir++ directory, with a sub-directory per folder
+	ExportMaildir = "maildir"
+)
+
+// ErrInvalidExportOptions is returned when the export query parameters can't be used
+var ErrInvalidExportOptions = errors.New("invalid export options")
+
+// mboxFromRegex matches the lines mboxrd quotes with an extra ">" so they aren't read as the start of a message
+var mboxFromRegex = regexp.MustCompile(`^>*From `)
+
+// maildirFlags are the info suffix letters of the IMAP flags, in the alphabetical order Maildir wants them
+var maildirFlags = []struct {
+	Letter string
+	Flag   string
+}{
+	{"D", FlagDraft},
+	{"F", FlagFlagged},
+	{"R", FlagAnswered},
+	{"S", FlagSeen},
+	{"T", FlagDeleted},
+}
+
+// ExportOptions select the emails to export and the format
+type ExportOptions struct {
+	// Format is ExportMbox or ExportMaildir
+	Format string
+	// Folder limits the export to a folder and its sub-folders, everything is exported when it is empty
+	Folder string
+	// After and Before limit the export to emails dated in between, either can be left zero
+	After  time.Time
+	Before time.Time
+}
+
+// ParseExportOptions from the query string parameters format, folder, after and before. Dates are YYYY-MM-DD.
+func ParseExportOptions(params map[string]string) (ExportOptions, error) {
+	opts := ExportOptions{
+		Format: strings.ToLower(params["format"]),
+		Folder: params["folder"],
+	}
+
+	switch opts.Format {
+	case "", "mbox":
+		opts.Format = ExportMbox
+	case ExportMbox, ExportMaildir:
+	default:
+		return opts, fmt.Errorf("%w: unknown format %q", ErrInvalidExportOptions, opts.Format)
+	}
+
+	if opts.Folder != "" {
+		folder, err := canonicalFolder(opts.Folder)
+		if err != nil {
+			return opts, fmt.Errorf("%w: %s", ErrInvalidExportOptions, err)
+		}
+		opts.Folder = folder
+	}
+
+	for name, date := range map[string]*time.Time{"after": &opts.After, "before": &opts.Before} {
+		value, ok := params[name]
+		if !ok || value == "" {
+			continue
+		}
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return opts, fmt.Errorf("%w: %s must be a date like 2006-01-02", ErrInvalidExportOptions, name)
+		}
+		*date = parsed
+	}
+
+	return opts, nil
+}
+
+// selects reports if the email is part of the export
+func (o ExportOptions) selects(meta Meta) bool {
+	if o.Folder != "" && !inFolder(meta.Folder, o.Folder) {
+		return false
+	}
+	if !o.After.IsZero() && meta.Date.Before(o.After) {
+		return false
+	}
+	if !o.Before.IsZero() && !meta.Date.Before(o.Before) {
+		return false
+	}
+
+	return true
+}
+
+// ExportMailbox writes the user's emails to w, oldest first, from the original messages. Emails
+// are read one at a time so the export is never held in memory.
+func ExportMailbox(ctx context.Context, store MailStore, mailboxPrefix, userID string, w io.Writer, opts ExportOptions) error {
+	index, err := LoadIndex(ctx, store, mailboxPrefix, userID)
+	if err == ErrNotFound {
+		index, err = RebuildIndex(ctx, store, mailboxPrefix, userID)
+	}
+	if err != nil {
+		return err
+	}
+
+	emails := []Meta{}
+	for _, meta := range index.Emails {
+		if opts.selects(meta) {
+			emails = append(emails, meta)
+		}
+	}
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emails[i].Date.Before(emails[j].Date)
+	})
+
+	switch opts.Format {
+	case ExportMaildir:
+		return exportMaildir(ctx, store, mailboxPrefix, userID, w, emails)
+	case ExportMbox, "":
+		return exportMbox(ctx, store, mailboxPrefix, userID, w, emails)
+	}
+
+	return fmt.Errorf("%w: unknown format %q", ErrInvalidExportOptions, opts.Format)
+}
+
+// exportMbox writes the emails as mboxrd, every message starts with a "From " line and lines
+// in the message that look like one are quoted
+func exportMbox(ctx context.Context, store MailStore, mailboxPrefix, userID string, w io.Writer, emails []Meta) error {
+	writer := bufio.NewWriter(w)
+
+	for _, meta := range emails {
+		raw, err := loadRaw(ctx, store, mailboxPrefix, userID, meta.MessageID)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(writer, "From %s %s\n", envelopeSender(raw, meta), exportDate(meta).Format(time.ANSIC))
+
+		scanner := bufio.NewScanner(bytes.NewReader(raw))
+		scanner.Buffer(make([]byte, 64*1024), len(raw)+1)
+		for scanner.Scan() {
+			line := strings.TrimSuffix(scanner.Text(), "\r")
+			if mboxFromRegex.MatchString(line) {
+				writer.WriteString(">")
+			}
+			writer.WriteString(line)
+			writer.WriteString("\n")
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		// a blank line separates the messages
+		writer.WriteString("\n")
+
+		err = writer.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+// exportMaildir writes the emails as a tarball of a Maildir, the Inbox is the top level
+// Maildir and every other folder is a Maildir++ sub-folder such as ".Projects.gopher-mail"
+func exportMaildir(ctx context.Context, store MailStore, mailboxPrefix, userID string, w io.Writer, emails []Meta) error {
+	writer := tar.NewWriter(w)
+	created := make(map[string]bool)
+
+	for _, meta := range emails {
+		dir := maildirFolder(meta.Folder)
+		if !created[dir] {
+			for _, sub := range []string{"", "cur", "new", "tmp"} {
+				err := writer.WriteHeader(&tar.Header{
+					Typeflag: tar.TypeDir,
+					Name:     path.Join(dir, sub) + "/",
+					Mode:     0700,
+					ModTime:  time.Now(),
+				})
+				if err != nil {
+					return err
+				}
+			}
+			created[dir] = true
+		}
+
+		raw, err := loadRaw(ctx, store, mailboxPrefix, userID, meta.MessageID)
+		if err != nil {
+			return err
+		}
+
+		err = writer.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Join(dir, "cur", maildirName(meta)),
+			Mode:     0600,
+			Size:     int64(len(raw)),
+			ModTime:  exportDate(meta),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(raw)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
+
+// maildirFolder is the directory of the folder in the tarball
+func maildirFolder(folder string) string {
+	if folder == FolderInbox || folder == "" {
+		return "Maildir"
+	}
+
+	return "Maildir/." + strings.Replace(strings.Replace(folder, ".", "_", -1), folderSeparator, ".", -1)
+}
+
+// maildirName is the unique file name of the email with its flags in the info suffix, e.g. "1577836800.<id>.gopher-mail:2,RS"
+func maildirName(meta Meta) string {
+	info := ""
+	for _, flag := range maildirFlags {
+		if hasFlag(meta.Flags, flag.Flag) {
+			info += flag.Letter
+		}
+	}
+
+	// the message ID can't contain the path or info separators
+	id := strings.NewReplacer("/", "_", ":", "_").Replace(meta.MessageID)
+
+	return fmt.Sprintf("%d.%s.gopher-mail:2,%s", exportDate(meta).Unix(), id, info)
+}
+
+// exportDate is the date of the email, or when it was filed for emails without one
+func exportDate(meta Meta) time.Time {
+	if meta.Date.IsZero() {
+		return meta.Filed.UTC()
+	}
+
+	return meta.Date.UTC()
+}
+
+// envelopeSender for the mbox "From " line, the Return-Path SES recorded or the From address
+func envelopeSender(raw []byte, meta Meta) string {
+	for _, header := range readHeaders(raw) {
+		if strings.EqualFold(header.Name, "Return-Path") {
+			sender := strings.Trim(header.Value, "<> ")
+			if sender != "" && !strings.ContainsAny(sender, " \t") {
+				return sender
+			}
+		}
+	}
+
+	if address, err := mail.ParseAddress(meta.From); err == nil {
+		return address.Address
+	}
+
+	return "MAILER-DAEMON"
+}
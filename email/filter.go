@@ -0,0 +1,490 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vacationLock serializes changes to the vacation replies sent within this process
+var vacationLock sync.Mutex
+
+// ErrSieveFailed is returned when a valid script can't be run against a message, e.g. it
+// rejects a message it also files. Postmaster then delivers the message as if there were no script.
+var ErrSieveFailed = errors.New("sieve script failed")
+
+// SievePolicy is how postmaster carries out the actions of the users' Sieve scripts
+type SievePolicy struct {
+	// Domain is the primary domain, the addresses of its mailboxes are the user at it
+	Domain string
+	// Mailer sends redirected mail and vacation replies, they are skipped without one
+	Mailer Mailer
+	// Bouncer returns rejected mail to its sender, rejected mail is dropped without one
+	Bouncer Bouncer
+}
+
+var sievePolicy SievePolicy
+
+// SetSievePolicy for every mailbox
+func SetSievePolicy(policy SievePolicy) {
+	sievePolicy = policy
+}
+
+// sieveKey is the key of the user's Sieve script
+func sieveKey(mailboxPrefix, userID string) string {
+	return userPrefix(mailboxPrefix, userID) + "_filter.sieve"
+}
+
+// vacationKey is the key of the vacation replies the user has sent
+func vacationKey(mailboxPrefix, userID string) string {
+	return userPrefix(mailboxPrefix, userID) + "_vacation.json"
+}
+
+// CheckSieveScript of the user, returns an ErrInvalidSieve with the line of the first problem in the script, nil if it is valid
+func CheckSieveScript(ctx context.Context, store MailStore, mailboxPrefix, userID, script string) error {
+	_, err := parseUserSieve(ctx, store, mailboxPrefix, userID, script)
+
+	return err
+}
+
+// parseUserSieve checks the script of the user, vacation replies can only be sent from their own addresses
+func parseUserSieve(ctx context.Context, store MailStore, mailboxPrefix, userID, script string) (sieveScript, error) {
+	return parseSieveFor(script, func(address string) (bool, error) {
+		return ownsAddress(ctx, store, mailboxPrefix, userID, address)
+	})
+}
+
+// ownsAddress reports if the address is the user's mailbox address or one of their aliases,
+// with or without a subaddress tag
+func ownsAddress(ctx context.Context, store MailStore, mailboxPrefix, userID, address string) (bool, error) {
+	address, err := parseRedirect(address)
+	if err != nil {
+		return false, nil
+	}
+	local, domain := splitAddress(address)
+	local, _ = splitSubaddress(strings.ToLower(local))
+
+	user, mailboxDomain := splitAddress(MailboxAddress(userID, sievePolicy.Domain))
+	user = strings.ToLower(user)
+	if domain != mailboxDomain {
+		return false, nil
+	}
+	if local == user {
+		return true, nil
+	}
+
+	namespace := ""
+	if domain != strings.ToLower(sievePolicy.Domain) {
+		namespace = domain
+	}
+	addresses, err := LoadAddressMap(ctx, store, mailboxPrefix, namespace)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return addresses.Aliases[local] == user, nil
+}
+
+// LoadSieveScript of the user, returns ErrNotFound if the user doesn't have one
+func LoadSieveScript(ctx context.Context, store MailStore, mailboxPrefix, userID string) (string, error) {
+	buf, err := store.Get(ctx, sieveKey(mailboxPrefix, userID))
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// PutSieveScript checks the script and makes it the one postmaster runs on the user's mail
+func PutSieveScript(ctx context.Context, store MailStore, mailboxPrefix, userID, script string) error {
+	_, err := parseUserSieve(ctx, store, mailboxPrefix, userID, script)
+	if err != nil {
+		return err
+	}
+
+	return store.Put(ctx, sieveKey(mailboxPrefix, userID), []byte(script), "application/sieve")
+}
+
+// DeleteSieveScript of the user, their mail is delivered as it was before they had one
+func DeleteSieveScript(ctx context.Context, store MailStore, mailboxPrefix, userID string) error {
+	_, err := store.Get(ctx, sieveKey(mailboxPrefix, userID))
+	if err != nil {
+		return err
+	}
+
+	return store.Delete(ctx, sieveKey(mailboxPrefix, userID))
+}
+
+// TestSieveScript runs the script against an email in the user's mailbox without carrying out
+// any of its actions. The user's own script is used when script is empty. Vacation replies are
+// reported even if the sender already got one.
+func TestSieveScript(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID, script string) (SieveResult, error) {
+	var err error
+	if script == "" {
+		script, err = LoadSieveScript(ctx, store, mailboxPrefix, userID)
+		if err != nil {
+			return SieveResult{}, err
+		}
+	}
+
+	parsed, err := parseUserSieve(ctx, store, mailboxPrefix, userID, script)
+	if err != nil {
+		return SieveResult{}, err
+	}
+
+	raw, err := loadRaw(ctx, store, mailboxPrefix, userID, messageID)
+	if err != nil {
+		return SieveResult{}, err
+	}
+	meta, err := loadMetadata(ctx, store, mailboxPrefix, userID, messageID)
+	if err != nil {
+		return SieveResult{}, err
+	}
+
+	// the envelope isn't stored, the sender is the Return-Path the message was delivered with
+	msg := newSieveMessage(raw, "", userID, meta.Tag)
+	for _, header := range msg.headers {
+		if strings.EqualFold(header.Name, "Return-Path") {
+			msg.from = strings.Trim(strings.TrimSpace(header.Value), "<>")
+			break
+		}
+	}
+
+	return parsed.run(msg)
+}
+
+// newSieveMessage is the message as a script sees it, sent from the envelope sender to the
+// user with the subaddress tag
+func newSieveMessage(raw []byte, from, userID, tag string) sieveMessage {
+	address := MailboxAddress(userID, sievePolicy.Domain)
+	to := address
+	if tag != "" {
+		local, domain := splitAddress(address)
+		to = local + "+" + tag + "@" + domain
+	}
+
+	return sieveMessage{
+		headers:   readHeaders(raw),
+		size:      len(raw),
+		from:      from,
+		to:        to,
+		addresses: []string{address, to},
+	}
+}
+
+// parseRedirect checks the address a message is redirected or replied from is a single
+// address, and returns it without a display name
+func parseRedirect(address string) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+
+	return parsed.Address, nil
+}
+
+// runFilters runs the Sieve script of each user the email is for, after it is routed and
+// before it is stored. Redirects, rejects and vacation replies are carried out here, returns
+// the users the email is still stored for and the copies each of them gets. A script that
+// fails, or whose actions fail, delivers the email as if there were no script. Mail triaged
+// as spam goes into the Spam folder without running the script, so spam isn't redirected
+// or answered.
+func runFilters(ctx context.Context, store MailStore, mailboxPrefix string, email MoveOperation, destPrefixes []string, spam map[string]bool, body []byte) ([]string, map[string][]SieveDelivery, error) {
+	deliver := []string{}
+	deliveries := make(map[string][]SieveDelivery)
+	implicitKeep := []SieveDelivery{{Flags: []string{}}}
+
+	for _, userID := range destPrefixes {
+		if spam[userID] {
+			deliver = append(deliver, userID)
+			deliveries[userID] = []SieveDelivery{{Folder: FolderSpam, Flags: []string{}}}
+			continue
+		}
+
+		script, err := LoadSieveScript(ctx, store, mailboxPrefix, userID)
+		if err == ErrNotFound {
+			deliver = append(deliver, userID)
+			deliveries[userID] = implicitKeep
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		result, err := runFilter(ctx, store, mailboxPrefix, userID, email, script, body)
+		if err != nil {
+			log.Printf("Sieve script of \"%s\" failed on \"%s\", delivering it to the Inbox: %s\n", userID, email.MessageID, err)
+			result.Deliveries = implicitKeep
+		}
+
+		if len(result.Deliveries) == 0 {
+			log.Printf("Sieve script of \"%s\" doesn't keep \"%s\"\n", userID, email.MessageID)
+			continue
+		}
+		deliver = append(deliver, userID)
+		deliveries[userID] = result.Deliveries
+	}
+
+	return deliver, deliveries, nil
+}
+
+// runFilter runs the user's script against the email and carries out everything but storing it.
+// The result only keeps the copies that are still to be stored.
+func runFilter(ctx context.Context, store MailStore, mailboxPrefix, userID string, email MoveOperation, script string, body []byte) (SieveResult, error) {
+	parsed, err := parseSieve(script)
+	if err != nil {
+		return SieveResult{}, err
+	}
+
+	msg := newSieveMessage(body, email.Sender, userID, email.tag(userID))
+	result, err := parsed.run(msg)
+	if err != nil {
+		return result, err
+	}
+
+	if len(result.Redirects) > 0 {
+		err = redirectMessage(ctx, userID, msg, result.Redirects, body)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if result.Reject != "" {
+		if sievePolicy.Bouncer == nil {
+			log.Printf("Dropping \"%s\" rejected by \"%s\", there is nothing to reject it with\n", email.MessageID, userID)
+			return result, nil
+		}
+		err = sievePolicy.Bouncer.Reject(ctx, email.MessageID, userID, result.Reject)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if result.Vacation != nil {
+		// a reply that can't be sent doesn't stop the message being delivered
+		err = sendVacation(ctx, store, mailboxPrefix, userID, msg, *result.Vacation)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return result, nil
+}
+
+// redirectMessage forwards the message to the addresses. SES only sends mail from our own
+// domains so the message is sent from the user, with a Reply-To of the original sender.
+func redirectMessage(ctx context.Context, userID string, msg sieveMessage, addresses []string, body []byte) error {
+	if sievePolicy.Mailer == nil {
+		return fmt.Errorf("%w: there is nothing to redirect with", ErrSieveFailed)
+	}
+
+	// X-Loop marks the mailboxes a message was redirected by, so two scripts can't send it back and forth
+	from := MailboxAddress(userID, sievePolicy.Domain)
+	for _, header := range msg.headers {
+		if strings.EqualFold(header.Name, "X-Loop") && strings.EqualFold(strings.TrimSpace(header.Value), from) {
+			return fmt.Errorf("%w: the message was already redirected by %s", ErrSieveFailed, from)
+		}
+	}
+
+	raw := rewriteHeaders(body, from)
+	log.Printf("Redirecting mail for \"%s\" to %s\n", userID, strings.Join(addresses, ", "))
+
+	return sievePolicy.Mailer.Send(ctx, from, addresses, raw)
+}
+
+// rewriteHeaders of a redirected message so it is sent from the address, the signatures and
+// return path of the original delivery are dropped
+func rewriteHeaders(body []byte, address string) []byte {
+	var out bytes.Buffer
+	reader := bufio.NewReader(bytes.NewReader(body))
+
+	originalFrom := ""
+	hasReplyTo := false
+	skip := false
+	for {
+		line, err := reader.ReadString('\n')
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			break
+		}
+
+		if trimmed[0] == ' ' || trimmed[0] == '\t' {
+			if !skip {
+				out.WriteString(line)
+			}
+		} else {
+			name := strings.ToLower(strings.TrimSpace(trimmed[:strings.Index(trimmed+":", ":")]))
+			switch name {
+			case "from":
+				originalFrom = strings.TrimSpace(trimmed[len(name)+1:])
+				skip = true
+			case "return-path", "dkim-signature", "sender", "x-ses-dkim-signature":
+				skip = true
+			default:
+				hasReplyTo = hasReplyTo || name == "reply-to"
+				skip = false
+				out.WriteString(line)
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	name := "Redirected mail"
+	if parsed, err := mail.ParseAddress(originalFrom); err == nil {
+		name = parsed.Address + " via " + domainOf(address)
+		if parsed.Name != "" {
+			name = parsed.Name + " via " + domainOf(address)
+		}
+	}
+	fmt.Fprintf(&out, "From: %s\r\n", (&mail.Address{Name: name, Address: address}).String())
+	if originalFrom != "" && !hasReplyTo {
+		fmt.Fprintf(&out, "Reply-To: %s\r\n", originalFrom)
+	}
+	fmt.Fprintf(&out, "X-Loop: %s\r\n\r\n", address)
+
+	// the body is everything after the first empty line
+	if i := bytes.Index(body, []byte("\r\n\r\n")); i >= 0 {
+		out.Write(body[i+4:])
+	} else if i := bytes.Index(body, []byte("\n\n")); i >= 0 {
+		out.Write(body[i+2:])
+	}
+
+	return out.Bytes()
+}
+
+// vacationLog is when each sender can get a vacation reply from the user again
+type vacationLog struct {
+	Replied map[string]time.Time
+}
+
+// dueVacation reports if the sender is due a reply for the vacation and records that they got
+// one, the records that have run out are dropped
+func dueVacation(ctx context.Context, store MailStore, mailboxPrefix, userID, sender string, vacation SieveVacation) (bool, error) {
+	vacationLock.Lock()
+	defer vacationLock.Unlock()
+
+	replies := vacationLog{
+		Replied: make(map[string]time.Time),
+	}
+	buf, err := store.Get(ctx, vacationKey(mailboxPrefix, userID))
+	if err != nil && err != ErrNotFound {
+		return false, err
+	}
+	if err == nil {
+		err = json.Unmarshal(buf, &replies)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	now := time.Now().UTC()
+	for key, until := range replies.Replied {
+		if now.After(until) {
+			delete(replies.Replied, key)
+		}
+	}
+
+	handle := vacation.Handle
+	if handle == "" {
+		handle = vacation.Reason + "\x00" + vacation.Subject + "\x00" + vacation.From
+	}
+	hash := sha256.Sum256([]byte(handle))
+	key := strings.ToLower(sender) + " " + hex.EncodeToString(hash[:8])
+	if _, ok := replies.Replied[key]; ok {
+		return false, nil
+	}
+	replies.Replied[key] = now.AddDate(0, 0, vacation.Days)
+
+	buf, err = json.Marshal(replies)
+	if err != nil {
+		return false, err
+	}
+
+	return true, store.Put(ctx, vacationKey(mailboxPrefix, userID), buf, "application/json")
+}
+
+// sendVacation replies to the sender of the message, once every so many days for each sender
+func sendVacation(ctx context.Context, store MailStore, mailboxPrefix, userID string, msg sieveMessage, vacation SieveVacation) error {
+	if sievePolicy.Mailer == nil {
+		return fmt.Errorf("%w: there is nothing to send the vacation reply with", ErrSieveFailed)
+	}
+
+	due, err := dueVacation(ctx, store, mailboxPrefix, userID, msg.from, vacation)
+	if err != nil || !due {
+		return err
+	}
+
+	address := MailboxAddress(userID, sievePolicy.Domain)
+	from := address
+	if vacation.From != "" {
+		// the script was checked when it was saved, but the alias may have gone since
+		owned, err := ownsAddress(ctx, store, mailboxPrefix, userID, vacation.From)
+		if err != nil {
+			return err
+		}
+		if owned {
+			from = vacation.From
+		} else {
+			log.Printf("Sending the vacation reply of \"%s\" from their own address, \"%s\" isn't one of them\n", userID, vacation.From)
+		}
+	}
+
+	var subject, messageID, references string
+	r := sieveRun{msg: msg}
+	if values := r.headerValues("Subject"); len(values) > 0 {
+		subject = values[0]
+	}
+	if values := r.headerValues("Message-ID"); len(values) > 0 {
+		messageID = values[0]
+	}
+	if values := r.headerValues("References"); len(values) > 0 {
+		references = values[0]
+	}
+	if vacation.Subject != "" {
+		subject = vacation.Subject
+	} else {
+		subject = "Auto: " + subject
+	}
+
+	now := time.Now().UTC()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", msg.from)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <vacation-%d@%s>\r\n", now.UnixNano(), domainOf(address))
+	if messageID != "" {
+		fmt.Fprintf(&buf, "In-Reply-To: %s\r\n", messageID)
+		fmt.Fprintf(&buf, "References: %s\r\n", strings.TrimSpace(references+" "+messageID))
+	}
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	if vacation.MIME {
+		// the reason is a MIME entity with its own Content-Type
+		buf.WriteString(vacation.Reason)
+	} else {
+		fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		buf.WriteString(vacation.Reason)
+	}
+
+	log.Printf("Sending the vacation reply of \"%s\" to \"%s\"\n", userID, msg.from)
+
+	return sievePolicy.Mailer.Send(ctx, address, []string{msg.from}, buf.Bytes())
+}
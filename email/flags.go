@@ -0,0 +1,110 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// IMAP system flags (RFC 3501 section 2.3.2) that can be set on an email
+const (
+	FlagSeen     = `\Seen`
+	FlagFlagged  = `\Flagged`
+	FlagAnswered = `\Answered`
+	FlagDraft    = `\Draft`
+	FlagDeleted  = `\Deleted`
+)
+
+var systemFlags = []string{FlagSeen, FlagFlagged, FlagAnswered, FlagDraft, FlagDeleted}
+
+// ErrInvalidFlag is returned for flags that aren't one of the IMAP system flags
+var ErrInvalidFlag = errors.New("invalid flag")
+
+// FlagsUpdate adds and removes flags on an email, like IMAP STORE +FLAGS and -FLAGS
+type FlagsUpdate struct {
+	Add    []string
+	Remove []string
+}
+
+// canonicalFlag matches the flag to an IMAP system flag, the backslash and case are optional
+func canonicalFlag(flag string) (string, error) {
+	name := strings.TrimPrefix(strings.TrimSpace(flag), `\`)
+	for _, system := range systemFlags {
+		if strings.EqualFold(name, system[1:]) {
+			return system, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %q", ErrInvalidFlag, flag)
+}
+
+// hasFlag reports if flag is in flags
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apply the update to flags, returning a sorted set
+func (u FlagsUpdate) apply(flags []string) ([]string, error) {
+	set := make(map[string]bool)
+	for _, flag := range flags {
+		set[flag] = true
+	}
+
+	for _, flag := range u.Add {
+		flag, err := canonicalFlag(flag)
+		if err != nil {
+			return flags, err
+		}
+		set[flag] = true
+	}
+	for _, flag := range u.Remove {
+		flag, err := canonicalFlag(flag)
+		if err != nil {
+			return flags, err
+		}
+		delete(set, flag)
+	}
+
+	ret := []string{}
+	for flag := range set {
+		ret = append(ret, flag)
+	}
+	sort.Strings(ret)
+
+	return ret, nil
+}
+
+// UpdateFlags of the email and return the flags now set on it
+func UpdateFlags(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string, update FlagsUpdate) ([]string, error) {
+	state, err := updateState(ctx, store, mailboxPrefix, userID, messageID, func(state *messageState) error {
+		flags, err := update.apply(state.Flags)
+		if err != nil {
+			return err
+		}
+		state.Flags = flags
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return state.Flags, nil
+}
+
+// MarkAnswered sets the \Answered flag once a reply to the email has been sent
+func MarkAnswered(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string) error {
+	_, err := UpdateFlags(ctx, store, mailboxPrefix, userID, messageID, FlagsUpdate{
+		Add: []string{FlagAnswered},
+	})
+
+	return err
+}
@@ -0,0 +1,383 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// System folders every mailbox has, they can't be renamed or deleted
+const (
+	FolderInbox   = "Inbox"
+	FolderSent    = "Sent"
+	FolderDrafts  = "Drafts"
+	FolderTrash   = "Trash"
+	FolderSpam    = "Spam"
+	FolderArchive = "Archive"
+)
+
+// folderSeparator splits a folder name into its place in the hierarchy, e.g. "Projects/gopher-mail"
+const folderSeparator = "/"
+
+var systemFolders = []string{FolderInbox, FolderSent, FolderDrafts, FolderTrash, FolderSpam, FolderArchive}
+
+// folderLock serializes changes to the folder list within this process
+var folderLock sync.Mutex
+
+var (
+	// ErrInvalidFolder is returned for folder names that can't be stored
+	ErrInvalidFolder = errors.New("invalid folder name")
+	// ErrFolderExists is returned when creating or renaming onto an existing folder
+	ErrFolderExists = errors.New("folder already exists")
+	// ErrFolderNotFound is returned for operations on a folder the user doesn't have
+	ErrFolderNotFound = errors.New("folder not found")
+	// ErrSystemFolder is returned when renaming or deleting a system folder
+	ErrSystemFolder = errors.New("system folders can't be changed")
+)
+
+// Folder in the user's mailbox along with the number of emails filed in it
+type Folder struct {
+	Name   string
+	System bool
+	Total  int
+	Unread int
+}
+
+// folderList is the custom folders a user has created, system folders are never stored
+type folderList struct {
+	Folders []string
+}
+
+// foldersKey is the key of the user's custom folders
+func foldersKey(mailboxPrefix, userID string) string {
+	return userPrefix(mailboxPrefix, userID) + "_folders.json"
+}
+
+// canonicalFolder cleans up the name and matches system folders case insensitively, like IMAP does for INBOX
+func canonicalFolder(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	for _, system := range systemFolders {
+		if strings.EqualFold(name, system) {
+			return system, nil
+		}
+	}
+
+	if name == "" || len(name) > 255 || strings.HasPrefix(name, "_") {
+		return "", fmt.Errorf("%w: %q", ErrInvalidFolder, name)
+	}
+	for _, part := range strings.Split(name, folderSeparator) {
+		if strings.TrimSpace(part) == "" {
+			return "", fmt.Errorf("%w: %q", ErrInvalidFolder, name)
+		}
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidFolder, name)
+		}
+	}
+
+	return name, nil
+}
+
+func isSystemFolder(name string) bool {
+	for _, system := range systemFolders {
+		if name == system {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inFolder reports if folder is name or one of its sub-folders
+func inFolder(folder, name string) bool {
+	return folder == name || strings.HasPrefix(folder, name+folderSeparator)
+}
+
+func loadFolderList(ctx context.Context, store MailStore, mailboxPrefix, userID string) (folderList, error) {
+	buf, err := store.Get(ctx, foldersKey(mailboxPrefix, userID))
+	if err != nil && err != ErrNotFound {
+		return folderList{Folders: []string{}}, err
+	}
+
+	return decodeFolderList(buf)
+}
+
+// decodeFolderList, an empty list when buf is nil
+func decodeFolderList(buf []byte) (folderList, error) {
+	list := folderList{
+		Folders: []string{},
+	}
+	if buf == nil {
+		return list, nil
+	}
+
+	return list, json.Unmarshal(buf, &list)
+}
+
+// updateFolderList loads the folder list, applies fn to it and writes it back. fn is run
+// again when another writer changed the list in the meantime.
+func updateFolderList(ctx context.Context, store MailStore, mailboxPrefix, userID string, fn func(*folderList) error) error {
+	return updateObject(ctx, store, foldersKey(mailboxPrefix, userID), "application/json", func(buf []byte) ([]byte, error) {
+		list, err := decodeFolderList(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		err = fn(&list)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(list)
+	})
+}
+
+// folderExists reports if name is a system folder or one of the user's custom folders
+func folderExists(ctx context.Context, store MailStore, mailboxPrefix, userID, name string) (bool, error) {
+	if isSystemFolder(name) {
+		return true, nil
+	}
+
+	list, err := loadFolderList(ctx, store, mailboxPrefix, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, folder := range list.Folders {
+		if folder == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ListFolders in the user's mailbox, system folders first followed by custom folders in the order they were created
+func ListFolders(ctx context.Context, store MailStore, mailboxPrefix, userID string) ([]Folder, error) {
+	list, err := loadFolderList(ctx, store, mailboxPrefix, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := LoadIndex(ctx, store, mailboxPrefix, userID)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	totals := make(map[string]int)
+	unread := make(map[string]int)
+	for i := range index.Emails {
+		totals[index.Emails[i].Folder]++
+		if !hasFlag(index.Emails[i].Flags, FlagSeen) {
+			unread[index.Emails[i].Folder]++
+		}
+	}
+
+	folders := []Folder{}
+	for _, name := range systemFolders {
+		folders = append(folders, Folder{Name: name, System: true, Total: totals[name], Unread: unread[name]})
+	}
+	for _, name := range list.Folders {
+		folders = append(folders, Folder{Name: name, Total: totals[name], Unread: unread[name]})
+	}
+
+	return folders, nil
+}
+
+// CreateFolder in the user's mailbox
+func CreateFolder(ctx context.Context, store MailStore, mailboxPrefix, userID, name string) (Folder, error) {
+	folderLock.Lock()
+	defer folderLock.Unlock()
+
+	name, err := canonicalFolder(name)
+	if err != nil {
+		return Folder{}, err
+	}
+	if isSystemFolder(name) {
+		return Folder{}, fmt.Errorf("%w: %q", ErrFolderExists, name)
+	}
+
+	err = updateFolderList(ctx, store, mailboxPrefix, userID, func(list *folderList) error {
+		for _, folder := range list.Folders {
+			if folder == name {
+				return fmt.Errorf("%w: %q", ErrFolderExists, name)
+			}
+		}
+		list.Folders = append(list.Folders, name)
+
+		return nil
+	})
+	if err != nil {
+		return Folder{}, err
+	}
+
+	return Folder{Name: name}, nil
+}
+
+// RenameFolder and all of its sub-folders, the emails filed in them move along with the folder
+func RenameFolder(ctx context.Context, store MailStore, mailboxPrefix, userID, from, to string) error {
+	folderLock.Lock()
+	defer folderLock.Unlock()
+
+	from, err := canonicalFolder(from)
+	if err != nil {
+		return err
+	}
+	to, err = canonicalFolder(to)
+	if err != nil {
+		return err
+	}
+	if isSystemFolder(from) || isSystemFolder(to) {
+		return fmt.Errorf("%w: %q", ErrSystemFolder, from)
+	}
+	if inFolder(to, from) {
+		return fmt.Errorf("%w: can't move %q inside itself", ErrInvalidFolder, from)
+	}
+
+	renamed := func(folder string) string {
+		return to + strings.TrimPrefix(folder, from)
+	}
+
+	// the emails and retention rules are moved before the list is written, moving them again
+	// finds nothing left to move when the list changed in the meantime
+	return updateFolderList(ctx, store, mailboxPrefix, userID, func(list *folderList) error {
+		found := false
+		for _, folder := range list.Folders {
+			if folder == to {
+				return fmt.Errorf("%w: %q", ErrFolderExists, to)
+			}
+			if folder == from {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: %q", ErrFolderNotFound, from)
+		}
+
+		for i, folder := range list.Folders {
+			if inFolder(folder, from) {
+				list.Folders[i] = renamed(folder)
+			}
+		}
+
+		err := refileEmails(ctx, store, mailboxPrefix, userID, from, renamed)
+		if err != nil {
+			return err
+		}
+
+		// retention rules follow the folder to its new name
+		_, err = updateSettings(ctx, store, mailboxPrefix, userID, func(settings *Settings) error {
+			for i := range settings.Retention {
+				if inFolder(settings.Retention[i].Folder, from) {
+					settings.Retention[i].Folder = renamed(settings.Retention[i].Folder)
+				}
+			}
+			return nil
+		})
+
+		return err
+	})
+}
+
+// DeleteFolder and all of its sub-folders, the emails filed in them are moved to the Trash
+func DeleteFolder(ctx context.Context, store MailStore, mailboxPrefix, userID, name string) error {
+	folderLock.Lock()
+	defer folderLock.Unlock()
+
+	name, err := canonicalFolder(name)
+	if err != nil {
+		return err
+	}
+	if isSystemFolder(name) {
+		return fmt.Errorf("%w: %q", ErrSystemFolder, name)
+	}
+
+	return updateFolderList(ctx, store, mailboxPrefix, userID, func(list *folderList) error {
+		kept := []string{}
+		for _, folder := range list.Folders {
+			if !inFolder(folder, name) {
+				kept = append(kept, folder)
+			}
+		}
+		if len(kept) == len(list.Folders) {
+			return fmt.Errorf("%w: %q", ErrFolderNotFound, name)
+		}
+		list.Folders = kept
+
+		err := refileEmails(ctx, store, mailboxPrefix, userID, name, func(string) string {
+			return FolderTrash
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = updateSettings(ctx, store, mailboxPrefix, userID, func(settings *Settings) error {
+			kept := []RetentionRule{}
+			for _, rule := range settings.Retention {
+				if !inFolder(rule.Folder, name) {
+					kept = append(kept, rule)
+				}
+			}
+			settings.Retention = kept
+			return nil
+		})
+
+		return err
+	})
+}
+
+// refileEmails moves every email in the folder, or its sub-folders, to the folder returned by dest
+func refileEmails(ctx context.Context, store MailStore, mailboxPrefix, userID, folder string, dest func(string) string) error {
+	return updateIndex(ctx, store, mailboxPrefix, userID, func(index *Index) error {
+		for i := range index.Emails {
+			if !inFolder(index.Emails[i].Folder, folder) {
+				continue
+			}
+
+			state, err := loadState(ctx, store, mailboxPrefix, userID, index.Emails[i].MessageID)
+			if err != nil {
+				return err
+			}
+			state.Folder = dest(state.Folder)
+			state.Filed = time.Now().UTC()
+
+			err = saveState(ctx, store, mailboxPrefix, userID, index.Emails[i].MessageID, state)
+			if err != nil {
+				return err
+			}
+			index.Emails[i].applyState(state)
+		}
+
+		return nil
+	})
+}
+
+// MoveEmail into the folder
+func MoveEmail(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID, folder string) error {
+	folder, err := canonicalFolder(folder)
+	if err != nil {
+		return err
+	}
+
+	exists, err := folderExists(ctx, store, mailboxPrefix, userID, folder)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: %q", ErrFolderNotFound, folder)
+	}
+
+	_, err = updateState(ctx, store, mailboxPrefix, userID, messageID, func(state *messageState) error {
+		if state.Folder != folder {
+			state.Filed = time.Now().UTC()
+		}
+		state.Folder = folder
+		return nil
+	})
+
+	return err
+}
@@ -0,0 +1,185 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tmpFilePrefix marks files that are still being written by FileStore.Put
+const tmpFilePrefix = ".tmp-"
+
+// FileStore is a MailStore that keeps objects as files under a root directory,
+// useful for running the handlers on a laptop without an AWS account.
+type FileStore struct {
+	root string
+
+	// mu makes checking the version and writing the file one step, within this process
+	mu sync.Mutex
+}
+
+// NewFileStore rooted at dir
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{
+		root: dir,
+	}
+}
+
+// path of the file the key is stored in, keys with ".." segments are refused since
+// filepath.Join would resolve them to a file outside of the root
+func (f *FileStore) path(key string) (string, error) {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("%w: %q", ErrInvalidPath, key)
+		}
+	}
+
+	return filepath.Join(f.root, filepath.FromSlash(key)), nil
+}
+
+// Get the object at key
+func (f *FileStore) Get(ctx context.Context, key string) ([]byte, error) {
+	name, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+
+	return buf, err
+}
+
+// Put the body at key, the file is written to a temporary file first so readers never see a partial object
+func (f *FileStore) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	dest, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), tmpFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(body)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dest)
+}
+
+// Copy the object at srcKey to destKey
+func (f *FileStore) Copy(ctx context.Context, srcKey, destKey string) error {
+	body, err := f.Get(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+
+	return f.Put(ctx, destKey, body, "")
+}
+
+// List the keys under prefix in lexical order
+func (f *FileStore) List(ctx context.Context, prefix string) ([]string, error) {
+	// the prefix may end part way through a file name so start walking from its directory
+	dir := path.Dir(prefix)
+	if strings.HasSuffix(prefix, "/") {
+		dir = strings.TrimSuffix(prefix, "/")
+	}
+
+	root, err := f.path(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), tmpFilePrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(f.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Delete the object at key
+func (f *FileStore) Delete(ctx context.Context, key string) error {
+	name, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// GetVersion of the object at key, the version is the hash of its contents
+func (f *FileStore) GetVersion(ctx context.Context, key string) ([]byte, string, error) {
+	body, err := f.Get(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return body, contentHash(body), nil
+}
+
+// PutIfVersion puts the body at key if the object is still at version. The check only holds
+// against writers in this process, which is all a laptop runs at once.
+func (f *FileStore) PutIfVersion(ctx context.Context, key string, body []byte, contentType, version string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current, err := f.Get(ctx, key)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if (err == ErrNotFound && version != "") || (err == nil && contentHash(current) != version) {
+		return fmt.Errorf("%w: %s", ErrConflict, key)
+	}
+
+	return f.Put(ctx, key, body, contentType)
+}
@@ -0,0 +1,243 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// receivedClauseRegex finds the clauses of a Received header, e.g. "from mail.example.com (1.2.3.4)"
+var receivedClauseRegex = regexp.MustCompile(`(?i)(?:^|\s)(from|by|via|with|id|for)\s+`)
+
+// commentRegex matches the comments mail servers put in header values
+var commentRegex = regexp.MustCompile(`\([^()]*\)`)
+
+// Header is a single header field, unfolded, in the order it appears in the message
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Hop is one server the message passed through, parsed from a Received header
+type Hop struct {
+	From string
+	By   string
+	With string
+	ID   string
+	For  string
+	Date time.Time
+	// Delay is how many seconds the message took to get here from the previous hop
+	Delay float64
+	Raw   string
+}
+
+// AuthResult is one method in an Authentication-Results header, e.g. dkim=pass header.d=example.com
+type AuthResult struct {
+	// AuthServID is the server that did the check
+	AuthServID string
+	Method     string
+	Result     string
+	Reason     string
+	Properties map[string]string
+}
+
+// MessageHeaders are the headers of the original message with the delivery path and
+// authentication checks parsed out
+type MessageHeaders struct {
+	Headers []Header
+	// Hops are oldest first so the last one is the server that delivered to us
+	Hops        []Hop
+	AuthResults []AuthResult
+	// TotalDelay is the seconds between the first and the last hop
+	TotalDelay float64
+}
+
+// GetRawEmail returns the original RFC 5322 message as it was delivered
+func GetRawEmail(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string) ([]byte, error) {
+	return loadRaw(ctx, store, mailboxPrefix, userID, messageID)
+}
+
+// GetHeaders parses the header of the original message
+func GetHeaders(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string) (MessageHeaders, error) {
+	raw, err := loadRaw(ctx, store, mailboxPrefix, userID, messageID)
+	if err != nil {
+		return MessageHeaders{}, err
+	}
+
+	return parseMessageHeaders(raw), nil
+}
+
+// parseMessageHeaders reads the header section of the message, keeping the order of the fields
+func parseMessageHeaders(raw []byte) MessageHeaders {
+	headers := MessageHeaders{
+		Headers:     readHeaders(raw),
+		Hops:        []Hop{},
+		AuthResults: []AuthResult{},
+	}
+
+	for _, header := range headers.Headers {
+		switch strings.ToLower(header.Name) {
+		case "received":
+			// servers prepend Received so the header order is newest first
+			headers.Hops = append([]Hop{parseReceived(header.Value)}, headers.Hops...)
+		case "authentication-results", "arc-authentication-results":
+			headers.AuthResults = append(headers.AuthResults, parseAuthResults(header.Value)...)
+		}
+	}
+
+	var first, last time.Time
+	for i := range headers.Hops {
+		date := headers.Hops[i].Date
+		if date.IsZero() {
+			continue
+		}
+		if !last.IsZero() {
+			headers.Hops[i].Delay = date.Sub(last).Seconds()
+		}
+		if first.IsZero() {
+			first = date
+		}
+		last = date
+	}
+	headers.TotalDelay = last.Sub(first).Seconds()
+
+	return headers
+}
+
+// readHeaders up to the blank line that ends the header section, folded lines are joined
+func readHeaders(raw []byte) []Header {
+	headers := []Header{}
+	reader := bufio.NewReader(bytes.NewReader(raw))
+
+	for {
+		line, err := reader.ReadString('\n')
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			return headers
+		}
+
+		if (trimmed[0] == ' ' || trimmed[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].Value += " " + strings.TrimSpace(trimmed)
+		} else if i := strings.Index(trimmed, ":"); i > 0 {
+			headers = append(headers, Header{
+				Name:  strings.TrimSpace(trimmed[:i]),
+				Value: strings.TrimSpace(trimmed[i+1:]),
+			})
+		}
+
+		if err != nil {
+			return headers
+		}
+	}
+}
+
+// parseReceived splits a Received header into its clauses and the date after the last ";"
+func parseReceived(value string) Hop {
+	hop := Hop{
+		Raw: value,
+	}
+
+	clauses := value
+	if i := strings.LastIndex(value, ";"); i >= 0 {
+		clauses = value[:i]
+		date := strings.TrimSpace(commentRegex.ReplaceAllString(value[i+1:], ""))
+		if parsed, err := mail.ParseDate(date); err == nil {
+			hop.Date = parsed
+		}
+	}
+
+	// comments such as "(using TLSv1.2 with cipher ...)" belong to the clause they are in
+	comments := commentRegex.FindAllStringIndex(clauses, -1)
+	matches := [][]int{}
+	for _, match := range receivedClauseRegex.FindAllStringSubmatchIndex(clauses, -1) {
+		inComment := false
+		for _, comment := range comments {
+			if match[2] > comment[0] && match[2] < comment[1] {
+				inComment = true
+			}
+		}
+		if !inComment {
+			matches = append(matches, match)
+		}
+	}
+
+	for i, match := range matches {
+		end := len(clauses)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		text := strings.TrimSpace(clauses[match[1]:end])
+
+		switch strings.ToLower(clauses[match[2]:match[3]]) {
+		case "from":
+			hop.From = text
+		case "by":
+			hop.By = text
+		case "with":
+			hop.With = text
+		case "id":
+			hop.ID = text
+		case "for":
+			hop.For = strings.Trim(text, "<>")
+		}
+	}
+
+	return hop
+}
+
+// parseAuthResults reads the methods of an Authentication-Results header as defined by RFC 8601
+func parseAuthResults(value string) []AuthResult {
+	results := []AuthResult{}
+
+	parts := strings.Split(commentRegex.ReplaceAllString(value, ""), ";")
+	servID := strings.TrimSpace(parts[0])
+	// ARC-Authentication-Results start with the instance, i=1
+	if strings.HasPrefix(strings.ToLower(servID), "i=") && len(parts) > 1 {
+		parts = parts[1:]
+		servID = strings.TrimSpace(parts[0])
+	}
+	if fields := strings.Fields(servID); len(fields) > 0 {
+		servID = fields[0]
+	}
+
+	for _, part := range parts[1:] {
+		// values such as the reason can be quoted and contain spaces
+		fields, err := splitQuery(part)
+		if err != nil {
+			fields = strings.Fields(part)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		method := strings.SplitN(fields[0], "=", 2)
+		if len(method) != 2 {
+			continue
+		}
+		result := AuthResult{
+			AuthServID: servID,
+			Method:     strings.ToLower(method[0]),
+			Result:     strings.ToLower(method[1]),
+			Properties: make(map[string]string),
+		}
+
+		for _, field := range fields[1:] {
+			property := strings.SplitN(field, "=", 2)
+			if len(property) != 2 {
+				continue
+			}
+			if strings.ToLower(property[0]) == "reason" {
+				result.Reason = property[1]
+				continue
+			}
+			result.Properties[strings.ToLower(property[0])] = property[1]
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
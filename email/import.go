@@ -0,0 +1,233 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// importLock serializes changes to the import positions within this process
+var importLock sync.Mutex
+
+// ImportedMessage is a message read from an archive along with what the archive knew about it
+type ImportedMessage struct {
+	Raw []byte
+	// Folder the message was filed in, empty if the archive has no folders
+	Folder string
+	Flags  []string
+	// Date the archive recorded for the message, such as the mbox "From " line or the Maildir file
+	// time. It is the date of messages without a Date header.
+	Date time.Time
+}
+
+// MessageSource reads the messages of an archive one at a time, Next returns io.EOF after the last one
+type MessageSource interface {
+	Next() (ImportedMessage, error)
+}
+
+// ImportReport counts what happened to each message of an import
+type ImportReport struct {
+	Imported int
+	// Duplicates are messages with a Message-ID that is already in the mailbox
+	Duplicates int
+	// Resumed are messages skipped because an earlier run of the import already got past them
+	Resumed int
+	Failed  int
+}
+
+// importPositions is how far each import got, by the name of its source, so it can pick up where it stopped
+type importPositions struct {
+	Sources map[string]int
+}
+
+// importsKey is the key of the user's import positions
+func importsKey(mailboxPrefix, userID string) string {
+	return userPrefix(mailboxPrefix, userID) + "_imports.json"
+}
+
+func loadImportPositions(ctx context.Context, store MailStore, mailboxPrefix, userID string) (importPositions, error) {
+	positions := importPositions{
+		Sources: make(map[string]int),
+	}
+
+	buf, err := store.Get(ctx, importsKey(mailboxPrefix, userID))
+	if err == ErrNotFound {
+		return positions, nil
+	}
+	if err != nil {
+		return positions, err
+	}
+
+	err = json.Unmarshal(buf, &positions)
+	if positions.Sources == nil {
+		positions.Sources = make(map[string]int)
+	}
+
+	return positions, err
+}
+
+// saveImportPosition records that the first position messages of the source are done
+func saveImportPosition(ctx context.Context, store MailStore, mailboxPrefix, userID, source string, position int) error {
+	importLock.Lock()
+	defer importLock.Unlock()
+
+	positions, err := loadImportPositions(ctx, store, mailboxPrefix, userID)
+	if err != nil {
+		return err
+	}
+	positions.Sources[source] = position
+
+	buf, err := json.Marshal(positions)
+	if err != nil {
+		return err
+	}
+
+	return store.Put(ctx, importsKey(mailboxPrefix, userID), buf, "application/json")
+}
+
+// mailboxMessageIDs collects the Message-ID headers of the emails in the mailbox
+func mailboxMessageIDs(ctx context.Context, store MailStore, mailboxPrefix, userID string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+
+	index, err := LoadIndex(ctx, store, mailboxPrefix, userID)
+	if err == ErrNotFound {
+		return ids, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, meta := range index.Emails {
+		email, err := loadMetadata(ctx, store, mailboxPrefix, userID, meta.MessageID)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range messageIDList(email.Email.MessageID) {
+			ids[id] = true
+		}
+	}
+
+	return ids, nil
+}
+
+// ImportMessages from the source into the user's mailbox through the same path as delivered
+// mail, keeping the folders, flags and dates of the archive. Messages without a folder go
+// into folder. Messages with a Message-ID already in the mailbox are skipped, and the import
+// resumes after the last message an earlier run with the same source name got to.
+func ImportMessages(ctx context.Context, store MailStore, mailboxPrefix, userID, sourceName string, source MessageSource, folder string) (ImportReport, error) {
+	var report ImportReport
+
+	positions, err := loadImportPositions(ctx, store, mailboxPrefix, userID)
+	if err != nil {
+		return report, err
+	}
+	resumeAt := positions.Sources[sourceName]
+
+	seen, err := mailboxMessageIDs(ctx, store, mailboxPrefix, userID)
+	if err != nil {
+		return report, err
+	}
+	folders := make(map[string]bool)
+
+	for position := 1; ; position++ {
+		message, err := source.Next()
+		if err == io.EOF {
+			return report, nil
+		}
+		if err != nil {
+			return report, err
+		}
+		if position <= resumeAt {
+			report.Resumed++
+			continue
+		}
+
+		if message.Folder == "" {
+			message.Folder = folder
+		}
+		duplicate, err := importMessage(ctx, store, mailboxPrefix, userID, message, seen, folders)
+		switch {
+		case err != nil:
+			// a broken message doesn't stop the rest of the archive from being imported
+			log.Printf("Failed to import message %d of \"%s\": %s\n", position, sourceName, err)
+			report.Failed++
+		case duplicate:
+			report.Duplicates++
+		default:
+			report.Imported++
+		}
+
+		err = saveImportPosition(ctx, store, mailboxPrefix, userID, sourceName, position)
+		if err != nil {
+			return report, err
+		}
+	}
+}
+
+// importMessage stores the message and files it, returns true without storing it if it is a duplicate
+func importMessage(ctx context.Context, store MailStore, mailboxPrefix, userID string, message ImportedMessage, seen, folders map[string]bool) (bool, error) {
+	parsed, err := parseEmail(message.Raw, "")
+	if err != nil {
+		return false, err
+	}
+
+	ids := messageIDList(parsed.Email.MessageID)
+	for _, id := range ids {
+		if seen[id] {
+			return true, nil
+		}
+	}
+
+	folder, err := canonicalFolder(message.Folder)
+	if err != nil {
+		return false, err
+	}
+	if !folders[folder] {
+		_, err = CreateFolder(ctx, store, mailboxPrefix, userID, folder)
+		if err != nil && !errors.Is(err, ErrFolderExists) {
+			return false, err
+		}
+		folders[folder] = true
+	}
+
+	flags, err := FlagsUpdate{Add: message.Flags}.apply(nil)
+	if err != nil {
+		return false, err
+	}
+
+	// the name comes from the content so importing the same message again overwrites it
+	hash := contentHash(message.Raw)
+	name := "imported-" + hash[:32]
+	parsed.Blob, err = putBlob(ctx, store, mailboxPrefix, message.Raw, []string{userID + "/" + name})
+	if err != nil {
+		return false, err
+	}
+
+	if parsed.Email.Date.IsZero() {
+		parsed.Email.Date = message.Date
+	}
+	err = processEmail(ctx, store, mailboxPrefix, userID, name, name, parsed)
+	if err != nil {
+		return false, err
+	}
+
+	// Filed stays the time of the import, retention rules would delete old mail as soon as it is imported
+	_, err = updateState(ctx, store, mailboxPrefix, userID, name, func(state *messageState) error {
+		state.Folder = folder
+		state.Flags = flags
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, id := range ids {
+		seen[id] = true
+	}
+
+	return false, nil
+}
@@ -0,0 +1,55 @@
+package email
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportKeepsTheDates(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	mbox := "From carol@example.com Mon Jan  2 15:04:05 2006\n" +
+		"From: Carol <carol@example.com>\n" +
+		"Subject: Lunch\n" +
+		"Date: Sun, 01 Jan 2006 12:00:00 +0000\n" +
+		"Message-ID: <lunch@example.com>\n" +
+		"\n" +
+		"Noon on Friday?\n" +
+		"\n" +
+		"From carol@example.com Tue Jan  3 15:04:05 2006\n" +
+		"From: Carol <carol@example.com>\n" +
+		"Subject: No date\n" +
+		"Message-ID: <nodate@example.com>\n" +
+		"\n" +
+		"Hello\n"
+
+	before := time.Now().UTC()
+	_, err := ImportMessages(ctx, store, "mailbox", "alice", "archive.mbox", NewMboxSource(strings.NewReader(mbox)), FolderArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := LoadIndex(ctx, store, "mailbox", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dates := map[string]time.Time{
+		"Lunch":   time.Date(2006, 1, 1, 12, 0, 0, 0, time.UTC),
+		"No date": time.Date(2006, 1, 3, 15, 4, 5, 0, time.UTC),
+	}
+	if len(index.Emails) != len(dates) {
+		t.Fatalf("imported %d emails, want %d", len(index.Emails), len(dates))
+	}
+	for _, meta := range index.Emails {
+		if want := dates[meta.Subject]; !meta.Date.Equal(want) {
+			t.Errorf("%q is dated %v, want %v", meta.Subject, meta.Date, want)
+		}
+		// retention counts from when the mail was filed, old mail isn't deleted as it is imported
+		if meta.Filed.Before(before) {
+			t.Errorf("%q was filed %v, before it was imported", meta.Subject, meta.Filed)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"path"
+	"strings"
+	"sync"
+)
+
+// indexLock serializes read-modify-write cycles of the index within this process, other
+// lambdas are kept from losing each other's changes by the conditional writes of updateObject
+var indexLock sync.Mutex
+
+// Index is the manifest of a user's mailbox, kept up to date by postmaster so the
+// mailbox can be listed with a single request.
+type Index struct {
+	Emails []Meta
+}
+
+// indexKey is the key of the user's mailbox index
+func indexKey(mailboxPrefix, userID string) string {
+	return userPrefix(mailboxPrefix, userID) + "_index.json"
+}
+
+// newMeta builds the index entry of a parsed email
+func newMeta(messageID string, email Message, attachments []Attachment, size int) Meta {
+	from := ""
+	if len(email.From) > 0 {
+		from = email.From[0].String()
+	}
+
+	return Meta{
+		MessageID:      messageID,
+		Subject:        email.Subject,
+		From:           from,
+		Date:           email.Date,
+		Size:           size,
+		HasAttachments: hasAttachments(attachments),
+		Folder:         FolderInbox,
+		Flags:          []string{},
+		ThreadID:       messageID,
+	}
+}
+
+// applyState copies the user editable state onto the entry
+func (m *Meta) applyState(state messageState) {
+	m.Folder = state.Folder
+	m.Flags = state.Flags
+	m.ThreadID = state.ThreadID
+	m.Filed = state.Filed
+}
+
+// LoadIndex of the user's mailbox, returns ErrNotFound if it has never been written
+func LoadIndex(ctx context.Context, store MailStore, mailboxPrefix, userID string) (Index, error) {
+	buf, err := store.Get(ctx, indexKey(mailboxPrefix, userID))
+	if err != nil {
+		return Index{Emails: []Meta{}}, err
+	}
+
+	return decodeIndex(buf)
+}
+
+// decodeIndex and fill in the fields of entries written before they existed
+func decodeIndex(buf []byte) (Index, error) {
+	index := Index{
+		Emails: []Meta{},
+	}
+
+	err := json.Unmarshal(buf, &index)
+	if err != nil {
+		return index, err
+	}
+
+	// entries written before folders existed are in the Inbox
+	for i := range index.Emails {
+		if index.Emails[i].Folder == "" {
+			index.Emails[i].Folder = FolderInbox
+		}
+		if index.Emails[i].Flags == nil {
+			index.Emails[i].Flags = []string{}
+		}
+		if index.Emails[i].ThreadID == "" {
+			index.Emails[i].ThreadID = index.Emails[i].MessageID
+		}
+	}
+
+	return index, nil
+}
+
+func saveIndex(ctx context.Context, store MailStore, mailboxPrefix, userID string, index Index) error {
+	buf, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	return store.Put(ctx, indexKey(mailboxPrefix, userID), buf, "application/json")
+}
+
+// updateIndex loads the index, applies fn to it and writes the whole index back as a single
+// object. fn is run again when another writer changed the index in the meantime.
+func updateIndex(ctx context.Context, store MailStore, mailboxPrefix, userID string, fn func(*Index) error) error {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+
+	return updateObject(ctx, store, indexKey(mailboxPrefix, userID), "application/json", func(buf []byte) ([]byte, error) {
+		var index Index
+		var err error
+		if buf == nil {
+			// Index the mail delivered before the index existed before adding to it
+			index, err = buildIndex(ctx, store, mailboxPrefix, userID, nil)
+		} else {
+			index, err = decodeIndex(buf)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		err = fn(&index)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(index)
+	})
+}
+
+// addToIndex inserts or replaces the entry for meta.MessageID
+func addToIndex(ctx context.Context, store MailStore, mailboxPrefix, userID string, meta Meta) error {
+	return updateIndex(ctx, store, mailboxPrefix, userID, func(index *Index) error {
+		for i := range index.Emails {
+			if index.Emails[i].MessageID == meta.MessageID {
+				index.Emails[i] = meta
+				return nil
+			}
+		}
+		index.Emails = append(index.Emails, meta)
+
+		return nil
+	})
+}
+
+// isIndexed reports if the email is in the user's index, the last step of delivering it
+func isIndexed(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string) (bool, error) {
+	index, err := LoadIndex(ctx, store, mailboxPrefix, userID)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, meta := range index.Emails {
+		if meta.MessageID == messageID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// updateIndexEntry applies fn to the entry for messageID, returns ErrNotFound if the email isn't in the index
+func updateIndexEntry(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string, fn func(*Meta)) error {
+	return updateIndex(ctx, store, mailboxPrefix, userID, func(index *Index) error {
+		for i := range index.Emails {
+			if index.Emails[i].MessageID == messageID {
+				fn(&index.Emails[i])
+				return nil
+			}
+		}
+
+		return ErrNotFound
+	})
+}
+
+// RebuildIndex and the search index from the metadata of every email in the user's mailbox, replacing the current indexes
+func RebuildIndex(ctx context.Context, store MailStore, mailboxPrefix, userID string) (Index, error) {
+	search := searchIndex{
+		Terms: make(map[string]map[string]int),
+	}
+	rebuilt, err := buildIndex(ctx, store, mailboxPrefix, userID, &search)
+	if err != nil {
+		return rebuilt, err
+	}
+
+	// mail delivered or deleted while the mailbox was listed is merged in rather than lost
+	var index Index
+	err = updateIndex(ctx, store, mailboxPrefix, userID, func(current *Index) error {
+		merged, err := mergeIndex(ctx, store, mailboxPrefix, userID, rebuilt, *current)
+		if err != nil {
+			return err
+		}
+		*current = merged
+		index = merged
+
+		return nil
+	})
+	if err != nil {
+		return index, err
+	}
+
+	err = updateSearchIndex(ctx, store, mailboxPrefix, userID, func(current *searchIndex) {
+		*current = mergeSearchIndex(search, *current, rebuilt, index)
+	})
+	if err != nil {
+		return index, err
+	}
+
+	// the usage is counted again along with the index, keeping the warnings already sent
+	_, err = updateUsage(ctx, store, mailboxPrefix, userID, func(u *usage) {
+		counted := countUsage(index)
+		u.Used = counted.Used
+		u.Messages = counted.Messages
+	})
+
+	return index, err
+}
+
+// mergeIndex takes the entries of the rebuilt index. Emails only one of the indexes has were
+// delivered or deleted since the mailbox was listed, or are why it is being rebuilt, and are
+// kept as long as their metadata is still there.
+func mergeIndex(ctx context.Context, store MailStore, mailboxPrefix, userID string, rebuilt, current Index) (Index, error) {
+	merged := Index{
+		Emails: []Meta{},
+	}
+	inRebuilt := make(map[string]bool)
+	for _, meta := range rebuilt.Emails {
+		inRebuilt[meta.MessageID] = true
+	}
+	inCurrent := make(map[string]bool)
+	for _, meta := range current.Emails {
+		inCurrent[meta.MessageID] = true
+	}
+
+	keep := func(meta Meta) error {
+		_, err := store.Get(ctx, metaKey(mailboxPrefix, userID, meta.MessageID))
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		merged.Emails = append(merged.Emails, meta)
+
+		return nil
+	}
+
+	for _, meta := range rebuilt.Emails {
+		if inCurrent[meta.MessageID] {
+			merged.Emails = append(merged.Emails, meta)
+			continue
+		}
+		err := keep(meta)
+		if err != nil {
+			return merged, err
+		}
+	}
+	for _, meta := range current.Emails {
+		if inRebuilt[meta.MessageID] {
+			continue
+		}
+		err := keep(meta)
+		if err != nil {
+			return merged, err
+		}
+	}
+
+	return merged, nil
+}
+
+// mergeSearchIndex takes the terms of the rebuilt search index for the emails still in the
+// merged index, and the terms of the current one for the emails kept from the current index
+func mergeSearchIndex(rebuilt, current searchIndex, rebuiltIndex, index Index) searchIndex {
+	merged := searchIndex{
+		Terms: make(map[string]map[string]int),
+	}
+	indexed := make(map[string]bool)
+	for _, meta := range index.Emails {
+		indexed[meta.MessageID] = true
+	}
+	inRebuilt := make(map[string]bool)
+	for _, meta := range rebuiltIndex.Emails {
+		inRebuilt[meta.MessageID] = true
+	}
+
+	add := func(term, messageID string, count int) {
+		if merged.Terms[term] == nil {
+			merged.Terms[term] = make(map[string]int)
+		}
+		merged.Terms[term][messageID] = count
+	}
+	for term, postings := range rebuilt.Terms {
+		for messageID, count := range postings {
+			if indexed[messageID] {
+				add(term, messageID, count)
+			}
+		}
+	}
+	for term, postings := range current.Terms {
+		for messageID, count := range postings {
+			if indexed[messageID] && !inRebuilt[messageID] {
+				add(term, messageID, count)
+			}
+		}
+	}
+
+	return merged
+}
+
+// buildIndex from the metadata of every email, when search is not nil the emails are added to it as well
+func buildIndex(ctx context.Context, store MailStore, mailboxPrefix, userID string, search *searchIndex) (Index, error) {
+	index := Index{
+		Emails: []Meta{},
+	}
+	log.Printf("Building index for \"%s\"\n", userPrefix(mailboxPrefix, userID))
+
+	keys, err := store.List(ctx, userPrefix(mailboxPrefix, userID))
+	if err != nil {
+		return index, err
+	}
+
+	for i := range keys {
+		// skip anything that isn't email metadata such as the index itself
+		name := path.Base(keys[i])
+		if !strings.HasSuffix(name, ".json") || strings.HasPrefix(name, "_") {
+			continue
+		}
+
+		buf, err := store.Get(ctx, keys[i])
+		if err == ErrNotFound {
+			// deleted since the mailbox was listed
+			continue
+		}
+		if err != nil {
+			return index, err
+		}
+
+		email, err := decodeMetadata(buf)
+		if err != nil {
+			return index, err
+		}
+
+		if email.Size == 0 {
+			// metadata written before the size was recorded
+			raw, err := loadRaw(ctx, store, mailboxPrefix, userID, email.MessageID)
+			if err != nil {
+				return index, err
+			}
+			email.Size = len(raw)
+		}
+
+		state, err := loadState(ctx, store, mailboxPrefix, userID, email.MessageID)
+		if err != nil {
+			return index, err
+		}
+
+		meta := newMeta(email.MessageID, email.Email, email.Attachments, email.Size)
+		meta.Tag = email.Tag
+		meta.applyState(state)
+		index.Emails = append(index.Emails, meta)
+
+		if search != nil {
+			search.add(email.MessageID, email.Email)
+		}
+	}
+
+	return index, nil
+}
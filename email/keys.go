@@ -0,0 +1,188 @@
+package email
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// ErrInvalidKey is returned when a wrapped key can't be unwrapped with the user's key
+var ErrInvalidKey = errors.New("invalid key")
+
+// KeyProvider holds a key for every user, data keys are wrapped with it so only the
+// user's key can unwrap them
+type KeyProvider interface {
+	// WrapKey encrypts the data key with the user's key
+	WrapKey(ctx context.Context, userID string, key []byte) ([]byte, error)
+	// UnwrapKey decrypts a data key wrapped by WrapKey
+	UnwrapKey(ctx context.Context, userID string, wrapped []byte) ([]byte, error)
+}
+
+// KMSKeyProvider wraps data keys with AWS KMS. The user is bound into the encryption
+// context so a key wrapped for one user can't be unwrapped as another.
+type KMSKeyProvider struct {
+	client *kms.Client
+	keyID  string
+}
+
+// NewKMSKeyProvider uses the KMS key, "{user}" in keyID is replaced by the user so each user can have their own key, e.g. "alias/gopher-mail-{user}"
+func NewKMSKeyProvider(client *kms.Client, keyID string) *KMSKeyProvider {
+	return &KMSKeyProvider{
+		client: client,
+		keyID:  keyID,
+	}
+}
+
+// WrapKey with the user's KMS key
+func (k *KMSKeyProvider) WrapKey(ctx context.Context, userID string, key []byte) ([]byte, error) {
+	resp, err := k.client.EncryptRequest(&kms.EncryptInput{
+		KeyId:             aws.String(strings.Replace(k.keyID, "{user}", userID, -1)),
+		Plaintext:         key,
+		EncryptionContext: map[string]string{"user": userID},
+	}).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.CiphertextBlob, nil
+}
+
+// UnwrapKey with the user's KMS key, KMS finds the key from the wrapped blob
+func (k *KMSKeyProvider) UnwrapKey(ctx context.Context, userID string, wrapped []byte) ([]byte, error) {
+	resp, err := k.client.DecryptRequest(&kms.DecryptInput{
+		CiphertextBlob:    wrapped,
+		EncryptionContext: map[string]string{"user": userID},
+	}).Send(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidKey, err)
+	}
+
+	return resp.Plaintext, nil
+}
+
+// FileKeyProvider keeps a key per user in a directory, for running locally and in tests.
+// Keys are created the first time they are needed.
+type FileKeyProvider struct {
+	dir string
+}
+
+// NewFileKeyProvider stores user keys in dir
+func NewFileKeyProvider(dir string) *FileKeyProvider {
+	return &FileKeyProvider{
+		dir: dir,
+	}
+}
+
+// userKey reads the user's key, creating it if the user doesn't have one
+func (f *FileKeyProvider) userKey(userID string) ([]byte, error) {
+	if userID == "" || strings.ContainsAny(userID, `/\`) || strings.HasPrefix(userID, ".") {
+		return nil, fmt.Errorf("%w: no key for user %q", ErrInvalidKey, userID)
+	}
+	name := filepath.Join(f.dir, userID+".key")
+
+	key, err := ioutil.ReadFile(name)
+	if err == nil {
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	err = os.MkdirAll(f.dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		// created by someone else in the meantime
+		return ioutil.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	_, err = file.Write(key)
+
+	return key, err
+}
+
+// WrapKey with AES-GCM under the user's key
+func (f *FileKeyProvider) WrapKey(ctx context.Context, userID string, key []byte) ([]byte, error) {
+	userKey, err := f.userKey(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return seal(userKey, key, []byte(userID))
+}
+
+// UnwrapKey with the user's key
+func (f *FileKeyProvider) UnwrapKey(ctx context.Context, userID string, wrapped []byte) ([]byte, error) {
+	userKey, err := f.userKey(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(userKey, wrapped, []byte(userID))
+}
+
+// seal the plaintext with AES-GCM, the random nonce is put in front of the ciphertext
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open a ciphertext written by seal
+func open(key, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrInvalidKey
+	}
+
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidKey, err)
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
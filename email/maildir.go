@@ -0,0 +1,141 @@
+package email
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maildirFile is a message in a Maildir, relative to the top of it
+type maildirFile struct {
+	Name    string
+	ModTime time.Time
+}
+
+// maildirSource reads the messages of a Maildir directory
+type maildirSource struct {
+	dir   string
+	files []maildirFile
+}
+
+// NewMaildirSource reads the messages in the cur and new directories of the Maildir, and of its
+// Maildir++ sub-folders, in a stable order so an import can be resumed
+func NewMaildirSource(dir string) (MessageSource, error) {
+	source := &maildirSource{
+		dir:   dir,
+		files: []maildirFile{},
+	}
+
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if info.Mode().IsRegular() && maildirMessage(rel) {
+			source.files = append(source.files, maildirFile{Name: rel, ModTime: info.ModTime()})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(source.files, func(i, j int) bool {
+		return source.files[i].Name < source.files[j].Name
+	})
+
+	return source, nil
+}
+
+// Next message of the Maildir
+func (m *maildirSource) Next() (ImportedMessage, error) {
+	if len(m.files) == 0 {
+		return ImportedMessage{}, io.EOF
+	}
+	file := m.files[0]
+	m.files = m.files[1:]
+
+	raw, err := ioutil.ReadFile(filepath.Join(m.dir, filepath.FromSlash(file.Name)))
+	if err != nil {
+		return ImportedMessage{}, err
+	}
+
+	return maildirImport(file.Name, file.ModTime, raw), nil
+}
+
+// maildirTarSource reads the messages of a Maildir in a tarball, such as one written by ExportMailbox
+type maildirTarSource struct {
+	reader *tar.Reader
+}
+
+// NewMaildirTarSource reads the messages of the Maildir in the tarball in the order they were archived
+func NewMaildirTarSource(r io.Reader) MessageSource {
+	return &maildirTarSource{
+		reader: tar.NewReader(r),
+	}
+}
+
+// Next message of the tarball, anything that isn't a Maildir message is skipped
+func (m *maildirTarSource) Next() (ImportedMessage, error) {
+	for {
+		header, err := m.reader.Next()
+		if err != nil {
+			return ImportedMessage{}, err
+		}
+		if header.Typeflag != tar.TypeReg || !maildirMessage(header.Name) {
+			continue
+		}
+
+		raw, err := ioutil.ReadAll(m.reader)
+		if err != nil {
+			return ImportedMessage{}, err
+		}
+
+		return maildirImport(header.Name, header.ModTime, raw), nil
+	}
+}
+
+// maildirMessage reports if the path is a message in a cur or new directory
+func maildirMessage(name string) bool {
+	dir := path.Base(path.Dir(name))
+	return (dir == "cur" || dir == "new") && !strings.HasPrefix(path.Base(name), ".")
+}
+
+// maildirImport reads the folder from the Maildir++ directory the message is in, and the
+// flags from the info suffix of its name
+func maildirImport(name string, modTime time.Time, raw []byte) ImportedMessage {
+	message := ImportedMessage{
+		Raw:   raw,
+		Flags: []string{},
+		Date:  modTime,
+	}
+
+	// the folder is the last directory starting with a "." above cur or new, e.g. "Maildir/.Projects.gopher-mail/cur"
+	parent := path.Base(path.Dir(path.Dir(name)))
+	if strings.HasPrefix(parent, ".") && len(parent) > 1 {
+		message.Folder = strings.Replace(parent[1:], ".", folderSeparator, -1)
+	}
+
+	if i := strings.LastIndex(path.Base(name), ":2,"); i >= 0 {
+		for _, letter := range path.Base(name)[i+3:] {
+			for _, flag := range maildirFlags {
+				if string(letter) == flag.Letter {
+					message.Flags = append(message.Flags, flag.Flag)
+				}
+			}
+		}
+	}
+
+	return message
+}
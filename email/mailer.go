@@ -0,0 +1,39 @@
+package email
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+)
+
+// Mailer sends messages postmaster writes or passes on, like redirected mail and vacation replies
+type Mailer interface {
+	// Send the raw RFC 5322 message to the recipients with from as the envelope sender
+	Send(ctx context.Context, from string, to []string, raw []byte) error
+}
+
+// SESMailer sends mail through SES
+type SESMailer struct {
+	client *ses.Client
+}
+
+// NewSESMailer sends mail with the SES client, the senders have to be on a verified domain
+func NewSESMailer(client *ses.Client) *SESMailer {
+	return &SESMailer{
+		client: client,
+	}
+}
+
+// Send the message as it is
+func (m *SESMailer) Send(ctx context.Context, from string, to []string, raw []byte) error {
+	_, err := m.client.SendRawEmailRequest(&ses.SendRawEmailInput{
+		Source:       aws.String(from),
+		Destinations: to,
+		RawMessage: &ses.RawMessage{
+			Data: raw,
+		},
+	}).Send(ctx)
+
+	return err
+}
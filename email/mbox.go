@@ -0,0 +1,145 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// mboxQuotedRegex matches the "From " lines mboxrd quoted inside a message
+var mboxQuotedRegex = regexp.MustCompile(`^>+From `)
+
+// mboxStatusFlags are the flags mail clients keep in the Status and X-Status headers of an mbox
+var mboxStatusFlags = map[string]map[rune]string{
+	"status":   {'R': FlagSeen},
+	"x-status": {'A': FlagAnswered, 'F': FlagFlagged, 'T': FlagDraft, 'D': FlagDeleted},
+}
+
+// mboxSource reads the messages of an mbox file
+type mboxSource struct {
+	reader *bufio.Reader
+	// next is the "From " line of the message after the current one
+	next string
+}
+
+// NewMboxSource reads mboxrd, and the mboxo files most clients write, one message at a time
+func NewMboxSource(r io.Reader) MessageSource {
+	return &mboxSource{
+		reader: bufio.NewReader(r),
+	}
+}
+
+// Next message of the mbox
+func (m *mboxSource) Next() (ImportedMessage, error) {
+	fromLine := m.next
+	m.next = ""
+
+	// skip anything before the first "From " line
+	for fromLine == "" {
+		line, err := m.reader.ReadString('\n')
+		if strings.HasPrefix(line, "From ") {
+			fromLine = line
+		} else if err != nil {
+			return ImportedMessage{}, io.EOF
+		}
+	}
+
+	var raw bytes.Buffer
+	for {
+		line, err := m.reader.ReadString('\n')
+		if strings.HasPrefix(line, "From ") {
+			m.next = line
+			break
+		}
+		if mboxQuotedRegex.MatchString(line) {
+			line = line[1:]
+		}
+		raw.WriteString(line)
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ImportedMessage{}, err
+		}
+	}
+
+	// the blank line before the next "From " line separates the messages
+	body := bytes.TrimSuffix(raw.Bytes(), []byte("\n"))
+	body = bytes.TrimSuffix(body, []byte("\r"))
+
+	message := ImportedMessage{
+		Raw:   body,
+		Flags: mboxFlags(body),
+		Date:  mboxDate(fromLine),
+	}
+
+	return message, nil
+}
+
+// mboxFlags reads the Status and X-Status headers
+func mboxFlags(raw []byte) []string {
+	flags := []string{}
+	for _, header := range readHeaders(raw) {
+		letters, ok := mboxStatusFlags[strings.ToLower(header.Name)]
+		if !ok {
+			continue
+		}
+		for _, letter := range header.Value {
+			if flag, ok := letters[letter]; ok {
+				flags = append(flags, flag)
+			}
+		}
+	}
+
+	return flags
+}
+
+// mboxDate parses the date at the end of a "From sender Mon Jan  2 15:04:05 2006" line
+func mboxDate(fromLine string) time.Time {
+	fields := strings.Fields(fromLine)
+	if len(fields) < 7 {
+		return time.Time{}
+	}
+
+	date, err := time.Parse("Mon Jan 2 15:04:05 2006", strings.Join(fields[len(fields)-5:], " "))
+	if err != nil {
+		return time.Time{}
+	}
+
+	return date
+}
+
+// emlSource is a single message
+type emlSource struct {
+	reader io.Reader
+	done   bool
+}
+
+// NewEmlSource reads a single RFC 5322 message, such as a .eml file
+func NewEmlSource(r io.Reader) MessageSource {
+	return &emlSource{
+		reader: r,
+	}
+}
+
+// Next returns the message the first time and io.EOF after that
+func (e *emlSource) Next() (ImportedMessage, error) {
+	if e.done {
+		return ImportedMessage{}, io.EOF
+	}
+	e.done = true
+
+	raw, err := ioutil.ReadAll(e.reader)
+	if err != nil {
+		return ImportedMessage{}, err
+	}
+
+	return ImportedMessage{
+		Raw: raw,
+	}, nil
+}
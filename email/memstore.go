@@ -0,0 +1,123 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MemoryStore is a MailStore that keeps every object in memory, it is meant for tests
+type MemoryStore struct {
+	mu       sync.RWMutex
+	objects  map[string][]byte
+	versions map[string]string
+	written  int
+}
+
+// NewMemoryStore that is empty
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		objects:  make(map[string][]byte),
+		versions: make(map[string]string),
+	}
+}
+
+// Get the object at key
+func (m *MemoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	body, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return append([]byte(nil), body...), nil
+}
+
+// Put the body at key
+func (m *MemoryStore) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.put(key, append([]byte(nil), body...))
+
+	return nil
+}
+
+// put the body at key with a new version, the lock must be held
+func (m *MemoryStore) put(key string, body []byte) {
+	m.written++
+	m.objects[key] = body
+	m.versions[key] = strconv.Itoa(m.written)
+}
+
+// GetVersion of the object at key, the version changes every time it is written
+func (m *MemoryStore) GetVersion(ctx context.Context, key string) ([]byte, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	body, ok := m.objects[key]
+	if !ok {
+		return nil, "", ErrNotFound
+	}
+
+	return append([]byte(nil), body...), m.versions[key], nil
+}
+
+// PutIfVersion puts the body at key if the object is still at version
+func (m *MemoryStore) PutIfVersion(ctx context.Context, key string, body []byte, contentType, version string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.versions[key] != version {
+		return fmt.Errorf("%w: %s", ErrConflict, key)
+	}
+	m.put(key, append([]byte(nil), body...))
+
+	return nil
+}
+
+// Copy the object at srcKey to destKey
+func (m *MemoryStore) Copy(ctx context.Context, srcKey, destKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	body, ok := m.objects[srcKey]
+	if !ok {
+		return ErrNotFound
+	}
+	m.put(destKey, body)
+
+	return nil
+}
+
+// List the keys under prefix in lexical order
+func (m *MemoryStore) List(ctx context.Context, prefix string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := []string{}
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Delete the object at key
+func (m *MemoryStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.objects, key)
+	delete(m.versions, key)
+
+	return nil
+}
@@ -0,0 +1,268 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/mail"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DusanKasan/parsemail"
+)
+
+// MetadataVersion is the version of the metadata schema written by this build. It goes up
+// whenever Metadata changes shape or what is stored in it changes, metadata written with an
+// older version is upgraded when it is read and rewritten by ReindexMailbox.
+//
+// Versions:
+//
+//	0 - the parsemail.Email as it was marshaled, without a version
+//	1 - Message owned by this project, attachments stored on their own
+//	2 - Tag
+//	3 - Verdicts
+const MetadataVersion = 3
+
+// Metadata of an email, stored next to the original message as <id>.json
+type Metadata struct {
+	Version int
+	// MessageID is the name the email is stored under in the mailbox
+	MessageID string
+	Email     Message
+	// Size of the original message
+	Size int
+	// Attachments and embedded files, their content is stored separately
+	Attachments []Attachment
+	// TrackingPixels is the number of tracking pixels removed from the html body
+	TrackingPixels int
+	// Tag is the subaddress tag the email was sent to the user with, e.g. github for alice+github
+	Tag string
+	// Verdicts are the checks SES ran on the email when it was received, nil if they aren't known
+	Verdicts *Verdicts `json:",omitempty"`
+}
+
+// Message is what is parsed out of the original message. The field names are the ones
+// parsemail uses so metadata written before the schema was versioned can still be read.
+type Message struct {
+	Header map[string][]string
+
+	Subject    string
+	Sender     *mail.Address
+	From       []*mail.Address
+	ReplyTo    []*mail.Address
+	To         []*mail.Address
+	Cc         []*mail.Address
+	Bcc        []*mail.Address
+	Date       time.Time
+	MessageID  string
+	InReplyTo  []string
+	References []string
+
+	ContentType string
+	HTMLBody    string
+	TextBody    string
+}
+
+// newMessage copies the fields of the parsed email that are kept in the metadata
+func newMessage(email parsemail.Email) Message {
+	return Message{
+		Header:      email.Header,
+		Subject:     email.Subject,
+		Sender:      email.Sender,
+		From:        email.From,
+		ReplyTo:     email.ReplyTo,
+		To:          email.To,
+		Cc:          email.Cc,
+		Bcc:         email.Bcc,
+		Date:        email.Date,
+		MessageID:   email.MessageID,
+		InReplyTo:   email.InReplyTo,
+		References:  email.References,
+		ContentType: email.ContentType,
+		HTMLBody:    email.HTMLBody,
+		TextBody:    email.TextBody,
+	}
+}
+
+// newMetadata of the parsed email, stored as messageID
+func newMetadata(messageID string, parsed parsedEmail) Metadata {
+	return Metadata{
+		Version:        MetadataVersion,
+		MessageID:      messageID,
+		Email:          parsed.Email,
+		Size:           parsed.Size,
+		Attachments:    parsed.Attachments,
+		TrackingPixels: parsed.TrackingPixels,
+		Tag:            parsed.Tag,
+		Verdicts:       parsed.Verdicts,
+	}
+}
+
+// putMetadata writes the attachments of the parsed email and its metadata under destObjectKey
+func putMetadata(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID, destObjectKey string, parsed parsedEmail) error {
+	err := putAttachments(ctx, store, mailboxPrefix, userID, destObjectKey, parsed.Attachments, parsed.contents)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(newMetadata(messageID, parsed))
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return store.Put(ctx, metaKey(mailboxPrefix, userID, destObjectKey), buf, "application/json")
+}
+
+// decodeMetadata reads email metadata of any version and upgrades it to the current one in memory
+func decodeMetadata(buf []byte) (Metadata, error) {
+	var metadata Metadata
+	err := json.Unmarshal(buf, &metadata)
+	if err != nil {
+		return metadata, err
+	}
+
+	if metadata.Version == 0 && metadata.Attachments == nil {
+		// metadata written before attachments were stored separately listed them on the
+		// parsemail email, those become attachment records that have no content
+		metadata.Attachments, err = legacyAttachments(buf)
+		if err != nil {
+			return metadata, err
+		}
+	}
+
+	return metadata, nil
+}
+
+// legacyAttachments reads the attachments and embedded files parsemail marshaled onto the email
+func legacyAttachments(buf []byte) ([]Attachment, error) {
+	var legacy struct {
+		Email struct {
+			Attachments []struct {
+				Filename    string
+				ContentType string
+			}
+			EmbeddedFiles []struct {
+				CID         string
+				ContentType string
+			}
+		}
+	}
+	err := json.Unmarshal(buf, &legacy)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := []Attachment{}
+	for _, a := range legacy.Email.Attachments {
+		attachments = append(attachments, Attachment{
+			ID:          strconv.Itoa(len(attachments) + 1),
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+		})
+	}
+	for _, e := range legacy.Email.EmbeddedFiles {
+		attachments = append(attachments, Attachment{
+			ID:          strconv.Itoa(len(attachments) + 1),
+			ContentType: e.ContentType,
+			ContentID:   strings.Trim(e.CID, "<>"),
+			Embedded:    true,
+		})
+	}
+
+	return attachments, nil
+}
+
+// loadMetadata of an email
+func loadMetadata(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string) (Metadata, error) {
+	buf, err := store.Get(ctx, metaKey(mailboxPrefix, userID, messageID))
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return decodeMetadata(buf)
+}
+
+// ReindexReport counts the emails of a mailbox ReindexMailbox went through
+type ReindexReport struct {
+	UserID    string
+	Reindexed int
+	// Current is the number of emails skipped because their metadata already had the current version
+	Current int
+	Failed  int
+}
+
+// ReindexMailbox parses the original of every email in the user's mailbox again and rewrites
+// its metadata and attachments, then rebuilds the indexes from the new metadata. Only metadata
+// older than MetadataVersion is rewritten unless all is set, which picks up parser changes too.
+// The folder, flags, thread and tag of each email are kept.
+func ReindexMailbox(ctx context.Context, store MailStore, mailboxPrefix, userID string, all bool) (ReindexReport, error) {
+	report := ReindexReport{
+		UserID: userID,
+	}
+	log.Printf("Reindexing \"%s\"\n", userPrefix(mailboxPrefix, userID))
+
+	keys, err := store.List(ctx, userPrefix(mailboxPrefix, userID))
+	if err != nil {
+		return report, err
+	}
+
+	for i := range keys {
+		// skip anything that isn't email metadata such as the index itself
+		name := path.Base(keys[i])
+		if !strings.HasSuffix(name, ".json") || strings.HasPrefix(name, "_") {
+			continue
+		}
+		name = strings.TrimSuffix(name, ".json")
+
+		reindexed, err := reindexEmail(ctx, store, mailboxPrefix, userID, name, all)
+		switch {
+		case err != nil:
+			// one unreadable email doesn't stop the rest of the mailbox from being reindexed
+			log.Printf("Failed to reindex \"%s\": %s\n", keys[i], err)
+			report.Failed++
+		case reindexed:
+			report.Reindexed++
+		default:
+			report.Current++
+		}
+	}
+
+	_, err = RebuildIndex(ctx, store, mailboxPrefix, userID)
+
+	return report, err
+}
+
+// reindexEmail rewrites the metadata of the email from its original, returns false if it was already current
+func reindexEmail(ctx context.Context, store MailStore, mailboxPrefix, userID, name string, all bool) (bool, error) {
+	old, err := loadMetadata(ctx, store, mailboxPrefix, userID, name)
+	if err != nil {
+		return false, err
+	}
+	if !all && old.Version >= MetadataVersion {
+		return false, nil
+	}
+
+	raw, err := loadRaw(ctx, store, mailboxPrefix, userID, name)
+	if err != nil {
+		return false, err
+	}
+
+	parsed, err := parseEmail(raw, "")
+	if err != nil {
+		return false, err
+	}
+
+	// the tag and verdicts came with the notification, they aren't in the original message
+	parsed.Tag = old.Tag
+	parsed.Verdicts = old.Verdicts
+
+	messageID := old.MessageID
+	if messageID == "" {
+		messageID = name
+	}
+
+	return true, putMetadata(ctx, store, mailboxPrefix, userID, messageID, name, parsed)
+}
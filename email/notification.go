@@ -0,0 +1,214 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrInvalidNotification is returned for SES notifications that don't decode or miss the fields
+// postmaster needs, the error says which field is wrong
+var ErrInvalidNotification = errors.New("invalid SES notification")
+
+// NotificationReceived is the type of the notification SES sends when it receives mail
+const NotificationReceived = "Received"
+
+// ActionS3 is the receipt rule action that stores the message in a bucket, the only one postmaster
+// can read mail from
+const ActionS3 = "S3"
+
+// SESNotification is the notification an SES receipt rule publishes to SNS for a received message
+// https://docs.aws.amazon.com/ses/latest/dg/receiving-email-notifications-contents.html
+type SESNotification struct {
+	NotificationType string     `json:"notificationType"`
+	Mail             SESMail    `json:"mail"`
+	Receipt          SESReceipt `json:"receipt"`
+	// Content is the raw message, only set when the SNS action includes it instead of an S3 action
+	Content string `json:"content,omitempty"`
+}
+
+// SESMail is the message the notification is about
+type SESMail struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Source is the envelope sender, <> for bounces
+	Source    string `json:"source"`
+	MessageID string `json:"messageId"`
+	// Destination are all of the envelope recipients, including the ones of domains we don't host
+	Destination      []string         `json:"destination"`
+	HeadersTruncated bool             `json:"headersTruncated"`
+	Headers          []SESHeader      `json:"headers"`
+	CommonHeaders    SESCommonHeaders `json:"commonHeaders"`
+}
+
+// SESHeader is one header of the message, in the order they appear in it
+type SESHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// SESCommonHeaders are the headers SES parses out of the message
+type SESCommonHeaders struct {
+	ReturnPath string   `json:"returnPath,omitempty"`
+	From       []string `json:"from,omitempty"`
+	Sender     string   `json:"sender,omitempty"`
+	ReplyTo    []string `json:"replyTo,omitempty"`
+	Date       string   `json:"date,omitempty"`
+	To         []string `json:"to,omitempty"`
+	Cc         []string `json:"cc,omitempty"`
+	Bcc        []string `json:"bcc,omitempty"`
+	MessageID  string   `json:"messageId,omitempty"`
+	Subject    string   `json:"subject,omitempty"`
+}
+
+// SESReceipt is how the receipt rule handled the message
+type SESReceipt struct {
+	Timestamp            time.Time `json:"timestamp"`
+	ProcessingTimeMillis int       `json:"processingTimeMillis"`
+	// Recipients are the envelope recipients the receipt rule matched
+	Recipients   []string   `json:"recipients"`
+	SpamVerdict  SESVerdict `json:"spamVerdict"`
+	VirusVerdict SESVerdict `json:"virusVerdict"`
+	SPFVerdict   SESVerdict `json:"spfVerdict"`
+	DKIMVerdict  SESVerdict `json:"dkimVerdict"`
+	DMARCVerdict SESVerdict `json:"dmarcVerdict"`
+	// DMARCPolicy is only set when the message failed DMARC, none, quarantine or reject
+	DMARCPolicy string    `json:"dmarcPolicy,omitempty"`
+	Action      SESAction `json:"action"`
+}
+
+// SESVerdict is the result of one of the checks, Status is one of the Verdict statuses. A status
+// SES adds later is kept as it is, only FAIL counts as a failed check.
+type SESVerdict struct {
+	Status string `json:"status"`
+}
+
+// SESAction is the receipt rule action that published the notification, the fields set depend on its Type
+type SESAction struct {
+	Type            string `json:"type"`
+	TopicARN        string `json:"topicArn,omitempty"`
+	BucketName      string `json:"bucketName,omitempty"`
+	ObjectKeyPrefix string `json:"objectKeyPrefix,omitempty"`
+	ObjectKey       string `json:"objectKey,omitempty"`
+	KMSKeyARN       string `json:"kmsKeyArn,omitempty"`
+	FunctionARN     string `json:"functionArn,omitempty"`
+	InvocationType  string `json:"invocationType,omitempty"`
+	OrganizationARN string `json:"organizationArn,omitempty"`
+	Encoding        string `json:"encoding,omitempty"`
+	SMTPReplyCode   string `json:"smtpReplyCode,omitempty"`
+	StatusCode      string `json:"statusCode,omitempty"`
+	Message         string `json:"message,omitempty"`
+	Sender          string `json:"sender,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+}
+
+// ParseNotification decodes the SES notification in an SNS message. Notifications without the
+// message, its recipients or where it is stored are rejected. Fields and verdict statuses SES
+// doesn't document are accepted, so something SES adds later doesn't send every message to the
+// errored mailbox.
+func ParseNotification(message string) (SESNotification, error) {
+	return parseNotification(message, false)
+}
+
+// parseNotification rejects the fields SES doesn't document when strict is set, for checking
+// the notifications SES sends still match SESNotification
+func parseNotification(message string, strict bool) (SESNotification, error) {
+	var notification SESNotification
+
+	decoder := json.NewDecoder(strings.NewReader(message))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(&notification)
+	if err != nil {
+		return notification, notificationError(err)
+	}
+	if decoder.More() {
+		return notification, fmt.Errorf("%w: unexpected data after the notification at offset %d", ErrInvalidNotification, decoder.InputOffset())
+	}
+
+	return notification, notification.validate()
+}
+
+// notificationError says which field of the message failed to decode
+func notificationError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var timeErr *time.ParseError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("%w: %s at offset %d", ErrInvalidNotification, syntaxErr, syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		return fmt.Errorf("%w: %s is a JSON %s, expected %s", ErrInvalidNotification, typeErr.Field, typeErr.Value, typeErr.Type)
+	case errors.As(err, &timeErr):
+		return fmt.Errorf("%w: timestamp %q is not RFC 3339", ErrInvalidNotification, timeErr.Value)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("%w: message is truncated", ErrInvalidNotification)
+	}
+
+	// unknown fields are only described by their name
+	return fmt.Errorf("%w: %s", ErrInvalidNotification, strings.TrimPrefix(err.Error(), "json: "))
+}
+
+// validate that the notification is for a received message stored in S3
+func (n SESNotification) validate() error {
+	missing := func(field string) error {
+		return fmt.Errorf("%w: %s is missing", ErrInvalidNotification, field)
+	}
+
+	if n.NotificationType != NotificationReceived {
+		return fmt.Errorf("%w: notificationType is %q, expected %q", ErrInvalidNotification, n.NotificationType, NotificationReceived)
+	}
+	if n.Mail.MessageID == "" {
+		return missing("mail.messageId")
+	}
+	if len(n.Mail.Destination) == 0 {
+		return missing("mail.destination")
+	}
+	for i, address := range n.Mail.Destination {
+		if address == "" {
+			return missing(fmt.Sprintf("mail.destination[%d]", i))
+		}
+	}
+
+	action := n.Receipt.Action
+	if action.Type != ActionS3 {
+		return fmt.Errorf("%w: receipt.action.type is %q, expected %q", ErrInvalidNotification, action.Type, ActionS3)
+	}
+	if action.BucketName == "" {
+		return missing("receipt.action.bucketName")
+	}
+	if action.ObjectKey == "" {
+		return missing("receipt.action.objectKey")
+	}
+
+	return nil
+}
+
+// Sender is the envelope sender of the message, empty for bounces
+func (n SESNotification) Sender() string {
+	if n.Mail.Source == "<>" {
+		return ""
+	}
+
+	return n.Mail.Source
+}
+
+// Verdicts of the checks SES ran on the message, nil when the receipt rule doesn't scan mail
+func (n SESNotification) Verdicts() *Verdicts {
+	verdicts := Verdicts{
+		Spam:        n.Receipt.SpamVerdict.Status,
+		Virus:       n.Receipt.VirusVerdict.Status,
+		SPF:         n.Receipt.SPFVerdict.Status,
+		DKIM:        n.Receipt.DKIMVerdict.Status,
+		DMARC:       n.Receipt.DMARCVerdict.Status,
+		DMARCPolicy: n.Receipt.DMARCPolicy,
+	}
+	if verdicts == (Verdicts{}) {
+		return nil
+	}
+
+	return &verdicts
+}
@@ -0,0 +1,219 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadNotification fixture from testdata, in the form SES publishes it to SNS
+func loadNotification(t *testing.T, name string) string {
+	t.Helper()
+
+	buf, err := ioutil.ReadFile("testdata/notification-" + name + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(buf)
+}
+
+// notificationJSON is a decoded notification fixture for tests to change
+type notificationJSON map[string]interface{}
+
+// object at the path of field names
+func (n notificationJSON) object(path ...string) map[string]interface{} {
+	object := map[string]interface{}(n)
+	for _, name := range path {
+		object = object[name].(map[string]interface{})
+	}
+
+	return object
+}
+
+// editNotification decodes the notification, applies fn and encodes it again
+func editNotification(t *testing.T, message string, fn func(notificationJSON)) string {
+	t.Helper()
+
+	var n notificationJSON
+	err := json.Unmarshal([]byte(message), &n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn(n)
+
+	buf, err := json.Marshal(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(buf)
+}
+
+func TestParseNotification(t *testing.T) {
+	for _, name := range []string{"s3", "bounce"} {
+		// the fixtures only hold documented fields, they'd be rejected otherwise
+		_, err := parseNotification(loadNotification(t, name), true)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	notification, err := ParseNotification(loadNotification(t, "s3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2015, 9, 11, 20, 32, 33, 936000000, time.UTC); !notification.Mail.Timestamp.Equal(want) {
+		t.Errorf("timestamp = %v, want %v", notification.Mail.Timestamp, want)
+	}
+	if notification.Mail.MessageID != "d6iitobk75ur44p8kdnnp7g2n800" {
+		t.Errorf("messageId = %q", notification.Mail.MessageID)
+	}
+	if want := []string{"recipient@example.com"}; !reflect.DeepEqual(notification.Mail.Destination, want) {
+		t.Errorf("destination = %v, want %v", notification.Mail.Destination, want)
+	}
+	if action := notification.Receipt.Action; action.BucketName != "my-S3-bucket" || action.ObjectKey != `\email` {
+		t.Errorf("action = %+v", action)
+	}
+	if sender := notification.Sender(); sender != "61967230-7A45-4A9D-BEC9-87CBCF2211C9@example.com" {
+		t.Errorf("Sender = %q", sender)
+	}
+	want := &Verdicts{Spam: VerdictPass, Virus: VerdictPass, SPF: VerdictPass, DKIM: VerdictPass, DMARC: VerdictGray}
+	if verdicts := notification.Verdicts(); !reflect.DeepEqual(verdicts, want) {
+		t.Errorf("Verdicts = %+v, want %+v", verdicts, want)
+	}
+}
+
+func TestParseNotificationBounce(t *testing.T) {
+	notification, err := ParseNotification(loadNotification(t, "bounce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if notification.Mail.Source != "<>" || notification.Sender() != "" {
+		t.Errorf("bounce from %q has the sender %q, want none", notification.Mail.Source, notification.Sender())
+	}
+}
+
+func TestParseNotificationUnknownFields(t *testing.T) {
+	message := editNotification(t, loadNotification(t, "s3"), func(n notificationJSON) {
+		n.object("receipt")["tlsVersion"] = "TLSv1.3"
+	})
+
+	_, err := ParseNotification(message)
+	if err != nil {
+		t.Errorf("a field SES added later was rejected: %v", err)
+	}
+
+	_, err = parseNotification(message, true)
+	if want := `invalid SES notification: unknown field "tlsVersion"`; err == nil || err.Error() != want {
+		t.Errorf("strict parse returned %v, want %q", err, want)
+	}
+}
+
+func TestParseNotificationUnknownVerdict(t *testing.T) {
+	message := editNotification(t, loadNotification(t, "s3"), func(n notificationJSON) {
+		n.object("receipt", "virusVerdict")["status"] = "INFECTED"
+	})
+
+	for _, strict := range []bool{false, true} {
+		notification, err := parseNotification(message, strict)
+		if err != nil {
+			t.Fatalf("a verdict status SES added later was rejected: %v", err)
+		}
+		verdicts := notification.Verdicts()
+		if verdicts.Virus != "INFECTED" || len(verdicts.Failed()) != 0 {
+			t.Errorf("verdicts = %+v, failed %v, want the status kept and nothing failed", verdicts, verdicts.Failed())
+		}
+	}
+}
+
+func TestParseNotificationErrors(t *testing.T) {
+	s3 := loadNotification(t, "s3")
+
+	for _, tc := range []struct {
+		name    string
+		message string
+		wantErr string
+	}{
+		{
+			name:    "SNS action",
+			message: loadNotification(t, "sns"),
+			wantErr: `invalid SES notification: receipt.action.type is "SNS", expected "S3"`,
+		},
+		{
+			name: "missing messageId",
+			message: editNotification(t, s3, func(n notificationJSON) {
+				delete(n.object("mail"), "messageId")
+			}),
+			wantErr: "invalid SES notification: mail.messageId is missing",
+		},
+		{
+			name: "missing objectKey",
+			message: editNotification(t, s3, func(n notificationJSON) {
+				delete(n.object("receipt", "action"), "objectKey")
+			}),
+			wantErr: "invalid SES notification: receipt.action.objectKey is missing",
+		},
+		{
+			name: "missing bucketName",
+			message: editNotification(t, s3, func(n notificationJSON) {
+				delete(n.object("receipt", "action"), "bucketName")
+			}),
+			wantErr: "invalid SES notification: receipt.action.bucketName is missing",
+		},
+		{
+			name: "empty destination",
+			message: editNotification(t, s3, func(n notificationJSON) {
+				n.object("mail")["destination"] = []interface{}{}
+			}),
+			wantErr: "invalid SES notification: mail.destination is missing",
+		},
+		{
+			name: "timestamp that isn't RFC 3339",
+			message: editNotification(t, s3, func(n notificationJSON) {
+				n.object("mail")["timestamp"] = "Fri, 11 Sep 2015 20:32:33 +0000"
+			}),
+			wantErr: `invalid SES notification: timestamp "Fri, 11 Sep 2015 20:32:33 +0000" is not RFC 3339`,
+		},
+		{
+			name:    "wrong type",
+			message: strings.Replace(s3, `"processingTimeMillis": 222`, `"processingTimeMillis": "222"`, 1),
+			wantErr: "invalid SES notification: receipt.processingTimeMillis is a JSON string, expected int",
+		},
+		{
+			name:    "not a received notification",
+			message: strings.Replace(s3, `"notificationType": "Received"`, `"notificationType": "Bounce"`, 1),
+			wantErr: `invalid SES notification: notificationType is "Bounce", expected "Received"`,
+		},
+		{
+			name:    "trailing data",
+			message: `{"notificationType": "Received"} {}`,
+			wantErr: "invalid SES notification: unexpected data after the notification at offset 33",
+		},
+		{
+			name:    "truncated",
+			message: s3[:100],
+			wantErr: "invalid SES notification: message is truncated",
+		},
+		{
+			name:    "not JSON",
+			message: "Received",
+			wantErr: "invalid SES notification: invalid character 'R' looking for beginning of value at offset 1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseNotification(tc.message)
+			if !errors.Is(err, ErrInvalidNotification) {
+				t.Fatalf("ParseNotification returned %v, want ErrInvalidNotification", err)
+			}
+			if err.Error() != tc.wantErr {
+				t.Errorf("ParseNotification returned %q, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
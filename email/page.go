@@ -0,0 +1,212 @@
+package email
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 1000
+)
+
+// ErrInvalidListOptions is returned when the list query parameters can't be used
+var ErrInvalidListOptions = errors.New("invalid list options")
+
+// ListOptions control which page of the mailbox ListEmails returns and in what order
+type ListOptions struct {
+	// Folder limits the page to a single folder, all emails are listed when it is empty
+	Folder string
+	Limit  int
+	Cursor string
+	// Sort is one of "date", "from" or "subject"
+	Sort string
+	// Order is "asc" or "desc"
+	Order string
+}
+
+// EmailPage is a single page of the mailbox, Next is empty on the last page
+type EmailPage struct {
+	Emails []Meta `json:"emails"`
+	Next   string `json:"next,omitempty"`
+}
+
+// pageCursor is the position after the last email of a page, it is handed out base64 encoded
+type pageCursor struct {
+	Sort      string `json:"s"`
+	Order     string `json:"o"`
+	Key       string `json:"k"`
+	MessageID string `json:"m"`
+}
+
+// ParseListOptions from the query string parameters folder, limit, cursor, sort and order
+func ParseListOptions(params map[string]string) (ListOptions, error) {
+	opts := ListOptions{
+		Folder: params["folder"],
+		Limit:  defaultPageLimit,
+		Cursor: params["cursor"],
+		Sort:   strings.ToLower(params["sort"]),
+		Order:  strings.ToLower(params["order"]),
+	}
+
+	if opts.Folder != "" {
+		folder, err := canonicalFolder(opts.Folder)
+		if err != nil {
+			return opts, fmt.Errorf("%w: %s", ErrInvalidListOptions, err)
+		}
+		opts.Folder = folder
+	}
+
+	if limit, ok := params["limit"]; ok {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("%w: limit must be a positive number", ErrInvalidListOptions)
+		}
+		opts.Limit = n
+	}
+	if opts.Limit > maxPageLimit {
+		opts.Limit = maxPageLimit
+	}
+
+	switch opts.Sort {
+	case "":
+		opts.Sort = "date"
+	case "date", "from", "subject":
+	default:
+		return opts, fmt.Errorf("%w: unknown sort %q", ErrInvalidListOptions, opts.Sort)
+	}
+
+	switch opts.Order {
+	case "":
+		// newest mail first, everything else alphabetical
+		opts.Order = "asc"
+		if opts.Sort == "date" {
+			opts.Order = "desc"
+		}
+	case "asc", "desc":
+	default:
+		return opts, fmt.Errorf("%w: unknown order %q", ErrInvalidListOptions, opts.Order)
+	}
+
+	return opts, nil
+}
+
+// sortKey is the value an email is ordered by for the given sort
+func sortKey(meta Meta, sortBy string) string {
+	switch sortBy {
+	case "from":
+		return strings.ToLower(meta.From)
+	case "subject":
+		return strings.ToLower(meta.Subject)
+	default:
+		return meta.Date.UTC().Format(time.RFC3339Nano)
+	}
+}
+
+// before reports if a sorts before b, the message ID breaks ties so the order is stable between pages
+func before(a, b Meta, opts ListOptions) bool {
+	aKey, bKey := sortKey(a, opts.Sort), sortKey(b, opts.Sort)
+	if opts.Sort == "date" {
+		if !a.Date.Equal(b.Date) {
+			return a.Date.Before(b.Date) == (opts.Order == "asc")
+		}
+	} else if aKey != bKey {
+		return (aKey < bKey) == (opts.Order == "asc")
+	}
+
+	if a.MessageID == b.MessageID {
+		return false
+	}
+
+	return (a.MessageID < b.MessageID) == (opts.Order == "asc")
+}
+
+// paginate sorts the emails and returns the page after the cursor in opts
+func paginate(emails []Meta, opts ListOptions) (EmailPage, error) {
+	page := EmailPage{
+		Emails: []Meta{},
+	}
+
+	sorted := []Meta{}
+	for i := range emails {
+		if opts.Folder == "" || emails[i].Folder == opts.Folder {
+			sorted = append(sorted, emails[i])
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return before(sorted[i], sorted[j], opts)
+	})
+
+	start := 0
+	if opts.Cursor != "" {
+		cursor, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return page, err
+		}
+		if cursor.Sort != opts.Sort || cursor.Order != opts.Order {
+			return page, fmt.Errorf("%w: cursor was issued for a different sort", ErrInvalidListOptions)
+		}
+
+		last := Meta{MessageID: cursor.MessageID}
+		switch opts.Sort {
+		case "date":
+			last.Date, err = time.Parse(time.RFC3339Nano, cursor.Key)
+			if err != nil {
+				return page, fmt.Errorf("%w: malformed cursor", ErrInvalidListOptions)
+			}
+		case "from":
+			last.From = cursor.Key
+		case "subject":
+			last.Subject = cursor.Key
+		}
+
+		// skip everything up to and including the last email of the previous page
+		start = sort.Search(len(sorted), func(i int) bool {
+			return before(last, sorted[i], opts)
+		})
+	}
+
+	end := start + opts.Limit
+	if end > len(sorted) {
+		end = len(sorted)
+	}
+	page.Emails = append(page.Emails, sorted[start:end]...)
+
+	if end < len(sorted) {
+		last := sorted[end-1]
+		page.Next = encodeCursor(pageCursor{
+			Sort:      opts.Sort,
+			Order:     opts.Order,
+			Key:       sortKey(last, opts.Sort),
+			MessageID: last.MessageID,
+		})
+	}
+
+	return page, nil
+}
+
+func encodeCursor(cursor pageCursor) string {
+	buf, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var cursor pageCursor
+
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, fmt.Errorf("%w: malformed cursor", ErrInvalidListOptions)
+	}
+	err = json.Unmarshal(buf, &cursor)
+	if err != nil {
+		return cursor, fmt.Errorf("%w: malformed cursor", ErrInvalidListOptions)
+	}
+
+	return cursor, nil
+}
@@ -0,0 +1,477 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What postmaster does with mail for a mailbox that is over its quota
+const (
+	// OverQuotaAccept delivers the mail anyway and warns the user
+	OverQuotaAccept = "accept"
+	// OverQuotaHold keeps the mail out of the mailbox until there is room for it
+	OverQuotaHold = "hold"
+	// OverQuotaBounce returns the mail to the sender
+	OverQuotaBounce = "bounce"
+)
+
+// quotaWarnings are the percentages of the quota the user is warned at, the last is the
+// warning sent once the mailbox is full
+var quotaWarnings = []int{80, 95, 100}
+
+// noWarningsKey marks the delivery of a warning, which counts against the quota but doesn't set off another warning
+type noWarningsKey struct{}
+
+// quotaLock serializes changes to the usage of a mailbox within this process
+var quotaLock sync.Mutex
+
+// ErrInvalidQuotaPolicy is returned for an over quota policy postmaster doesn't know
+var ErrInvalidQuotaPolicy = errors.New("invalid over quota policy")
+
+// ErrOverQuota is returned when mail is moved into a mailbox that has no room for it
+var ErrOverQuota = errors.New("mailbox is over its quota")
+
+// QuotaPolicy is how much mail each mailbox can hold and what happens once it is full
+type QuotaPolicy struct {
+	// Limit is the size in bytes of the mail a mailbox can hold, 0 is unlimited
+	Limit int64
+	// OverQuota is one of OverQuotaAccept, OverQuotaHold or OverQuotaBounce
+	OverQuota string
+	// From is the address quota warnings are sent from
+	From string
+	// Bouncer returns mail to its sender, only handlers that deliver mail need one
+	Bouncer Bouncer
+}
+
+var quotaPolicy = QuotaPolicy{
+	OverQuota: OverQuotaAccept,
+}
+
+// SetQuotaPolicy for every mailbox, the over quota policy defaults to accepting mail
+func SetQuotaPolicy(policy QuotaPolicy) error {
+	if policy.OverQuota == "" {
+		policy.OverQuota = OverQuotaAccept
+	}
+	if policy.OverQuota != OverQuotaAccept && policy.OverQuota != OverQuotaHold && policy.OverQuota != OverQuotaBounce {
+		return fmt.Errorf("%w: %q", ErrInvalidQuotaPolicy, policy.OverQuota)
+	}
+
+	quotaPolicy = policy
+
+	return nil
+}
+
+// Quota is how much of the mailbox is in use
+type Quota struct {
+	// Limit in bytes, 0 is unlimited
+	Limit int64
+	// Used is the size of the original messages in the mailbox
+	Used     int64
+	Messages int
+	Percent  float64
+	// Held is the number of emails waiting for room in the mailbox
+	Held      int
+	OverQuota string
+}
+
+// usage is the running total of the mail in a mailbox, updated on every delivery and deletion
+type usage struct {
+	Used     int64
+	Messages int
+	// Warned is the highest warning sent since the mailbox was last below it
+	Warned int
+}
+
+// quotaKey is the key of the usage of the user's mailbox
+func quotaKey(mailboxPrefix, userID string) string {
+	return userPrefix(mailboxPrefix, userID) + "_quota.json"
+}
+
+// heldPrefix is where mail for mailboxes over their quota waits
+func heldPrefix(mailboxPrefix string) string {
+	return mailboxPrefix + "/_held/"
+}
+
+// heldKey is the key of a held email
+func heldKey(mailboxPrefix, userID, name string) string {
+	return heldPrefix(mailboxPrefix) + userID + "/" + name
+}
+
+// heldVerdictsKey is the key of the SES verdicts of the held email at key
+func heldVerdictsKey(key string) string {
+	return key + ".verdicts.json"
+}
+
+// loadUsage of the mailbox, mailboxes from before usage was tracked are counted from the index
+func loadUsage(ctx context.Context, store MailStore, mailboxPrefix, userID string) (usage, error) {
+	buf, err := store.Get(ctx, quotaKey(mailboxPrefix, userID))
+	if err != nil && err != ErrNotFound {
+		return usage{}, err
+	}
+
+	return decodeUsage(ctx, store, mailboxPrefix, userID, buf)
+}
+
+// decodeUsage of the mailbox, without buf the mailbox is counted from the index
+func decodeUsage(ctx context.Context, store MailStore, mailboxPrefix, userID string, buf []byte) (usage, error) {
+	var u usage
+	if buf != nil {
+		return u, json.Unmarshal(buf, &u)
+	}
+
+	index, err := LoadIndex(ctx, store, mailboxPrefix, userID)
+	if err == ErrNotFound {
+		return u, nil
+	}
+	if err != nil {
+		return u, err
+	}
+
+	return countUsage(index), nil
+}
+
+// countUsage adds up the emails in the index
+func countUsage(index Index) usage {
+	var u usage
+	for i := range index.Emails {
+		u.Used += int64(index.Emails[i].Size)
+		u.Messages++
+	}
+
+	return u
+}
+
+// updateUsage loads the usage, applies fn to it and writes it back, fn is run again when
+// another writer changed the usage in the meantime
+func updateUsage(ctx context.Context, store MailStore, mailboxPrefix, userID string, fn func(*usage)) (usage, error) {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	var u usage
+	err := updateObject(ctx, store, quotaKey(mailboxPrefix, userID), "application/json", func(buf []byte) ([]byte, error) {
+		var err error
+		u, err = decodeUsage(ctx, store, mailboxPrefix, userID, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		fn(&u)
+		if u.Used < 0 {
+			u.Used = 0
+		}
+		if u.Messages < 0 {
+			u.Messages = 0
+		}
+
+		return json.Marshal(u)
+	})
+
+	return u, err
+}
+
+// GetQuota of the user's mailbox
+func GetQuota(ctx context.Context, store MailStore, mailboxPrefix, userID string) (Quota, error) {
+	u, err := loadUsage(ctx, store, mailboxPrefix, userID)
+	if err != nil {
+		return Quota{}, err
+	}
+
+	keys, err := store.List(ctx, heldKey(mailboxPrefix, userID, ""))
+	if err != nil {
+		return Quota{}, err
+	}
+	held := 0
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".verdicts.json") {
+			held++
+		}
+	}
+
+	quota := Quota{
+		Limit:     quotaPolicy.Limit,
+		Used:      u.Used,
+		Messages:  u.Messages,
+		Held:      held,
+		OverQuota: quotaPolicy.OverQuota,
+	}
+	if quota.Limit > 0 {
+		quota.Percent = float64(quota.Used) * 100 / float64(quota.Limit)
+	}
+
+	return quota, nil
+}
+
+// warningLevel is the highest warning the usage has reached
+func warningLevel(used int64) int {
+	level := 0
+	if quotaPolicy.Limit <= 0 {
+		return level
+	}
+	for _, warning := range quotaWarnings {
+		if used*100 >= int64(warning)*quotaPolicy.Limit {
+			level = warning
+		}
+	}
+
+	return level
+}
+
+// hasRoom reports if a message of size fits in the mailbox
+func hasRoom(ctx context.Context, store MailStore, mailboxPrefix, userID string, size int) (bool, error) {
+	if quotaPolicy.Limit <= 0 {
+		return true, nil
+	}
+
+	u, err := loadUsage(ctx, store, mailboxPrefix, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return u.Used+int64(size) <= quotaPolicy.Limit, nil
+}
+
+// checkQuotas splits the recipients of the message into the mailboxes it can be delivered to
+// and the ones that are full, which get the over quota policy. keep is set when the message
+// is being released from the holding area and has to stay there.
+func checkQuotas(ctx context.Context, store MailStore, mailboxPrefix string, email MoveOperation, body []byte) ([]string, bool, error) {
+	deliver := []string{}
+	bounce := []string{}
+	keep := false
+
+	for _, userID := range email.DestPrefixes {
+		room, err := hasRoom(ctx, store, mailboxPrefix, userID, len(body))
+		if err != nil {
+			return nil, false, err
+		}
+		if room || quotaPolicy.OverQuota == OverQuotaAccept {
+			deliver = append(deliver, userID)
+			continue
+		}
+
+		log.Printf("Mailbox \"%s\" is over quota, %s \"%s\"\n", userID, quotaPolicy.OverQuota, email.DestObjectKey)
+		switch quotaPolicy.OverQuota {
+		case OverQuotaHold:
+			key := heldKey(mailboxPrefix, userID, email.DestObjectKey)
+			if key == email.SourceObjectKey {
+				keep = true
+				continue
+			}
+			// held mail is still only readable by the user it is for
+			userCtx := withRecipients(ctx, []string{userID})
+			err = store.Put(userCtx, key, body, "message/rfc822")
+			if err != nil {
+				return nil, false, err
+			}
+			err = putHeldVerdicts(userCtx, store, key, email.Verdicts)
+			if err != nil {
+				return nil, false, err
+			}
+		case OverQuotaBounce:
+			bounce = append(bounce, userID)
+		}
+	}
+
+	if len(bounce) > 0 {
+		if quotaPolicy.Bouncer == nil {
+			return nil, false, fmt.Errorf("%w: nothing to bounce with", ErrInvalidQuotaPolicy)
+		}
+		err := quotaPolicy.Bouncer.Bounce(ctx, email.MessageID, bounce)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return deliver, keep, nil
+}
+
+// LoadHeldEmails that now fit in their mailbox
+func LoadHeldEmails(ctx context.Context, store MailStore, mailboxPrefix string) ([]MoveOperation, error) {
+	ret := []MoveOperation{}
+
+	keys, err := store.List(ctx, heldPrefix(mailboxPrefix))
+	if err != nil {
+		return ret, err
+	}
+
+	for _, key := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(key, heldPrefix(mailboxPrefix)), "/", 2)
+		if len(parts) != 2 || strings.HasSuffix(key, ".verdicts.json") {
+			continue
+		}
+
+		// the message is only read again once the mailbox is below its quota
+		room, err := hasRoom(ctx, store, mailboxPrefix, parts[0], 0)
+		if err != nil {
+			return ret, err
+		}
+		if !room {
+			continue
+		}
+
+		verdicts, err := loadHeldVerdicts(ctx, store, key)
+		if err != nil {
+			return ret, err
+		}
+
+		ret = append(ret, MoveOperation{
+			MessageID:       parts[1],
+			SourceObjectKey: key,
+			DestPrefixes:    []string{parts[0]},
+			DestObjectKey:   parts[1],
+			Verdicts:        verdicts,
+		})
+	}
+
+	return ret, nil
+}
+
+// putHeldVerdicts stores the verdicts of the held email, the headers of the message can't be
+// trusted to carry them once the notification is gone
+func putHeldVerdicts(ctx context.Context, store MailStore, key string, verdicts *Verdicts) error {
+	if verdicts == nil {
+		return nil
+	}
+
+	buf, err := json.Marshal(verdicts)
+	if err != nil {
+		return err
+	}
+
+	return store.Put(ctx, heldVerdictsKey(key), buf, "application/json")
+}
+
+// loadHeldVerdicts of the held email, nil when they weren't known when it was held
+func loadHeldVerdicts(ctx context.Context, store MailStore, key string) (*Verdicts, error) {
+	buf, err := store.Get(ctx, heldVerdictsKey(key))
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var verdicts Verdicts
+	err = json.Unmarshal(buf, &verdicts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &verdicts, nil
+}
+
+// recordDelivery adds the email to the usage of the mailbox and warns the user when the
+// mailbox fills past one of the warnings
+func recordDelivery(ctx context.Context, store MailStore, mailboxPrefix, userID string, size int) error {
+	warn := 0
+	u, err := updateUsage(ctx, store, mailboxPrefix, userID, func(u *usage) {
+		// the update may run again, only the attempt that was written counts
+		warn = 0
+		u.Used += int64(size)
+		u.Messages++
+		if level := warningLevel(u.Used); level > u.Warned && ctx.Value(noWarningsKey{}) == nil {
+			u.Warned = level
+			warn = level
+		}
+	})
+	if err != nil || warn == 0 {
+		return err
+	}
+
+	return sendQuotaWarning(ctx, store, mailboxPrefix, userID, warn, u)
+}
+
+// recordDeletion takes the email out of the usage of the mailbox, warnings are sent again
+// once the mailbox fills back up
+func recordDeletion(ctx context.Context, store MailStore, mailboxPrefix, userID string, size int) error {
+	_, err := updateUsage(ctx, store, mailboxPrefix, userID, func(u *usage) {
+		u.Used -= int64(size)
+		u.Messages--
+		// without a limit, e.g. when it isn't configured for this handler, the warnings are left alone
+		if level := warningLevel(u.Used); quotaPolicy.Limit > 0 && level < u.Warned {
+			u.Warned = level
+		}
+	})
+
+	return err
+}
+
+// sendQuotaWarning delivers a message from the postmaster into the user's Inbox
+func sendQuotaWarning(ctx context.Context, store MailStore, mailboxPrefix, userID string, level int, u usage) error {
+	now := time.Now().UTC()
+	name := fmt.Sprintf("quota-%d-%d", level, now.UnixNano())
+
+	subject := fmt.Sprintf("Your mailbox is %d%% full", level)
+	if level >= 100 {
+		subject = "Your mailbox is full"
+	}
+
+	next := "is still delivered"
+	switch quotaPolicy.OverQuota {
+	case OverQuotaHold:
+		next = "is held until there is room for it"
+	case OverQuotaBounce:
+		next = "is returned to the sender"
+	}
+
+	from := quotaPolicy.From
+	if from == "" {
+		from = "postmaster@localhost"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: Postmaster <%s>\r\n", from)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", MailboxAddress(userID, domainOf(from)))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", name, domainOf(from))
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "Your mailbox is using %s of its %s quota, %d messages.\r\n\r\n", formatSize(u.Used), formatSize(quotaPolicy.Limit), u.Messages)
+	fmt.Fprintf(&buf, "Delete mail you no longer need, or empty the Trash and Spam folders, to make room. ")
+	fmt.Fprintf(&buf, "Once the mailbox is full new mail %s.\r\n", next)
+
+	log.Printf("Warning \"%s\" their mailbox is %d%% full\n", userID, level)
+
+	return deliverMessage(context.WithValue(ctx, noWarningsKey{}, true), store, mailboxPrefix, userID, name, buf.Bytes())
+}
+
+// deliverMessage stores a message generated by us in the user's mailbox as if it had come through SES
+func deliverMessage(ctx context.Context, store MailStore, mailboxPrefix, userID, name string, raw []byte) error {
+	hash, err := putBlob(ctx, store, mailboxPrefix, raw, []string{userID + "/" + name})
+	if err != nil {
+		return err
+	}
+
+	parsed, err := parseEmail(raw, hash)
+	if err != nil {
+		return err
+	}
+
+	return processEmail(ctx, store, mailboxPrefix, userID, name, name, parsed)
+}
+
+func domainOf(address string) string {
+	return address[strings.LastIndex(address, "@")+1:]
+}
+
+// formatSize in the largest unit that keeps it above 1, e.g. 1.5 GB
+func formatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[unit])
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
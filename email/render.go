@@ -0,0 +1,367 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	nethtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// RenderOptions control how links to other resources are written into rendered html
+type RenderOptions struct {
+	// AttachmentURL returns the url an embedded file is served from
+	AttachmentURL func(attachment Attachment) string
+	// ImageProxyURL returns the url a remote image is loaded through, remote images are
+	// blocked without it
+	ImageProxyURL func(src string) string
+	// LoadRemoteImages for this email even if the sender isn't on the user's allowlist
+	LoadRemoteImages bool
+}
+
+// RenderedEmail is the sanitized html body
+type RenderedEmail struct {
+	HTML string
+	// BlockedImages is the number of remote images that were removed
+	BlockedImages int
+	// RemoteImages reports if the remote images were loaded through the proxy
+	RemoteImages bool
+}
+
+// renderAllowedTags are kept when sanitizing, along with the attributes allowed on them.
+// Tags that aren't listed are unwrapped so their text is still shown.
+var renderAllowedTags = map[atom.Atom][]string{
+	atom.A:          {"href"},
+	atom.Abbr:       nil,
+	atom.Address:    nil,
+	atom.B:          nil,
+	atom.Big:        nil,
+	atom.Blockquote: nil,
+	atom.Br:         nil,
+	atom.Caption:    nil,
+	atom.Center:     nil,
+	atom.Cite:       nil,
+	atom.Code:       nil,
+	atom.Col:        {"span"},
+	atom.Colgroup:   {"span"},
+	atom.Dd:         nil,
+	atom.Del:        nil,
+	atom.Div:        nil,
+	atom.Dl:         nil,
+	atom.Dt:         nil,
+	atom.Em:         nil,
+	atom.Font:       {"color", "face", "size"},
+	atom.H1:         nil,
+	atom.H2:         nil,
+	atom.H3:         nil,
+	atom.H4:         nil,
+	atom.H5:         nil,
+	atom.H6:         nil,
+	atom.Hr:         {"noshade", "size"},
+	atom.I:          nil,
+	atom.Img:        {"src", "alt", "border", "hspace", "vspace"},
+	atom.Ins:        nil,
+	atom.Kbd:        nil,
+	atom.Li:         {"type", "value"},
+	atom.Ol:         {"start", "type"},
+	atom.P:          nil,
+	atom.Pre:        nil,
+	atom.Q:          nil,
+	atom.S:          nil,
+	atom.Small:      nil,
+	atom.Span:       nil,
+	atom.Strike:     nil,
+	atom.Strong:     nil,
+	atom.Sub:        nil,
+	atom.Sup:        nil,
+	atom.Table:      {"border", "cellpadding", "cellspacing", "summary"},
+	atom.Tbody:      nil,
+	atom.Td:         {"colspan", "rowspan", "nowrap"},
+	atom.Tfoot:      nil,
+	atom.Th:         {"colspan", "rowspan", "nowrap", "scope"},
+	atom.Thead:      nil,
+	atom.Tr:         nil,
+	atom.Tt:         nil,
+	atom.U:          nil,
+	atom.Ul:         {"type"},
+}
+
+// renderGlobalAttributes are allowed on every kept tag, mostly the presentational ones html mail relies on
+var renderGlobalAttributes = []string{
+	"align", "bgcolor", "class", "color", "dir", "height", "lang", "style", "title", "valign", "width",
+}
+
+// renderDroppedTags are removed along with everything inside them
+var renderDroppedTags = map[atom.Atom]bool{
+	atom.Applet:   true,
+	atom.Base:     true,
+	atom.Button:   true,
+	atom.Embed:    true,
+	atom.Form:     true,
+	atom.Frame:    true,
+	atom.Frameset: true,
+	atom.Iframe:   true,
+	atom.Input:    true,
+	atom.Link:     true,
+	atom.Math:     true,
+	atom.Meta:     true,
+	atom.Noscript: true,
+	atom.Object:   true,
+	atom.Script:   true,
+	atom.Select:   true,
+	atom.Svg:      true,
+	atom.Template: true,
+	atom.Textarea: true,
+	atom.Title:    true,
+}
+
+// cssImportRegex matches @import rules, which load external stylesheets
+var cssImportRegex = regexp.MustCompile(`(?i)@import[^;]*;?`)
+
+// cssUnsafeRegex matches css that loads a resource or runs script
+var cssUnsafeRegex = regexp.MustCompile(`(?i)(url\s*\(|image-set\s*\(|image\s*\(|src\s*\(|expression\s*\(|behavior\s*:|-moz-binding|javascript:)`)
+
+// cssEscapeRegex matches a css escape, a backslash followed by up to six hex digits and an
+// optional white space, or by any other character
+var cssEscapeRegex = regexp.MustCompile(`\\(?:([0-9a-fA-F]{1,6})(?:\r\n|[ \t\r\n\f])?|([^0-9a-fA-F\r\n\f]))`)
+
+// RenderHTML returns the html body of the email sanitized so it can be shown in the browser.
+// Remote images are only loaded, through the proxy, for senders on the user's allowlist so
+// tracking pixels can't see the user's address or when the email was read. Emails without
+// an html body have their text body rendered instead.
+func RenderHTML(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string, opts RenderOptions) (RenderedEmail, error) {
+	rendered := RenderedEmail{}
+
+	email, err := loadMetadata(ctx, store, mailboxPrefix, userID, messageID)
+	if err != nil {
+		return rendered, err
+	}
+
+	if strings.TrimSpace(email.Email.HTMLBody) == "" {
+		rendered.HTML = "<pre>" + html.EscapeString(email.Email.TextBody) + "</pre>"
+		return rendered, nil
+	}
+
+	settings, err := LoadSettings(ctx, store, mailboxPrefix, userID)
+	if err != nil {
+		return rendered, err
+	}
+	rendered.RemoteImages = opts.ImageProxyURL != nil && opts.LoadRemoteImages
+	if len(email.Email.From) > 0 && settings.remoteImagesAllowed(email.Email.From[0].Address) {
+		rendered.RemoteImages = opts.ImageProxyURL != nil
+	}
+
+	embedded := make(map[string]Attachment)
+	for _, attachment := range email.Attachments {
+		if attachment.Embedded && attachment.ContentID != "" {
+			embedded[strings.ToLower(attachment.ContentID)] = attachment
+		}
+	}
+
+	images := func(src string) string {
+		switch {
+		case strings.HasPrefix(strings.ToLower(src), "data:"):
+			return src
+		case !strings.HasPrefix(strings.ToLower(src), "cid:"):
+			if !rendered.RemoteImages {
+				rendered.BlockedImages++
+				return ""
+			}
+			return opts.ImageProxyURL(src)
+		}
+
+		attachment, ok := embedded[strings.ToLower(strings.Trim(src[len("cid:"):], "<>"))]
+		if !ok || opts.AttachmentURL == nil {
+			return ""
+		}
+		return opts.AttachmentURL(attachment)
+	}
+
+	rendered.HTML, err = sanitizeHTML(email.Email.HTMLBody, images)
+
+	return rendered, err
+}
+
+// sanitizeHTML keeps the allowlisted tags and attributes of the html body and drops everything
+// else. images maps the src of each image to the url it is loaded from, an empty url removes the image.
+func sanitizeHTML(body string, images func(src string) string) (string, error) {
+	doc, err := nethtml.Parse(strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	for _, node := range sanitizeNode(doc, images) {
+		err = nethtml.Render(&buf, node)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// sanitizeNode returns the safe replacement for the node, which can be none, the node
+// itself, or its children when the tag is unwrapped.
+func sanitizeNode(node *nethtml.Node, images func(src string) string) []*nethtml.Node {
+	switch node.Type {
+	case nethtml.TextNode:
+		return []*nethtml.Node{{Type: nethtml.TextNode, Data: node.Data}}
+	case nethtml.DocumentNode, nethtml.ElementNode:
+	default:
+		// comments can hide conditional markup for old versions of Outlook
+		return nil
+	}
+
+	if node.Type == nethtml.ElementNode && renderDroppedTags[node.DataAtom] {
+		return nil
+	}
+
+	if node.Type == nethtml.ElementNode && node.DataAtom == atom.Style {
+		text := ""
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type == nethtml.TextNode {
+				text += child.Data
+			}
+		}
+		style := &nethtml.Node{Type: nethtml.ElementNode, Data: "style", DataAtom: atom.Style}
+		style.AppendChild(&nethtml.Node{Type: nethtml.TextNode, Data: sanitizeCSS(text)})
+		return []*nethtml.Node{style}
+	}
+
+	children := []*nethtml.Node{}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		children = append(children, sanitizeNode(child, images)...)
+	}
+
+	allowed, ok := renderAllowedTags[node.DataAtom]
+	if node.Type != nethtml.ElementNode || !ok {
+		return children
+	}
+
+	clean := &nethtml.Node{Type: nethtml.ElementNode, Data: node.Data, DataAtom: node.DataAtom}
+	for _, attr := range node.Attr {
+		key := strings.ToLower(attr.Key)
+		if attr.Namespace != "" || !(containsString(allowed, key) || containsString(renderGlobalAttributes, key)) {
+			continue
+		}
+
+		value := attr.Val
+		switch key {
+		case "href":
+			if !safeLink(value) {
+				continue
+			}
+		case "src":
+			if !safeImage(value) {
+				continue
+			}
+			value = images(strings.TrimSpace(value))
+			if value == "" {
+				continue
+			}
+		case "style":
+			value = sanitizeCSS(value)
+		}
+		clean.Attr = append(clean.Attr, nethtml.Attribute{Key: key, Val: value})
+	}
+
+	switch clean.DataAtom {
+	case atom.Img:
+		if !hasAttribute(clean, "src") {
+			return nil
+		}
+	case atom.A:
+		// links open outside of the page the email is shown in
+		clean.Attr = append(clean.Attr,
+			nethtml.Attribute{Key: "target", Val: "_blank"},
+			nethtml.Attribute{Key: "rel", Val: "noopener noreferrer"},
+		)
+	}
+
+	for _, child := range children {
+		clean.AppendChild(child)
+	}
+
+	return []*nethtml.Node{clean}
+}
+
+// sanitizeCSS removes rules that load external resources or run script
+func sanitizeCSS(css string) string {
+	// escapes would hide names from the rules below, e.g. \75 rl( is url(
+	css = decodeCSSEscapes(css)
+	css = cssImportRegex.ReplaceAllString(css, "")
+
+	// the replacement is invalid css so the browser drops the whole declaration
+	return cssUnsafeRegex.ReplaceAllString(css, "invalid(")
+}
+
+// decodeCSSEscapes replaces the escapes of letters, digits, "-" and "_" with the character itself,
+// which means the same in names and strings. Other escapes are kept, they could turn into quotes or
+// brackets that end the string or name they are in.
+func decodeCSSEscapes(css string) string {
+	if !strings.Contains(css, "\\") {
+		return css
+	}
+
+	return cssEscapeRegex.ReplaceAllStringFunc(css, func(escape string) string {
+		match := cssEscapeRegex.FindStringSubmatch(escape)
+		decoded := match[2]
+		if match[1] != "" {
+			code, err := strconv.ParseUint(match[1], 16, 32)
+			if err != nil || code > unicode.MaxASCII {
+				return escape
+			}
+			decoded = string(rune(code))
+		}
+
+		if len(decoded) != 1 || !isCSSNameChar(decoded[0]) {
+			return escape
+		}
+		return decoded
+	})
+}
+
+// isCSSNameChar reports if c is an ascii letter, digit, "-" or "_"
+func isCSSNameChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_'
+}
+
+// safeLink reports if the href is a web or mailto link
+func safeLink(href string) bool {
+	href = strings.ToLower(strings.TrimSpace(href))
+	for _, scheme := range []string{"http://", "https://", "mailto:"} {
+		if strings.HasPrefix(href, scheme) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// safeImage reports if the src is a web url, an embedded file or an inline image
+func safeImage(src string) bool {
+	src = strings.ToLower(strings.TrimSpace(src))
+	for _, scheme := range []string{"http://", "https://", "cid:", "data:image/"} {
+		if strings.HasPrefix(src, scheme) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasAttribute(node *nethtml.Node, key string) bool {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,130 @@
+package email
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeCSS(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		css  string
+		want string
+	}{
+		{"plain", "color: red; font-weight: bold", "color: red; font-weight: bold"},
+		{"url", "background: url(https://example.org/a.png)", "background: invalid(https://example.org/a.png)"},
+		{"url with space", "background: URL (https://example.org/a.png)", "background: invalid(https://example.org/a.png)"},
+		{"escaped url", `background: \75 rl(https://example.org/a.png)`, "background: invalid(https://example.org/a.png)"},
+		{"escaped url without a space", `background: \000075rl(https://example.org/a.png)`, "background: invalid(https://example.org/a.png)"},
+		{"escaped letter", `background: u\rl(https://example.org/a.png)`, "background: invalid(https://example.org/a.png)"},
+		{"import", `@import "https://example.org/a.css"; p { color: red }`, " p { color: red }"},
+		{"escaped import", `@\69mport "https://example.org/a.css"; p { color: red }`, " p { color: red }"},
+		{"image-set", `background: image-set("a.png" 1x)`, `background: invalid("a.png" 1x)`},
+		{"prefixed image-set", `background: -webkit-image-set("a.png" 1x)`, `background: -webkit-invalid("a.png" 1x)`},
+		{"image", `background: image("a.png")`, `background: invalid("a.png")`},
+		{"src", `background: src("a.png")`, `background: invalid("a.png")`},
+		{"escaped expression", `width: expr\65ssion(alert(1))`, "width: invalid(alert(1))"},
+		{"escaped binding", `\2d moz-binding: x`, "invalid(: x"},
+		{"escaped quote", `content: "\22"`, `content: "\22"`},
+		{"escaped font name", `font-family: "\5FAE\8F6F\96C5\9ED1"`, `font-family: "\5FAE\8F6F\96C5\9ED1"`},
+		{"escaped backslash", `content: "\\75 rl("`, `content: "\\75 rl("`},
+	} {
+		if got := sanitizeCSS(tc.css); got != tc.want {
+			t.Errorf("%s: sanitizeCSS(%q) = %q, want %q", tc.name, tc.css, got, tc.want)
+		}
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	images := func(src string) string {
+		if strings.HasPrefix(src, "cid:") {
+			return ""
+		}
+		return "/proxy?url=" + src
+	}
+
+	for _, tc := range []struct {
+		name string
+		body string
+		want string
+	}{
+		{"text", "<p>Hello <b>Alice</b></p>", "<p>Hello <b>Alice</b></p>"},
+		{"script", "<p>Hi</p><script>alert(1)</script>", "<p>Hi</p>"},
+		{"event handler", `<p onclick="alert(1)">Hi</p>`, "<p>Hi</p>"},
+		{"unknown tag", "<blink>Hi</blink>", "Hi"},
+		{"form", `<form action="https://example.org"><input name="password"/></form>Hi`, "Hi"},
+		{"link", `<a href="https://example.org">Hi</a>`, `<a href="https://example.org" target="_blank" rel="noopener noreferrer">Hi</a>`},
+		{"script link", `<a href="javascript:alert(1)">Hi</a>`, `<a target="_blank" rel="noopener noreferrer">Hi</a>`},
+		{"remote image", `<img src="https://example.org/a.png" alt="A"/>`, `<img src="/proxy?url=https://example.org/a.png" alt="A"/>`},
+		{"removed image", `<img src="cid:logo" alt="A"/>`, ""},
+		{"script image", `<img src="javascript:alert(1)"/>`, ""},
+		{"style attribute", `<p style="background: \75 rl(https://example.org/a.png)">Hi</p>`, `<p style="background: invalid(https://example.org/a.png)">Hi</p>`},
+		{"style tag", `<style>@\69mport "https://example.org/a.css"; p { color: red }</style>`, "<style> p { color: red }</style>"},
+		{"comment", "<!--[if mso]><p>Outlook</p><![endif]-->Hi", "Hi"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := sanitizeHTML(tc.body, images)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("sanitizeHTML(%q) = %q, want %q", tc.body, got, tc.want)
+			}
+		})
+	}
+}
+
+const renderTestMessage = "From: Carol <carol@example.org>\r\n" +
+	"To: alice@example.com\r\n" +
+	"Subject: News\r\n" +
+	"Message-ID: <news@example.org>\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	`<p>News</p><img src="https://example.org/banner.png"/>` +
+	`<img src="https://example.org/open.gif" width="1" height="1"/>` + "\r\n"
+
+func TestRenderHTMLRemoteImages(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	deliver(t, store, "news", renderTestMessage, "alice")
+
+	opts := RenderOptions{
+		ImageProxyURL: func(src string) string {
+			return "/proxy?url=" + src
+		},
+	}
+
+	rendered, err := RenderHTML(ctx, store, "mailbox", "alice", "news", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rendered.RemoteImages || rendered.BlockedImages != 1 || strings.Contains(rendered.HTML, "<img") {
+		t.Errorf("remote images of a sender that isn't allowed were loaded: %+v", rendered)
+	}
+
+	_, err = AllowRemoteImages(ctx, store, "mailbox", "alice", "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, err = RenderHTML(ctx, store, "mailbox", "alice", "news", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<img src="/proxy?url=https://example.org/banner.png"/>`; !rendered.RemoteImages || !strings.Contains(rendered.HTML, want) {
+		t.Errorf("rendered %q, want the image through the proxy", rendered.HTML)
+	}
+	// the tracking pixel was already removed when the email was delivered
+	if strings.Contains(rendered.HTML, "open.gif") {
+		t.Errorf("rendered %q with the tracking pixel", rendered.HTML)
+	}
+
+	// without a proxy nothing is loaded, even from allowed senders
+	rendered, err = RenderHTML(ctx, store, "mailbox", "alice", "news", RenderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rendered.RemoteImages || strings.Contains(rendered.HTML, "<img") {
+		t.Errorf("remote images were loaded without the proxy: %+v", rendered)
+	}
+}
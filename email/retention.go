@@ -0,0 +1,195 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ErrInvalidRetention is returned for retention rules that don't keep mail for at least a day
+var ErrInvalidRetention = errors.New("invalid retention")
+
+// RetentionRule deletes mail that has been in the folder, or one of its sub-folders, for more than Days
+type RetentionRule struct {
+	Folder string
+	Days   int
+}
+
+// PurgedEmail is an email deleted, or that would be deleted, by a retention rule
+type PurgedEmail struct {
+	MessageID string
+	Subject   string
+	From      string
+	// Folder is empty for mail purged from the quarantine
+	Folder string
+	// Filed is when the email was put in the folder, or its date for mail filed before that was recorded
+	Filed time.Time
+	Size  int
+	Days  int
+}
+
+// PurgeReport lists what was deleted from a mailbox, in a dry run nothing is deleted
+type PurgeReport struct {
+	UserID string
+	DryRun bool
+	Emails []PurgedEmail
+	// Size is the total size of the purged emails
+	Size int
+}
+
+// SetRetention keeps mail in the folder for the number of days, replacing the folder's current rule
+func SetRetention(ctx context.Context, store MailStore, mailboxPrefix, userID, folder string, days int) (Settings, error) {
+	folder, err := canonicalFolder(folder)
+	if err != nil {
+		return Settings{}, err
+	}
+	if days < 1 {
+		return Settings{}, fmt.Errorf("%w: %d days", ErrInvalidRetention, days)
+	}
+
+	exists, err := folderExists(ctx, store, mailboxPrefix, userID, folder)
+	if err != nil {
+		return Settings{}, err
+	}
+	if !exists {
+		return Settings{}, fmt.Errorf("%w: %q", ErrFolderNotFound, folder)
+	}
+
+	return updateSettings(ctx, store, mailboxPrefix, userID, func(settings *Settings) error {
+		for i := range settings.Retention {
+			if settings.Retention[i].Folder == folder {
+				settings.Retention[i].Days = days
+				return nil
+			}
+		}
+		settings.Retention = append(settings.Retention, RetentionRule{Folder: folder, Days: days})
+
+		return nil
+	})
+}
+
+// RemoveRetention from the folder so its mail is kept forever, returns ErrNotFound if it had no rule
+func RemoveRetention(ctx context.Context, store MailStore, mailboxPrefix, userID, folder string) (Settings, error) {
+	folder, err := canonicalFolder(folder)
+	if err != nil {
+		return Settings{}, err
+	}
+
+	return updateSettings(ctx, store, mailboxPrefix, userID, func(settings *Settings) error {
+		kept := []RetentionRule{}
+		for _, rule := range settings.Retention {
+			if rule.Folder != folder {
+				kept = append(kept, rule)
+			}
+		}
+		if len(kept) == len(settings.Retention) {
+			return ErrNotFound
+		}
+		settings.Retention = kept
+
+		return nil
+	})
+}
+
+// retentionFor the folder, the rule of the closest folder up the hierarchy applies
+func (s Settings) retentionFor(folder string) (RetentionRule, bool) {
+	var found RetentionRule
+	for _, rule := range s.Retention {
+		if inFolder(folder, rule.Folder) && len(rule.Folder) > len(found.Folder) {
+			found = rule
+		}
+	}
+
+	return found, found.Folder != ""
+}
+
+// PurgeMailbox deletes the emails the user's retention rules have expired at now. A dry run
+// only reports what would be deleted.
+func PurgeMailbox(ctx context.Context, store MailStore, mailboxPrefix, userID string, now time.Time, dryRun bool) (PurgeReport, error) {
+	report := PurgeReport{
+		UserID: userID,
+		DryRun: dryRun,
+		Emails: []PurgedEmail{},
+	}
+
+	settings, err := LoadSettings(ctx, store, mailboxPrefix, userID)
+	if err != nil || len(settings.Retention) == 0 {
+		return report, err
+	}
+
+	index, err := LoadIndex(ctx, store, mailboxPrefix, userID)
+	if err == ErrNotFound {
+		// nothing has been delivered since indexes were added, build it once
+		index, err = RebuildIndex(ctx, store, mailboxPrefix, userID)
+	}
+	if err != nil {
+		return report, err
+	}
+
+	var lastErr error
+	for _, meta := range index.Emails {
+		rule, ok := settings.retentionFor(meta.Folder)
+		if !ok {
+			continue
+		}
+
+		filed := meta.Filed
+		if filed.IsZero() {
+			filed = meta.Date
+		}
+		if filed.IsZero() || !filed.Before(now.AddDate(0, 0, -rule.Days)) {
+			continue
+		}
+
+		if !dryRun {
+			log.Printf("Purging \"%s\" from %s/%s, filed %s\n", meta.MessageID, userID, meta.Folder, filed.Format(time.RFC3339))
+			err = DeleteEmail(ctx, store, mailboxPrefix, userID, meta.MessageID)
+			if err != nil {
+				// keep going, the email is picked up again by the next purge
+				log.Println(err)
+				lastErr = err
+				continue
+			}
+		}
+
+		report.Emails = append(report.Emails, PurgedEmail{
+			MessageID: meta.MessageID,
+			Subject:   meta.Subject,
+			From:      meta.From,
+			Folder:    meta.Folder,
+			Filed:     filed,
+			Size:      meta.Size,
+			Days:      rule.Days,
+		})
+		report.Size += meta.Size
+	}
+
+	return report, lastErr
+}
+
+// ListMailboxes returns the users that have a mailbox under the prefix
+func ListMailboxes(ctx context.Context, store MailStore, mailboxPrefix string) ([]string, error) {
+	keys, err := store.List(ctx, mailboxPrefix+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	users := []string{}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(key, mailboxPrefix+"/"), "/", 2)
+		// system folders such as _errored and _blobs aren't mailboxes
+		if len(parts) < 2 || parts[0] == "" || strings.HasPrefix(parts[0], "_") {
+			continue
+		}
+		if !seen[parts[0]] {
+			seen[parts[0]] = true
+			users = append(users, parts[0])
+		}
+	}
+
+	return users, nil
+}
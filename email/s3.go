@@ -3,28 +3,18 @@ package email
 import (
 	"context"
 	"encoding/json"
-	"io/ioutil"
 	"log"
-	"strings"
 	"time"
-
-	"github.com/DusanKasan/parsemail"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-func GetEmailByID(ctx context.Context, s3Client *s3.Client, mailboxBucket, mailboxPrefix, userID, ID string) (string, error) {
-	getInput := &s3.GetObjectInput{
-		Bucket: aws.String(mailboxBucket),
-		Key:    aws.String(mailboxPrefix + "/" + userID + "/" + ID + ".json"),
-	}
-
-	result, err := s3Client.GetObjectRequest(getInput).Send(ctx)
-	if checkAwsErr(err) != nil {
+func GetEmailByID(ctx context.Context, store MailStore, mailboxPrefix, userID, ID string) (string, error) {
+	metadata, err := loadMetadata(ctx, store, mailboxPrefix, userID, ID)
+	if err != nil {
 		return "", err
 	}
 
-	buf, err := ioutil.ReadAll(result.Body)
+	// metadata of an older version is returned in the current shape
+	buf, err := json.Marshal(metadata)
 	if err != nil {
 		return "", err
 	}
@@ -32,68 +22,39 @@ func GetEmailByID(ctx context.Context, s3Client *s3.Client, mailboxBucket, mailb
 	return string(buf), nil
 }
 
-type emailStorage struct {
-	MessageID string
-	Email     parsemail.Email
-}
-
-// Meta contians a snapshot of an email for the frontend
+// Meta contians a snapshot of an email for the frontend, it is also the entry stored in the mailbox index
 type Meta struct {
-	MessageID string
-	Subject   string
-	Date      time.Time
+	MessageID      string
+	Subject        string
+	From           string
+	Date           time.Time
+	Size           int
+	HasAttachments bool
+	Folder         string
+	Flags          []string
+	ThreadID       string
+	Filed          time.Time
+	// Tag is the subaddress tag the email was sent with
+	Tag string `json:",omitempty"`
 }
 
-// MetaMultiMap represents a simple json object with a single key holding the emails
-type MetaMultiMap map[string][]Meta
-
-// listEmails in the user's mailbox sitting in S3, as JSON
-func ListEmails(ctx context.Context, s3Client *s3.Client, mailboxBucket, mailboxPrefix, userID string) (string, error) {
-	prefix := mailboxPrefix + "/" + userID
-
-	listInput := &s3.ListObjectsV2Input{
-		Bucket: aws.String(mailboxBucket),
-		Prefix: aws.String(prefix),
+// ListEmails returns a page of the user's mailbox from the mailbox index, as JSON
+func ListEmails(ctx context.Context, store MailStore, mailboxPrefix, userID string, opts ListOptions) (string, error) {
+	index, err := LoadIndex(ctx, store, mailboxPrefix, userID)
+	if err == ErrNotFound {
+		// mailbox was created before the index, build it once
+		index, err = RebuildIndex(ctx, store, mailboxPrefix, userID)
 	}
-
-	result, err := s3Client.ListObjectsV2Request(listInput).Send(ctx)
-	if checkAwsErr(err) != nil {
+	if err != nil {
 		return "", err
 	}
 
-	ret := make(MetaMultiMap)
-	ret["emails"] = []Meta{}
-
-	for i := range result.Contents {
-		if strings.HasSuffix(*result.Contents[i].Key, ".json") {
-			result, err := s3Client.GetObjectRequest(&s3.GetObjectInput{
-				Bucket: aws.String(mailboxBucket),
-				Key:    aws.String(*result.Contents[i].Key),
-			}).Send(ctx)
-			if checkAwsErr(err) != nil {
-				return "", err
-			}
-
-			bodyBuf, err := ioutil.ReadAll(result.Body)
-			if err != nil {
-				return "", err
-			}
-
-			var email emailStorage
-			err = json.Unmarshal(bodyBuf, &email)
-			if err != nil {
-				return "", err
-			}
-
-			ret["emails"] = append(ret["emails"], Meta{
-				MessageID: email.MessageID,
-				Subject:   email.Email.Subject,
-				Date:      email.Email.Date,
-			})
-		}
+	page, err := paginate(index.Emails, opts)
+	if err != nil {
+		return "", err
 	}
 
-	buf, err := json.Marshal(ret)
+	buf, err := json.Marshal(page)
 	if err != nil {
 		log.Println(err)
 		return "", err
@@ -0,0 +1,227 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3Store is a MailStore backed by a single S3 bucket
+type S3Store struct {
+	client *s3.Client
+	bucket string
+}
+
+// NewS3Store for the given mailbox bucket
+func NewS3Store(client *s3.Client, bucket string) *S3Store {
+	return &S3Store{
+		client: client,
+		bucket: bucket,
+	}
+}
+
+// Get the object at key
+func (s *S3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	getInput := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	log.Printf("Getting \"%s\"\n", s.bucket+"/"+key)
+
+	result, err := s.client.GetObjectRequest(getInput).Send(ctx)
+	if isNoSuchKey(err) {
+		return nil, ErrNotFound
+	}
+	if checkAwsErr(err) != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+
+	return ioutil.ReadAll(result.Body)
+}
+
+// Put the body at key
+func (s *S3Store) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	putInput := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	}
+	log.Printf("Writing \"%s\"\n", s.bucket+"/"+key)
+
+	putResp, err := s.client.PutObjectRequest(putInput).Send(ctx)
+	if checkAwsErr(err) != nil {
+		log.Println(putResp)
+		return err
+	}
+
+	return nil
+}
+
+// GetVersion of the object at key, the version is its ETag
+func (s *S3Store) GetVersion(ctx context.Context, key string) ([]byte, string, error) {
+	getInput := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	log.Printf("Getting \"%s\"\n", s.bucket+"/"+key)
+
+	result, err := s.client.GetObjectRequest(getInput).Send(ctx)
+	if isNoSuchKey(err) {
+		return nil, "", ErrNotFound
+	}
+	if checkAwsErr(err) != nil {
+		return nil, "", err
+	}
+	defer result.Body.Close()
+
+	body, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return body, aws.StringValue(result.ETag), nil
+}
+
+// PutIfVersion puts the body at key with an S3 conditional write, If-Match on the ETag that
+// was read or If-None-Match when the object didn't exist
+func (s *S3Store) PutIfVersion(ctx context.Context, key string, body []byte, contentType, version string) error {
+	putInput := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	}
+	log.Printf("Writing \"%s\" if it is at %s\n", s.bucket+"/"+key, version)
+
+	// the SDK doesn't model the conditional headers of PutObject yet
+	req := s.client.PutObjectRequest(putInput)
+	if version == "" {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		req.HTTPRequest.Header.Set("If-Match", version)
+	}
+
+	_, err := req.Send(ctx)
+	if isConflict(err) {
+		return fmt.Errorf("%w: %s", ErrConflict, key)
+	}
+
+	return checkAwsErr(err)
+}
+
+// Copy the object at srcKey to destKey within the bucket
+func (s *S3Store) Copy(ctx context.Context, srcKey, destKey string) error {
+	sourcePath := s.bucket + "/" + srcKey
+
+	copyInput := &s3.CopyObjectInput{
+		CopySource: aws.String(url.PathEscape(sourcePath)),
+
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(destKey),
+	}
+	log.Printf("Copying from \"%s\" to \"%s\"\n", sourcePath, s.bucket+"/"+destKey)
+
+	copyResp, err := s.client.CopyObjectRequest(copyInput).Send(ctx)
+	if checkAwsErr(err) != nil {
+		log.Println(copyResp)
+		return err
+	}
+
+	return nil
+}
+
+// List the keys under prefix, following continuation tokens until every page has been read
+func (s *S3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	listInput := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}
+	log.Printf("Listing \"%s\"\n", s.bucket+"/"+prefix)
+
+	keys := []string{}
+	for {
+		result, err := s.client.ListObjectsV2Request(listInput).Send(ctx)
+		if checkAwsErr(err) != nil {
+			log.Println(result)
+			return nil, err
+		}
+
+		for i := range result.Contents {
+			keys = append(keys, *result.Contents[i].Key)
+		}
+
+		if result.IsTruncated == nil || !*result.IsTruncated {
+			break
+		}
+		listInput.ContinuationToken = result.NextContinuationToken
+	}
+
+	return keys, nil
+}
+
+// Delete the object at key
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	delInput := &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	log.Printf("Deleting object \"%s\"\n", s.bucket+"/"+key)
+
+	delResp, err := s.client.DeleteObjectRequest(delInput).Send(ctx)
+	if checkAwsErr(err) != nil {
+		log.Println(delResp)
+		return err
+	}
+
+	return nil
+}
+
+func isNoSuchKey(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchKey
+	}
+
+	return false
+}
+
+// isConflict reports if a conditional write lost, S3 answers 412 when the object changed and
+// 409 when another conditional write to it is in flight
+func isConflict(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "PreconditionFailed" || aerr.Code() == "ConditionalRequestConflict"
+	}
+
+	return false
+}
+
+func checkAwsErr(err error) error {
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case s3.ErrCodeNoSuchBucket:
+				log.Println(s3.ErrCodeNoSuchBucket, aerr.Error())
+			default:
+				log.Println(aerr.Error())
+			}
+		} else {
+			// Print the error, cast err to awserr.Error to get the Code and
+			// Message from an error.
+			log.Println(err.Error())
+		}
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,393 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	nethtml "golang.org/x/net/html"
+)
+
+// Fields of an email that are tokenized into the search index
+const (
+	searchFieldSubject = "subject"
+	searchFieldFrom    = "from"
+	searchFieldTo      = "to"
+	searchFieldBody    = "body"
+)
+
+// maxIndexedBody caps how much of a body is indexed so huge newsletters don't bloat the index
+const maxIndexedBody = 100000
+
+const defaultSearchLimit = 50
+
+// searchFieldWeights rank a match in the subject or addresses above one in the body
+var searchFieldWeights = map[string]float64{
+	searchFieldSubject: 3,
+	searchFieldFrom:    2,
+	searchFieldTo:      2,
+	searchFieldBody:    1,
+}
+
+var searchStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true,
+	"for": true, "from": true, "in": true, "is": true, "it": true, "of": true, "on": true, "or": true,
+	"that": true, "the": true, "this": true, "to": true, "was": true, "with": true,
+}
+
+// searchLock serializes changes to the search index within this process
+var searchLock sync.Mutex
+
+// ErrInvalidQuery is returned for search queries that can't be parsed
+var ErrInvalidQuery = errors.New("invalid search query")
+
+// searchIndex is the inverted index of a user's mailbox. Terms maps a field qualified
+// term, e.g. "subject:invoice", to the emails containing it and how many times.
+type searchIndex struct {
+	Terms map[string]map[string]int
+}
+
+// SearchQuery is a parsed search, every term and filter has to match
+type SearchQuery struct {
+	HasAttachment bool
+	Before        time.Time
+	After         time.Time
+	Limit         int
+
+	// terms are field qualified, a term without a field matches any field
+	terms []searchTerm
+}
+
+type searchTerm struct {
+	Field string
+	Term  string
+}
+
+// searchKey is the key of the user's search index
+func searchKey(mailboxPrefix, userID string) string {
+	return userPrefix(mailboxPrefix, userID) + "_search.json"
+}
+
+// tokenize text into lower case words, dropping stop words and single characters
+func tokenize(text string) []string {
+	tokens := []string{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if len([]rune(word)) > 1 && !searchStopWords[word] {
+			tokens = append(tokens, word)
+		}
+	}
+
+	return tokens
+}
+
+// tokenizeAddresses indexes the whole address as well as the words in the name, local part and domain
+func tokenizeAddresses(addresses []*mail.Address) []string {
+	tokens := []string{}
+	for _, address := range addresses {
+		if address == nil {
+			continue
+		}
+		if address.Address != "" {
+			tokens = append(tokens, strings.ToLower(address.Address))
+		}
+		tokens = append(tokens, tokenize(address.Name+" "+address.Address)...)
+	}
+
+	return tokens
+}
+
+// htmlToText returns the text content of an html document, ignoring scripts and styles
+func htmlToText(body string) string {
+	var text strings.Builder
+	skip := 0
+
+	tokenizer := nethtml.NewTokenizer(strings.NewReader(body))
+	for {
+		switch tokenizer.Next() {
+		case nethtml.ErrorToken:
+			return text.String()
+		case nethtml.StartTagToken:
+			name, _ := tokenizer.TagName()
+			if string(name) == "script" || string(name) == "style" {
+				skip++
+			}
+		case nethtml.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if (string(name) == "script" || string(name) == "style") && skip > 0 {
+				skip--
+			}
+		case nethtml.TextToken:
+			if skip == 0 {
+				text.Write(tokenizer.Text())
+				text.WriteString(" ")
+			}
+		}
+	}
+}
+
+// searchDocument is every token of the email grouped by the field it came from
+func searchDocument(email Message) map[string][]string {
+	body := email.TextBody + " " + htmlToText(email.HTMLBody)
+	if len(body) > maxIndexedBody {
+		body = body[:maxIndexedBody]
+	}
+
+	return map[string][]string{
+		searchFieldSubject: tokenize(email.Subject),
+		searchFieldFrom:    tokenizeAddresses(email.From),
+		searchFieldTo:      tokenizeAddresses(append(append([]*mail.Address{}, email.To...), email.Cc...)),
+		searchFieldBody:    tokenize(body),
+	}
+}
+
+func (s *searchIndex) add(messageID string, email Message) {
+	for field, tokens := range searchDocument(email) {
+		for _, token := range tokens {
+			term := field + ":" + token
+			if s.Terms[term] == nil {
+				s.Terms[term] = make(map[string]int)
+			}
+			s.Terms[term][messageID]++
+		}
+	}
+}
+
+func (s *searchIndex) remove(messageID string) {
+	for term, postings := range s.Terms {
+		delete(postings, messageID)
+		if len(postings) == 0 {
+			delete(s.Terms, term)
+		}
+	}
+}
+
+func loadSearchIndex(ctx context.Context, store MailStore, mailboxPrefix, userID string) (searchIndex, error) {
+	buf, err := store.Get(ctx, searchKey(mailboxPrefix, userID))
+	if err != nil && err != ErrNotFound {
+		return searchIndex{}, err
+	}
+
+	return decodeSearchIndex(buf)
+}
+
+// decodeSearchIndex, an empty index when buf is nil
+func decodeSearchIndex(buf []byte) (searchIndex, error) {
+	index := searchIndex{
+		Terms: make(map[string]map[string]int),
+	}
+	if buf == nil {
+		return index, nil
+	}
+
+	return index, json.Unmarshal(buf, &index)
+}
+
+// updateSearchIndex loads the search index, applies fn to it and writes it back
+func updateSearchIndex(ctx context.Context, store MailStore, mailboxPrefix, userID string, fn func(*searchIndex)) error {
+	searchLock.Lock()
+	defer searchLock.Unlock()
+
+	return updateObject(ctx, store, searchKey(mailboxPrefix, userID), "application/json", func(buf []byte) ([]byte, error) {
+		index, err := decodeSearchIndex(buf)
+		if err != nil {
+			return nil, err
+		}
+		fn(&index)
+
+		return json.Marshal(index)
+	})
+}
+
+// addToSearchIndex tokenizes the email into the user's search index
+func addToSearchIndex(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string, email Message) error {
+	return updateSearchIndex(ctx, store, mailboxPrefix, userID, func(index *searchIndex) {
+		index.remove(messageID)
+		index.add(messageID, email)
+	})
+}
+
+// ParseSearchQuery parses words and the qualifiers from:, to:, subject:, has:attachment,
+// before: and after: with dates as YYYY-MM-DD. Double quotes group words into one value.
+func ParseSearchQuery(q string) (SearchQuery, error) {
+	query := SearchQuery{
+		Limit: defaultSearchLimit,
+		terms: []searchTerm{},
+	}
+
+	words, err := splitQuery(q)
+	if err != nil {
+		return query, err
+	}
+	for _, word := range words {
+		field, value := "", word
+		if i := strings.Index(word, ":"); i > 0 {
+			field, value = strings.ToLower(word[:i]), word[i+1:]
+		}
+
+		switch field {
+		case searchFieldFrom, searchFieldTo:
+			if strings.Contains(value, "@") {
+				query.terms = append(query.terms, searchTerm{Field: field, Term: strings.ToLower(value)})
+				continue
+			}
+			fallthrough
+		case searchFieldSubject:
+			tokens := tokenize(value)
+			if len(tokens) == 0 {
+				return query, fmt.Errorf("%w: nothing to search for in %q", ErrInvalidQuery, word)
+			}
+			for _, token := range tokens {
+				query.terms = append(query.terms, searchTerm{Field: field, Term: token})
+			}
+		case "has":
+			if strings.ToLower(value) != "attachment" {
+				return query, fmt.Errorf("%w: unknown has:%s", ErrInvalidQuery, value)
+			}
+			query.HasAttachment = true
+		case "before", "after":
+			date, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				return query, fmt.Errorf("%w: %s: dates are YYYY-MM-DD", ErrInvalidQuery, word)
+			}
+			if field == "before" {
+				query.Before = date
+			} else {
+				query.After = date
+			}
+		default:
+			// an unknown qualifier is searched for as plain text, e.g. "re:" or "10:30"
+			tokens := tokenize(word)
+			if len(tokens) == 0 && strings.Contains(word, "@") {
+				tokens = []string{strings.ToLower(word)}
+			}
+			for _, token := range tokens {
+				query.terms = append(query.terms, searchTerm{Term: token})
+			}
+		}
+	}
+
+	if len(query.terms) == 0 && !query.HasAttachment && query.Before.IsZero() && query.After.IsZero() {
+		return query, fmt.Errorf("%w: nothing to search for in %q", ErrInvalidQuery, q)
+	}
+
+	return query, nil
+}
+
+// splitQuery on whitespace while keeping double quoted values together
+func splitQuery(q string) ([]string, error) {
+	words := []string{}
+	var word strings.Builder
+	quoted := false
+
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case unicode.IsSpace(r) && !quoted:
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+		default:
+			word.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("%w: unterminated quote", ErrInvalidQuery)
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
+
+// Search the user's mailbox, emails matching every term and filter are ranked by tf-idf
+// with matches in the subject and addresses weighted above the body.
+func Search(ctx context.Context, store MailStore, mailboxPrefix, userID string, query SearchQuery) ([]Meta, error) {
+	ret := []Meta{}
+
+	index, err := LoadIndex(ctx, store, mailboxPrefix, userID)
+	if err == ErrNotFound {
+		return ret, nil
+	}
+	if err != nil {
+		return ret, err
+	}
+
+	terms, err := loadSearchIndex(ctx, store, mailboxPrefix, userID)
+	if err != nil {
+		return ret, err
+	}
+
+	total := float64(len(index.Emails))
+	scores := make(map[string]float64)
+	for i := range index.Emails {
+		meta := index.Emails[i]
+		if query.HasAttachment && !meta.HasAttachments {
+			continue
+		}
+		if !query.Before.IsZero() && !meta.Date.Before(query.Before) {
+			continue
+		}
+		if !query.After.IsZero() && meta.Date.Before(query.After) {
+			continue
+		}
+		scores[meta.MessageID] = 0
+	}
+
+	for _, term := range query.terms {
+		fields := []string{term.Field}
+		if term.Field == "" {
+			fields = []string{searchFieldSubject, searchFieldFrom, searchFieldTo, searchFieldBody}
+		}
+
+		matched := make(map[string]float64)
+		for _, field := range fields {
+			postings := terms.Terms[field+":"+term.Term]
+			idf := math.Log(1 + total/float64(len(postings)+1))
+			for messageID, count := range postings {
+				matched[messageID] += searchFieldWeights[field] * (1 + math.Log(float64(count))) * idf
+			}
+		}
+
+		// every term has to match so anything without this one is out
+		for messageID := range scores {
+			score, ok := matched[messageID]
+			if !ok {
+				delete(scores, messageID)
+				continue
+			}
+			scores[messageID] += score
+		}
+	}
+
+	for i := range index.Emails {
+		if _, ok := scores[index.Emails[i].MessageID]; ok {
+			ret = append(ret, index.Emails[i])
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		a, b := scores[ret[i].MessageID], scores[ret[j].MessageID]
+		if a != b {
+			return a > b
+		}
+		return ret[i].Date.After(ret[j].Date)
+	})
+
+	if query.Limit > 0 && len(ret) > query.Limit {
+		ret = ret[:query.Limit]
+	}
+
+	return ret, nil
+}
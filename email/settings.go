@@ -0,0 +1,164 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+)
+
+// settingsLock serializes changes to the user settings within this process
+var settingsLock sync.Mutex
+
+// ErrInvalidSender is returned for allowlist entries that aren't an address or a domain
+var ErrInvalidSender = errors.New("invalid sender")
+
+// Settings are the preferences of a user that change how their mail is handled
+type Settings struct {
+	// RemoteImageSenders are the addresses, or whole domains, remote images are loaded for
+	RemoteImageSenders []string
+	// Retention rules delete mail that has been in a folder for longer than the rule allows
+	Retention []RetentionRule
+	// Subaddressing decides what happens to mail sent to the user with a tag
+	Subaddressing SubaddressSettings
+	// Triage decides what happens to mail that fails the spam, virus, SPF, DKIM or DMARC checks of SES
+	Triage TriageSettings
+}
+
+// settingsKey is the key of the user's settings
+func settingsKey(mailboxPrefix, userID string) string {
+	return userPrefix(mailboxPrefix, userID) + "_settings.json"
+}
+
+// LoadSettings of the user, users that never changed anything get the defaults
+func LoadSettings(ctx context.Context, store MailStore, mailboxPrefix, userID string) (Settings, error) {
+	settings := Settings{
+		RemoteImageSenders: []string{},
+		Retention:          []RetentionRule{},
+		Subaddressing: SubaddressSettings{
+			Blocked: []string{},
+		},
+		Triage: defaultTriage,
+	}
+
+	buf, err := store.Get(ctx, settingsKey(mailboxPrefix, userID))
+	if err == ErrNotFound {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+
+	err = json.Unmarshal(buf, &settings)
+	if err != nil {
+		return settings, err
+	}
+	if settings.RemoteImageSenders == nil {
+		settings.RemoteImageSenders = []string{}
+	}
+	if settings.Retention == nil {
+		settings.Retention = []RetentionRule{}
+	}
+	if settings.Subaddressing.Blocked == nil {
+		settings.Subaddressing.Blocked = []string{}
+	}
+	settings.Triage = settings.Triage.withDefaults()
+
+	return settings, nil
+}
+
+// updateSettings loads the settings, applies fn to them and writes them back
+func updateSettings(ctx context.Context, store MailStore, mailboxPrefix, userID string, fn func(*Settings) error) (Settings, error) {
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+
+	settings, err := LoadSettings(ctx, store, mailboxPrefix, userID)
+	if err != nil {
+		return settings, err
+	}
+
+	err = fn(&settings)
+	if err != nil {
+		return settings, err
+	}
+
+	buf, err := json.Marshal(settings)
+	if err != nil {
+		return settings, err
+	}
+
+	return settings, store.Put(ctx, settingsKey(mailboxPrefix, userID), buf, "application/json")
+}
+
+// canonicalSender lower cases an address, or a domain with or without a leading "@"
+func canonicalSender(sender string) (string, error) {
+	sender = strings.ToLower(strings.TrimSpace(sender))
+	if strings.Contains(strings.TrimPrefix(sender, "@"), "@") {
+		address, err := mail.ParseAddress(sender)
+		if err != nil {
+			return "", fmt.Errorf("%w: %q", ErrInvalidSender, sender)
+		}
+		return strings.ToLower(address.Address), nil
+	}
+
+	domain := strings.TrimPrefix(sender, "@")
+	if domain == "" || strings.ContainsAny(domain, " \t<>,;:\"") || !strings.Contains(domain, ".") {
+		return "", fmt.Errorf("%w: %q", ErrInvalidSender, sender)
+	}
+
+	return domain, nil
+}
+
+// AllowRemoteImages from the sender, which is an address or a domain
+func AllowRemoteImages(ctx context.Context, store MailStore, mailboxPrefix, userID, sender string) (Settings, error) {
+	sender, err := canonicalSender(sender)
+	if err != nil {
+		return Settings{}, err
+	}
+
+	return updateSettings(ctx, store, mailboxPrefix, userID, func(settings *Settings) error {
+		if !containsString(settings.RemoteImageSenders, sender) {
+			settings.RemoteImageSenders = append(settings.RemoteImageSenders, sender)
+		}
+		return nil
+	})
+}
+
+// BlockRemoteImages from the sender again, returns ErrNotFound if it wasn't allowed
+func BlockRemoteImages(ctx context.Context, store MailStore, mailboxPrefix, userID, sender string) (Settings, error) {
+	sender, err := canonicalSender(sender)
+	if err != nil {
+		return Settings{}, err
+	}
+
+	return updateSettings(ctx, store, mailboxPrefix, userID, func(settings *Settings) error {
+		kept := []string{}
+		for _, allowed := range settings.RemoteImageSenders {
+			if allowed != sender {
+				kept = append(kept, allowed)
+			}
+		}
+		if len(kept) == len(settings.RemoteImageSenders) {
+			return ErrNotFound
+		}
+		settings.RemoteImageSenders = kept
+
+		return nil
+	})
+}
+
+// remoteImagesAllowed reports if the address, or its domain, is on the allowlist
+func (s Settings) remoteImagesAllowed(address string) bool {
+	address = strings.ToLower(address)
+	domain := address[strings.LastIndex(address, "@")+1:]
+	for _, allowed := range s.RemoteImageSenders {
+		if allowed == address || allowed == domain {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,892 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidSieve is returned for scripts that aren't valid Sieve, the error has the line of the problem
+var ErrInvalidSieve = errors.New("invalid sieve script")
+
+// maxSieveSize is the largest script a user can upload
+const maxSieveSize = 64 << 10
+
+// sieveCapabilities are the extensions a script can require, on top of the commands of RFC 5228
+var sieveCapabilities = []string{
+	"fileinto",
+	"reject",
+	"envelope",
+	"imap4flags",
+	"vacation",
+	"comparator-i;octet",
+	"comparator-i;ascii-casemap",
+}
+
+// sieveError is an ErrInvalidSieve for the line
+func sieveError(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: line %d: %s", ErrInvalidSieve, line, fmt.Sprintf(format, args...))
+}
+
+const (
+	tokenIdentifier = iota
+	tokenTag
+	tokenNumber
+	tokenString
+	tokenSymbol
+	tokenEOF
+)
+
+// sieveToken is one lexical token of a script
+type sieveToken struct {
+	kind   int
+	text   string
+	number int64
+	line   int
+}
+
+// describe the token for error messages
+func (t sieveToken) describe() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of script"
+	case tokenString:
+		return "string"
+	case tokenNumber:
+		return "number " + strconv.FormatInt(t.number, 10)
+	case tokenTag:
+		return ":" + t.text
+	}
+
+	return strconv.Quote(t.text)
+}
+
+// sieveLexer splits a script into tokens (RFC 5228 section 8.1)
+type sieveLexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+// skip the white space and comments before the next token
+func (l *sieveLexer) skip() error {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			start := l.line
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return sieveError(start, "unterminated comment")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// next token of the script
+func (l *sieveLexer) next() (sieveToken, error) {
+	err := l.skip()
+	if err != nil {
+		return sieveToken{}, err
+	}
+	if l.pos >= len(l.src) {
+		return sieveToken{kind: tokenEOF, line: l.line}, nil
+	}
+
+	line := l.line
+	c := l.src[l.pos]
+	switch {
+	case strings.IndexByte("[](){},;", c) >= 0:
+		l.pos++
+		return sieveToken{kind: tokenSymbol, text: string(c), line: line}, nil
+	case c == '"':
+		return l.quoted()
+	case c == ':':
+		l.pos++
+		name := l.identifier()
+		if name == "" {
+			return sieveToken{}, sieveError(line, "expected a tag name after \":\"")
+		}
+		return sieveToken{kind: tokenTag, text: strings.ToLower(name), line: line}, nil
+	case c >= '0' && c <= '9':
+		return l.number()
+	case isSieveAlpha(c):
+		name := l.identifier()
+		if strings.EqualFold(name, "text") && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			return l.multiline(line)
+		}
+		return sieveToken{kind: tokenIdentifier, text: strings.ToLower(name), line: line}, nil
+	}
+
+	return sieveToken{}, sieveError(line, "unexpected character %q", c)
+}
+
+func isSieveAlpha(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// identifier at the current position, empty if there isn't one
+func (l *sieveLexer) identifier() string {
+	start := l.pos
+	for l.pos < len(l.src) && (isSieveAlpha(l.src[l.pos]) || (l.pos > start && l.src[l.pos] >= '0' && l.src[l.pos] <= '9')) {
+		l.pos++
+	}
+
+	return l.src[start:l.pos]
+}
+
+// number with an optional K, M or G quantifier
+func (l *sieveLexer) number() (sieveToken, error) {
+	line := l.line
+	start := l.pos
+	for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+		l.pos++
+	}
+	n, err := strconv.ParseInt(l.src[start:l.pos], 10, 64)
+	if err != nil {
+		return sieveToken{}, sieveError(line, "number %s is too large", l.src[start:l.pos])
+	}
+
+	if l.pos < len(l.src) {
+		shift := map[byte]uint{'k': 10, 'K': 10, 'm': 20, 'M': 20, 'g': 30, 'G': 30}[l.src[l.pos]]
+		if shift > 0 {
+			l.pos++
+			if n > (1<<63-1)>>shift {
+				return sieveToken{}, sieveError(line, "number %s is too large", l.src[start:l.pos])
+			}
+			n <<= shift
+		}
+	}
+
+	return sieveToken{kind: tokenNumber, number: n, line: line}, nil
+}
+
+// quoted string, a backslash escapes the character after it
+func (l *sieveLexer) quoted() (sieveToken, error) {
+	line := l.line
+	var b strings.Builder
+
+	for l.pos++; l.pos < len(l.src); l.pos++ {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return sieveToken{kind: tokenString, text: b.String(), line: line}, nil
+		case '\\':
+			l.pos++
+			if l.pos >= len(l.src) {
+				continue
+			}
+			c = l.src[l.pos]
+		}
+		if c == '\n' {
+			l.line++
+		}
+		b.WriteByte(c)
+	}
+
+	return sieveToken{}, sieveError(line, "unterminated string")
+}
+
+// multiline string after text:, it ends at a line with a single "." and leading dots are doubled
+func (l *sieveLexer) multiline(line int) (sieveToken, error) {
+	// the rest of the line can only hold white space and a comment
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '#' {
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos >= len(l.src) || l.src[l.pos] != '\n' {
+		return sieveToken{}, sieveError(line, "expected a new line after text:")
+	}
+	l.pos++
+	l.line++
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		if end < 0 {
+			end = len(l.src) - l.pos
+		}
+		text := strings.TrimSuffix(l.src[l.pos:l.pos+end], "\r")
+		l.pos += end + 1
+		l.line++
+
+		if text == "." {
+			return sieveToken{kind: tokenString, text: b.String(), line: line}, nil
+		}
+		b.WriteString(strings.TrimPrefix(text, "."))
+		b.WriteString("\r\n")
+	}
+
+	return sieveToken{}, sieveError(line, "unterminated text: string, it ends with a line holding a single \".\"")
+}
+
+// the kinds of argument, the zero value is none so a missing tag doesn't look like one
+const (
+	argTag = iota + 1
+	argNumber
+	argString
+	argStringList
+)
+
+// sieveArg is a tag, a number, a string or a string list passed to a command or test
+type sieveArg struct {
+	kind    int
+	tag     string
+	number  int64
+	strings []string
+	line    int
+}
+
+// describe the argument for error messages
+func (a sieveArg) describe() string {
+	switch a.kind {
+	case argTag:
+		return ":" + a.tag
+	case argNumber:
+		return "a number"
+	case argString:
+		return "a string"
+	}
+
+	return "a string list"
+}
+
+// sieveTest is a test of an if or elsif, not, allof and anyof hold other tests
+type sieveTest struct {
+	name  string
+	args  []sieveArg
+	tests []sieveTest
+	line  int
+
+	// tags and positional are the arguments sorted out by sieveChecker.args
+	tags       map[string]sieveArg
+	positional []sieveArg
+}
+
+// sieveCommand is a command of a script, with the test of an if or elsif and the commands of its block
+type sieveCommand struct {
+	name  string
+	args  []sieveArg
+	tests []sieveTest
+	block []sieveCommand
+	// hasBlock is set for commands followed by a block rather than a ";"
+	hasBlock bool
+	line     int
+
+	// tags and positional are the arguments sorted out by sieveChecker.args
+	tags       map[string]sieveArg
+	positional []sieveArg
+}
+
+// sieveParser builds the commands of a script out of its tokens (RFC 5228 section 8.2)
+type sieveParser struct {
+	lexer sieveLexer
+	token sieveToken
+}
+
+// advance to the next token
+func (p *sieveParser) advance() error {
+	token, err := p.lexer.next()
+	p.token = token
+
+	return err
+}
+
+// isSymbol reports if the current token is the symbol
+func (p *sieveParser) isSymbol(symbol string) bool {
+	return p.token.kind == tokenSymbol && p.token.text == symbol
+}
+
+// expect the symbol and move past it
+func (p *sieveParser) expect(symbol string) error {
+	if !p.isSymbol(symbol) {
+		return sieveError(p.token.line, "expected %q, found %s", symbol, p.token.describe())
+	}
+
+	return p.advance()
+}
+
+// commands until the end of the block or script
+func (p *sieveParser) commands() ([]sieveCommand, error) {
+	commands := []sieveCommand{}
+	for p.token.kind != tokenEOF && !p.isSymbol("}") {
+		command, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, command)
+	}
+
+	return commands, nil
+}
+
+// command = identifier arguments (";" / block)
+func (p *sieveParser) command() (sieveCommand, error) {
+	if p.token.kind != tokenIdentifier {
+		return sieveCommand{}, sieveError(p.token.line, "expected a command, found %s", p.token.describe())
+	}
+	command := sieveCommand{
+		name: p.token.text,
+		line: p.token.line,
+	}
+	err := p.advance()
+	if err != nil {
+		return command, err
+	}
+
+	command.args, command.tests, err = p.arguments()
+	if err != nil {
+		return command, err
+	}
+
+	if p.isSymbol("{") {
+		err = p.advance()
+		if err != nil {
+			return command, err
+		}
+		command.hasBlock = true
+		command.block, err = p.commands()
+		if err != nil {
+			return command, err
+		}
+
+		return command, p.expect("}")
+	}
+
+	if !p.isSymbol(";") {
+		return command, sieveError(p.token.line, "expected \";\" after %s, found %s", command.name, p.token.describe())
+	}
+
+	return command, p.advance()
+}
+
+// arguments = *argument [ test / test-list ]
+func (p *sieveParser) arguments() ([]sieveArg, []sieveTest, error) {
+	args := []sieveArg{}
+	for {
+		switch {
+		case p.token.kind == tokenTag:
+			args = append(args, sieveArg{kind: argTag, tag: p.token.text, line: p.token.line})
+		case p.token.kind == tokenNumber:
+			args = append(args, sieveArg{kind: argNumber, number: p.token.number, line: p.token.line})
+		case p.token.kind == tokenString:
+			args = append(args, sieveArg{kind: argString, strings: []string{p.token.text}, line: p.token.line})
+		case p.isSymbol("["):
+			list, err := p.stringList()
+			if err != nil {
+				return nil, nil, err
+			}
+			args = append(args, list)
+			continue
+		case p.isSymbol("("):
+			tests, err := p.testList()
+			return args, tests, err
+		case p.token.kind == tokenIdentifier:
+			test, err := p.test()
+			return args, []sieveTest{test}, err
+		default:
+			return args, nil, nil
+		}
+
+		err := p.advance()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// string-list = "[" string *("," string) "]"
+func (p *sieveParser) stringList() (sieveArg, error) {
+	list := sieveArg{kind: argStringList, strings: []string{}, line: p.token.line}
+	err := p.advance()
+	if err != nil {
+		return list, err
+	}
+
+	for {
+		if p.token.kind != tokenString {
+			return list, sieveError(p.token.line, "expected a string in the list, found %s", p.token.describe())
+		}
+		list.strings = append(list.strings, p.token.text)
+		err = p.advance()
+		if err != nil {
+			return list, err
+		}
+
+		if p.isSymbol("]") {
+			return list, p.advance()
+		}
+		err = p.expect(",")
+		if err != nil {
+			return list, err
+		}
+	}
+}
+
+// test-list = "(" test *("," test) ")"
+func (p *sieveParser) testList() ([]sieveTest, error) {
+	tests := []sieveTest{}
+	err := p.advance()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		test, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+
+		if p.isSymbol(")") {
+			return tests, p.advance()
+		}
+		err = p.expect(",")
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// test = identifier arguments
+func (p *sieveParser) test() (sieveTest, error) {
+	if p.token.kind != tokenIdentifier {
+		return sieveTest{}, sieveError(p.token.line, "expected a test, found %s", p.token.describe())
+	}
+	test := sieveTest{
+		name: p.token.text,
+		line: p.token.line,
+	}
+	err := p.advance()
+	if err != nil {
+		return test, err
+	}
+
+	test.args, test.tests, err = p.arguments()
+
+	return test, err
+}
+
+// sieveSpec is the arguments a command or test takes
+type sieveSpec struct {
+	// capability has to be required before the command or test is used, empty for the core ones
+	capability string
+	// tags the command takes and the kind of value that follows them, -1 for tags without one
+	tags map[string]int
+	// exclusive are groups of tags only one of which can be used
+	exclusive [][]string
+	// positional are the kinds of the arguments after the tags
+	positional []int
+	// tests is how many tests follow, -1 for a test list
+	tests int
+}
+
+// the comparator, match type and address part tags of the tests that compare strings
+var (
+	comparatorTags   = map[string]int{"comparator": argString, "is": -1, "contains": -1, "matches": -1}
+	addressTags      = map[string]int{"comparator": argString, "is": -1, "contains": -1, "matches": -1, "all": -1, "localpart": -1, "domain": -1}
+	matchExclusive   = [][]string{{"is", "contains", "matches"}}
+	addressExclusive = [][]string{{"is", "contains", "matches"}, {"all", "localpart", "domain"}}
+)
+
+// sieveCommands are the commands a script can use
+var sieveCommands = map[string]sieveSpec{
+	"require": {positional: []int{argStringList}},
+	"stop":    {},
+	"keep":    {},
+	"discard": {},
+	"redirect": {
+		positional: []int{argString},
+	},
+	"fileinto": {
+		capability: "fileinto",
+		tags:       map[string]int{"flags": argStringList},
+		positional: []int{argString},
+	},
+	"reject": {
+		capability: "reject",
+		positional: []int{argString},
+	},
+	"setflag":    {capability: "imap4flags", positional: []int{argStringList}},
+	"addflag":    {capability: "imap4flags", positional: []int{argStringList}},
+	"removeflag": {capability: "imap4flags", positional: []int{argStringList}},
+	"vacation": {
+		capability: "vacation",
+		tags: map[string]int{
+			"days":      argNumber,
+			"subject":   argString,
+			"from":      argString,
+			"addresses": argStringList,
+			"mime":      -1,
+			"handle":    argString,
+		},
+		positional: []int{argString},
+	},
+}
+
+// sieveTests are the tests a script can use
+var sieveTests = map[string]sieveSpec{
+	"address": {
+		tags:       addressTags,
+		exclusive:  addressExclusive,
+		positional: []int{argStringList, argStringList},
+	},
+	"envelope": {
+		capability: "envelope",
+		tags:       addressTags,
+		exclusive:  addressExclusive,
+		positional: []int{argStringList, argStringList},
+	},
+	"header": {
+		tags:       comparatorTags,
+		exclusive:  matchExclusive,
+		positional: []int{argStringList, argStringList},
+	},
+	"hasflag": {
+		capability: "imap4flags",
+		tags:       comparatorTags,
+		exclusive:  matchExclusive,
+		positional: []int{argStringList},
+	},
+	"exists": {positional: []int{argStringList}},
+	"size": {
+		tags:       map[string]int{"over": -1, "under": -1},
+		exclusive:  [][]string{{"over", "under"}},
+		positional: []int{argNumber},
+	},
+	"true":  {},
+	"false": {},
+	"not":   {tests: 1},
+	"allof": {tests: -1},
+	"anyof": {tests: -1},
+}
+
+// sieveScript is a parsed and checked script
+type sieveScript struct {
+	commands []sieveCommand
+}
+
+// parseSieve parses the script and checks every command and test in it, the error is an
+// ErrInvalidSieve with the line of the first problem
+func parseSieve(script string) (sieveScript, error) {
+	return parseSieveFor(script, nil)
+}
+
+// parseSieveFor parses and checks the script of a user, owns reports if the user can send
+// vacation replies from the address. Without it any address is accepted.
+func parseSieveFor(script string, owns func(address string) (bool, error)) (sieveScript, error) {
+	if len(script) > maxSieveSize {
+		return sieveScript{}, fmt.Errorf("%w: the script is larger than %s", ErrInvalidSieve, formatSize(maxSieveSize))
+	}
+
+	p := sieveParser{lexer: sieveLexer{src: script, line: 1}}
+	err := p.advance()
+	if err != nil {
+		return sieveScript{}, err
+	}
+
+	commands, err := p.commands()
+	if err != nil {
+		return sieveScript{}, err
+	}
+	if p.token.kind != tokenEOF {
+		return sieveScript{}, sieveError(p.token.line, "unexpected \"}\"")
+	}
+
+	c := sieveChecker{required: []string{}, owns: owns}
+	err = c.commands(commands, true)
+	if err != nil {
+		return sieveScript{}, err
+	}
+
+	return sieveScript{commands: commands}, nil
+}
+
+// sieveChecker checks the commands of a script against their specs
+type sieveChecker struct {
+	// required are the capabilities the script required
+	required []string
+	// owns reports if the user can send from the address, nil when any address will do
+	owns func(address string) (bool, error)
+}
+
+// commands of a block, top is set for the commands of the script itself
+func (c *sieveChecker) commands(commands []sieveCommand, top bool) error {
+	previous := ""
+	for i := range commands {
+		command := &commands[i]
+
+		switch command.name {
+		case "require":
+			if !top || (previous != "" && previous != "require") {
+				return sieveError(command.line, "require has to come before any other command")
+			}
+		case "if":
+			if len(command.tests) != 1 || !command.hasBlock {
+				return sieveError(command.line, "if takes a test and a block")
+			}
+		case "elsif", "else":
+			if previous != "if" && previous != "elsif" {
+				return sieveError(command.line, "%s has to follow if or elsif", command.name)
+			}
+			if command.name == "elsif" && len(command.tests) != 1 {
+				return sieveError(command.line, "elsif takes a test and a block")
+			}
+			if command.name == "else" && len(command.tests) != 0 {
+				return sieveError(command.line, "else takes no test")
+			}
+			if !command.hasBlock || len(command.args) > 0 {
+				return sieveError(command.line, "%s takes a block", command.name)
+			}
+		}
+		previous = command.name
+
+		if command.name == "if" || command.name == "elsif" || command.name == "else" {
+			for j := range command.tests {
+				err := c.test(&command.tests[j])
+				if err != nil {
+					return err
+				}
+			}
+			err := c.commands(command.block, false)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		spec, ok := sieveCommands[command.name]
+		if !ok {
+			return sieveError(command.line, "unknown command %q", command.name)
+		}
+		if command.hasBlock {
+			return sieveError(command.line, "%s doesn't take a block", command.name)
+		}
+		if len(command.tests) > 0 {
+			return sieveError(command.line, "%s doesn't take a test", command.name)
+		}
+
+		var err error
+		command.tags, command.positional, err = c.args(command.name, command.line, spec, command.args)
+		if err != nil {
+			return err
+		}
+
+		err = c.command(command)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// command checks the values of the arguments of the command
+func (c *sieveChecker) command(command *sieveCommand) error {
+	switch command.name {
+	case "require":
+		for _, capability := range command.positional[0].strings {
+			if !containsString(sieveCapabilities, capability) {
+				return sieveError(command.line, "unsupported capability %q", capability)
+			}
+			c.required = append(c.required, capability)
+		}
+	case "redirect":
+		_, err := parseRedirect(command.positional[0].strings[0])
+		if err != nil {
+			return sieveError(command.line, "redirect to %q, it isn't an address", command.positional[0].strings[0])
+		}
+	case "fileinto":
+		_, err := canonicalFolder(command.positional[0].strings[0])
+		if err != nil {
+			return sieveError(command.line, "%s", err)
+		}
+		if flags, ok := command.tags["flags"]; ok {
+			return c.flags(flags)
+		}
+	case "setflag", "addflag", "removeflag":
+		return c.flags(command.positional[0])
+	case "vacation":
+		if days, ok := command.tags["days"]; ok && days.number < 1 {
+			return sieveError(days.line, ":days has to be at least 1")
+		}
+		if from, ok := command.tags["from"]; ok {
+			_, err := parseRedirect(from.strings[0])
+			if err != nil {
+				return sieveError(from.line, ":from %q isn't an address", from.strings[0])
+			}
+			if c.owns == nil {
+				return nil
+			}
+			owned, err := c.owns(from.strings[0])
+			if err != nil {
+				return err
+			}
+			if !owned {
+				return sieveError(from.line, ":from %q isn't one of your addresses", from.strings[0])
+			}
+		}
+	}
+
+	return nil
+}
+
+// flags checks every flag of the list is one of the IMAP system flags
+func (c *sieveChecker) flags(list sieveArg) error {
+	for _, value := range list.strings {
+		for _, flag := range strings.Fields(value) {
+			_, err := canonicalFlag(flag)
+			if err != nil {
+				return sieveError(list.line, "%s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// test checks the test and the tests inside it
+func (c *sieveChecker) test(test *sieveTest) error {
+	spec, ok := sieveTests[test.name]
+	if !ok {
+		return sieveError(test.line, "unknown test %q", test.name)
+	}
+
+	switch {
+	case spec.tests == 0 && len(test.tests) > 0:
+		return sieveError(test.line, "%s doesn't take a test", test.name)
+	case spec.tests == 1 && len(test.tests) != 1:
+		return sieveError(test.line, "%s takes one test", test.name)
+	case spec.tests == -1 && len(test.tests) == 0:
+		return sieveError(test.line, "%s takes a list of tests", test.name)
+	}
+
+	var err error
+	test.tags, test.positional, err = c.args(test.name, test.line, spec, test.args)
+	if err != nil {
+		return err
+	}
+
+	switch test.name {
+	case "size":
+		if len(test.tags) == 0 {
+			return sieveError(test.line, "size takes :over or :under")
+		}
+	case "envelope":
+		for _, part := range test.positional[0].strings {
+			if part = strings.ToLower(part); part != "from" && part != "to" {
+				return sieveError(test.line, "unsupported envelope part %q, use \"from\" or \"to\"", part)
+			}
+		}
+	case "hasflag":
+		err = c.flags(test.positional[0])
+		if err != nil {
+			return err
+		}
+	}
+	if comparator, ok := test.tags["comparator"]; ok {
+		name := comparator.strings[0]
+		if name != "i;octet" && name != "i;ascii-casemap" {
+			return sieveError(comparator.line, "unsupported comparator %q", name)
+		}
+	}
+
+	for i := range test.tests {
+		err = c.test(&test.tests[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// args sorts the arguments into tags and positional ones and checks them against the spec
+func (c *sieveChecker) args(name string, line int, spec sieveSpec, args []sieveArg) (map[string]sieveArg, []sieveArg, error) {
+	if spec.capability != "" && !containsString(c.required, spec.capability) {
+		return nil, nil, sieveError(line, "%s needs require %q", name, spec.capability)
+	}
+
+	tags := make(map[string]sieveArg)
+	positional := []sieveArg{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg.kind != argTag {
+			positional = append(positional, arg)
+			continue
+		}
+		if len(positional) > 0 {
+			return nil, nil, sieveError(arg.line, "%s: tag :%s has to come before the other arguments", name, arg.tag)
+		}
+
+		kind, ok := spec.tags[arg.tag]
+		if !ok {
+			return nil, nil, sieveError(arg.line, "%s doesn't take :%s", name, arg.tag)
+		}
+		if _, ok := tags[arg.tag]; ok {
+			return nil, nil, sieveError(arg.line, "%s: :%s is used more than once", name, arg.tag)
+		}
+		for _, group := range spec.exclusive {
+			if !containsString(group, arg.tag) {
+				continue
+			}
+			for _, other := range group {
+				if _, ok := tags[other]; ok {
+					return nil, nil, sieveError(arg.line, "%s: :%s can't be used with :%s", name, arg.tag, other)
+				}
+			}
+		}
+
+		// tags like :days are followed by their value, the others stand on their own
+		value := arg
+		if kind >= 0 {
+			i++
+			if i >= len(args) || !sieveArgFits(args[i], kind) {
+				return nil, nil, sieveError(arg.line, "%s: :%s takes %s", name, arg.tag, sieveArg{kind: kind}.describe())
+			}
+			value = args[i]
+		}
+		tags[arg.tag] = value
+	}
+
+	if len(positional) != len(spec.positional) {
+		return nil, nil, sieveError(line, "%s takes %d arguments, found %d", name, len(spec.positional), len(positional))
+	}
+	for i, kind := range spec.positional {
+		if !sieveArgFits(positional[i], kind) {
+			return nil, nil, sieveError(positional[i].line, "%s: argument %d has to be %s, found %s", name, i+1, sieveArg{kind: kind}.describe(), positional[i].describe())
+		}
+	}
+
+	return tags, positional, nil
+}
+
+// sieveArgFits reports if the argument can be used where the kind is expected, a single
+// string is a string list of one
+func sieveArgFits(arg sieveArg, kind int) bool {
+	return arg.kind == kind || (kind == argStringList && arg.kind == argString)
+}
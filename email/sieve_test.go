@@ -0,0 +1,148 @@
+package email
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSieve(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		script  string
+		wantErr string
+	}{
+		{"empty", "", ""},
+		{"keep", "keep;", ""},
+		{"string list", `require ["fileinto", "reject"]; if header :contains "subject" ["a", "b"] { fileinto "Work"; }`, ""},
+		{"hash comment", "# file the lists\nkeep; # and keep\n", ""},
+		{"bracket comment", "/* one\ntwo */ keep;", ""},
+		{"line after a comment", "/* one\ntwo */\nbogus;", `invalid sieve script: line 3: unknown command "bogus"`},
+		{"unterminated comment", "keep;\n/* one", "invalid sieve script: line 2: unterminated comment"},
+		{"multiline", "require \"vacation\";\nvacation text: # the reply\nAway\n.\n;", ""},
+		{"unterminated multiline", "require \"vacation\";\nvacation text:\nAway\n", `invalid sieve script: line 2: unterminated text: string, it ends with a line holding a single "."`},
+		{"text without a new line", "require \"vacation\";\nvacation text: Away\n.\n;", "invalid sieve script: line 2: expected a new line after text:"},
+		{"unterminated string", `fileinto "Work;`, "invalid sieve script: line 1: unterminated string"},
+		{"missing require", `fileinto "Work";`, `invalid sieve script: line 1: fileinto needs require "fileinto"`},
+		{"missing require in a test", `if envelope "from" "a@example.com" { keep; }`, `invalid sieve script: line 1: envelope needs require "envelope"`},
+		{"unsupported capability", `require "variables";`, `invalid sieve script: line 1: unsupported capability "variables"`},
+		{"require after a command", "keep;\nrequire \"fileinto\";", "invalid sieve script: line 2: require has to come before any other command"},
+		{"require in a block", "if true {\nrequire \"fileinto\";\n}", "invalid sieve script: line 2: require has to come before any other command"},
+		{"else without if", "else { keep; }", "invalid sieve script: line 1: else has to follow if or elsif"},
+		{"invalid folder", "require \"fileinto\";\nfileinto \"_system\";", `invalid sieve script: line 2: invalid folder name: "_system"`},
+		{"invalid redirect", `redirect "not an address";`, `invalid sieve script: line 1: redirect to "not an address", it isn't an address`},
+		{"invalid flag", "require \"imap4flags\";\naddflag \"\\\\Bogus\";", `invalid sieve script: line 2: invalid flag: "\\Bogus"`},
+		{"exclusive tags", `if header :is :contains "subject" "a" { keep; }`, "invalid sieve script: line 1: header: :contains can't be used with :is"},
+		{"unsupported comparator", `if header :comparator "i;unicode" "subject" "a" { keep; }`, `invalid sieve script: line 1: unsupported comparator "i;unicode"`},
+		{"wrong arguments", `redirect;`, "invalid sieve script: line 1: redirect takes 1 arguments, found 0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseSieve(tc.script)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tc.wantErr {
+				t.Errorf("parseSieve = %q, want %q", got, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseSieveArguments(t *testing.T) {
+	script, err := parseSieve("require [\"fileinto\", \"vacation\"];\n" +
+		"if header :contains [\"from\", \"sender\"] [\"list\", \"news\"] {\n" +
+		"  fileinto \"News\";\n" +
+		"}\n" +
+		"vacation :days 3 text:\n" +
+		"Away until Monday\n" +
+		"..with a leading dot\n" +
+		".\n" +
+		";\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"fileinto", "vacation"}; !reflect.DeepEqual(script.commands[0].positional[0].strings, want) {
+		t.Errorf("require = %v, want %v", script.commands[0].positional[0].strings, want)
+	}
+
+	test := script.commands[1].tests[0]
+	if want := []string{"from", "sender"}; !reflect.DeepEqual(test.positional[0].strings, want) {
+		t.Errorf("header names = %v, want %v", test.positional[0].strings, want)
+	}
+	if want := []string{"list", "news"}; !reflect.DeepEqual(test.positional[1].strings, want) {
+		t.Errorf("header keys = %v, want %v", test.positional[1].strings, want)
+	}
+	if folder := script.commands[1].block[0].positional[0].strings[0]; folder != "News" {
+		t.Errorf("fileinto = %q, want %q", folder, "News")
+	}
+
+	vacation := script.commands[2]
+	if vacation.line != 5 || vacation.tags["days"].number != 3 {
+		t.Errorf("vacation is on line %d with :days %d", vacation.line, vacation.tags["days"].number)
+	}
+	if reason, want := vacation.positional[0].strings[0], "Away until Monday\r\n.with a leading dot\r\n"; reason != want {
+		t.Errorf("vacation reason = %q, want %q", reason, want)
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		value   string
+		want    bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"a*", "abc", true},
+		{"*c", "abc", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abcd", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"*@example.com", "alice@example.com", true},
+		{"*@example.com", "alice@example.org", false},
+		{"*a*b*", "xxaxxbxx", true},
+		{"*a*b", "xxbxxa", false},
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{`a\?`, "a?", true},
+		{`a\?`, "ab", false},
+		{"ü?", "üß", true},
+	} {
+		if got := wildcardMatch(tc.pattern, tc.value); got != tc.want {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", tc.pattern, tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestSieveMatch(t *testing.T) {
+	tag := sieveArg{kind: argTag}
+	octet := sieveArg{kind: argString, strings: []string{"i;octet"}}
+
+	for _, tc := range []struct {
+		name   string
+		tags   map[string]sieveArg
+		values []string
+		keys   []string
+		want   bool
+	}{
+		{"is", map[string]sieveArg{}, []string{"Lunch"}, []string{"lunch"}, true},
+		{"is a part", map[string]sieveArg{"is": tag}, []string{"Lunch on Friday"}, []string{"lunch"}, false},
+		{"is with octet", map[string]sieveArg{"comparator": octet}, []string{"Lunch"}, []string{"lunch"}, false},
+		{"contains", map[string]sieveArg{"contains": tag}, []string{"Lunch on Friday"}, []string{"FRIDAY"}, true},
+		{"contains with octet", map[string]sieveArg{"contains": tag, "comparator": octet}, []string{"Lunch on Friday"}, []string{"FRIDAY"}, false},
+		{"contains none", map[string]sieveArg{"contains": tag}, []string{"Lunch"}, []string{"dinner"}, false},
+		{"matches", map[string]sieveArg{"matches": tag}, []string{"[list] news"}, []string{"[LIST]*"}, true},
+		{"matches with octet", map[string]sieveArg{"matches": tag, "comparator": octet}, []string{"[list] news"}, []string{"[LIST]*"}, false},
+		{"any value and key", map[string]sieveArg{}, []string{"a", "b"}, []string{"c", "b"}, true},
+		{"no values", map[string]sieveArg{}, []string{}, []string{""}, false},
+		{"ascii only case map", map[string]sieveArg{}, []string{"Ü"}, []string{"ü"}, false},
+	} {
+		if got := sieveMatch(tc.tags, tc.values, tc.keys); got != tc.want {
+			t.Errorf("%s: sieveMatch(%v, %v) = %v, want %v", tc.name, tc.values, tc.keys, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,494 @@
+package email
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"sort"
+	"strings"
+)
+
+// maxSieveRedirects is how many addresses one script can redirect a message to
+const maxSieveRedirects = 4
+
+// defaultVacationDays is how long a sender waits for another vacation reply when the script doesn't set :days
+const defaultVacationDays = 7
+
+// SieveResult is what a user's Sieve script does with a message
+type SieveResult struct {
+	// Deliveries are the copies of the message stored in the mailbox
+	Deliveries []SieveDelivery
+	// Redirects are the addresses the message is forwarded to
+	Redirects []string
+	// Reject is the reason the message is returned to its sender with, empty when it isn't
+	Reject string
+	// Vacation is the reply sent to the sender, if one is due
+	Vacation *SieveVacation
+}
+
+// SieveDelivery is a copy of the message filed into a folder
+type SieveDelivery struct {
+	// Folder the copy is filed into, empty for where mail goes without a script, the Inbox or the folder of its tag
+	Folder string
+	// Flags are set on the copy
+	Flags []string
+}
+
+// SieveVacation is an automatic reply to the sender of a message
+type SieveVacation struct {
+	Reason  string
+	Subject string
+	From    string
+	// Days the sender won't get another reply with the same Handle for
+	Days int
+	// Handle tells vacations apart, when it is empty the reason, subject and from do
+	Handle string
+	// MIME is set when the Reason is a MIME entity with its own headers
+	MIME bool
+}
+
+// sieveMessage is the message, and its envelope, a script is run against
+type sieveMessage struct {
+	headers []Header
+	size    int
+	// from is the envelope sender, empty for bounces
+	from string
+	// to is the envelope recipient
+	to string
+	// addresses are the user's own, vacation only replies to mail sent to one of them
+	addresses []string
+}
+
+// sieveRun is the state of one run of a script
+type sieveRun struct {
+	msg    sieveMessage
+	result SieveResult
+	// flags are set on copies of the message filed without their own :flags
+	flags []string
+	// keep is the implicit keep, cancelled by fileinto, redirect, discard and reject
+	keep    bool
+	stopped bool
+}
+
+// run the script against the message
+func (s sieveScript) run(msg sieveMessage) (SieveResult, error) {
+	r := sieveRun{
+		msg:   msg,
+		flags: []string{},
+		keep:  true,
+		result: SieveResult{
+			Deliveries: []SieveDelivery{},
+			Redirects:  []string{},
+		},
+	}
+
+	err := r.commands(s.commands)
+	if err != nil {
+		return SieveResult{}, err
+	}
+
+	if r.keep {
+		r.deliver("", r.flags)
+	}
+	if r.result.Reject != "" && (len(r.result.Deliveries) > 0 || len(r.result.Redirects) > 0 || r.result.Vacation != nil) {
+		return SieveResult{}, fmt.Errorf("%w: reject can't be used with keep, fileinto, redirect or vacation", ErrSieveFailed)
+	}
+
+	return r.result, nil
+}
+
+// commands of a block, an if is followed by the elsif and else that go with it
+func (r *sieveRun) commands(commands []sieveCommand) error {
+	matched := false
+	for _, command := range commands {
+		if r.stopped {
+			return nil
+		}
+
+		switch command.name {
+		case "if", "elsif", "else":
+			if command.name == "if" {
+				matched = false
+			}
+			if matched {
+				continue
+			}
+			if command.name != "else" && !r.test(command.tests[0]) {
+				continue
+			}
+			matched = true
+
+			err := r.commands(command.block)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := r.command(command)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// command runs an action
+func (r *sieveRun) command(command sieveCommand) error {
+	switch command.name {
+	case "stop":
+		r.stopped = true
+	case "keep":
+		r.keep = false
+		r.deliver("", r.flags)
+	case "discard":
+		r.keep = false
+	case "fileinto":
+		r.keep = false
+		// the folder was checked with the script, it only fails here if the folder names changed since
+		folder, err := canonicalFolder(command.positional[0].strings[0])
+		if err != nil {
+			return fmt.Errorf("%w: line %d: %s", ErrSieveFailed, command.line, err)
+		}
+		flags := r.flags
+		if list, ok := command.tags["flags"]; ok {
+			flags = sieveFlags(list.strings)
+		}
+		r.deliver(folder, flags)
+	case "redirect":
+		r.keep = false
+		address, err := parseRedirect(command.positional[0].strings[0])
+		if err != nil {
+			return fmt.Errorf("%w: line %d: %s", ErrSieveFailed, command.line, err)
+		}
+		if containsString(r.result.Redirects, address) {
+			return nil
+		}
+		if len(r.result.Redirects) >= maxSieveRedirects {
+			return fmt.Errorf("%w: line %d: more than %d redirects", ErrSieveFailed, command.line, maxSieveRedirects)
+		}
+		r.result.Redirects = append(r.result.Redirects, address)
+	case "reject":
+		if r.result.Reject != "" {
+			return fmt.Errorf("%w: line %d: the message is already rejected", ErrSieveFailed, command.line)
+		}
+		r.keep = false
+		r.result.Reject = command.positional[0].strings[0]
+	case "setflag":
+		r.flags = sieveFlags(command.positional[0].strings)
+	case "addflag":
+		r.flags = sieveFlags(append(append([]string{}, r.flags...), command.positional[0].strings...))
+	case "removeflag":
+		remove := sieveFlags(command.positional[0].strings)
+		flags := []string{}
+		for _, flag := range r.flags {
+			if !hasFlag(remove, flag) {
+				flags = append(flags, flag)
+			}
+		}
+		r.flags = flags
+	case "vacation":
+		if r.result.Vacation != nil {
+			return fmt.Errorf("%w: line %d: vacation is used more than once", ErrSieveFailed, command.line)
+		}
+		r.vacation(command)
+	}
+
+	return nil
+}
+
+// deliver a copy of the message into the folder, a folder only gets one copy
+func (r *sieveRun) deliver(folder string, flags []string) {
+	for _, delivery := range r.result.Deliveries {
+		if delivery.Folder == folder {
+			return
+		}
+	}
+
+	r.result.Deliveries = append(r.result.Deliveries, SieveDelivery{
+		Folder: folder,
+		Flags:  append([]string{}, flags...),
+	})
+}
+
+// sieveFlags are the IMAP flags in the list, a string can hold several separated by spaces
+func sieveFlags(list []string) []string {
+	flags := []string{}
+	for _, value := range list {
+		for _, name := range strings.Fields(value) {
+			flag, err := canonicalFlag(name)
+			if err == nil && !hasFlag(flags, flag) {
+				flags = append(flags, flag)
+			}
+		}
+	}
+	sort.Strings(flags)
+
+	return flags
+}
+
+// vacation sets up the reply unless the message is one that must not be answered (RFC 5230 section 4.5)
+func (r *sieveRun) vacation(command sieveCommand) {
+	vacation := &SieveVacation{
+		Reason: command.positional[0].strings[0],
+		Days:   defaultVacationDays,
+		MIME:   command.tags["mime"].kind == argTag,
+	}
+	if days, ok := command.tags["days"]; ok {
+		vacation.Days = int(days.number)
+	}
+	if subject, ok := command.tags["subject"]; ok {
+		vacation.Subject = subject.strings[0]
+	}
+	if from, ok := command.tags["from"]; ok {
+		vacation.From = from.strings[0]
+	}
+	if handle, ok := command.tags["handle"]; ok {
+		vacation.Handle = handle.strings[0]
+	}
+
+	// bounces and mail from lists and robots don't get a reply
+	sender := strings.ToLower(r.msg.from)
+	local, _ := splitAddress(sender)
+	if sender == "" || local == "mailer-daemon" || local == "listserv" || local == "majordomo" ||
+		strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") {
+		return
+	}
+	for _, header := range r.msg.headers {
+		name := strings.ToLower(header.Name)
+		value := strings.ToLower(header.Value)
+		switch {
+		case name == "auto-submitted" && value != "no",
+			name == "precedence" && (value == "bulk" || value == "list" || value == "junk"),
+			strings.HasPrefix(name, "list-"):
+			return
+		}
+	}
+
+	// only mail sent to the user directly gets a reply, not mail they got through a list or as a Bcc
+	addresses := append([]string{}, r.msg.addresses...)
+	if list, ok := command.tags["addresses"]; ok {
+		addresses = append(addresses, list.strings...)
+	}
+	for _, name := range []string{"to", "cc", "bcc", "resent-to", "resent-cc", "resent-bcc"} {
+		for _, address := range r.headerAddresses(name) {
+			for _, own := range addresses {
+				if strings.EqualFold(address, own) {
+					r.result.Vacation = vacation
+					return
+				}
+			}
+		}
+	}
+}
+
+// test evaluates a test against the message
+func (r *sieveRun) test(test sieveTest) bool {
+	switch test.name {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "not":
+		return !r.test(test.tests[0])
+	case "allof":
+		for _, t := range test.tests {
+			if !r.test(t) {
+				return false
+			}
+		}
+		return true
+	case "anyof":
+		for _, t := range test.tests {
+			if r.test(t) {
+				return true
+			}
+		}
+		return false
+	case "exists":
+		for _, name := range test.positional[0].strings {
+			if len(r.headerValues(name)) == 0 {
+				return false
+			}
+		}
+		return true
+	case "size":
+		limit := test.positional[0].number
+		if _, ok := test.tags["over"]; ok {
+			return int64(r.msg.size) > limit
+		}
+		return int64(r.msg.size) < limit
+	case "header":
+		values := []string{}
+		for _, name := range test.positional[0].strings {
+			values = append(values, r.headerValues(name)...)
+		}
+		return sieveMatch(test.tags, values, test.positional[1].strings)
+	case "address":
+		values := []string{}
+		for _, name := range test.positional[0].strings {
+			for _, address := range r.headerAddresses(name) {
+				values = append(values, addressPart(test.tags, address))
+			}
+		}
+		return sieveMatch(test.tags, values, test.positional[1].strings)
+	case "envelope":
+		values := []string{}
+		for _, part := range test.positional[0].strings {
+			address := r.msg.to
+			if strings.EqualFold(part, "from") {
+				address = r.msg.from
+			}
+			values = append(values, addressPart(test.tags, address))
+		}
+		return sieveMatch(test.tags, values, test.positional[1].strings)
+	case "hasflag":
+		keys := test.positional[0].strings
+		if test.tags["contains"].kind != argTag && test.tags["matches"].kind != argTag {
+			// flags are compared whole, with or without their backslash
+			keys = sieveFlags(keys)
+		}
+		return sieveMatch(test.tags, r.flags, keys)
+	}
+
+	return false
+}
+
+// headerValues are the decoded values of every header field with the name
+func (r *sieveRun) headerValues(name string) []string {
+	decoder := new(mime.WordDecoder)
+	values := []string{}
+	for _, header := range r.msg.headers {
+		if !strings.EqualFold(header.Name, name) {
+			continue
+		}
+		value, err := decoder.DecodeHeader(header.Value)
+		if err != nil {
+			value = header.Value
+		}
+		values = append(values, value)
+	}
+
+	return values
+}
+
+// headerAddresses are the addresses in every header field with the name, fields that
+// can't be parsed are used as they are
+func (r *sieveRun) headerAddresses(name string) []string {
+	addresses := []string{}
+	for _, value := range r.headerValues(name) {
+		list, err := mail.ParseAddressList(value)
+		if err != nil {
+			addresses = append(addresses, strings.Trim(strings.TrimSpace(value), "<>"))
+			continue
+		}
+		for _, address := range list {
+			addresses = append(addresses, address.Address)
+		}
+	}
+
+	return addresses
+}
+
+// addressPart is the part of the address the :localpart or :domain tag asks for, the whole address otherwise
+func addressPart(tags map[string]sieveArg, address string) string {
+	local, domain := splitAddress(address)
+	if _, ok := tags["localpart"]; ok {
+		return local
+	}
+	if _, ok := tags["domain"]; ok {
+		return domain
+	}
+
+	return address
+}
+
+// sieveMatch reports if any of the values matches any of the keys with the match type and
+// comparator of the tags, :is and i;ascii-casemap by default
+func sieveMatch(tags map[string]sieveArg, values, keys []string) bool {
+	fold := true
+	if comparator, ok := tags["comparator"]; ok && comparator.strings[0] == "i;octet" {
+		fold = false
+	}
+
+	for _, value := range values {
+		for _, key := range keys {
+			v, k := value, key
+			if fold {
+				v, k = asciiLower(v), asciiLower(k)
+			}
+
+			var matched bool
+			switch {
+			case tags["contains"].kind == argTag:
+				matched = strings.Contains(v, k)
+			case tags["matches"].kind == argTag:
+				matched = wildcardMatch(k, v)
+			default:
+				matched = v == k
+			}
+			if matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// asciiLower lower cases the ASCII letters only, as the i;ascii-casemap comparator does
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+
+	return string(b)
+}
+
+// wildcardMatch matches the value against a :matches pattern, * is any number of characters,
+// ? is one and a backslash escapes the character after it
+func wildcardMatch(pattern, value string) bool {
+	p := []rune(pattern)
+	v := []rune(value)
+
+	// the position in the pattern after the last *, and the value position it was tried at
+	star, retry := -1, 0
+	i, j := 0, 0
+	for j < len(v) {
+		if i < len(p) {
+			switch c := p[i]; {
+			case c == '*':
+				star, retry = i+1, j
+				i++
+				continue
+			case c == '?':
+				i++
+				j++
+				continue
+			case c == '\\' && i+1 < len(p) && p[i+1] == v[j]:
+				i += 2
+				j++
+				continue
+			case c != '\\' && c == v[j]:
+				i++
+				j++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		retry++
+		i, j = star, retry
+	}
+
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+
+	return i == len(p)
+}
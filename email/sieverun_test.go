@@ -0,0 +1,335 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testMailer records the mail it is asked to send
+type testMailer struct {
+	sent []testSent
+}
+
+type testSent struct {
+	from string
+	to   []string
+	raw  string
+}
+
+func (m *testMailer) Send(ctx context.Context, from string, to []string, raw []byte) error {
+	m.sent = append(m.sent, testSent{from: from, to: to, raw: string(raw)})
+	return nil
+}
+
+// testBouncer records the rejections it is asked to send
+type testBouncer struct {
+	rejected []string
+}
+
+func (b *testBouncer) Bounce(ctx context.Context, messageID string, userIDs []string) error {
+	return nil
+}
+
+func (b *testBouncer) Reject(ctx context.Context, messageID, userID, reason string) error {
+	b.rejected = append(b.rejected, reason)
+	return nil
+}
+
+// useTestSievePolicy sends redirects, rejects and vacation replies to the returned mailer and bouncer
+func useTestSievePolicy(t *testing.T) (*testMailer, *testBouncer) {
+	mailer := &testMailer{}
+	bouncer := &testBouncer{}
+
+	previous := sievePolicy
+	SetSievePolicy(SievePolicy{Domain: "example.com", Mailer: mailer, Bouncer: bouncer})
+	t.Cleanup(func() {
+		SetSievePolicy(previous)
+	})
+
+	return mailer, bouncer
+}
+
+// filterTestMessage for alice, sent by carol
+func filterTestMessage(t *testing.T, store MailStore, script, raw string, tags []string) []SieveDelivery {
+	t.Helper()
+	ctx := context.Background()
+
+	err := PutSieveScript(ctx, store, "mailbox", "alice", script)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	email := MoveOperation{
+		MessageID: "message",
+		Sender:    "carol@example.org",
+		Tags:      map[string][]string{"alice": tags},
+	}
+	_, deliveries, err := runFilters(ctx, store, "mailbox", email, []string{"alice"}, map[string]bool{}, []byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return deliveries["alice"]
+}
+
+const sieveTestMessage = "From: Carol <carol@example.org>\r\n" +
+	"To: alice@example.com\r\n" +
+	"Subject: [list] News\r\n" +
+	"Message-ID: <news@example.org>\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+func TestSieveActions(t *testing.T) {
+	inbox := []SieveDelivery{{Flags: []string{}}}
+
+	for _, tc := range []struct {
+		name           string
+		script         string
+		raw            string
+		tags           []string
+		wantDeliveries []SieveDelivery
+		wantSent       []string
+		wantRejected   []string
+	}{
+		{
+			name:           "no actions",
+			script:         "",
+			wantDeliveries: inbox,
+		},
+		{
+			name:           "fileinto",
+			script:         `require "fileinto"; if header :matches "subject" "[list]*" { fileinto "lists"; }`,
+			wantDeliveries: []SieveDelivery{{Folder: "lists", Flags: []string{}}},
+		},
+		{
+			name:           "fileinto a system folder",
+			script:         `require "fileinto"; fileinto "trash";`,
+			wantDeliveries: []SieveDelivery{{Folder: FolderTrash, Flags: []string{}}},
+		},
+		{
+			name:   "fileinto and keep with flags",
+			script: `require ["fileinto", "imap4flags"]; addflag "\\Seen"; addflag ["\\Flagged \\Seen"]; fileinto :flags "\\Answered" "Work"; keep;`,
+			wantDeliveries: []SieveDelivery{
+				{Folder: "Work", Flags: []string{`\Answered`}},
+				{Flags: []string{`\Flagged`, `\Seen`}},
+			},
+		},
+		{
+			name:   "discard",
+			script: `discard;`,
+		},
+		{
+			name:         "reject",
+			script:       `require "reject"; reject "Not here";`,
+			wantRejected: []string{"Not here"},
+		},
+		{
+			name:           "reject with keep fails",
+			script:         `require "reject"; reject "Not here"; keep;`,
+			wantDeliveries: inbox,
+		},
+		{
+			name:     "redirect",
+			script:   `redirect "bob@example.net"; redirect "Bob <bob@example.net>";`,
+			wantSent: []string{"bob@example.net"},
+		},
+		{
+			name:           "redirect over the cap",
+			script:         `redirect "a@example.net"; redirect "b@example.net"; redirect "c@example.net"; redirect "d@example.net"; redirect "e@example.net";`,
+			wantDeliveries: inbox,
+		},
+		{
+			name:           "redirect of a redirected message",
+			script:         `redirect "bob@example.net";`,
+			raw:            "X-Loop: alice@example.com\r\n" + sieveTestMessage,
+			wantDeliveries: inbox,
+		},
+		{
+			name:           "vacation",
+			script:         `require "vacation"; vacation "Away";`,
+			wantDeliveries: inbox,
+			wantSent:       []string{"carol@example.org"},
+		},
+		{
+			name:           "vacation for a list",
+			script:         `require "vacation"; vacation "Away";`,
+			raw:            "List-Id: <news.example.org>\r\n" + sieveTestMessage,
+			wantDeliveries: inbox,
+		},
+		{
+			name:           "envelope from",
+			script:         `require ["envelope", "fileinto"]; if envelope :domain "from" "example.org" { fileinto "Carol"; }`,
+			wantDeliveries: []SieveDelivery{{Folder: "Carol", Flags: []string{}}},
+		},
+		{
+			name:           "envelope to with a tag",
+			script:         `require ["envelope", "fileinto"]; if envelope :localpart "to" "alice+github" { fileinto "GitHub"; }`,
+			tags:           []string{"github"},
+			wantDeliveries: []SieveDelivery{{Folder: "GitHub", Flags: []string{}}},
+		},
+		{
+			name:           "envelope to without a tag",
+			script:         `require ["envelope", "fileinto"]; if envelope :localpart "to" "alice+github" { fileinto "GitHub"; }`,
+			wantDeliveries: inbox,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mailer, bouncer := useTestSievePolicy(t)
+			raw := tc.raw
+			if raw == "" {
+				raw = sieveTestMessage
+			}
+
+			deliveries := filterTestMessage(t, NewMemoryStore(), tc.script, raw, tc.tags)
+			if !reflect.DeepEqual(deliveries, tc.wantDeliveries) {
+				t.Errorf("deliveries = %v, want %v", deliveries, tc.wantDeliveries)
+			}
+
+			sent := []string{}
+			for _, mail := range mailer.sent {
+				sent = append(sent, mail.to...)
+			}
+			if len(sent) != len(tc.wantSent) || (len(sent) > 0 && !reflect.DeepEqual(sent, tc.wantSent)) {
+				t.Errorf("sent to %v, want %v", sent, tc.wantSent)
+			}
+			if len(bouncer.rejected) != len(tc.wantRejected) || (len(tc.wantRejected) > 0 && !reflect.DeepEqual(bouncer.rejected, tc.wantRejected)) {
+				t.Errorf("rejected with %v, want %v", bouncer.rejected, tc.wantRejected)
+			}
+		})
+	}
+}
+
+func TestSieveRedirectMarksTheLoop(t *testing.T) {
+	mailer, _ := useTestSievePolicy(t)
+
+	filterTestMessage(t, NewMemoryStore(), `redirect "bob@example.net";`, sieveTestMessage, nil)
+	if len(mailer.sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(mailer.sent))
+	}
+
+	raw := mailer.sent[0].raw
+	for _, want := range []string{"X-Loop: alice@example.com\r\n", "Reply-To: Carol <carol@example.org>\r\n", "\r\n\r\nHello\r\n"} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("redirected message doesn't have %q:\n%s", want, raw)
+		}
+	}
+	if mailer.sent[0].from != "alice@example.com" {
+		t.Errorf("redirected from %q, want alice@example.com", mailer.sent[0].from)
+	}
+}
+
+func TestSieveVacationOnce(t *testing.T) {
+	mailer, _ := useTestSievePolicy(t)
+	store := NewMemoryStore()
+	script := `require "vacation"; vacation :days 2 :subject "Away" "Back on Monday";`
+
+	filterTestMessage(t, store, script, sieveTestMessage, nil)
+	filterTestMessage(t, store, script, sieveTestMessage, nil)
+	if len(mailer.sent) != 1 {
+		t.Fatalf("sent %d vacation replies, want 1", len(mailer.sent))
+	}
+
+	raw := mailer.sent[0].raw
+	for _, want := range []string{"Subject: Away\r\n", "In-Reply-To: <news@example.org>\r\n", "Auto-Submitted: auto-replied\r\n", "Back on Monday"} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("vacation reply doesn't have %q:\n%s", want, raw)
+		}
+	}
+}
+
+func TestSieveFileintoInvalidFolderFails(t *testing.T) {
+	script, err := parseSieve(`require "fileinto"; fileinto "Work";`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a folder the checker let through but that isn't a valid name any more
+	script.commands[1].positional[0].strings[0] = "_system"
+
+	_, err = script.run(newSieveMessage([]byte(sieveTestMessage), "carol@example.org", "alice", ""))
+	if !errors.Is(err, ErrSieveFailed) {
+		t.Fatalf("run returned %v, want ErrSieveFailed", err)
+	}
+	if want := `sieve script failed: line 1: invalid folder name: "_system"`; err.Error() != want {
+		t.Errorf("run returned %q, want %q", err, want)
+	}
+}
+
+func TestSieveVacationFromOwnAddresses(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	useTestSievePolicy(t)
+
+	_, err := AddUser(ctx, store, "mailbox", "", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = AddUser(ctx, store, "mailbox", "", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SetAlias(ctx, store, "mailbox", "", "ali", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for from, wantErr := range map[string]string{
+		"alice@example.com":                "",
+		"Alice@Example.com":                "",
+		"Alice <alice+away@example.com>":   "",
+		"ali@example.com":                  "",
+		"ali+away@example.com":             "",
+		"bob@example.com":                  `invalid sieve script: line 1: :from "bob@example.com" isn't one of your addresses`,
+		"alice@example.org":                `invalid sieve script: line 1: :from "alice@example.org" isn't one of your addresses`,
+		"postmaster@example.com":           `invalid sieve script: line 1: :from "postmaster@example.com" isn't one of your addresses`,
+		"Postmaster <bob+ali@example.com>": `invalid sieve script: line 1: :from "Postmaster <bob+ali@example.com>" isn't one of your addresses`,
+	} {
+		err := PutSieveScript(ctx, store, "mailbox", "alice", `require "vacation"; vacation :from "`+from+`" "Away";`)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != wantErr {
+			t.Errorf(":from %q returned %q, want %q", from, got, wantErr)
+		}
+	}
+}
+
+func TestSieveVacationFromRemovedAlias(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	mailer, _ := useTestSievePolicy(t)
+
+	_, err := AddUser(ctx, store, "mailbox", "", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SetAlias(ctx, store, "mailbox", "", "ali", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filterTestMessage(t, store, `require "vacation"; vacation :from "ali@example.com" "Away";`, sieveTestMessage, nil)
+
+	// the alias went to someone else after the script was saved
+	_, err = RemoveAlias(ctx, store, "mailbox", "", "ali")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := `require "vacation"; vacation :handle "again" :from "ali@example.com" "Away";`
+	deliveries, err := runFilter(ctx, store, "mailbox", "alice", MoveOperation{MessageID: "message", Sender: "carol@example.org"}, script, []byte(sieveTestMessage))
+	if err != nil || len(deliveries.Deliveries) != 1 {
+		t.Fatalf("runFilter = %+v, %v", deliveries, err)
+	}
+
+	if len(mailer.sent) != 2 {
+		t.Fatalf("sent %d vacation replies, want 2", len(mailer.sent))
+	}
+	for i, want := range []string{"From: ali@example.com\r\n", "From: alice@example.com\r\n"} {
+		if !strings.Contains(mailer.sent[i].raw, want) {
+			t.Errorf("vacation reply %d doesn't have %q:\n%s", i, want, mailer.sent[i].raw)
+		}
+	}
+}
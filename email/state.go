@@ -0,0 +1,104 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// messageState is the part of an email the user changes after delivery, it is stored
+// next to the email metadata so the metadata never has to be rewritten.
+type messageState struct {
+	Folder   string
+	Flags    []string
+	ThreadID string
+	// Filed is when the email was delivered or last moved into its folder
+	Filed time.Time
+}
+
+// stateKey is the key of the mutable state of the email
+func stateKey(mailboxPrefix, userID, messageID string) string {
+	return rawKey(mailboxPrefix, userID, messageID) + ".state"
+}
+
+// loadState of the email, emails delivered before state was recorded are in the Inbox and a thread of their own
+func loadState(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string) (messageState, error) {
+	buf, err := store.Get(ctx, stateKey(mailboxPrefix, userID, messageID))
+	if err != nil && err != ErrNotFound {
+		return messageState{}, err
+	}
+
+	return decodeState(messageID, buf)
+}
+
+// decodeState stored for the email, buf is nil when no state was recorded
+func decodeState(messageID string, buf []byte) (messageState, error) {
+	state := messageState{
+		Folder:   FolderInbox,
+		Flags:    []string{},
+		ThreadID: messageID,
+	}
+	if buf == nil {
+		return state, nil
+	}
+
+	err := json.Unmarshal(buf, &state)
+	if err != nil {
+		return state, err
+	}
+	if state.Folder == "" {
+		state.Folder = FolderInbox
+	}
+	if state.Flags == nil {
+		state.Flags = []string{}
+	}
+	if state.ThreadID == "" {
+		state.ThreadID = messageID
+	}
+
+	return state, nil
+}
+
+func saveState(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string, state messageState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return store.Put(ctx, stateKey(mailboxPrefix, userID, messageID), buf, "application/json")
+}
+
+// updateState applies fn to the state of the email and keeps the index entry in sync with it
+func updateState(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string, fn func(*messageState) error) (messageState, error) {
+	// the index doubles as the check that the email exists
+	indexed, err := isIndexed(ctx, store, mailboxPrefix, userID, messageID)
+	if err != nil {
+		return messageState{}, err
+	}
+	if !indexed {
+		return messageState{}, ErrNotFound
+	}
+
+	var state messageState
+	err = updateObject(ctx, store, stateKey(mailboxPrefix, userID, messageID), "application/json", func(buf []byte) ([]byte, error) {
+		var err error
+		state, err = decodeState(messageID, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		err = fn(&state)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(state)
+	})
+	if err != nil {
+		return state, err
+	}
+
+	return state, updateIndexEntry(ctx, store, mailboxPrefix, userID, messageID, func(meta *Meta) {
+		meta.applyState(state)
+	})
+}
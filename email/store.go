@@ -0,0 +1,61 @@
+package email
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotFound is returned by a MailStore when the requested object does not exist
+var ErrNotFound = errors.New("object not found")
+
+// ErrInvalidPath is returned by a MailStore for keys that would leave the store, e.g. with a ".." segment
+var ErrInvalidPath = errors.New("invalid object key")
+
+// ErrConflict is returned by a ConditionalStore when the object was written by someone else since it was read
+var ErrConflict = errors.New("object changed since it was read")
+
+// MailStore is the object storage the mailboxes live in. Keys are slash separated
+// paths relative to the root of the store, e.g. "mailbox/gideonw/<messageID>.json".
+type MailStore interface {
+	// Get the contents of the object at key, returns ErrNotFound if it does not exist
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put the body at key, replacing any existing object
+	Put(ctx context.Context, key string, body []byte, contentType string) error
+	// Copy the object at srcKey to destKey
+	Copy(ctx context.Context, srcKey, destKey string) error
+	// List the keys that start with prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete the object at key, deleting a missing object is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// ConditionalStore is a MailStore that only replaces an object if it is still the version that
+// was read, so concurrent lambdas updating the same index don't lose each other's changes
+type ConditionalStore interface {
+	MailStore
+	// GetVersion returns the contents of the object at key along with its version, returns ErrNotFound if it does not exist
+	GetVersion(ctx context.Context, key string) ([]byte, string, error)
+	// PutIfVersion puts the body at key if the object is still at version, an empty version
+	// means the object must not exist yet. Returns ErrConflict otherwise.
+	PutIfVersion(ctx context.Context, key string, body []byte, contentType, version string) error
+}
+
+// userPrefix is the key prefix all of a user's mail is stored under
+func userPrefix(mailboxPrefix, userID string) string {
+	return mailboxPrefix + "/" + userID + "/"
+}
+
+// rawKey is the key of the original RFC 5322 message
+func rawKey(mailboxPrefix, userID, messageID string) string {
+	return userPrefix(mailboxPrefix, userID) + messageID
+}
+
+// metaKey is the key of the parsed json representation of the message
+func metaKey(mailboxPrefix, userID, messageID string) string {
+	return rawKey(mailboxPrefix, userID, messageID) + ".json"
+}
+
+// erroredKey is the key emails are copied to when they fail to be sorted
+func erroredKey(mailboxPrefix, name string) string {
+	return mailboxPrefix + "/_errored/" + name
+}
@@ -0,0 +1,148 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// testMailStore checks the MailStore contract every store has to keep
+func testMailStore(t *testing.T, store MailStore) {
+	ctx := context.Background()
+
+	_, err := store.Get(ctx, "mailbox/alice/missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a missing key returned %v, want ErrNotFound", err)
+	}
+
+	objects := map[string]string{
+		"mailbox/alice/a":      "a",
+		"mailbox/alice/a.json": "{}",
+		"mailbox/alice/b":      "b",
+		"mailbox/alicia/c":     "c",
+		"mailbox/bob/d":        "d",
+	}
+	for key, body := range objects {
+		err := store.Put(ctx, key, []byte(body), "text/plain")
+		if err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	for key, body := range objects {
+		buf, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Get %s: %v", key, err)
+		}
+		if string(buf) != body {
+			t.Errorf("Get %s = %q, want %q", key, buf, body)
+		}
+	}
+
+	err = store.Put(ctx, "mailbox/alice/b", []byte("b2"), "text/plain")
+	if err != nil {
+		t.Fatalf("Put over an object: %v", err)
+	}
+	buf, _ := store.Get(ctx, "mailbox/alice/b")
+	if string(buf) != "b2" {
+		t.Errorf("Put didn't replace the object, got %q", buf)
+	}
+
+	for _, tc := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"mailbox/alice/", []string{"mailbox/alice/a", "mailbox/alice/a.json", "mailbox/alice/b"}},
+		{"mailbox/ali", []string{"mailbox/alice/a", "mailbox/alice/a.json", "mailbox/alice/b", "mailbox/alicia/c"}},
+		{"mailbox/alice/a", []string{"mailbox/alice/a", "mailbox/alice/a.json"}},
+		{"mailbox/carol/", []string{}},
+	} {
+		keys, err := store.List(ctx, tc.prefix)
+		if err != nil {
+			t.Fatalf("List %s: %v", tc.prefix, err)
+		}
+		if !reflect.DeepEqual(keys, tc.want) {
+			t.Errorf("List %s = %v, want %v", tc.prefix, keys, tc.want)
+		}
+	}
+
+	err = store.Copy(ctx, "mailbox/alice/a", "mailbox/bob/a")
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	buf, _ = store.Get(ctx, "mailbox/bob/a")
+	if string(buf) != "a" {
+		t.Errorf("Copy wrote %q, want %q", buf, "a")
+	}
+	err = store.Copy(ctx, "mailbox/alice/missing", "mailbox/bob/missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Copy of a missing key returned %v, want ErrNotFound", err)
+	}
+
+	err = store.Delete(ctx, "mailbox/alice/a")
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	_, err = store.Get(ctx, "mailbox/alice/a")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete returned %v, want ErrNotFound", err)
+	}
+	err = store.Delete(ctx, "mailbox/alice/a")
+	if err != nil {
+		t.Errorf("Delete of a missing key returned %v", err)
+	}
+	keys, _ := store.List(ctx, "mailbox/alice/")
+	if !reflect.DeepEqual(keys, []string{"mailbox/alice/a.json", "mailbox/alice/b"}) {
+		t.Errorf("List after Delete = %v", keys)
+	}
+}
+
+// tempDir that is removed when the test finishes
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gopher-mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	return dir
+}
+
+func TestMemoryStore(t *testing.T) {
+	testMailStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	testMailStore(t, NewFileStore(tempDir(t)))
+}
+
+func TestFileStoreRefusesParentSegments(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileStore(tempDir(t) + "/root")
+
+	for _, key := range []string{"mailbox/alice/..", "mailbox/../../etc/passwd", "../outside"} {
+		if _, err := store.Get(ctx, key); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Get %s returned %v, want ErrInvalidPath", key, err)
+		}
+		if err := store.Put(ctx, key, []byte("x"), ""); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Put %s returned %v, want ErrInvalidPath", key, err)
+		}
+		if err := store.Delete(ctx, key); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Delete %s returned %v, want ErrInvalidPath", key, err)
+		}
+		if _, err := store.List(ctx, key+"/"); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("List %s returned %v, want ErrInvalidPath", key, err)
+		}
+	}
+
+	// dots inside a segment are just part of the name
+	err := store.Put(ctx, "mailbox/alice/a..b", []byte("x"), "")
+	if err != nil {
+		t.Errorf("Put of a name with dots returned %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// subaddressSeparator splits the user from the tag in a subaddress, e.g. "alice+github" (RFC 5233)
+const subaddressSeparator = "+"
+
+// ErrInvalidTag is returned for subaddress tags that can't be part of an address
+var ErrInvalidTag = errors.New("invalid tag")
+
+// tagRegex matches the characters RFC 5322 allows in a local part without quoting
+var tagRegex = regexp.MustCompile(`^[a-z0-9!#$%&'*+\-=?^_{|}~.]+$`)
+
+// SubaddressSettings decide what happens to mail sent to the user with a tag, e.g. alice+github
+type SubaddressSettings struct {
+	// Disabled rejects mail sent to the user with any tag
+	Disabled bool
+	// AutoFile files mail into the folder named after its tag, the folder is created when it doesn't exist
+	AutoFile bool
+	// Blocked tags are rejected, e.g. a tag given to a site that leaked it
+	Blocked []string
+}
+
+// splitSubaddress splits the local part into the user and the tag, the tag is empty for plain addresses
+func splitSubaddress(local string) (string, string) {
+	i := strings.Index(local, subaddressSeparator)
+	if i < 0 {
+		return local, ""
+	}
+
+	return local[:i], local[i+1:]
+}
+
+// canonicalTag lower cases the tag and checks it can be part of an address
+func canonicalTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if !tagRegex.MatchString(tag) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidTag, tag)
+	}
+
+	return tag, nil
+}
+
+// SetSubaddressing turns tags off for the user, and turns filing into the folder of the tag on or off
+func SetSubaddressing(ctx context.Context, store MailStore, mailboxPrefix, userID string, disabled, autoFile bool) (Settings, error) {
+	return updateSettings(ctx, store, mailboxPrefix, userID, func(settings *Settings) error {
+		settings.Subaddressing.Disabled = disabled
+		settings.Subaddressing.AutoFile = autoFile
+		return nil
+	})
+}
+
+// BlockTag rejects the mail sent to the user with the tag
+func BlockTag(ctx context.Context, store MailStore, mailboxPrefix, userID, tag string) (Settings, error) {
+	tag, err := canonicalTag(tag)
+	if err != nil {
+		return Settings{}, err
+	}
+
+	return updateSettings(ctx, store, mailboxPrefix, userID, func(settings *Settings) error {
+		if !containsString(settings.Subaddressing.Blocked, tag) {
+			settings.Subaddressing.Blocked = append(settings.Subaddressing.Blocked, tag)
+		}
+		return nil
+	})
+}
+
+// UnblockTag delivers the mail sent with the tag again, returns ErrNotFound if it wasn't blocked
+func UnblockTag(ctx context.Context, store MailStore, mailboxPrefix, userID, tag string) (Settings, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+
+	return updateSettings(ctx, store, mailboxPrefix, userID, func(settings *Settings) error {
+		blocked := []string{}
+		for _, t := range settings.Subaddressing.Blocked {
+			if t != tag {
+				blocked = append(blocked, t)
+			}
+		}
+		if len(blocked) == len(settings.Subaddressing.Blocked) {
+			return ErrNotFound
+		}
+		settings.Subaddressing.Blocked = blocked
+
+		return nil
+	})
+}
+
+// accepts reports if mail sent to the user with the tag is delivered
+func (s SubaddressSettings) accepts(tag string) bool {
+	return tag == "" || (!s.Disabled && !containsString(s.Blocked, tag))
+}
+
+// filterSubaddresses drops the users that reject every address the email was sent to them
+// with, and keeps the first tag each user accepts as the one the email is delivered with.
+// Like mail for an unknown address it is dropped rather than bounced.
+func filterSubaddresses(ctx context.Context, store MailStore, mailboxPrefix string, email MoveOperation) (MoveOperation, error) {
+	if len(email.Tags) == 0 {
+		return email, nil
+	}
+
+	deliver := []string{}
+	accepted := make(map[string][]string)
+	for _, userID := range email.DestPrefixes {
+		tags := email.Tags[userID]
+		if len(tags) == 0 {
+			deliver = append(deliver, userID)
+			continue
+		}
+
+		var settings *Settings
+		for _, tag := range tags {
+			if settings == nil && tag != "" {
+				loaded, err := LoadSettings(ctx, store, mailboxPrefix, userID)
+				if err != nil {
+					return email, err
+				}
+				settings = &loaded
+			}
+			// the plain address always delivers
+			if tag == "" || settings.Subaddressing.accepts(tag) {
+				deliver = append(deliver, userID)
+				accepted[userID] = []string{tag}
+				break
+			}
+		}
+		if len(accepted[userID]) == 0 {
+			log.Printf("Rejecting \"%s\" for \"%s\", none of the tags %q are accepted\n", email.MessageID, userID, tags)
+		}
+	}
+	email.DestPrefixes = deliver
+	email.Tags = accepted
+
+	return email, nil
+}
+
+// tag the email is delivered to the user with, the first of their tags until they are filtered
+func (email MoveOperation) tag(userID string) string {
+	if tags := email.Tags[userID]; len(tags) > 0 {
+		return tags[0]
+	}
+
+	return ""
+}
+
+// tagFolder is the folder mail with the tag is delivered into, the Inbox unless the user files
+// mail by its tag. The folder is created the first time mail arrives with the tag.
+func tagFolder(ctx context.Context, store MailStore, mailboxPrefix, userID, tag string) (string, error) {
+	if tag == "" {
+		return FolderInbox, nil
+	}
+
+	settings, err := LoadSettings(ctx, store, mailboxPrefix, userID)
+	if err != nil {
+		return FolderInbox, err
+	}
+	if !settings.Subaddressing.AutoFile {
+		return FolderInbox, nil
+	}
+
+	folder, err := canonicalFolder(tag)
+	if err != nil {
+		// tags that can't be a folder name stay in the Inbox
+		log.Println(err)
+		return FolderInbox, nil
+	}
+	if isSystemFolder(folder) {
+		// senders can't file mail into the Trash or Spam by tagging the address with it
+		log.Printf("Delivering the tag \"%s\" of \"%s\" into the Inbox, it names a system folder\n", tag, userID)
+		return FolderInbox, nil
+	}
+
+	_, err = CreateFolder(ctx, store, mailboxPrefix, userID, folder)
+	if err != nil && !errors.Is(err, ErrFolderExists) {
+		return FolderInbox, err
+	}
+
+	return folder, nil
+}
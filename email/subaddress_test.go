@@ -0,0 +1,104 @@
+package email
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestAddressMapResolveKeepsEveryTag(t *testing.T) {
+	addresses := AddressMap{
+		Users:   []string{"alice", "bob"},
+		Aliases: map[string]string{"ali": "alice"},
+	}
+
+	users, tags, rejected := addresses.Resolve([]string{"alice+github@example.com", "ali+shop@example.com", "alice@example.com", "bob@example.com", "carol@example.com"})
+	if want := []string{"alice", "bob"}; !reflect.DeepEqual(users, want) {
+		t.Errorf("users = %v, want %v", users, want)
+	}
+	if want := map[string][]string{"alice": {"github", "shop", ""}, "bob": {""}}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags = %v, want %v", tags, want)
+	}
+	if want := []string{"carol@example.com"}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("rejected = %v, want %v", rejected, want)
+	}
+}
+
+func TestFilterSubaddresses(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	_, err := BlockTag(ctx, store, "mailbox", "alice", "leaked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SetSubaddressing(ctx, store, "mailbox", "bob", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		user        string
+		tags        []string
+		wantDeliver bool
+		wantTag     string
+	}{
+		{"plain address", "alice", nil, true, ""},
+		{"allowed tag", "alice", []string{"github"}, true, "github"},
+		{"blocked tag", "alice", []string{"leaked"}, false, ""},
+		{"blocked then allowed tag", "alice", []string{"leaked", "github"}, true, "github"},
+		{"blocked tag and the plain address", "alice", []string{"leaked", ""}, true, ""},
+		{"tags disabled", "bob", []string{"github"}, false, ""},
+		{"tags disabled and the plain address", "bob", []string{"github", ""}, true, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			email := MoveOperation{
+				MessageID:    "message",
+				DestPrefixes: []string{tc.user},
+				Tags:         map[string][]string{},
+			}
+			if tc.tags != nil {
+				email.Tags[tc.user] = tc.tags
+			}
+
+			email, err := filterSubaddresses(ctx, store, "mailbox", email)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if delivered := len(email.DestPrefixes) == 1; delivered != tc.wantDeliver {
+				t.Fatalf("delivered = %v, want %v", delivered, tc.wantDeliver)
+			}
+			if tag := email.tag(tc.user); tag != tc.wantTag {
+				t.Errorf("tag = %q, want %q", tag, tc.wantTag)
+			}
+		})
+	}
+}
+
+func TestTagFolderRefusesSystemFolders(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	_, err := SetSubaddressing(ctx, store, "mailbox", "alice", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for tag, want := range map[string]string{
+		"":       FolderInbox,
+		"github": "github",
+		"trash":  FolderInbox,
+		"spam":   FolderInbox,
+		"inbox":  FolderInbox,
+		"sent":   FolderInbox,
+	} {
+		folder, err := tagFolder(ctx, store, "mailbox", "alice", tag)
+		if err != nil {
+			t.Fatalf("tagFolder %q: %v", tag, err)
+		}
+		if folder != want {
+			t.Errorf("tagFolder %q = %q, want %q", tag, folder, want)
+		}
+	}
+}
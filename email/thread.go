@@ -0,0 +1,296 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replyPrefixRegex matches the reply and forward markers, and list tags, mail clients put in front of a subject
+var replyPrefixRegex = regexp.MustCompile(`(?i)^\s*((re|fw|fwd|aw|sv|antw)(\[\d+\])?\s*:|\[[^\]]*\])\s*`)
+
+// threadLock serializes changes to the thread table within this process
+var threadLock sync.Mutex
+
+// threadTable maps the Message-ID headers seen in a mailbox, including the ones only
+// referenced by other emails, and reply subjects to the thread they belong to.
+type threadTable struct {
+	IDs      map[string]string
+	Subjects map[string]string
+}
+
+// Thread is a summary of a conversation in the user's mailbox
+type Thread struct {
+	ThreadID     string
+	Subject      string
+	Participants []string
+	Count        int
+	Unread       int
+	FirstDate    time.Time
+	LastDate     time.Time
+}
+
+// threadsKey is the key of the user's thread table
+func threadsKey(mailboxPrefix, userID string) string {
+	return userPrefix(mailboxPrefix, userID) + "_threads.json"
+}
+
+// baseSubject strips reply markers and list tags so replies share the subject of the original
+func baseSubject(subject string) (string, bool) {
+	isReply := false
+	for {
+		loc := replyPrefixRegex.FindStringIndex(subject)
+		if loc == nil {
+			break
+		}
+		if !strings.HasPrefix(strings.TrimSpace(subject), "[") {
+			isReply = true
+		}
+		subject = subject[loc[1]:]
+	}
+
+	return strings.ToLower(strings.Join(strings.Fields(subject), " ")), isReply
+}
+
+// messageIDList normalizes Message-ID header values, which may be folded onto several lines
+func messageIDList(values ...string) []string {
+	ids := []string{}
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, field := range strings.Fields(value) {
+			id := strings.Trim(field, "<>,")
+			if id != "" && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids
+}
+
+// decodeThreadTable, an empty table when buf is nil
+func decodeThreadTable(buf []byte) (threadTable, error) {
+	table := threadTable{
+		IDs:      make(map[string]string),
+		Subjects: make(map[string]string),
+	}
+	if buf == nil {
+		return table, nil
+	}
+
+	return table, json.Unmarshal(buf, &table)
+}
+
+// assignThread finds the thread the email belongs to, JWZ style, by following its
+// References and In-Reply-To headers. Replies without any references fall back to the
+// subject. When an email links threads that were separate they are merged.
+func assignThread(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string, email Message) (string, error) {
+	threadLock.Lock()
+	defer threadLock.Unlock()
+
+	var threadID string
+	err := updateObject(ctx, store, threadsKey(mailboxPrefix, userID), "application/json", func(buf []byte) ([]byte, error) {
+		table, err := decodeThreadTable(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		threadID, err = linkThread(ctx, store, mailboxPrefix, userID, messageID, email, table)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(table)
+	})
+
+	return threadID, err
+}
+
+// linkThread adds the email to the table and returns its thread, merging the threads it links
+func linkThread(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string, email Message, table threadTable) (string, error) {
+
+	headerID := email.MessageID
+	if headerID == "" {
+		headerID = messageID
+	}
+	references := messageIDList(append(append([]string{}, email.References...), email.InReplyTo...)...)
+	linked := append(append([]string{}, references...), headerID)
+	subject, isReply := baseSubject(email.Subject)
+
+	// every thread the email is connected to, oldest reference first
+	found := []string{}
+	for _, id := range linked {
+		if threadID, ok := table.IDs[id]; ok && !containsString(found, threadID) {
+			found = append(found, threadID)
+		}
+	}
+	if len(found) == 0 && len(references) == 0 && isReply && subject != "" {
+		if threadID, ok := table.Subjects[subject]; ok {
+			found = append(found, threadID)
+		}
+	}
+
+	threadID := messageID
+	if len(found) > 0 {
+		threadID = found[0]
+	}
+
+	// merge the other threads into the one the oldest reference belongs to
+	if len(found) > 1 {
+		for id, t := range table.IDs {
+			if containsString(found[1:], t) {
+				table.IDs[id] = threadID
+			}
+		}
+		for s, t := range table.Subjects {
+			if containsString(found[1:], t) {
+				table.Subjects[s] = threadID
+			}
+		}
+
+		err := rethreadEmails(ctx, store, mailboxPrefix, userID, found[1:], threadID)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for _, id := range linked {
+		table.IDs[id] = threadID
+	}
+	if subject != "" {
+		if _, ok := table.Subjects[subject]; !ok || len(found) == 0 {
+			table.Subjects[subject] = threadID
+		}
+	}
+
+	return threadID, nil
+}
+
+// rethreadEmails moves every email in the old threads into threadID
+func rethreadEmails(ctx context.Context, store MailStore, mailboxPrefix, userID string, old []string, threadID string) error {
+	return updateIndex(ctx, store, mailboxPrefix, userID, func(index *Index) error {
+		for i := range index.Emails {
+			if !containsString(old, index.Emails[i].ThreadID) {
+				continue
+			}
+
+			state, err := loadState(ctx, store, mailboxPrefix, userID, index.Emails[i].MessageID)
+			if err != nil {
+				return err
+			}
+			state.ThreadID = threadID
+
+			err = saveState(ctx, store, mailboxPrefix, userID, index.Emails[i].MessageID, state)
+			if err != nil {
+				return err
+			}
+			index.Emails[i].applyState(state)
+		}
+
+		return nil
+	})
+}
+
+// ListThreads in the user's mailbox with the most recently active first, folder limits
+// the list to threads with an email in that folder.
+func ListThreads(ctx context.Context, store MailStore, mailboxPrefix, userID, folder string) ([]Thread, error) {
+	index, err := LoadIndex(ctx, store, mailboxPrefix, userID)
+	if err == ErrNotFound {
+		index, err = RebuildIndex(ctx, store, mailboxPrefix, userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if folder != "" {
+		folder, err = canonicalFolder(folder)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	emails := make([]Meta, len(index.Emails))
+	copy(emails, index.Emails)
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emails[i].Date.Before(emails[j].Date)
+	})
+
+	threads := make(map[string]*Thread)
+	matches := make(map[string]bool)
+	order := []string{}
+	for _, meta := range emails {
+		thread, ok := threads[meta.ThreadID]
+		if !ok {
+			thread = &Thread{
+				ThreadID:     meta.ThreadID,
+				Subject:      meta.Subject,
+				Participants: []string{},
+				FirstDate:    meta.Date,
+			}
+			threads[meta.ThreadID] = thread
+			order = append(order, meta.ThreadID)
+		}
+
+		thread.Count++
+		thread.LastDate = meta.Date
+		if !hasFlag(meta.Flags, FlagSeen) {
+			thread.Unread++
+		}
+		if meta.From != "" && !containsString(thread.Participants, meta.From) {
+			thread.Participants = append(thread.Participants, meta.From)
+		}
+		if folder == "" || meta.Folder == folder {
+			matches[meta.ThreadID] = true
+		}
+	}
+
+	ret := []Thread{}
+	for _, threadID := range order {
+		if matches[threadID] {
+			ret = append(ret, *threads[threadID])
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].LastDate.After(ret[j].LastDate)
+	})
+
+	return ret, nil
+}
+
+// GetThread returns the emails in the thread, oldest first
+func GetThread(ctx context.Context, store MailStore, mailboxPrefix, userID, threadID string) ([]Meta, error) {
+	index, err := LoadIndex(ctx, store, mailboxPrefix, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	emails := []Meta{}
+	for i := range index.Emails {
+		if index.Emails[i].ThreadID == threadID {
+			emails = append(emails, index.Emails[i])
+		}
+	}
+	if len(emails) == 0 {
+		return nil, ErrNotFound
+	}
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emails[i].Date.Before(emails[j].Date)
+	})
+
+	return emails, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,82 @@
+package email
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// stripTrackingPixels removes the remote images that are at most 1x1 pixels, they are only
+// there to tell the sender when and where the email was read. The rest of the body is kept
+// byte for byte. Returns the body and how many pixels were removed.
+func stripTrackingPixels(body string) (string, int) {
+	if !strings.Contains(strings.ToLower(body), "<img") {
+		return body, 0
+	}
+
+	var out strings.Builder
+	removed := 0
+
+	tokenizer := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			return out.String(), removed
+		}
+
+		raw := tokenizer.Raw()
+		if tokenType == html.StartTagToken || tokenType == html.SelfClosingTagToken {
+			// Token() unescapes the attributes so raw has to be copied first
+			raw = append([]byte{}, raw...)
+			if isTrackingPixel(tokenizer.Token()) {
+				removed++
+				continue
+			}
+		}
+		out.Write(raw)
+	}
+}
+
+// isTrackingPixel reports if the tag is a remote image with a width and height of at most one pixel
+func isTrackingPixel(token html.Token) bool {
+	if token.Data != "img" {
+		return false
+	}
+
+	src := ""
+	dimensions := make(map[string]string)
+	for _, attr := range token.Attr {
+		switch strings.ToLower(attr.Key) {
+		case "src":
+			src = strings.ToLower(strings.TrimSpace(attr.Val))
+		case "width", "height":
+			dimensions[strings.ToLower(attr.Key)] = attr.Val
+		case "style":
+			for _, declaration := range strings.Split(attr.Val, ";") {
+				parts := strings.SplitN(declaration, ":", 2)
+				property := strings.ToLower(strings.TrimSpace(parts[0]))
+				if len(parts) == 2 && (property == "width" || property == "height") {
+					dimensions[property] = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(parts[1]), "!important"))
+				}
+			}
+		}
+	}
+
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return false
+	}
+
+	for _, key := range []string{"width", "height"} {
+		value, ok := dimensions[key]
+		if !ok {
+			return false
+		}
+		pixels, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "px"), 64)
+		if err != nil || pixels > 1 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,26 @@
+package email
+
+import "testing"
+
+func TestStripTrackingPixels(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		body        string
+		want        string
+		wantRemoved int
+	}{
+		{"no images", "<p>Hi</p>", "<p>Hi</p>", 0},
+		{"pixel", `<p>Hi</p><img src="https://example.org/open.gif" width="1" height="1">`, "<p>Hi</p>", 1},
+		{"pixel in the style", `<img src="https://example.org/open.gif" style="width: 1px; height: 0px !important">Hi`, "Hi", 1},
+		{"self closing pixel", `<IMG SRC="http://example.org/open.gif" WIDTH="0" HEIGHT="0"/>Hi`, "Hi", 1},
+		{"image", `<img src="https://example.org/logo.png" width="100" height="1">`, `<img src="https://example.org/logo.png" width="100" height="1">`, 0},
+		{"image without a size", `<img src="https://example.org/logo.png">`, `<img src="https://example.org/logo.png">`, 0},
+		{"embedded image", `<img src="cid:spacer" width="1" height="1">`, `<img src="cid:spacer" width="1" height="1">`, 0},
+		{"rest kept byte for byte", `<P  class=a>Caf&eacute;<img src="https://example.org/open.gif" width=1 height=1></P >`, `<P  class=a>Caf&eacute;</P >`, 1},
+	} {
+		got, removed := stripTrackingPixels(tc.body)
+		if got != tc.want || removed != tc.wantRemoved {
+			t.Errorf("%s: stripTrackingPixels(%q) = %q, %d, want %q, %d", tc.name, tc.body, got, removed, tc.want, tc.wantRemoved)
+		}
+	}
+}
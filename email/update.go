@@ -0,0 +1,62 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// maxUpdateAttempts bounds how often an update is retried when other writers keep winning
+const maxUpdateAttempts = 10
+
+// getVersion of the object at key, stores that can't write conditionally return no version
+func getVersion(ctx context.Context, store MailStore, key string) ([]byte, string, error) {
+	if conditional, ok := store.(ConditionalStore); ok {
+		return conditional.GetVersion(ctx, key)
+	}
+
+	body, err := store.Get(ctx, key)
+
+	return body, "", err
+}
+
+// putIfVersion writes the body if the object is still at version, stores that can't write
+// conditionally always write it
+func putIfVersion(ctx context.Context, store MailStore, key string, body []byte, contentType, version string) error {
+	if conditional, ok := store.(ConditionalStore); ok {
+		return conditional.PutIfVersion(ctx, key, body, contentType, version)
+	}
+
+	return store.Put(ctx, key, body, contentType)
+}
+
+// updateObject reads the object at key, nil if it doesn't exist, and writes back what fn
+// returns. When someone else wrote the object in the meantime fn is run again on their
+// version, so fn must be safe to repeat. Stores that can't write conditionally only have the
+// package locks keeping updates from running over each other, within this process.
+func updateObject(ctx context.Context, store MailStore, key, contentType string, fn func([]byte) ([]byte, error)) error {
+	for attempt := 1; ; attempt++ {
+		current, version, err := getVersion(ctx, store, key)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+
+		body, err := fn(current)
+		if err != nil {
+			return err
+		}
+
+		err = putIfVersion(ctx, store, key, body, contentType, version)
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+		if attempt == maxUpdateAttempts {
+			return fmt.Errorf("%s: %w after %d attempts", key, err, attempt)
+		}
+
+		// back off a little so the writers don't keep colliding
+		time.Sleep(time.Duration(attempt*10+rand.Intn(20)) * time.Millisecond)
+	}
+}
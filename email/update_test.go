@@ -0,0 +1,245 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testConditionalStore checks that a ConditionalStore refuses writes over versions it didn't hand out
+func testConditionalStore(t *testing.T, store ConditionalStore) {
+	ctx := context.Background()
+	key := "mailbox/alice/_index.json"
+
+	err := store.PutIfVersion(ctx, key, []byte("1"), "application/json", "")
+	if err != nil {
+		t.Fatalf("PutIfVersion of a new object: %v", err)
+	}
+	err = store.PutIfVersion(ctx, key, []byte("2"), "application/json", "")
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("PutIfVersion over an existing object returned %v, want ErrConflict", err)
+	}
+
+	body, version, err := store.GetVersion(ctx, key)
+	if err != nil || string(body) != "1" {
+		t.Fatalf("GetVersion = %q, %v", body, err)
+	}
+	err = store.Put(ctx, key, []byte("3"), "application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.PutIfVersion(ctx, key, []byte("4"), "application/json", version)
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("PutIfVersion over a newer object returned %v, want ErrConflict", err)
+	}
+
+	_, version, _ = store.GetVersion(ctx, key)
+	err = store.PutIfVersion(ctx, key, []byte("5"), "application/json", version)
+	if err != nil {
+		t.Errorf("PutIfVersion at the current version: %v", err)
+	}
+
+	_, _, err = store.GetVersion(ctx, "mailbox/alice/missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetVersion of a missing key returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryStoreConditional(t *testing.T) {
+	testConditionalStore(t, NewMemoryStore())
+}
+
+func TestFileStoreConditional(t *testing.T) {
+	testConditionalStore(t, NewFileStore(tempDir(t)))
+}
+
+func TestCompressedStoreConditional(t *testing.T) {
+	store, err := NewCompressedStore(NewMemoryStore(), EncodingGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConditionalStore(t, store)
+}
+
+func TestEncryptedStoreConditional(t *testing.T) {
+	testConditionalStore(t, NewEncryptedStore(NewMemoryStore(), "mailbox", NewFileKeyProvider(tempDir(t))))
+}
+
+// TestUpdateObjectRetries has another writer, such as a second lambda, get in between the read
+// and the write of an update. Neither of the changes may be lost.
+func TestUpdateObjectRetries(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	key := "mailbox/alice/_threads.json"
+
+	attempts := 0
+	err := updateObject(ctx, store, key, "application/json", func(buf []byte) ([]byte, error) {
+		attempts++
+		if attempts == 1 {
+			err := store.Put(ctx, key, []byte("other"), "application/json")
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return append(buf, '+'), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("update ran %d times, want 2", attempts)
+	}
+	buf, _ := store.Get(ctx, key)
+	if string(buf) != "other+" {
+		t.Errorf("object is %q, want %q", buf, "other+")
+	}
+}
+
+func TestUpdateIndexKeepsConcurrentDeliveries(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	// a delivery by another lambda lands while this one is adding to the index
+	err := updateIndex(ctx, store, "mailbox", "alice", func(index *Index) error {
+		if len(index.Emails) == 0 {
+			// the other lambda doesn't share indexLock, it writes straight to the store
+			err := saveIndex(ctx, store, "mailbox", "alice", Index{Emails: []Meta{{MessageID: "other"}}})
+			if err != nil {
+				return err
+			}
+		}
+		index.Emails = append(index.Emails, Meta{MessageID: "mine"})
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := LoadIndex(ctx, store, "mailbox", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, meta := range index.Emails {
+		ids = append(ids, meta.MessageID)
+	}
+	if len(ids) != 2 || ids[0] != "other" || ids[1] != "mine" {
+		t.Errorf("index has %v, want [other mine]", ids)
+	}
+}
+
+func TestUpdateStateKeepsConcurrentChanges(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	deliver(t, store, "lunch", testMessage, "alice")
+
+	// another lambda flags the email while this one is marking it seen
+	attempts := 0
+	state, err := updateState(ctx, store, "mailbox", "alice", "lunch", func(state *messageState) error {
+		attempts++
+		if attempts == 1 {
+			_, err := UpdateFlags(ctx, store, "mailbox", "alice", "lunch", FlagsUpdate{Add: []string{FlagFlagged}})
+			if err != nil {
+				return err
+			}
+		}
+		state.Flags = append(state.Flags, FlagSeen)
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{FlagFlagged, FlagSeen}; !reflect.DeepEqual(state.Flags, want) {
+		t.Errorf("flags = %v, want %v", state.Flags, want)
+	}
+
+	index, err := LoadIndex(ctx, store, "mailbox", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags := index.Emails[0].Flags; !reflect.DeepEqual(flags, state.Flags) {
+		t.Errorf("index has the flags %v, want %v", flags, state.Flags)
+	}
+
+	_, err = updateState(ctx, store, "mailbox", "alice", "missing", func(*messageState) error { return nil })
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("update of a missing email returned %v, want ErrNotFound", err)
+	}
+	_, err = store.Get(ctx, stateKey("mailbox", "alice", "missing"))
+	if err != ErrNotFound {
+		t.Errorf("update of a missing email wrote its state: %v", err)
+	}
+}
+
+// listHookStore runs onList the first time the store is listed, after the keys were read
+type listHookStore struct {
+	*MemoryStore
+	onList func()
+}
+
+func (s *listHookStore) List(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := s.MemoryStore.List(ctx, prefix)
+	if s.onList != nil {
+		onList := s.onList
+		s.onList = nil
+		onList()
+	}
+
+	return keys, err
+}
+
+func TestRebuildIndexKeepsConcurrentChanges(t *testing.T) {
+	ctx := context.Background()
+	store := &listHookStore{MemoryStore: NewMemoryStore()}
+	message := func(subject string) string {
+		return strings.Replace(testMessage, "Subject: Lunch", "Subject: "+subject, 1)
+	}
+
+	deliver(t, store, "lunch", message("Lunch"), "alice")
+	deliver(t, store, "dinner", message("Dinner"), "alice")
+
+	// another lambda delivers breakfast and deletes dinner while the mailbox is being read
+	store.onList = func() {
+		deliver(t, store, "breakfast", message("Breakfast"), "alice")
+		err := DeleteEmail(ctx, store, "mailbox", "alice", "dinner")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := RebuildIndex(ctx, store, "mailbox", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for _, meta := range index.Emails {
+		ids = append(ids, meta.MessageID)
+	}
+	if want := []string{"lunch", "breakfast"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("rebuilt index has %v, want %v", ids, want)
+	}
+
+	for subject, want := range map[string]int{"lunch": 1, "breakfast": 1, "dinner": 0} {
+		query, err := ParseSearchQuery("subject:" + subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := Search(ctx, store, "mailbox", "alice", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != want {
+			t.Errorf("search for %q found %d emails, want %d", subject, len(found), want)
+		}
+	}
+
+	quota, _ := GetQuota(ctx, store, "mailbox", "alice")
+	if quota.Messages != 2 {
+		t.Errorf("quota after the rebuild counts %d messages, want 2", quota.Messages)
+	}
+}
@@ -0,0 +1,482 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Statuses of the checks SES runs on received mail
+const (
+	VerdictPass             = "PASS"
+	VerdictFail             = "FAIL"
+	VerdictGray             = "GRAY"
+	VerdictProcessingFailed = "PROCESSING_FAILED"
+	VerdictDisabled         = "DISABLED"
+)
+
+// Triage actions for mail that fails a check
+const (
+	// TriageDeliver delivers the mail as if it passed
+	TriageDeliver = "deliver"
+	// TriageSpam files the mail into the Spam folder, without running the user's Sieve script
+	TriageSpam = "spam"
+	// TriageQuarantine keeps the mail out of the mailbox until the user releases it
+	TriageQuarantine = "quarantine"
+	// TriageDrop deletes the mail without telling the sender
+	TriageDrop = "drop"
+)
+
+// triageActions are in order of severity, the most severe action of the failed checks is taken
+var triageActions = []string{TriageDeliver, TriageSpam, TriageQuarantine, TriageDrop}
+
+// ErrInvalidTriage is returned for triage actions postmaster doesn't know
+var ErrInvalidTriage = errors.New("invalid triage action")
+
+// Verdicts are the results of the checks SES ran on a received message, each is one of the
+// Verdict statuses and empty when the notification didn't have it
+type Verdicts struct {
+	Spam  string
+	Virus string
+	SPF   string
+	DKIM  string
+	DMARC string
+	// DMARCPolicy is the policy the sender's domain publishes for mail that fails DMARC, none, quarantine or reject
+	DMARCPolicy string `json:",omitempty"`
+}
+
+// TriageSettings are the action taken on mail that fails each check, one of the Triage actions
+type TriageSettings struct {
+	Spam  string
+	Virus string
+	SPF   string
+	DKIM  string
+	DMARC string
+}
+
+// defaultTriage files spam and mail failing DMARC as Spam and quarantines viruses
+var defaultTriage = TriageSettings{
+	Spam:  TriageSpam,
+	Virus: TriageQuarantine,
+	SPF:   TriageDeliver,
+	DKIM:  TriageDeliver,
+	DMARC: TriageSpam,
+}
+
+// QuarantinedEmail is mail kept out of the user's mailbox because it failed a check
+type QuarantinedEmail struct {
+	// MessageID is the name the email is delivered under when it is released
+	MessageID   string
+	From        string
+	Subject     string
+	Size        int
+	Verdicts    Verdicts
+	Quarantined time.Time
+}
+
+// quarantinePrefix is where quarantined mail is kept, outside of the mailboxes
+func quarantinePrefix(mailboxPrefix, userID string) string {
+	return mailboxPrefix + "/_quarantine/" + userID + "/"
+}
+
+// quarantineKey is the key of the original message, the QuarantinedEmail is stored next to it as <key>.json
+func quarantineKey(mailboxPrefix, userID, messageID string) string {
+	return quarantinePrefix(mailboxPrefix, userID) + messageID
+}
+
+// failed reports if the check failed, checks that couldn't run or were off don't count
+func failed(status string) bool {
+	return status == VerdictFail
+}
+
+// Failed are the names of the checks the message failed
+func (v Verdicts) Failed() []string {
+	checks := []string{}
+	for _, check := range []struct {
+		name   string
+		status string
+	}{
+		{"spam", v.Spam},
+		{"virus", v.Virus},
+		{"spf", v.SPF},
+		{"dkim", v.DKIM},
+		{"dmarc", v.DMARC},
+	} {
+		if failed(check.status) {
+			checks = append(checks, check.name)
+		}
+	}
+
+	return checks
+}
+
+// verdictsFromHeaders reads the spam and virus verdicts SES adds to the message headers,
+// for mail that is processed again after the notification is gone. Returns nil without them.
+// SES adds its headers at the top, so only the first of each counts, later ones came from the sender.
+func verdictsFromHeaders(headers []Header) *Verdicts {
+	var verdicts *Verdicts
+	for _, header := range headers {
+		switch strings.ToLower(header.Name) {
+		case "x-ses-spam-verdict":
+			if verdicts == nil {
+				verdicts = &Verdicts{}
+			}
+			if verdicts.Spam == "" {
+				verdicts.Spam = strings.ToUpper(strings.TrimSpace(header.Value))
+			}
+		case "x-ses-virus-verdict":
+			if verdicts == nil {
+				verdicts = &Verdicts{}
+			}
+			if verdicts.Virus == "" {
+				verdicts.Virus = strings.ToUpper(strings.TrimSpace(header.Value))
+			}
+		}
+	}
+
+	return verdicts
+}
+
+// action is the most severe action of the checks the message failed, with the checks that set it off
+func (t TriageSettings) action(verdicts Verdicts) (string, []string) {
+	actions := map[string]string{
+		"spam":  t.Spam,
+		"virus": t.Virus,
+		"spf":   t.SPF,
+		"dkim":  t.DKIM,
+		"dmarc": t.DMARC,
+	}
+
+	action := TriageDeliver
+	checks := []string{}
+	for _, check := range verdicts.Failed() {
+		if severity(actions[check]) > severity(action) {
+			action = actions[check]
+		}
+		checks = append(checks, check)
+	}
+
+	return action, checks
+}
+
+// severity of the action, unknown actions are delivered
+func severity(action string) int {
+	for i, a := range triageActions {
+		if a == action {
+			return i
+		}
+	}
+
+	return 0
+}
+
+// withDefaults fills the checks that have no action with the default one
+func (t TriageSettings) withDefaults() TriageSettings {
+	if t.Spam == "" {
+		t.Spam = defaultTriage.Spam
+	}
+	if t.Virus == "" {
+		t.Virus = defaultTriage.Virus
+	}
+	if t.SPF == "" {
+		t.SPF = defaultTriage.SPF
+	}
+	if t.DKIM == "" {
+		t.DKIM = defaultTriage.DKIM
+	}
+	if t.DMARC == "" {
+		t.DMARC = defaultTriage.DMARC
+	}
+
+	return t
+}
+
+// SetTriage sets the action taken on mail failing each check, checks left empty get the default action
+func SetTriage(ctx context.Context, store MailStore, mailboxPrefix, userID string, triage TriageSettings) (Settings, error) {
+	triage = triage.withDefaults()
+	for _, action := range []string{triage.Spam, triage.Virus, triage.SPF, triage.DKIM, triage.DMARC} {
+		if severity(action) == 0 && action != TriageDeliver {
+			return Settings{}, fmt.Errorf("%w: %q, use one of %s", ErrInvalidTriage, action, strings.Join(triageActions, ", "))
+		}
+	}
+
+	return updateSettings(ctx, store, mailboxPrefix, userID, func(settings *Settings) error {
+		settings.Triage = triage
+		return nil
+	})
+}
+
+// triageEmail applies the triage settings of each user to the verdicts of the email. Users that
+// drop or quarantine it are taken out of its DestPrefixes, returns the users it is filed as
+// Spam for.
+func triageEmail(ctx context.Context, store MailStore, mailboxPrefix string, email MoveOperation, body []byte) (MoveOperation, map[string]bool, error) {
+	spam := make(map[string]bool)
+
+	verdicts := email.Verdicts
+	if verdicts == nil {
+		verdicts = verdictsFromHeaders(readHeaders(body))
+	}
+	if verdicts == nil {
+		return email, spam, nil
+	}
+	// kept with mail that is held so it is triaged the same way when it is released
+	email.Verdicts = verdicts
+	if len(verdicts.Failed()) == 0 {
+		return email, spam, nil
+	}
+
+	deliver := []string{}
+	for _, userID := range email.DestPrefixes {
+		settings, err := LoadSettings(ctx, store, mailboxPrefix, userID)
+		if err != nil {
+			return email, nil, err
+		}
+
+		action, checks := settings.Triage.withDefaults().action(*verdicts)
+		if action != TriageDeliver {
+			log.Printf("Triage of \"%s\" for \"%s\" failed %s, %s\n", email.MessageID, userID, strings.Join(checks, ", "), action)
+		}
+
+		switch action {
+		case TriageDrop:
+			continue
+		case TriageQuarantine:
+			err = quarantineEmail(ctx, store, mailboxPrefix, userID, email, body)
+			if err != nil {
+				return email, nil, err
+			}
+			continue
+		case TriageSpam:
+			spam[userID] = true
+		}
+		deliver = append(deliver, userID)
+	}
+	email.DestPrefixes = deliver
+
+	return email, spam, nil
+}
+
+// quarantineEmail keeps the message for the user outside of their mailbox
+func quarantineEmail(ctx context.Context, store MailStore, mailboxPrefix, userID string, email MoveOperation, body []byte) error {
+	entry := QuarantinedEmail{
+		MessageID:   email.DestObjectKey,
+		Size:        len(body),
+		Verdicts:    *email.Verdicts,
+		Quarantined: time.Now().UTC(),
+	}
+	decoder := new(mime.WordDecoder)
+	for _, header := range readHeaders(body) {
+		value, err := decoder.DecodeHeader(header.Value)
+		if err != nil {
+			value = header.Value
+		}
+		switch strings.ToLower(header.Name) {
+		case "from":
+			entry.From = value
+		case "subject":
+			entry.Subject = value
+		}
+	}
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// quarantined mail is still only readable by the user it is for
+	ctx = withRecipients(ctx, []string{userID})
+	key := quarantineKey(mailboxPrefix, userID, email.DestObjectKey)
+	err = store.Put(ctx, key, body, "message/rfc822")
+	if err != nil {
+		return err
+	}
+
+	return store.Put(ctx, key+".json", buf, "application/json")
+}
+
+// ListQuarantine of the user, newest first
+func ListQuarantine(ctx context.Context, store MailStore, mailboxPrefix, userID string) ([]QuarantinedEmail, error) {
+	emails := []QuarantinedEmail{}
+
+	keys, err := store.List(ctx, quarantinePrefix(mailboxPrefix, userID))
+	if err != nil {
+		return emails, err
+	}
+
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".json") {
+			continue
+		}
+
+		buf, err := store.Get(ctx, key)
+		if err != nil {
+			return emails, err
+		}
+		var entry QuarantinedEmail
+		err = json.Unmarshal(buf, &entry)
+		if err != nil {
+			return emails, err
+		}
+		emails = append(emails, entry)
+	}
+	sort.Slice(emails, func(i, j int) bool {
+		return emails[i].Quarantined.After(emails[j].Quarantined)
+	})
+
+	return emails, nil
+}
+
+// loadQuarantined email of the user along with its original message
+func loadQuarantined(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string) (QuarantinedEmail, []byte, error) {
+	key := quarantineKey(mailboxPrefix, userID, messageID)
+
+	buf, err := store.Get(ctx, key+".json")
+	if err != nil {
+		return QuarantinedEmail{}, nil, err
+	}
+	var entry QuarantinedEmail
+	err = json.Unmarshal(buf, &entry)
+	if err != nil {
+		return entry, nil, err
+	}
+
+	raw, err := store.Get(ctx, key)
+
+	return entry, raw, err
+}
+
+// ReleaseQuarantined delivers the quarantined email into the user's Inbox. Returns ErrOverQuota
+// when the mailbox has no room for it, unless the over quota policy accepts mail anyway. An email
+// that was already delivered by a release that failed to clean up is only taken out of the quarantine.
+func ReleaseQuarantined(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string) error {
+	entry, raw, err := loadQuarantined(ctx, store, mailboxPrefix, userID, messageID)
+	if err != nil {
+		return err
+	}
+
+	delivered, err := isIndexed(ctx, store, mailboxPrefix, userID, messageID)
+	if err != nil {
+		return err
+	}
+	if delivered {
+		log.Printf("\"%s\" was already released from the quarantine of \"%s\"\n", messageID, userID)
+		return DeleteQuarantined(ctx, store, mailboxPrefix, userID, messageID)
+	}
+
+	room, err := hasRoom(ctx, store, mailboxPrefix, userID, len(raw))
+	if err != nil {
+		return err
+	}
+	if !room && quotaPolicy.OverQuota != OverQuotaAccept {
+		return fmt.Errorf("%w: %s needs %s", ErrOverQuota, messageID, formatSize(int64(len(raw))))
+	}
+
+	// parsed before the blob is referenced, like delivered mail
+	parsed, err := parseEmail(raw, contentHash(raw))
+	if err != nil {
+		return err
+	}
+	parsed.Verdicts = &entry.Verdicts
+	parsed.Folder = FolderInbox
+
+	_, err = putBlob(ctx, store, mailboxPrefix, raw, []string{userID + "/" + messageID})
+	if err != nil {
+		return err
+	}
+
+	err = processEmail(ctx, store, mailboxPrefix, userID, messageID, messageID, parsed)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Released \"%s\" from the quarantine of \"%s\"\n", messageID, userID)
+
+	return DeleteQuarantined(ctx, store, mailboxPrefix, userID, messageID)
+}
+
+// PurgeQuarantine deletes the user's quarantined mail that is older than days at now. A dry run
+// only reports what would be deleted.
+func PurgeQuarantine(ctx context.Context, store MailStore, mailboxPrefix, userID string, now time.Time, days int, dryRun bool) (PurgeReport, error) {
+	report := PurgeReport{
+		UserID: userID,
+		DryRun: dryRun,
+		Emails: []PurgedEmail{},
+	}
+
+	emails, err := ListQuarantine(ctx, store, mailboxPrefix, userID)
+	if err != nil {
+		return report, err
+	}
+
+	var lastErr error
+	for _, entry := range emails {
+		if !entry.Quarantined.Before(now.AddDate(0, 0, -days)) {
+			continue
+		}
+
+		if !dryRun {
+			log.Printf("Purging \"%s\" from the quarantine of \"%s\", quarantined %s\n", entry.MessageID, userID, entry.Quarantined.Format(time.RFC3339))
+			err = DeleteQuarantined(ctx, store, mailboxPrefix, userID, entry.MessageID)
+			if err != nil {
+				// keep going, the email is picked up again by the next purge
+				log.Println(err)
+				lastErr = err
+				continue
+			}
+		}
+
+		report.Emails = append(report.Emails, PurgedEmail{
+			MessageID: entry.MessageID,
+			Subject:   entry.Subject,
+			From:      entry.From,
+			Filed:     entry.Quarantined,
+			Size:      entry.Size,
+			Days:      days,
+		})
+		report.Size += entry.Size
+	}
+
+	return report, lastErr
+}
+
+// ListQuarantines returns the users that have quarantined mail
+func ListQuarantines(ctx context.Context, store MailStore, mailboxPrefix string) ([]string, error) {
+	prefix := mailboxPrefix + "/_quarantine/"
+	keys, err := store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []string{}
+	for _, key := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(key, prefix), "/", 2)
+		if len(parts) == 2 && parts[0] != "" && !containsString(users, parts[0]) {
+			users = append(users, parts[0])
+		}
+	}
+
+	return users, nil
+}
+
+// DeleteQuarantined email of the user for good
+func DeleteQuarantined(ctx context.Context, store MailStore, mailboxPrefix, userID, messageID string) error {
+	key := quarantineKey(mailboxPrefix, userID, messageID)
+
+	_, err := store.Get(ctx, key+".json")
+	if err != nil {
+		return err
+	}
+
+	err = store.Delete(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return store.Delete(ctx, key+".json")
+}
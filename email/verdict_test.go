@@ -0,0 +1,217 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// quarantine the raw message for alice the way postmaster does for a virus
+func quarantine(t *testing.T, store MailStore, messageID, raw string) {
+	t.Helper()
+	ctx := context.Background()
+
+	err := store.Put(ctx, "incoming/"+messageID, []byte(raw), "message/rfc822")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SortEmailIntoMailbox(ctx, store, "mailbox", MoveOperation{
+		MessageID:       messageID,
+		SourceObjectKey: "incoming/" + messageID,
+		DestObjectKey:   messageID,
+		DestPrefixes:    []string{"alice"},
+		Verdicts:        &Verdicts{Virus: VerdictFail},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReleaseQuarantinedOnce(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	quarantine(t, store, "lunch", testMessage)
+	err := ReleaseQuarantined(ctx, store, "mailbox", "alice", "lunch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a release whose clean up failed leaves the email quarantined after delivering it
+	quarantine(t, store, "lunch", testMessage)
+	err = ReleaseQuarantined(ctx, store, "mailbox", "alice", "lunch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := LoadIndex(ctx, store, "mailbox", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Emails) != 1 || index.Emails[0].Folder != FolderInbox {
+		t.Errorf("index after releasing twice is %+v, want the email once in the Inbox", index.Emails)
+	}
+	quota, _ := GetQuota(ctx, store, "mailbox", "alice")
+	if quota.Used != int64(len(testMessage)) || quota.Messages != 1 {
+		t.Errorf("quota after releasing twice is %d bytes in %d messages", quota.Used, quota.Messages)
+	}
+	emails, _ := ListQuarantine(ctx, store, "mailbox", "alice")
+	if len(emails) != 0 {
+		t.Errorf("quarantine still has %v", emails)
+	}
+}
+
+func TestReleaseQuarantinedChecksQuota(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	previous := quotaPolicy
+	err := SetQuotaPolicy(QuotaPolicy{Limit: int64(len(testMessage)) - 1, OverQuota: OverQuotaHold})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		quotaPolicy = previous
+	})
+
+	quarantine(t, store, "lunch", testMessage)
+	err = ReleaseQuarantined(ctx, store, "mailbox", "alice", "lunch")
+	if !errors.Is(err, ErrOverQuota) {
+		t.Fatalf("release into a full mailbox returned %v, want ErrOverQuota", err)
+	}
+	emails, _ := ListQuarantine(ctx, store, "mailbox", "alice")
+	if len(emails) != 1 {
+		t.Errorf("quarantine has %v, want the email kept", emails)
+	}
+
+	quotaPolicy.OverQuota = OverQuotaAccept
+	err = ReleaseQuarantined(ctx, store, "mailbox", "alice", "lunch")
+	if err != nil {
+		t.Errorf("release with the accept policy returned %v", err)
+	}
+}
+
+func TestReleaseUnparsableQuarantinedLeavesNoBlobRefs(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	quarantine(t, store, "broken", "Content-Type: multipart/mixed\r\n\r\nno boundary")
+	err := ReleaseQuarantined(ctx, store, "mailbox", "alice", "broken")
+	if err == nil {
+		t.Fatal("release of an unparsable email succeeded")
+	}
+
+	refs, _ := store.List(ctx, "mailbox/_blobs/")
+	if len(refs) != 0 {
+		t.Errorf("blobs %v were referenced for an email that wasn't released", refs)
+	}
+}
+
+func TestPurgeQuarantine(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	quarantine(t, store, "lunch", testMessage)
+	now := time.Now().UTC()
+
+	report, err := PurgeQuarantine(ctx, store, "mailbox", "alice", now, 30, false)
+	if err != nil || len(report.Emails) != 0 {
+		t.Fatalf("purge of new mail deleted %v, %v", report.Emails, err)
+	}
+
+	later := now.AddDate(0, 0, 31)
+	report, err = PurgeQuarantine(ctx, store, "mailbox", "alice", later, 30, true)
+	if err != nil || len(report.Emails) != 1 {
+		t.Fatalf("dry run reported %v, %v, want the email", report.Emails, err)
+	}
+	emails, _ := ListQuarantine(ctx, store, "mailbox", "alice")
+	if len(emails) != 1 {
+		t.Fatalf("dry run deleted the email")
+	}
+
+	report, err = PurgeQuarantine(ctx, store, "mailbox", "alice", later, 30, false)
+	if err != nil || len(report.Emails) != 1 || report.Size != len(testMessage) {
+		t.Fatalf("purge reported %+v, %v", report, err)
+	}
+	keys, _ := store.List(ctx, quarantinePrefix("mailbox", "alice"))
+	if len(keys) != 0 {
+		t.Errorf("purge left %v", keys)
+	}
+
+	users, err := ListQuarantines(ctx, store, "mailbox")
+	if err != nil || len(users) != 0 {
+		t.Errorf("ListQuarantines after the purge = %v, %v", users, err)
+	}
+}
+
+func TestVerdictsFromHeadersTakesTheFirst(t *testing.T) {
+	// SES adds its verdicts at the top, the sender can't override them further down
+	raw := "X-SES-Spam-Verdict: FAIL\r\n" +
+		"X-SES-Virus-Verdict: PASS\r\n" +
+		"X-SES-Spam-Verdict: PASS\r\n" +
+		"X-SES-Virus-Verdict: FAIL\r\n" +
+		testMessage
+
+	verdicts := verdictsFromHeaders(readHeaders([]byte(raw)))
+	if want := (&Verdicts{Spam: VerdictFail, Virus: VerdictPass}); !reflect.DeepEqual(verdicts, want) {
+		t.Errorf("verdicts = %+v, want %+v", verdicts, want)
+	}
+}
+
+func TestReleaseHeldKeepsVerdicts(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	previous := quotaPolicy
+	err := SetQuotaPolicy(QuotaPolicy{Limit: 1, OverQuota: OverQuotaHold})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		quotaPolicy = previous
+	})
+
+	// spam held for a full mailbox, with a verdict header the sender added
+	raw := "X-SES-Spam-Verdict: PASS\r\n" + testMessage
+	err = store.Put(ctx, "incoming/lunch", []byte(raw), "message/rfc822")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SortEmailIntoMailbox(ctx, store, "mailbox", MoveOperation{
+		MessageID:       "lunch",
+		SourceObjectKey: "incoming/lunch",
+		DestObjectKey:   "lunch",
+		DestPrefixes:    []string{"alice"},
+		Verdicts:        &Verdicts{Spam: VerdictFail},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quotaPolicy.Limit = 0
+	held, err := LoadHeldEmails(ctx, store, "mailbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(held) != 1 || held[0].Verdicts == nil || held[0].Verdicts.Spam != VerdictFail {
+		t.Fatalf("held emails are %+v, want the email with its spam verdict", held)
+	}
+	err = SortEmailIntoMailbox(ctx, store, "mailbox", held[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := LoadIndex(ctx, store, "mailbox", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Emails) != 1 || index.Emails[0].Folder != FolderSpam {
+		t.Errorf("index after the release is %+v, want the email in Spam", index.Emails)
+	}
+	keys, _ := store.List(ctx, heldPrefix("mailbox"))
+	if len(keys) != 0 {
+		t.Errorf("release left %v", keys)
+	}
+}
@@ -7,5 +7,7 @@ require (
 	github.com/aws/aws-lambda-go v1.17.0
 	github.com/aws/aws-sdk-go-v2 v0.23.0
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/klauspost/compress v1.10.10
 	github.com/lestrrat-go/jwx v1.0.2
+	golang.org/x/net v0.0.0-20200707034311-ab3426394381
 )
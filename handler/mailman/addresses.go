@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+// addressRequest is the body used to point an alias or the catch-all at a user
+type addressRequest struct {
+	User string
+}
+
+// groupRequest is the body used to set the users of a group
+type groupRequest struct {
+	Users []string
+}
+
+// addressNamespace is the namespace of the domain in the domain query string parameter, the primary domain when there is none
+func addressNamespace(ctx context.Context, event events.APIGatewayV2HTTPRequest) (string, error) {
+	registry, err := email.LoadDomainRegistry(ctx, store, mailboxPrefix, domain)
+	if err != nil {
+		return "", err
+	}
+
+	return registry.Namespace(event.QueryStringParameters["domain"])
+}
+
+func getAddresses(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	namespace, err := addressNamespace(ctx, event)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	addresses, err := email.LoadAddressMap(ctx, store, mailboxPrefix, namespace)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, addresses)
+}
+
+func addUser(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	namespace, err := addressNamespace(ctx, event)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	addresses, err := email.AddUser(ctx, store, mailboxPrefix, namespace, pathParameter(event, "name"))
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, addresses)
+}
+
+func removeUser(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	namespace, err := addressNamespace(ctx, event)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	addresses, err := email.RemoveUser(ctx, store, mailboxPrefix, namespace, pathParameter(event, "name"))
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, addresses)
+}
+
+func setAlias(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	namespace, err := addressNamespace(ctx, event)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	var req addressRequest
+	err = decodeJSONBody(event, &req)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	addresses, err := email.SetAlias(ctx, store, mailboxPrefix, namespace, pathParameter(event, "name"), req.User)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, addresses)
+}
+
+func removeAlias(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	namespace, err := addressNamespace(ctx, event)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	addresses, err := email.RemoveAlias(ctx, store, mailboxPrefix, namespace, pathParameter(event, "name"))
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, addresses)
+}
+
+func setGroup(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	namespace, err := addressNamespace(ctx, event)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	var req groupRequest
+	err = decodeJSONBody(event, &req)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	addresses, err := email.SetGroup(ctx, store, mailboxPrefix, namespace, pathParameter(event, "name"), req.Users)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, addresses)
+}
+
+func removeGroup(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	namespace, err := addressNamespace(ctx, event)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	addresses, err := email.RemoveGroup(ctx, store, mailboxPrefix, namespace, pathParameter(event, "name"))
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, addresses)
+}
+
+func setCatchAll(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	namespace, err := addressNamespace(ctx, event)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	var req addressRequest
+	err = decodeJSONBody(event, &req)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	addresses, err := email.SetCatchAll(ctx, store, mailboxPrefix, namespace, req.User)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, addresses)
+}
+
+func listDomains(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	registry, err := email.LoadDomainRegistry(ctx, store, mailboxPrefix, domain)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, registry)
+}
+
+func addDomain(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	registry, err := email.AddDomain(ctx, store, mailboxPrefix, domain, pathParameter(event, "domain"))
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, registry)
+}
+
+func removeDomain(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	registry, err := email.RemoveDomain(ctx, store, mailboxPrefix, domain, pathParameter(event, "domain"))
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, registry)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"mime"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+func getAttachment(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	attachment, data, err := email.GetAttachment(ctx, store, mailboxPrefix, event.PathParameters["userID"], event.PathParameters["emailID"], event.PathParameters["attachmentID"])
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildFileResponse(ctx, attachment, data), nil
+}
+
+// buildFileResponse serves the attachment content. Only embedded images are shown inline,
+// anything else is downloaded so an html attachment can't run on our domain.
+func buildFileResponse(ctx context.Context, attachment email.Attachment, data []byte) events.APIGatewayV2HTTPResponse {
+	disposition := "attachment"
+	if attachment.Embedded && strings.HasPrefix(strings.ToLower(attachment.ContentType), "image/") {
+		disposition = "inline"
+	}
+	filename := attachment.Filename
+	if filename == "" {
+		filename = "attachment-" + attachment.ID
+	}
+	if formatted := mime.FormatMediaType(disposition, map[string]string{"filename": filename}); formatted != "" {
+		disposition = formatted
+	}
+
+	res := buildOKResponse(ctx, false, map[string]string{
+		"Content-Type":            attachment.ContentType,
+		"Content-Disposition":     disposition,
+		"Content-Security-Policy": "default-src 'none'; sandbox",
+		"X-Content-Type-Options":  "nosniff",
+	},
+		base64.StdEncoding.EncodeToString(data),
+	)
+	res.IsBase64Encoded = true
+
+	return res
+}
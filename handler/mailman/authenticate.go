@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/gideonw/gopher-mail/auth"
+	"github.com/gideonw/gopher-mail/email"
+)
+
+// errWrongUser is returned when the signed in user asks for someone else's mailbox
+var errWrongUser = errors.New("signed in as another user")
+
+// errNoToken is returned when a mailbox is asked for without signing in
+var errNoToken = errors.New("sign in to use this mailbox")
+
+// errNotAdmin is returned when a user that isn't an admin uses the admin routes
+var errNotAdmin = errors.New("signed in user is not an admin")
+
+// adminRoutePrefix is the start of the path of every route that manages the whole system
+const adminRoutePrefix = pathPrefix + "/admin/"
+
+// authenticate the request, every route with a mailbox in its path needs the token of the
+// user that owns it and the store acts as them. Routes outside of a mailbox, such as login,
+// don't need a token.
+func authenticate(ctx context.Context, event events.APIGatewayV2HTTPRequest) (context.Context, *events.APIGatewayV2HTTPResponse) {
+	token := auth.TokenFromRequest(event.Headers, event.Cookies)
+	if isAdminRoute(event.RouteKey) {
+		return ctx, authorizeAdmin(ctx, token)
+	}
+
+	owner, ok := event.PathParameters["userID"]
+	if !ok {
+		return ctx, nil
+	}
+	if token == "" {
+		res := buildClientErrorResponse(ctx, 401, errNoToken)
+		return ctx, &res
+	}
+
+	userID, err := auth.VerifyToken(token)
+	if err != nil {
+		log.Println(err)
+		res := buildClientErrorResponse(ctx, 401, err)
+		return ctx, &res
+	}
+
+	if owner != userID {
+		res := buildClientErrorResponse(ctx, 403, errWrongUser)
+		return ctx, &res
+	}
+
+	return email.WithOwner(ctx, userID), nil
+}
+
+// isAdminRoute reports if the route key, e.g. "GET /api/admin/addresses", is an admin route
+func isAdminRoute(routeKey string) bool {
+	parts := strings.SplitN(routeKey, " ", 2)
+
+	return len(parts) == 2 && strings.HasPrefix(parts[1], adminRoutePrefix)
+}
+
+// authorizeAdmin requires the token of one of the ADMIN_USERS, admin routes don't act as
+// anyone so they can't read encrypted mail
+func authorizeAdmin(ctx context.Context, token string) *events.APIGatewayV2HTTPResponse {
+	userID, err := auth.VerifyToken(token)
+	if err != nil {
+		log.Println(err)
+		res := buildClientErrorResponse(ctx, 401, err)
+		return &res
+	}
+
+	if !containsString(adminUsers, userID) {
+		res := buildClientErrorResponse(ctx, 403, errNotAdmin)
+		return &res
+	}
+
+	return nil
+}
+
+// containsString reports if s is in the list
+func containsString(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redactEvent removes the credentials from the request so it can be logged
+func redactEvent(event events.APIGatewayV2HTTPRequest) events.APIGatewayV2HTTPRequest {
+	headers := make(map[string]string)
+	for name, value := range event.Headers {
+		if strings.EqualFold(name, "authorization") || strings.EqualFold(name, "cookie") {
+			value = "REDACTED"
+		}
+		headers[name] = value
+	}
+	event.Headers = headers
+	event.Cookies = nil
+	if event.RouteKey == "POST /api/auth/login" {
+		event.Body = "REDACTED"
+	}
+
+	return event
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/gideonw/gopher-mail/auth"
+)
+
+func signTestToken(t *testing.T, key, userID string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{
+		Subject:   userID,
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	signed, err := token.SignedString([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestAuthenticate(t *testing.T) {
+	auth.SetSigningKey("test-key")
+	alice := signTestToken(t, "test-key", "alice")
+	forged := signTestToken(t, "other-key", "alice")
+
+	mailbox := map[string]string{"userID": "alice"}
+	for _, tc := range []struct {
+		name       string
+		routeKey   string
+		params     map[string]string
+		token      string
+		wantStatus int
+	}{
+		{"login needs no token", "POST /api/login", nil, "", 0},
+		{"mailbox without a token", "GET /api/{userID}/emails", mailbox, "", 401},
+		{"mailbox with a forged token", "GET /api/{userID}/emails", mailbox, forged, 401},
+		{"someone else's mailbox", "GET /api/{userID}/emails", map[string]string{"userID": "bob"}, alice, 403},
+		{"own mailbox", "GET /api/{userID}/emails", mailbox, alice, 0},
+		{"admin route without a token", "GET /api/admin/addresses", nil, "", 401},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tc.token != "" {
+				headers["Authorization"] = "Bearer " + tc.token
+			}
+
+			_, res := authenticate(context.Background(), events.APIGatewayV2HTTPRequest{
+				RouteKey:       tc.routeKey,
+				PathParameters: tc.params,
+				Headers:        headers,
+			})
+			status := 0
+			if res != nil {
+				status = res.StatusCode
+			}
+			if status != tc.wantStatus {
+				t.Errorf("status = %d, want %d", status, tc.wantStatus)
+			}
+		})
+	}
+}
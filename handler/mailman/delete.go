@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+// deleteEmail permanently, moving it to the Trash is done with the move route
+func deleteEmail(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	err := email.DeleteEmail(ctx, store, mailboxPrefix, event.PathParameters["userID"], event.PathParameters["emailID"])
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, map[string]string{
+		"MessageID": event.PathParameters["emailID"],
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"log"
+	"mime"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+// exportMailbox serves the mailbox as an mbox or Maildir download. Lambda responses are limited
+// to 6MB, larger mailboxes have to be exported with the gopher-mail command.
+func exportMailbox(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	userID := event.PathParameters["userID"]
+
+	opts, err := email.ParseExportOptions(event.QueryStringParameters)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	var buf bytes.Buffer
+	err = email.ExportMailbox(ctx, store, mailboxPrefix, userID, &buf, opts)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	contentType, filename := "application/mbox", userID+".mbox"
+	if opts.Format == email.ExportMaildir {
+		contentType, filename = "application/x-tar", userID+".maildir.tar"
+	}
+
+	res := buildOKResponse(ctx, false, map[string]string{
+		"Content-Type":           contentType,
+		"Content-Disposition":    mime.FormatMediaType("attachment", map[string]string{"filename": filename}),
+		"X-Content-Type-Options": "nosniff",
+	},
+		base64.StdEncoding.EncodeToString(buf.Bytes()),
+	)
+	res.IsBase64Encoded = true
+
+	return res, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+func updateFlags(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	var update email.FlagsUpdate
+	err := decodeJSONBody(event, &update)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	flags, err := email.UpdateFlags(ctx, store, mailboxPrefix, event.PathParameters["userID"], event.PathParameters["emailID"], update)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, map[string]interface{}{
+		"MessageID": event.PathParameters["emailID"],
+		"Flags":     flags,
+	})
+}
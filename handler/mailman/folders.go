@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+// folderRequest is the body used to create, rename and move into folders
+type folderRequest struct {
+	Name string
+}
+
+func listFolders(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	folders, err := email.ListFolders(ctx, store, mailboxPrefix, event.PathParameters["userID"])
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, folders)
+}
+
+func createFolder(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	var req folderRequest
+	err := decodeJSONBody(event, &req)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	folder, err := email.CreateFolder(ctx, store, mailboxPrefix, event.PathParameters["userID"], req.Name)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, folder)
+}
+
+func renameFolder(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	var req folderRequest
+	err := decodeJSONBody(event, &req)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	err = email.RenameFolder(ctx, store, mailboxPrefix, event.PathParameters["userID"], pathParameter(event, "folder"), req.Name)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return listFolders(ctx, event)
+}
+
+func deleteFolder(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	err := email.DeleteFolder(ctx, store, mailboxPrefix, event.PathParameters["userID"], pathParameter(event, "folder"))
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return listFolders(ctx, event)
+}
+
+func moveEmail(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	var req folderRequest
+	err := decodeJSONBody(event, &req)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	err = email.MoveEmail(ctx, store, mailboxPrefix, event.PathParameters["userID"], event.PathParameters["emailID"], req.Name)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, map[string]string{
+		"MessageID": event.PathParameters["emailID"],
+		"Folder":    req.Name,
+	})
+}
+
+// buildJSONResponse marshals v as the body of an uncached 200 response
+func buildJSONResponse(ctx context.Context, v interface{}) (events.APIGatewayV2HTTPResponse, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return buildErrorResponse(ctx, err), err
+	}
+
+	return buildOKResponse(ctx, false, map[string]string{
+		"Content-Type": "application/json",
+	},
+		string(buf),
+	), nil
+}
@@ -4,22 +4,22 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 
-	"github.com/aws/aws-sdk-go-v2/aws/external"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-
 	"github.com/gideonw/gopher-mail/auth"
 	"github.com/gideonw/gopher-mail/email"
 )
 
 var invokeCount = 0
-var s3Client *s3.Client
+var store email.MailStore
 
 // ENV variables
 var domain string
@@ -27,6 +27,10 @@ var mailboxBucket string
 var mailboxPrefix string
 var verifyHeader string
 var verifyValue string
+var imageProxySecret string
+
+// adminUsers can manage the address map, from the comma separated ADMIN_USERS
+var adminUsers []string
 
 const pathPrefix = "/api"
 
@@ -37,16 +41,40 @@ func init() {
 	mailboxPrefix = os.Getenv("MAILBOX_PREFIX")
 	verifyHeader = os.Getenv("CF_VERIFY_HEADER")
 	verifyValue = os.Getenv("CF_VERIFY_VALUE")
+	imageProxySecret = os.Getenv("IMAGE_PROXY_SECRET")
+	for _, userID := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if userID = strings.TrimSpace(userID); userID != "" {
+			adminUsers = append(adminUsers, userID)
+		}
+	}
+	if key := os.Getenv("AUTH_SIGNING_KEY"); key != "" {
+		auth.SetSigningKey(key)
+	}
 
-	cfg, err := external.LoadDefaultAWSConfig()
+	var err error
+	store, err = email.NewStoreFromEnv(mailboxBucket, mailboxPrefix, email.StoreOptions{
+		// mail is only decrypted for the user that signed in
+		RequireOwner: true,
+	})
 	if err != nil {
-		panic("unable to load SDK config, " + err.Error())
+		panic("unable to open the mailboxes, " + err.Error())
 	}
 
-	// Set the AWS Region that the service clients should use
-	// cfg.Region = endpoints.UsWest2RegionID
+	// testing a Sieve script needs the addresses of the mailboxes, postmaster is the one running them
+	email.SetSievePolicy(email.SievePolicy{
+		Domain: domain,
+	})
 
-	s3Client = s3.New(cfg)
+	// the quota is only needed to report on it, postmaster is the one enforcing it
+	if quota, err := strconv.ParseInt(os.Getenv("MAILBOX_QUOTA_MB"), 10, 64); err == nil {
+		err = email.SetQuotaPolicy(email.QuotaPolicy{
+			Limit:     quota << 20,
+			OverQuota: os.Getenv("OVER_QUOTA_POLICY"),
+		})
+		if err != nil {
+			panic("unable to configure quotas, " + err.Error())
+		}
+	}
 }
 
 func main() {
@@ -55,13 +83,17 @@ func main() {
 
 // Handler is our lambda handler invoked by the `lambda.Start` function call
 func Handler(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
-	buf, _ := json.Marshal(event)
+	buf, _ := json.Marshal(redactEvent(event))
 	log.Println(string(buf))
-	log.Println(event)
 
 	// verify request is from cloudfront
 	cfHeaderValue, cfHeaderOk := event.Headers[verifyHeader]
 	if cfHeaderOk && cfHeaderValue == verifyValue {
+		ctx, denied := authenticate(ctx, event)
+		if denied != nil {
+			return *denied, nil
+		}
+
 		// Handle routes
 		switch event.RouteKey {
 		case "GET /.well-known/openid-configuration":
@@ -89,10 +121,15 @@ func Handler(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.
 				payload,
 			), nil
 		case "GET /api/{userID}/emails":
-			emails, err := email.ListEmails(ctx, s3Client, mailboxBucket, mailboxPrefix, event.PathParameters["userID"])
+			opts, err := email.ParseListOptions(event.QueryStringParameters)
+			if err != nil {
+				return buildClientErrorResponse(ctx, 400, err), nil
+			}
+
+			emails, err := email.ListEmails(ctx, store, mailboxPrefix, event.PathParameters["userID"], opts)
 			if err != nil {
 				log.Println(err)
-				return buildErrorResponse(ctx, err), err
+				return handleError(ctx, err)
 			}
 
 			return buildOKResponse(ctx, false, map[string]string{
@@ -101,8 +138,119 @@ func Handler(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.
 				emails,
 			), nil
 
+		case "POST /api/{userID}/emails/rebuild":
+			index, err := email.RebuildIndex(ctx, store, mailboxPrefix, event.PathParameters["userID"])
+			if err != nil {
+				log.Println(err)
+				return buildErrorResponse(ctx, err), err
+			}
+			buf, _ := json.Marshal(index)
+
+			return buildOKResponse(ctx, false, map[string]string{
+				"Content-Type": "application/json",
+			},
+				string(buf),
+			), nil
+
+		case "GET /api/{userID}/search":
+			return search(ctx, event)
+
+		case "GET /api/{userID}/threads":
+			return listThreads(ctx, event)
+		case "GET /api/{userID}/thread/{threadID}":
+			return getThread(ctx, event)
+
+		case "GET /api/{userID}/folders":
+			return listFolders(ctx, event)
+		case "POST /api/{userID}/folders":
+			return createFolder(ctx, event)
+		case "PUT /api/{userID}/folders/{folder+}":
+			return renameFolder(ctx, event)
+		case "DELETE /api/{userID}/folders/{folder+}":
+			return deleteFolder(ctx, event)
+		case "POST /api/{userID}/email/{emailID}/move":
+			return moveEmail(ctx, event)
+		case "PATCH /api/{userID}/email/{emailID}":
+			return updateFlags(ctx, event)
+		case "DELETE /api/{userID}/email/{emailID}":
+			return deleteEmail(ctx, event)
+		case "GET /api/{userID}/email/{emailID}/attachment/{attachmentID}":
+			return getAttachment(ctx, event)
+		case "GET /api/{userID}/email/{emailID}/raw":
+			return getRawEmail(ctx, event)
+		case "GET /api/{userID}/email/{emailID}/headers":
+			return getHeaders(ctx, event)
+		case "GET /api/{userID}/email/{emailID}/html":
+			return renderEmail(ctx, event)
+		case "GET /api/{userID}/image":
+			return proxyImage(ctx, event)
+
+		case "GET /api/{userID}/settings":
+			return getSettings(ctx, event)
+		case "POST /api/{userID}/settings/remote-images":
+			return allowRemoteImages(ctx, event)
+		case "DELETE /api/{userID}/settings/remote-images/{sender}":
+			return blockRemoteImages(ctx, event)
+		case "PUT /api/{userID}/settings/retention/{folder+}":
+			return setRetention(ctx, event)
+		case "DELETE /api/{userID}/settings/retention/{folder+}":
+			return removeRetention(ctx, event)
+		case "PUT /api/{userID}/settings/subaddressing":
+			return setSubaddressing(ctx, event)
+		case "POST /api/{userID}/settings/blocked-tags":
+			return blockTag(ctx, event)
+		case "DELETE /api/{userID}/settings/blocked-tags/{tag}":
+			return unblockTag(ctx, event)
+		case "PUT /api/{userID}/settings/triage":
+			return setTriage(ctx, event)
+		case "GET /api/{userID}/quarantine":
+			return listQuarantine(ctx, event)
+		case "POST /api/{userID}/quarantine/{emailID}/release":
+			return releaseQuarantined(ctx, event)
+		case "DELETE /api/{userID}/quarantine/{emailID}":
+			return deleteQuarantined(ctx, event)
+		case "GET /api/{userID}/sieve":
+			return getSieveScript(ctx, event)
+		case "PUT /api/{userID}/sieve":
+			return putSieveScript(ctx, event)
+		case "DELETE /api/{userID}/sieve":
+			return deleteSieveScript(ctx, event)
+		case "POST /api/{userID}/sieve/validate":
+			return validateSieveScript(ctx, event)
+		case "POST /api/{userID}/sieve/test":
+			return testSieveScript(ctx, event)
+		case "GET /api/{userID}/retention":
+			return previewRetention(ctx, event)
+		case "GET /api/{userID}/quota":
+			return getQuota(ctx, event)
+		case "GET /api/{userID}/export":
+			return exportMailbox(ctx, event)
+
+		case "GET /api/admin/domains":
+			return listDomains(ctx, event)
+		case "PUT /api/admin/domains/{domain}":
+			return addDomain(ctx, event)
+		case "DELETE /api/admin/domains/{domain}":
+			return removeDomain(ctx, event)
+		case "GET /api/admin/addresses":
+			return getAddresses(ctx, event)
+		case "PUT /api/admin/addresses/users/{name}":
+			return addUser(ctx, event)
+		case "DELETE /api/admin/addresses/users/{name}":
+			return removeUser(ctx, event)
+		case "PUT /api/admin/addresses/aliases/{name}":
+			return setAlias(ctx, event)
+		case "DELETE /api/admin/addresses/aliases/{name}":
+			return removeAlias(ctx, event)
+		case "PUT /api/admin/addresses/groups/{name}":
+			return setGroup(ctx, event)
+		case "DELETE /api/admin/addresses/groups/{name}":
+			return removeGroup(ctx, event)
+		case "PUT /api/admin/addresses/catch-all":
+			return setCatchAll(ctx, event)
+
 		case "GET /api/{userID}/email/{emailID}":
-			email, err := email.GetEmailByID(ctx, s3Client, mailboxBucket, mailboxPrefix, event.PathParameters["userID"], event.PathParameters["emailID"])
+			email, err := email.GetEmailByID(ctx, store, mailboxPrefix, event.PathParameters["userID"], event.PathParameters["emailID"])
 			if err != nil {
 				log.Println(err)
 				return buildErrorResponse(ctx, err), err
@@ -133,11 +281,10 @@ func Handler(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.
 			res := events.APIGatewayV2HTTPResponse{
 				StatusCode: 200,
 				Body:       string(buf),
+				// the browser sends the cookie with requests it makes on its own, like images
+				Cookies: []string{auth.TokenCookie(token.Token)},
 			}
 
-			buf, _ = json.Marshal(res)
-			log.Println(string(buf))
-
 			return res, nil
 		default:
 			return events.APIGatewayV2HTTPResponse{
@@ -165,6 +312,51 @@ func buildErrorResponse(ctx context.Context, err error) events.APIGatewayV2HTTPR
 	}
 }
 
+// handleError responds with a 4xx for errors caused by the request, anything else is a 500
+func handleError(ctx context.Context, err error) (events.APIGatewayV2HTTPResponse, error) {
+	switch {
+	case errors.Is(err, email.ErrNotFound),
+		errors.Is(err, email.ErrFolderNotFound),
+		errors.Is(err, email.ErrDomainNotFound):
+		return buildClientErrorResponse(ctx, 404, err), nil
+	case errors.Is(err, email.ErrForbidden):
+		return buildClientErrorResponse(ctx, 403, err), nil
+	case errors.Is(err, email.ErrFolderExists),
+		errors.Is(err, email.ErrAddressExists),
+		errors.Is(err, email.ErrAddressInUse),
+		errors.Is(err, email.ErrDomainExists),
+		errors.Is(err, email.ErrOverQuota):
+		return buildClientErrorResponse(ctx, 409, err), nil
+	case errors.Is(err, email.ErrInvalidListOptions),
+		errors.Is(err, email.ErrInvalidFolder),
+		errors.Is(err, email.ErrSystemFolder),
+		errors.Is(err, email.ErrInvalidFlag),
+		errors.Is(err, email.ErrInvalidQuery),
+		errors.Is(err, email.ErrInvalidSender),
+		errors.Is(err, email.ErrInvalidRetention),
+		errors.Is(err, email.ErrInvalidExportOptions),
+		errors.Is(err, email.ErrInvalidAddress),
+		errors.Is(err, email.ErrInvalidTag),
+		errors.Is(err, email.ErrInvalidDomain),
+		errors.Is(err, email.ErrUnknownUser),
+		errors.Is(err, email.ErrInvalidSieve),
+		errors.Is(err, email.ErrSieveFailed),
+		errors.Is(err, email.ErrInvalidTriage),
+		errors.Is(err, email.ErrInvalidPath),
+		errors.Is(err, errBadRequest):
+		return buildClientErrorResponse(ctx, 400, err), nil
+	}
+
+	return buildErrorResponse(ctx, err), err
+}
+
+func buildClientErrorResponse(ctx context.Context, statusCode int, err error) events.APIGatewayV2HTTPResponse {
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: statusCode,
+		Body:       fmt.Sprintf("%s", err),
+	}
+}
+
 func buildOKResponse(ctx context.Context, cache bool, headers map[string]string, body string) events.APIGatewayV2HTTPResponse {
 	finalHeaders := headers
 	if !cache {
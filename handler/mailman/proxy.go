@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// maxProxiedImage keeps the base64 encoded image under the lambda response limit
+const maxProxiedImage = 4 << 20
+
+// errForbiddenImage is returned for proxy requests with a bad signature or to an address the proxy won't fetch
+var errForbiddenImage = errors.New("image can't be proxied")
+
+// blockedNetworks are the addresses the image proxy never connects to, otherwise an email
+// could have the proxy read the lambda metadata endpoint or anything else inside the VPC
+var blockedNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+var imageClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || isBlockedIP(ip) {
+					return fmt.Errorf("%w: %s", errForbiddenImage, host)
+				}
+				return nil
+			},
+		}).DialContext,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     30 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+func isBlockedIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// imageSignature binds the image url to the user so the proxy can't be used to fetch arbitrary urls
+func imageSignature(userID, src string) []byte {
+	mac := hmac.New(sha256.New, []byte(imageProxySecret))
+	mac.Write([]byte(userID + "\n" + src))
+
+	return mac.Sum(nil)
+}
+
+// imageProxyURL is the signed path of the image proxy route for the remote image
+func imageProxyURL(userID, src string) string {
+	return pathPrefix + "/" + url.PathEscape(userID) + "/image?" + url.Values{
+		"url": {src},
+		"sig": {hex.EncodeToString(imageSignature(userID, src))},
+	}.Encode()
+}
+
+// proxyImage fetches a remote image for an email so the sender never sees the user's address
+func proxyImage(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	if imageProxySecret == "" {
+		return buildClientErrorResponse(ctx, 404, errForbiddenImage), nil
+	}
+
+	src := event.QueryStringParameters["url"]
+	sig, err := hex.DecodeString(event.QueryStringParameters["sig"])
+	if err != nil || !hmac.Equal(sig, imageSignature(event.PathParameters["userID"], src)) {
+		return buildClientErrorResponse(ctx, 403, errForbiddenImage), nil
+	}
+
+	parsed, err := url.Parse(src)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return buildClientErrorResponse(ctx, 403, errForbiddenImage), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, parsed.String(), nil)
+	if err != nil {
+		return buildClientErrorResponse(ctx, 403, errForbiddenImage), nil
+	}
+	req.Header.Set("User-Agent", "gopher-mail image proxy")
+	req.Header.Set("Accept", "image/*")
+
+	res, err := imageClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return buildClientErrorResponse(ctx, 502, errForbiddenImage), nil
+	}
+	defer res.Body.Close()
+
+	// svg can carry script so it is never served from our domain
+	contentType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if res.StatusCode != http.StatusOK || err != nil || !strings.HasPrefix(contentType, "image/") || contentType == "image/svg+xml" {
+		return buildClientErrorResponse(ctx, 502, fmt.Errorf("%w: %s returned %d %s", errForbiddenImage, parsed.Host, res.StatusCode, contentType)), nil
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxProxiedImage+1))
+	if err != nil {
+		log.Println(err)
+		return buildClientErrorResponse(ctx, 502, errForbiddenImage), nil
+	}
+	if len(data) > maxProxiedImage {
+		return buildClientErrorResponse(ctx, 502, fmt.Errorf("%w: image is too large", errForbiddenImage)), nil
+	}
+
+	response := buildOKResponse(ctx, true, map[string]string{
+		"Content-Type":            contentType,
+		"Cache-Control":           "private,max-age=86400",
+		"Content-Disposition":     "inline",
+		"Content-Security-Policy": "default-src 'none'; sandbox",
+		"X-Content-Type-Options":  "nosniff",
+	},
+		base64.StdEncoding.EncodeToString(data),
+	)
+	response.IsBase64Encoded = true
+
+	return response, nil
+}
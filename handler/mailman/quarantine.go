@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+func listQuarantine(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	emails, err := email.ListQuarantine(ctx, store, mailboxPrefix, event.PathParameters["userID"])
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, emails)
+}
+
+// releaseQuarantined delivers the email into the Inbox
+func releaseQuarantined(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	err := email.ReleaseQuarantined(ctx, store, mailboxPrefix, event.PathParameters["userID"], event.PathParameters["emailID"])
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, map[string]string{
+		"MessageID": event.PathParameters["emailID"],
+	})
+}
+
+func deleteQuarantined(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	err := email.DeleteQuarantined(ctx, store, mailboxPrefix, event.PathParameters["userID"], event.PathParameters["emailID"])
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, map[string]string{
+		"MessageID": event.PathParameters["emailID"],
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"mime"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+// getRawEmail serves the original message as an .eml download
+func getRawEmail(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	emailID := event.PathParameters["emailID"]
+
+	raw, err := email.GetRawEmail(ctx, store, mailboxPrefix, event.PathParameters["userID"], emailID)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	res := buildOKResponse(ctx, false, map[string]string{
+		"Content-Type":           "message/rfc822",
+		"Content-Disposition":    mime.FormatMediaType("attachment", map[string]string{"filename": emailID + ".eml"}),
+		"X-Content-Type-Options": "nosniff",
+	},
+		base64.StdEncoding.EncodeToString(raw),
+	)
+	res.IsBase64Encoded = true
+
+	return res, nil
+}
+
+func getHeaders(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	headers, err := email.GetHeaders(ctx, store, mailboxPrefix, event.PathParameters["userID"], event.PathParameters["emailID"])
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, headers)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+// renderContentSecurityPolicy stops anything the sanitizer missed from running, the rendered
+// email can only use inline styles and load images from us, remote images go through the proxy.
+// The sandbox keeps our origin so the browser sends the auth cookie with image requests.
+const renderContentSecurityPolicy = "default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'; sandbox allow-same-origin allow-popups allow-popups-to-escape-sandbox"
+
+func renderEmail(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	userID := event.PathParameters["userID"]
+	emailID := event.PathParameters["emailID"]
+
+	opts := email.RenderOptions{
+		AttachmentURL: func(attachment email.Attachment) string {
+			return attachmentURL(userID, emailID, attachment.ID)
+		},
+		// ?images=load shows the remote images of this email once without allowing the sender
+		LoadRemoteImages: event.QueryStringParameters["images"] == "load",
+	}
+	if imageProxySecret != "" {
+		opts.ImageProxyURL = func(src string) string {
+			return imageProxyURL(userID, src)
+		}
+	}
+
+	rendered, err := email.RenderHTML(ctx, store, mailboxPrefix, userID, emailID, opts)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildOKResponse(ctx, false, map[string]string{
+		"Content-Type":            "text/html; charset=utf-8",
+		"Content-Security-Policy": renderContentSecurityPolicy,
+		"X-Content-Type-Options":  "nosniff",
+		"X-Blocked-Images":        strconv.Itoa(rendered.BlockedImages),
+	},
+		rendered.HTML,
+	), nil
+}
+
+// attachmentURL is the path of the attachment route
+func attachmentURL(userID, emailID, attachmentID string) string {
+	return pathPrefix + "/" + url.PathEscape(userID) + "/email/" + url.PathEscape(emailID) + "/attachment/" + url.PathEscape(attachmentID)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// errBadRequest is returned when the request body or parameters can't be understood
+var errBadRequest = errors.New("bad request")
+
+// decodeBody of the request, API Gateway base64 encodes bodies it considers binary
+func decodeBody(event events.APIGatewayV2HTTPRequest) ([]byte, error) {
+	if event.IsBase64Encoded {
+		return base64.StdEncoding.DecodeString(event.Body)
+	}
+
+	return []byte(event.Body), nil
+}
+
+// decodeJSONBody of the request into v
+func decodeJSONBody(event events.APIGatewayV2HTTPRequest, v interface{}) error {
+	body, err := decodeBody(event)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errBadRequest, err)
+	}
+
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errBadRequest, err)
+	}
+
+	return nil
+}
+
+// pathParameter that may still be URL encoded, such as greedy parameters holding a folder path
+func pathParameter(event events.APIGatewayV2HTTPRequest, name string) string {
+	value := event.PathParameters[name]
+	if unescaped, err := url.PathUnescape(value); err == nil {
+		return unescaped
+	}
+
+	return value
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+func search(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	query, err := email.ParseSearchQuery(event.QueryStringParameters["q"])
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	if limit, ok := event.QueryStringParameters["limit"]; ok {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 {
+			return handleError(ctx, fmt.Errorf("%w: limit must be a positive number", errBadRequest))
+		}
+	}
+
+	emails, err := email.Search(ctx, store, mailboxPrefix, event.PathParameters["userID"], query)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, map[string][]email.Meta{
+		"emails": emails,
+	})
+}
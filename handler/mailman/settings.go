@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+// senderRequest is the body used to allow remote images from a sender
+type senderRequest struct {
+	Sender string
+}
+
+func getSettings(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	settings, err := email.LoadSettings(ctx, store, mailboxPrefix, event.PathParameters["userID"])
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, settings)
+}
+
+func allowRemoteImages(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	var req senderRequest
+	err := decodeJSONBody(event, &req)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	settings, err := email.AllowRemoteImages(ctx, store, mailboxPrefix, event.PathParameters["userID"], req.Sender)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, settings)
+}
+
+func blockRemoteImages(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	settings, err := email.BlockRemoteImages(ctx, store, mailboxPrefix, event.PathParameters["userID"], pathParameter(event, "sender"))
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, settings)
+}
+
+// retentionRequest is the body used to set the retention of a folder
+type retentionRequest struct {
+	Days int
+}
+
+func setRetention(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	var req retentionRequest
+	err := decodeJSONBody(event, &req)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	settings, err := email.SetRetention(ctx, store, mailboxPrefix, event.PathParameters["userID"], pathParameter(event, "folder"), req.Days)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, settings)
+}
+
+func removeRetention(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	settings, err := email.RemoveRetention(ctx, store, mailboxPrefix, event.PathParameters["userID"], pathParameter(event, "folder"))
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, settings)
+}
+
+// previewRetention is a dry run of the next purge, it lists the emails the retention rules would delete
+func previewRetention(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	report, err := email.PurgeMailbox(ctx, store, mailboxPrefix, event.PathParameters["userID"], time.Now().UTC(), true)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, report)
+}
+
+func getQuota(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	quota, err := email.GetQuota(ctx, store, mailboxPrefix, event.PathParameters["userID"])
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, quota)
+}
+
+// subaddressingRequest is the body used to change how mail sent with a tag is handled
+type subaddressingRequest struct {
+	Disabled bool
+	AutoFile bool
+}
+
+func setSubaddressing(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	var req subaddressingRequest
+	err := decodeJSONBody(event, &req)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	settings, err := email.SetSubaddressing(ctx, store, mailboxPrefix, event.PathParameters["userID"], req.Disabled, req.AutoFile)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, settings)
+}
+
+// tagRequest is the body used to block a tag
+type tagRequest struct {
+	Tag string
+}
+
+func blockTag(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	var req tagRequest
+	err := decodeJSONBody(event, &req)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	settings, err := email.BlockTag(ctx, store, mailboxPrefix, event.PathParameters["userID"], req.Tag)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, settings)
+}
+
+func unblockTag(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	settings, err := email.UnblockTag(ctx, store, mailboxPrefix, event.PathParameters["userID"], pathParameter(event, "tag"))
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, settings)
+}
+
+// setTriage sets what happens to mail failing each SES check, the body is an email.TriageSettings
+func setTriage(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	var req email.TriageSettings
+	err := decodeJSONBody(event, &req)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	settings, err := email.SetTriage(ctx, store, mailboxPrefix, event.PathParameters["userID"], req)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, settings)
+}
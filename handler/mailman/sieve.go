@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+// sieveRequest is the body used to upload, validate or test a Sieve script
+type sieveRequest struct {
+	Script string
+	// EmailID is the email in the user's mailbox a script is tested against
+	EmailID string
+}
+
+// sieveValidation is the outcome of validating a script, Error has the line of the first problem
+type sieveValidation struct {
+	Valid bool
+	Error string `json:",omitempty"`
+}
+
+func getSieveScript(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	script, err := email.LoadSieveScript(ctx, store, mailboxPrefix, event.PathParameters["userID"])
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, sieveRequest{Script: script})
+}
+
+func putSieveScript(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	var req sieveRequest
+	err := decodeJSONBody(event, &req)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	err = email.PutSieveScript(ctx, store, mailboxPrefix, event.PathParameters["userID"], req.Script)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, sieveValidation{Valid: true})
+}
+
+func deleteSieveScript(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	err := email.DeleteSieveScript(ctx, store, mailboxPrefix, event.PathParameters["userID"])
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, map[string]string{
+		"UserID": event.PathParameters["userID"],
+	})
+}
+
+// validateSieveScript checks a script without saving it, an invalid script is still a 200
+func validateSieveScript(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	var req sieveRequest
+	err := decodeJSONBody(event, &req)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	err = email.CheckSieveScript(ctx, store, mailboxPrefix, event.PathParameters["userID"], req.Script)
+	if errors.Is(err, email.ErrInvalidSieve) {
+		return buildJSONResponse(ctx, sieveValidation{Error: err.Error()})
+	}
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, sieveValidation{Valid: true})
+}
+
+// testSieveScript runs a script, or the user's own when there is none in the body, against
+// an email in the mailbox and responds with what it would do
+func testSieveScript(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	var req sieveRequest
+	err := decodeJSONBody(event, &req)
+	if err != nil {
+		return handleError(ctx, err)
+	}
+
+	result, err := email.TestSieveScript(ctx, store, mailboxPrefix, event.PathParameters["userID"], req.EmailID, req.Script)
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, result)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/gideonw/gopher-mail/email"
+)
+
+func listThreads(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	threads, err := email.ListThreads(ctx, store, mailboxPrefix, event.PathParameters["userID"], event.QueryStringParameters["folder"])
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, map[string][]email.Thread{
+		"threads": threads,
+	})
+}
+
+func getThread(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	emails, err := email.GetThread(ctx, store, mailboxPrefix, event.PathParameters["userID"], event.PathParameters["threadID"])
+	if err != nil {
+		log.Println(err)
+		return handleError(ctx, err)
+	}
+
+	return buildJSONResponse(ctx, map[string][]email.Meta{
+		"emails": emails,
+	})
+}
@@ -2,41 +2,75 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"log"
 	"os"
 	"regexp"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-
-	"github.com/aws/aws-sdk-go-v2/aws/external"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gideonw/gopher-mail/email"
 )
 
 var invokeCount = 0
-var s3Client *s3.Client
+var store email.MailStore
 var addressRegex *regexp.Regexp
 var domain string
+var mailboxBucket string
+var mailboxPrefix string
+
+// sendRequest is published to mailtruck when a user sends an email
+type sendRequest struct {
+	UserID string
+	// InReplyTo is the ID of the email in the user's mailbox being replied to
+	InReplyTo string
+
+	To       []string
+	Cc       []string
+	Subject  string
+	TextBody string
+}
 
 func init() {
 	domain = os.Getenv("DOMAIN")
+	mailboxBucket = os.Getenv("MAILBOX_BUCKET")
+	mailboxPrefix = os.Getenv("MAILBOX_PREFIX")
 	addressRegex = regexp.MustCompile(`[^a-zA-Z0-9\-_()*'.].*`)
 
-	cfg, err := external.LoadDefaultAWSConfig()
+	var err error
+	store, err = email.NewStoreFromEnv(mailboxBucket, mailboxPrefix, email.StoreOptions{})
 	if err != nil {
-		panic("unable to load SDK config, " + err.Error())
+		panic("unable to open the mailboxes, " + err.Error())
 	}
-
-	// Set the AWS Region that the service clients should use
-	// cfg.Region = endpoints.UsWest2RegionID
-
-	s3Client = s3.New(cfg)
 }
 
 // Handler is our lambda handler invoked by the `lambda.Start` function call
 func Handler(ctx context.Context, event events.SNSEvent) (int, error) {
+	var lastErr error
 	invokeCount = invokeCount + 1
 
-	return invokeCount, nil
+	for i := range event.Records {
+		var req sendRequest
+		err := json.Unmarshal([]byte(event.Records[i].SNS.Message), &req)
+		if err != nil {
+			log.Println(err)
+			lastErr = err
+			continue
+		}
+
+		// TODO: Send the email through SES
+
+		// Replies mark the original email as answered
+		if req.InReplyTo != "" {
+			err = email.MarkAnswered(ctx, store, mailboxPrefix, req.UserID, req.InReplyTo)
+			if err != nil {
+				log.Println(err)
+				lastErr = err
+			}
+		}
+	}
+
+	return invokeCount, lastErr
 }
 
 func main() {
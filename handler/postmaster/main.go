@@ -5,16 +5,17 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"strconv"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/gideonw/gopher-mail/email"
 
 	"github.com/aws/aws-sdk-go-v2/aws/external"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
 )
 
-var s3Client *s3.Client
+var store email.MailStore
 var addressRegex *regexp.Regexp
 var domain string
 var mailboxBucket string
@@ -29,15 +30,57 @@ func init() {
 
 	addressRegex = regexp.MustCompile(`[^a-zA-Z0-9\-_()*'.].*`)
 
+	var err error
+	store, err = email.NewStoreFromEnv(mailboxBucket, mailboxPrefix, email.StoreOptions{})
+	if err != nil {
+		panic("unable to open the mailboxes, " + err.Error())
+	}
+
+	policy := email.QuotaPolicy{
+		OverQuota: os.Getenv("OVER_QUOTA_POLICY"),
+		From:      "postmaster@" + domain,
+	}
+	// MAILBOX_QUOTA_MB is the size of each mailbox, mailboxes are unlimited without it
+	if quota, err := strconv.ParseInt(os.Getenv("MAILBOX_QUOTA_MB"), 10, 64); err == nil {
+		policy.Limit = quota << 20
+	}
+	if policy.OverQuota == email.OverQuotaBounce {
+		policy.Bouncer = newBouncer()
+	}
+	err = email.SetQuotaPolicy(policy)
+	if err != nil {
+		panic("unable to configure quotas, " + err.Error())
+	}
+
+	// Sieve scripts redirect, reject and reply through SES, only filing mail works on a laptop
+	sieve := email.SievePolicy{
+		Domain: domain,
+	}
+	if os.Getenv("MAILBOX_DIR") == "" {
+		sieve.Mailer = newMailer()
+		sieve.Bouncer = newBouncer()
+	}
+	email.SetSievePolicy(sieve)
+}
+
+// newBouncer sends bounces through SES
+func newBouncer() email.Bouncer {
 	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
 		panic("unable to load SDK config, " + err.Error())
 	}
 
-	// Set the AWS Region that the service clients should use
-	// cfg.Region = endpoints.UsWest2RegionID
+	return email.NewSESBouncer(ses.New(cfg), domain)
+}
+
+// newMailer sends redirected mail and vacation replies through SES
+func newMailer() email.Mailer {
+	cfg, err := external.LoadDefaultAWSConfig()
+	if err != nil {
+		panic("unable to load SDK config, " + err.Error())
+	}
 
-	s3Client = s3.New(cfg)
+	return email.NewSESMailer(ses.New(cfg))
 }
 
 // Handler is our lambda handler invoked by the `lambda.Start` function call
@@ -45,20 +88,35 @@ func Handler(ctx context.Context, event events.SNSEvent) error {
 	var lastErr error
 	emailsToProcess := []email.MoveOperation{}
 
+	// DOMAIN is the primary domain, the others are added to the registry through mailman
+	registry, err := email.LoadDomainRegistry(ctx, store, mailboxPrefix, domain)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
 	for i := range event.Records {
 		record := event.Records[i]
 
 		// Accumulate emails in the triggering event
-		email, err := email.ParseEvent(ctx, domain, record)
+		op, err := email.ParseEvent(ctx, registry, record)
 		if err != nil {
 			log.Println(err)
 			lastErr = err
 		}
-		emailsToProcess = append(emailsToProcess, email)
+		if !op.Errored {
+			op, err = email.ResolveRecipients(ctx, store, mailboxPrefix, registry, op)
+			if err != nil {
+				log.Println(err)
+				lastErr = err
+				op.Errored = true
+			}
+		}
+		emailsToProcess = append(emailsToProcess, op)
 	}
 
 	// Retrieve all of the emails in the `_errored` folder for reprocessing
-	erroredEmails, err := email.LoadErroredEmails(ctx, s3Client, mailboxBucket, mailboxPrefix)
+	erroredEmails, err := email.LoadErroredEmails(ctx, store, mailboxPrefix)
 	if err != nil {
 		log.Println(err)
 		lastErr = err
@@ -66,9 +124,18 @@ func Handler(ctx context.Context, event events.SNSEvent) error {
 		emailsToProcess = append(emailsToProcess, erroredEmails...)
 	}
 
+	// Retrieve the held emails that now fit in their mailbox
+	heldEmails, err := email.LoadHeldEmails(ctx, store, mailboxPrefix)
+	if err != nil {
+		log.Println(err)
+		lastErr = err
+	} else {
+		emailsToProcess = append(emailsToProcess, heldEmails...)
+	}
+
 	// Sort the emails into their mailboxes
 	for i := range emailsToProcess {
-		err = email.SortEmailIntoMailbox(ctx, s3Client, mailboxBucket, mailboxPrefix, emailsToProcess[i])
+		err = email.SortEmailIntoMailbox(ctx, store, mailboxPrefix, emailsToProcess[i])
 		if err != nil {
 			log.Println(err)
 			lastErr = err
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/gideonw/gopher-mail/email"
+)
+
+var store email.MailStore
+var mailboxBucket string
+var mailboxPrefix string
+var dryRun bool
+
+// quarantineDays is how long quarantined mail is kept before it is purged, 0 keeps it forever
+var quarantineDays = 30
+
+// purgeRequest is the input of the scheduled event, an empty request purges every mailbox
+type purgeRequest struct {
+	// UserIDs limits the purge to these mailboxes
+	UserIDs []string
+	// DryRun only reports what would be deleted
+	DryRun bool
+}
+
+func init() {
+	mailboxBucket = os.Getenv("MAILBOX_BUCKET")
+	mailboxPrefix = os.Getenv("MAILBOX_PREFIX")
+	// PURGE_DRY_RUN turns every run into a dry run, for trying out new retention rules
+	dryRun, _ = strconv.ParseBool(os.Getenv("PURGE_DRY_RUN"))
+	if days, err := strconv.Atoi(os.Getenv("QUARANTINE_RETENTION_DAYS")); err == nil && days >= 0 {
+		quarantineDays = days
+	}
+
+	var err error
+	store, err = email.NewStoreFromEnv(mailboxBucket, mailboxPrefix, email.StoreOptions{})
+	if err != nil {
+		panic("unable to open the mailboxes, " + err.Error())
+	}
+
+	// with the quota the warnings are sent again once purging makes room
+	if quota, err := strconv.ParseInt(os.Getenv("MAILBOX_QUOTA_MB"), 10, 64); err == nil {
+		err = email.SetQuotaPolicy(email.QuotaPolicy{
+			Limit:     quota << 20,
+			OverQuota: os.Getenv("OVER_QUOTA_POLICY"),
+		})
+		if err != nil {
+			panic("unable to configure quotas, " + err.Error())
+		}
+	}
+}
+
+// Handler is our lambda handler invoked by the `lambda.Start` function call, it applies the
+// retention rules of each mailbox, purges old quarantined mail and returns what was deleted
+func Handler(ctx context.Context, req purgeRequest) ([]email.PurgeReport, error) {
+	var lastErr error
+	reports := []email.PurgeReport{}
+	now := time.Now().UTC()
+
+	userIDs := req.UserIDs
+	if len(userIDs) == 0 {
+		var err error
+		userIDs, err = email.ListMailboxes(ctx, store, mailboxPrefix)
+		if err != nil {
+			return reports, err
+		}
+
+		// mail can be quarantined for a user before anything is delivered to their mailbox
+		quarantined, err := email.ListQuarantines(ctx, store, mailboxPrefix)
+		if err != nil {
+			return reports, err
+		}
+		for _, userID := range quarantined {
+			if !containsString(userIDs, userID) {
+				userIDs = append(userIDs, userID)
+			}
+		}
+	}
+
+	for _, userID := range userIDs {
+		report, err := email.PurgeMailbox(ctx, store, mailboxPrefix, userID, now, dryRun || req.DryRun)
+		if err != nil {
+			log.Println(err)
+			lastErr = err
+		}
+
+		if quarantineDays > 0 {
+			purged, err := email.PurgeQuarantine(ctx, store, mailboxPrefix, userID, now, quarantineDays, dryRun || req.DryRun)
+			if err != nil {
+				log.Println(err)
+				lastErr = err
+			}
+			report.Emails = append(report.Emails, purged.Emails...)
+			report.Size += purged.Size
+		}
+		if len(report.Emails) == 0 {
+			continue
+		}
+
+		buf, _ := json.Marshal(report)
+		log.Println(string(buf))
+		reports = append(reports, report)
+	}
+
+	return reports, lastErr
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func main() {
+	lambda.Start(Handler)
+}
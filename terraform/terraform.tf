@@ -19,6 +19,12 @@ variable "base_domain" {
   default     = ""
 }
 
+variable "hosted_domains" {
+  type        = list(string)
+  default     = []
+  description = "Other domains to receive mail for, each must be an already existing Route53 Hosted zone. Add them to the domain registry through mailman as well."
+}
+
 variable "sub_domain" {
   type    = string
   default = ""
@@ -43,6 +49,48 @@ variable "email_mailbox_prefix" {
   description = "S3 prefix postmaster uses to sort emails."
 }
 
+variable "email_compression" {
+  type        = string
+  default     = "zstd"
+  description = "Encoding mail is compressed with in the mailbox bucket, one of zstd, gzip or identity."
+}
+
+variable "mailbox_quota_mb" {
+  type        = number
+  default     = 0
+  description = "Size of each mailbox in MB, 0 is unlimited."
+}
+
+variable "over_quota_policy" {
+  type        = string
+  default     = "accept"
+  description = "What postmaster does with mail for a full mailbox, one of accept, hold or bounce."
+}
+
+variable "admin_users" {
+  type        = list(string)
+  default     = []
+  description = "Users that can manage the addresses mail is delivered to through mailman."
+}
+
+variable "purge_schedule" {
+  type        = string
+  default     = "rate(1 day)"
+  description = "How often shredder applies the retention rules of each mailbox."
+}
+
+variable "purge_dry_run" {
+  type        = bool
+  default     = false
+  description = "Only log what shredder would delete instead of deleting it."
+}
+
+variable "quarantine_retention_days" {
+  type        = number
+  default     = 30
+  description = "How many days quarantined mail is kept before shredder deletes it, 0 keeps it forever."
+}
+
 ####################################################################################
 # Locals
 locals {
@@ -57,7 +105,54 @@ locals {
 
   mailman_routes = [
     "GET /api/{userID}/emails",
+    "POST /api/{userID}/emails/rebuild",
     "GET /api/{userID}/email/{emailID}",
+    "PATCH /api/{userID}/email/{emailID}",
+    "DELETE /api/{userID}/email/{emailID}",
+    "POST /api/{userID}/email/{emailID}/move",
+    "GET /api/{userID}/email/{emailID}/attachment/{attachmentID}",
+    "GET /api/{userID}/email/{emailID}/html",
+    "GET /api/{userID}/email/{emailID}/raw",
+    "GET /api/{userID}/email/{emailID}/headers",
+    "GET /api/{userID}/image",
+    "GET /api/{userID}/settings",
+    "POST /api/{userID}/settings/remote-images",
+    "DELETE /api/{userID}/settings/remote-images/{sender}",
+    "PUT /api/{userID}/settings/retention/{folder+}",
+    "DELETE /api/{userID}/settings/retention/{folder+}",
+    "PUT /api/{userID}/settings/subaddressing",
+    "POST /api/{userID}/settings/blocked-tags",
+    "DELETE /api/{userID}/settings/blocked-tags/{tag}",
+    "PUT /api/{userID}/settings/triage",
+    "GET /api/{userID}/quarantine",
+    "POST /api/{userID}/quarantine/{emailID}/release",
+    "DELETE /api/{userID}/quarantine/{emailID}",
+    "GET /api/{userID}/sieve",
+    "PUT /api/{userID}/sieve",
+    "DELETE /api/{userID}/sieve",
+    "POST /api/{userID}/sieve/validate",
+    "POST /api/{userID}/sieve/test",
+    "GET /api/{userID}/retention",
+    "GET /api/{userID}/quota",
+    "GET /api/{userID}/export",
+    "GET /api/{userID}/search",
+    "GET /api/{userID}/threads",
+    "GET /api/{userID}/thread/{threadID}",
+    "GET /api/{userID}/folders",
+    "POST /api/{userID}/folders",
+    "PUT /api/{userID}/folders/{folder+}",
+    "DELETE /api/{userID}/folders/{folder+}",
+    "GET /api/admin/domains",
+    "PUT /api/admin/domains/{domain}",
+    "DELETE /api/admin/domains/{domain}",
+    "GET /api/admin/addresses",
+    "PUT /api/admin/addresses/users/{name}",
+    "DELETE /api/admin/addresses/users/{name}",
+    "PUT /api/admin/addresses/aliases/{name}",
+    "DELETE /api/admin/addresses/aliases/{name}",
+    "PUT /api/admin/addresses/groups/{name}",
+    "DELETE /api/admin/addresses/groups/{name}",
+    "PUT /api/admin/addresses/catch-all",
     "POST /api/auth/login",
     "GET /.well-known/openid-configuration",
     "GET /api/auth/jwks.json",
@@ -187,6 +282,16 @@ resource "random_string" "cf_verify_value" {
 
 }
 
+resource "random_string" "image_proxy_secret" {
+  length  = 32
+  special = false
+}
+
+resource "random_string" "auth_signing_key" {
+  length  = 32
+  special = false
+}
+
 resource "aws_cloudfront_distribution" "gopher_mail" {
   enabled = true
 
@@ -263,7 +368,7 @@ resource "aws_cloudfront_distribution" "gopher_mail" {
     cached_methods   = ["GET", "HEAD"]
 
     forwarded_values {
-      query_string = false
+      query_string = true
 
       cookies {
         forward = "none"
@@ -375,6 +480,19 @@ resource "aws_s3_bucket" "mailbox" {
 }
 
 # explicitly set these in-case they are changed, on terraform apply it will be reapplied
+# wraps the data key of every message, each user's data keys are bound to them with the encryption context
+resource "aws_kms_key" "mailbox" {
+  description         = "${local.app_name} mailbox encryption"
+  enable_key_rotation = true
+
+  tags = local.tags
+}
+
+resource "aws_kms_alias" "mailbox" {
+  name          = "alias/${local.app_name}-mailbox"
+  target_key_id = aws_kms_key.mailbox.key_id
+}
+
 resource "aws_s3_bucket_public_access_block" "force_private" {
   bucket = aws_s3_bucket.mailbox.id
 
@@ -418,6 +536,49 @@ resource "aws_ses_domain_identity_verification" "mail_domain_identity_verified"
   depends_on = [aws_route53_record.mail_domain_verification]
 }
 
+resource "aws_ses_domain_identity" "hosted_domain" {
+  count = length(var.hosted_domains)
+
+  domain = element(var.hosted_domains, count.index)
+
+  depends_on = [aws_lambda_function.postmaster]
+}
+
+data "aws_route53_zone" "hosted_domain_zone" {
+  count = length(var.hosted_domains)
+
+  name         = element(var.hosted_domains, count.index)
+  private_zone = false
+}
+
+resource "aws_route53_record" "hosted_domain_inbound_mx" {
+  count = length(var.hosted_domains)
+
+  zone_id = element(data.aws_route53_zone.hosted_domain_zone.*.zone_id, count.index)
+  name    = element(var.hosted_domains, count.index)
+  type    = "MX"
+  ttl     = "1800"
+  records = ["10 inbound-smtp.${data.aws_region.selected.name}.amazonaws.com"]
+}
+
+resource "aws_route53_record" "hosted_domain_verification" {
+  count = length(var.hosted_domains)
+
+  zone_id = element(data.aws_route53_zone.hosted_domain_zone.*.zone_id, count.index)
+  name    = "_amazonses.${element(var.hosted_domains, count.index)}"
+  type    = "TXT"
+  ttl     = "1800"
+  records = [element(aws_ses_domain_identity.hosted_domain.*.verification_token, count.index)]
+}
+
+resource "aws_ses_domain_identity_verification" "hosted_domain_identity_verified" {
+  count = length(var.hosted_domains)
+
+  domain = element(aws_ses_domain_identity.hosted_domain.*.domain, count.index)
+
+  depends_on = [aws_route53_record.hosted_domain_verification]
+}
+
 resource "aws_ses_domain_dkim" "mail_domain" {
   domain = aws_ses_domain_identity.mail_domain.domain
 }
@@ -462,9 +623,7 @@ resource "aws_ses_receipt_rule" "mail_domain" {
   name          = "${local.dash_domain}-save-to-s3"
   rule_set_name = "default-rule-set"
 
-  recipients = [
-    var.base_domain
-  ]
+  recipients   = concat([var.base_domain], var.hosted_domains)
   scan_enabled = true
 
   s3_action {
@@ -563,6 +722,30 @@ data "aws_iam_policy_document" "postmaster" {
       aws_s3_bucket.mailbox.arn
     ]
   }
+
+  statement {
+    sid    = "KMSWrapKeys"
+    effect = "Allow"
+
+    actions = [
+      "kms:Encrypt",
+      "kms:Decrypt",
+    ]
+    resources = [
+      aws_kms_key.mailbox.arn
+    ]
+  }
+
+  statement {
+    sid    = "SESSend"
+    effect = "Allow"
+
+    actions = [
+      "ses:SendBounce",
+      "ses:SendRawEmail",
+    ]
+    resources = ["*"]
+  }
 }
 
 data "aws_s3_bucket_object" "postmaster" {
@@ -628,10 +811,14 @@ resource "aws_lambda_function" "postmaster" {
 
   environment {
     variables = {
-      DOMAIN             = var.base_domain
-      MAILBOX_BUCKET     = aws_s3_bucket.mailbox.id
-      POST_OFFICE_PREFIX = var.email_post_office_prefix
-      MAILBOX_PREFIX     = var.email_mailbox_prefix
+      DOMAIN              = var.base_domain
+      MAILBOX_BUCKET      = aws_s3_bucket.mailbox.id
+      POST_OFFICE_PREFIX  = var.email_post_office_prefix
+      MAILBOX_PREFIX      = var.email_mailbox_prefix
+      MAILBOX_COMPRESSION = var.email_compression
+      KMS_KEY_ID          = aws_kms_key.mailbox.arn
+      MAILBOX_QUOTA_MB    = var.mailbox_quota_mb
+      OVER_QUOTA_POLICY   = var.over_quota_policy
     }
   }
 
@@ -687,6 +874,19 @@ data "aws_iam_policy_document" "mailman" {
       aws_s3_bucket.mailbox.arn
     ]
   }
+
+  statement {
+    sid    = "KMSWrapKeys"
+    effect = "Allow"
+
+    actions = [
+      "kms:Encrypt",
+      "kms:Decrypt",
+    ]
+    resources = [
+      aws_kms_key.mailbox.arn
+    ]
+  }
 }
 
 data "aws_s3_bucket_object" "mailman" {
@@ -752,11 +952,18 @@ resource "aws_lambda_function" "mailman" {
 
   environment {
     variables = {
-      DOMAIN           = var.base_domain
-      MAILBOX_BUCKET   = aws_s3_bucket.mailbox.id
-      MAILBOX_PREFIX   = var.email_mailbox_prefix
-      CF_VERIFY_HEADER = random_string.cf_verify_header.result
-      CF_VERIFY_VALUE  = random_string.cf_verify_value.result
+      DOMAIN              = var.base_domain
+      MAILBOX_BUCKET      = aws_s3_bucket.mailbox.id
+      MAILBOX_PREFIX      = var.email_mailbox_prefix
+      MAILBOX_COMPRESSION = var.email_compression
+      CF_VERIFY_HEADER    = random_string.cf_verify_header.result
+      CF_VERIFY_VALUE     = random_string.cf_verify_value.result
+      IMAGE_PROXY_SECRET  = random_string.image_proxy_secret.result
+      KMS_KEY_ID          = aws_kms_key.mailbox.arn
+      AUTH_SIGNING_KEY    = random_string.auth_signing_key.result
+      ADMIN_USERS         = join(",", var.admin_users)
+      MAILBOX_QUOTA_MB    = var.mailbox_quota_mb
+      OVER_QUOTA_POLICY   = var.over_quota_policy
     }
   }
 
@@ -818,3 +1025,149 @@ resource "aws_apigatewayv2_route" "mailman_routes" {
   route_key = element(local.mailman_routes, count.index)
   target    = "integrations/${aws_apigatewayv2_integration.mailman_lambda.id}"
 }
+
+
+# Shredder Lambda
+data "aws_iam_policy_document" "shredder" {
+  statement {
+    sid    = "S3ReadWrite"
+    effect = "Allow"
+
+    actions = [
+      "s3:GetObject",
+      "s3:PutObject",
+      "s3:DeleteObject",
+    ]
+    resources = [
+      "${aws_s3_bucket.mailbox.arn}/*"
+    ]
+  }
+
+  statement {
+    sid    = "S3List"
+    effect = "Allow"
+
+    actions = [
+      "s3:ListBucket",
+    ]
+    resources = [
+      aws_s3_bucket.mailbox.arn
+    ]
+  }
+
+  statement {
+    sid    = "KMSWrapKeys"
+    effect = "Allow"
+
+    actions = [
+      "kms:Encrypt",
+      "kms:Decrypt",
+    ]
+    resources = [
+      aws_kms_key.mailbox.arn
+    ]
+  }
+}
+
+data "aws_s3_bucket_object" "shredder" {
+  bucket = aws_s3_bucket.lambda_archive.id
+  key    = "shredder/shredder.zip"
+
+  depends_on = [
+    aws_s3_bucket_object.shredder
+  ]
+}
+
+resource "aws_s3_bucket_object" "shredder" {
+  bucket = aws_s3_bucket.lambda_archive.id
+  key    = "shredder/shredder.zip"
+
+  source = "${path.root}/../bin/shredder.zip"
+}
+
+resource "aws_cloudwatch_log_group" "shredder" {
+  name              = "/aws/lambda/${aws_lambda_function.shredder.function_name}"
+  retention_in_days = 14
+}
+
+resource "aws_iam_role" "shredder" {
+  name = "${local.app_name}-shredder"
+
+  assume_role_policy = data.aws_iam_policy_document.lambda_assume_role.json
+}
+
+resource "aws_iam_role_policy" "shredder_service_permissions" {
+  name = "shredder-service-permissions"
+  role = aws_iam_role.shredder.id
+
+  policy = data.aws_iam_policy_document.shredder.json
+}
+
+resource "aws_iam_role_policy" "shredder_log_permissions" {
+  name = "shredder-log-permissions"
+  role = aws_iam_role.shredder.id
+
+  policy = data.aws_iam_policy_document.lambda_logging.json
+}
+
+resource "aws_lambda_function" "shredder" {
+  function_name = "${local.app_name}-shredder"
+
+  s3_bucket         = aws_s3_bucket.lambda_archive.id
+  s3_key            = data.aws_s3_bucket_object.shredder.key
+  s3_object_version = data.aws_s3_bucket_object.shredder.version_id
+
+  role = aws_iam_role.shredder.arn
+
+  handler = "shredder"
+  runtime = "go1.x"
+
+  memory_size = 512
+  timeout     = 300
+
+  environment {
+    variables = {
+      MAILBOX_BUCKET            = aws_s3_bucket.mailbox.id
+      MAILBOX_PREFIX            = var.email_mailbox_prefix
+      MAILBOX_COMPRESSION       = var.email_compression
+      KMS_KEY_ID                = aws_kms_key.mailbox.arn
+      PURGE_DRY_RUN             = var.purge_dry_run
+      QUARANTINE_RETENTION_DAYS = var.quarantine_retention_days
+      MAILBOX_QUOTA_MB          = var.mailbox_quota_mb
+      OVER_QUOTA_POLICY         = var.over_quota_policy
+    }
+  }
+
+  depends_on = [
+    aws_iam_role_policy.shredder_log_permissions,
+    aws_s3_bucket.lambda_archive,
+    aws_s3_bucket_object.shredder
+  ]
+
+  tags = local.tags
+}
+
+resource "aws_cloudwatch_event_rule" "purge" {
+  name                = "${local.app_name}-purge"
+  description         = "Apply the retention rules of every mailbox."
+  schedule_expression = var.purge_schedule
+
+  tags = local.tags
+}
+
+resource "aws_cloudwatch_event_target" "purge" {
+  rule = aws_cloudwatch_event_rule.purge.name
+  arn  = aws_lambda_function.shredder.arn
+
+  input = jsonencode({
+    DryRun = false
+  })
+}
+
+resource "aws_lambda_permission" "purge_schedule" {
+  statement_id  = "CloudWatchSchedulePermission"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.shredder.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.purge.arn
+}
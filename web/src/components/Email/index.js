@@ -13,6 +13,7 @@ const Email = () => {
   const [email, setEmail] = useState();
   const [isLoaded, setIsLoaded] = useState(false);
   const [loading, setIsLoading] = useState(false);
+  const [loadImages, setLoadImages] = useState(false);
 
   useEffect(() => {
     if (isLoaded || loading) return;
@@ -58,6 +59,9 @@ const Email = () => {
               <BsForward />
               Forward
             </div>
+            {email.HTMLBody && !loadImages && (
+              <div onClick={() => setLoadImages(true)}>Load images</div>
+            )}
           </IconContext.Provider>
         </div>
         <ul className="email">
@@ -67,7 +71,17 @@ const Email = () => {
           <li>To: {email.To[0].Address}</li>
         </ul>
         <div className="email-body">
-          <pre>{email.TextBody}</pre>
+          {email.HTMLBody ? (
+            <iframe
+              title={email.Subject}
+              sandbox="allow-same-origin allow-popups allow-popups-to-escape-sandbox"
+              src={`https://gps.gideonw.xyz/api/gideon/email/${messageID}/html${
+                loadImages ? "?images=load" : ""
+              }`}
+            />
+          ) : (
+            <pre>{email.TextBody}</pre>
+          )}
         </div>
       </div>
     );
@@ -19,14 +19,25 @@ function Mailbox() {
   useEffect(() => {
     if (isLoaded || loading) return;
     setIsLoading(true);
-    axios.get("https://gps.gideonw.xyz/api/gideon/emails").then((result) => {
-      _.forEach(result.data.emails, (value) => {
-        emails[value.MessageID] = value;
-        setEmails(emails);
-      });
-      setIsLoaded(true);
-      setIsLoading(false);
-    });
+    const loadPage = (cursor) => {
+      axios
+        .get("https://gps.gideonw.xyz/api/gideon/emails", {
+          params: cursor ? { cursor } : {},
+        })
+        .then((result) => {
+          _.forEach(result.data.emails, (value) => {
+            emails[value.MessageID] = value;
+            setEmails(emails);
+          });
+          if (result.data.next) {
+            loadPage(result.data.next);
+            return;
+          }
+          setIsLoaded(true);
+          setIsLoading(false);
+        });
+    };
+    loadPage();
   }, [emails, isLoaded, loading]);
 
   let emailList = <EmailList emails={emails} />;